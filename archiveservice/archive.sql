@@ -31,11 +31,17 @@ CREATE TABLE `Archive` (
   `version` tinyint(4) DEFAULT NULL,
   `number` smallint(6) DEFAULT NULL,
   `domain` text,
-  `timestamp` datetime DEFAULT NULL,
+  `timestamp` bigint(20) DEFAULT NULL,
   `details.related` bigint(20) DEFAULT NULL,
   `network` text,
   `provider` text,
   `details.source` blob,
+  `details.source.area` smallint(6) DEFAULT NULL,
+  `details.source.service` smallint(6) DEFAULT NULL,
+  `details.source.version` tinyint(4) DEFAULT NULL,
+  `details.source.number` smallint(6) DEFAULT NULL,
+  `details.source.domain` text,
+  `details.source.instId` bigint(20) DEFAULT NULL,
   PRIMARY KEY (`id`)
 ) ENGINE=InnoDB DEFAULT CHARSET=utf8;
 /*!40101 SET character_set_client = @saved_cs_client */;
@@ -0,0 +1,553 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"io/ioutil"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/CNES/ccsdsmo-malgo/com"
+	"github.com/CNES/ccsdsmo-malgo/mal"
+	"github.com/juju/loggo"
+
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/provider"
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/storage"
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/utils"
+)
+
+// Default values of the configuration
+const (
+	DEFAULT_PROVIDER_URI = "maltcp://127.0.0.1:12400"
+	DEFAULT_BACKEND      = "mysql"
+	DEFAULT_MYSQL_DSN    = "archiveService@/archive?parseTime=true"
+	DEFAULT_SQLITE_DSN   = "archive.db"
+	DEFAULT_POSTGRES_DSN = "postgres://archiveService@localhost/archive?sslmode=disable"
+	DEFAULT_LOG_LEVEL    = "INFO"
+)
+
+// Environment variables overriding the configuration file
+const (
+	ENV_CONFIG                         = "ARCHIVE_CONFIG"
+	ENV_PROVIDER_URI                   = "ARCHIVE_PROVIDER_URI"
+	ENV_PROVIDER_NAME                  = "ARCHIVE_PROVIDER_NAME"
+	ENV_QUERY_CHUNK_OBJECTS            = "ARCHIVE_QUERY_CHUNK_OBJECTS"
+	ENV_QUERY_CHUNK_BYTES              = "ARCHIVE_QUERY_CHUNK_BYTES"
+	ENV_GLOBAL_SORT_ORDER              = "ARCHIVE_GLOBAL_SORT_ORDER"
+	ENV_BACKEND                        = "ARCHIVE_BACKEND"
+	ENV_DSN                            = "ARCHIVE_DSN"
+	ENV_DSN_FILE                       = "ARCHIVE_DSN_FILE"
+	ENV_TABLE                          = "ARCHIVE_TABLE"
+	ENV_MAX_OPEN_CONNS                 = "ARCHIVE_MAX_OPEN_CONNS"
+	ENV_MAX_IDLE_CONNS                 = "ARCHIVE_MAX_IDLE_CONNS"
+	ENV_CONN_MAX_LIFETIME              = "ARCHIVE_CONN_MAX_LIFETIME"
+	ENV_MIGRATE                        = "ARCHIVE_MIGRATE"
+	ENV_LOG_LEVEL                      = "ARCHIVE_LOG_LEVEL"
+	ENV_RETENTION_INTERVAL             = "ARCHIVE_RETENTION_INTERVAL"
+	ENV_RETENTION_BATCH_SIZE           = "ARCHIVE_RETENTION_BATCH_SIZE"
+	ENV_RETENTION_DRY_RUN              = "ARCHIVE_RETENTION_DRY_RUN"
+	ENV_SOFT_DELETE                    = "ARCHIVE_SOFT_DELETE"
+	ENV_RETENTION_DELETED_GRACE_PERIOD = "ARCHIVE_RETENTION_DELETED_GRACE_PERIOD"
+)
+
+// Config holds the configuration of the archive provider
+type Config struct {
+	Provider ProviderConfig `json:"provider"`
+	Database DatabaseConfig `json:"database"`
+	// Retention holds the retention rules enforced by the provider
+	Retention RetentionConfig `json:"retention"`
+	// LogLevel is the level of the root logger (e.g. DEBUG, INFO, WARNING)
+	LogLevel string `json:"logLevel"`
+}
+
+// ProviderConfig holds the address of the provider
+type ProviderConfig struct {
+	// URI is the URL of the MAL context of the provider
+	URI string `json:"uri"`
+	// Name is the name of the provider, appended to its URI
+	Name string `json:"name"`
+	// QueryChunkObjects and QueryChunkBytes bound the number of objects
+	// and the encoded size of the objects sent by each Update message
+	// of the Query operation, 0 or less means no limit
+	QueryChunkObjects int `json:"queryChunkObjects"`
+	QueryChunkBytes   int `json:"queryChunkBytes"`
+	// GlobalSortOrder sends the objects of a query in its sort order
+	// across the object types and domains, instead of grouping them by
+	// object type and domain first
+	GlobalSortOrder bool `json:"globalSortOrder"`
+}
+
+// DatabaseConfig holds the storage backend of the provider
+type DatabaseConfig struct {
+	// Backend is one of mysql, postgres, sqlite or memory
+	Backend string `json:"backend"`
+	// DSN is the data source name given to the database driver, for
+	// the sqlite backend it's the path of the database file
+	DSN string `json:"dsn"`
+	// DSNFile is the path of a file holding the data source name, it's
+	// used instead of DSN so that the password isn't written in the
+	// configuration file
+	DSNFile string `json:"dsnFile"`
+	// Table is the name of the Archive table
+	Table string `json:"table"`
+	// MaxOpenConns and MaxIdleConns limit the connection pool, 0 keeps
+	// the default of database/sql and a negative MaxIdleConns means
+	// that no connection is kept idle
+	MaxOpenConns int `json:"maxOpenConns"`
+	MaxIdleConns int `json:"maxIdleConns"`
+	// ConnMaxLifetime is the maximum amount of time a connection is
+	// reused (e.g. "5m"), empty means no limit
+	ConnMaxLifetime string `json:"connMaxLifetime"`
+	// Migrate applies the migrations of the schema to a table holding
+	// objects when the backend is created. Without it only an empty
+	// database is migrated (i.e. created from nothing), and a table
+	// holding objects must be at the last version of the schema.
+	Migrate bool `json:"migrate"`
+	// SoftDelete keeps the deleted objects as tombstones, which can be
+	// restored until they are purged
+	SoftDelete bool `json:"softDelete"`
+}
+
+// RetentionConfig holds the retention rules enforced by the provider in
+// the background
+type RetentionConfig struct {
+	// Interval is the time between two purges (e.g. "1h")
+	Interval string `json:"interval"`
+	// BatchSize is the maximum number of objects deleted at once, 0 or
+	// less means no limit
+	BatchSize int `json:"batchSize"`
+	// DryRun only logs and reports the objects which would be purged
+	DryRun bool `json:"dryRun"`
+	// Rules are the retention rules, there is no rule by default
+	Rules []RetentionRuleConfig `json:"rules"`
+	// DeletedGracePeriod is the time the tombstones of the deleted objects
+	// are kept before being purged (e.g. "720h"), empty means forever
+	DeletedGracePeriod string `json:"deletedGracePeriod"`
+}
+
+// RetentionRuleConfig is a retention rule, it has a maximum age, a maximum
+// count or both
+type RetentionRuleConfig struct {
+	// Area, Service, Version and Number select the object types, 0 is a
+	// wildcard
+	Area    uint16 `json:"area"`
+	Service uint16 `json:"service"`
+	Version uint8  `json:"version"`
+	Number  uint16 `json:"number"`
+	// Domain selects the domains (e.g. "fr.cnes.*"), empty means all of
+	// them
+	Domain string `json:"domain"`
+	// MaxAge is the maximum age of an object (e.g. "720h"), empty means
+	// no limit
+	MaxAge string `json:"maxAge"`
+	// MaxCount is the maximum number of objects kept for each object
+	// type and domain, 0 means no limit
+	MaxCount int `json:"maxCount"`
+}
+
+// Default returns the default configuration, the data source name
+// depends on the backend and is only set by DataSourceName
+func Default() *Config {
+	return &Config{
+		Provider: ProviderConfig{
+			URI:               DEFAULT_PROVIDER_URI,
+			Name:              provider.PROVIDER_NAME,
+			QueryChunkObjects: storage.DEFAULT_CHUNK_OBJECTS,
+			QueryChunkBytes:   storage.DefaultChunkLimits().MaxBytes,
+		},
+		Database: DatabaseConfig{
+			Backend: DEFAULT_BACKEND,
+			Table:   storage.TABLE,
+		},
+		Retention: RetentionConfig{
+			Interval:  provider.DEFAULT_RETENTION_INTERVAL.String(),
+			BatchSize: provider.DEFAULT_RETENTION_BATCH_SIZE,
+		},
+		LogLevel: DEFAULT_LOG_LEVEL,
+	}
+}
+
+// Load creates the configuration of the provider. The default values are
+// overridden by the configuration file, then by the environment variables
+// and finally by the command line arguments (args doesn't contain the
+// name of the program).
+func Load(args []string) (*Config, error) {
+	var flags = flag.NewFlagSet("archive", flag.ContinueOnError)
+	var configFile = flags.String("config", os.Getenv(ENV_CONFIG), "path of the JSON configuration file")
+	var providerURI = flags.String("uri", "", "URI of the provider")
+	var providerName = flags.String("name", "", "name of the provider")
+	var queryChunkObjects = flags.String("query-chunk-objects", "", "maximum number of objects sent by each message of the Query operation")
+	var queryChunkBytes = flags.String("query-chunk-bytes", "", "maximum encoded size of the objects sent by each message of the Query operation")
+	var globalSortOrder = flags.String("global-sort-order", "", "keep the sort order of the queries across the object types and domains: true or false")
+	var backend = flags.String("backend", "", "storage backend of the archive: mysql, postgres, sqlite or memory")
+	var dsn = flags.String("dsn", "", "data source name of the database (path of the database file for sqlite)")
+	var dsnFile = flags.String("dsn-file", "", "path of a file holding the data source name of the database")
+	var table = flags.String("table", "", "name of the Archive table")
+	var maxOpenConns = flags.String("max-open-conns", "", "maximum number of open connections to the database")
+	var maxIdleConns = flags.String("max-idle-conns", "", "maximum number of idle connections to the database")
+	var connMaxLifetime = flags.String("conn-max-lifetime", "", "maximum amount of time a connection to the database is reused (e.g. 5m)")
+	var migrate = flags.String("migrate", "", "apply the migrations of the schema of the database on start: true or false")
+	var logLevel = flags.String("log-level", "", "level of the logs: TRACE, DEBUG, INFO, WARNING, ERROR or CRITICAL")
+	var retentionInterval = flags.String("retention-interval", "", "time between two purges of the objects exceeding the retention rules (e.g. 1h)")
+	var retentionBatchSize = flags.String("retention-batch-size", "", "maximum number of objects deleted at once by a purge")
+	var retentionDryRun = flags.String("retention-dry-run", "", "only report the objects exceeding the retention rules: true or false")
+	var softDelete = flags.String("soft-delete", "", "keep the deleted objects as tombstones which can be restored: true or false")
+	var deletedGracePeriod = flags.String("retention-deleted-grace-period", "", "time the tombstones of the deleted objects are kept before being purged (e.g. 720h)")
+	err := flags.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+
+	// Read the configuration file
+	config := Default()
+	if *configFile != "" {
+		err = config.LoadFile(*configFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Apply the environment variables
+	err = config.LoadEnv()
+	if err != nil {
+		return nil, err
+	}
+
+	// Apply the command line arguments
+	override(&config.Provider.URI, *providerURI)
+	override(&config.Provider.Name, *providerName)
+	override(&config.Database.Backend, *backend)
+	override(&config.Database.DSN, *dsn)
+	override(&config.Database.DSNFile, *dsnFile)
+	override(&config.Database.Table, *table)
+	override(&config.Database.ConnMaxLifetime, *connMaxLifetime)
+	override(&config.LogLevel, *logLevel)
+	override(&config.Retention.Interval, *retentionInterval)
+	override(&config.Retention.DeletedGracePeriod, *deletedGracePeriod)
+	err = overrideInt(&config.Provider.QueryChunkObjects, *queryChunkObjects)
+	if err != nil {
+		return nil, err
+	}
+	err = overrideInt(&config.Provider.QueryChunkBytes, *queryChunkBytes)
+	if err != nil {
+		return nil, err
+	}
+	err = overrideInt(&config.Database.MaxOpenConns, *maxOpenConns)
+	if err != nil {
+		return nil, err
+	}
+	err = overrideInt(&config.Database.MaxIdleConns, *maxIdleConns)
+	if err != nil {
+		return nil, err
+	}
+	err = overrideBool(&config.Provider.GlobalSortOrder, *globalSortOrder)
+	if err != nil {
+		return nil, err
+	}
+	err = overrideBool(&config.Database.Migrate, *migrate)
+	if err != nil {
+		return nil, err
+	}
+	err = overrideInt(&config.Retention.BatchSize, *retentionBatchSize)
+	if err != nil {
+		return nil, err
+	}
+	err = overrideBool(&config.Retention.DryRun, *retentionDryRun)
+	if err != nil {
+		return nil, err
+	}
+	err = overrideBool(&config.Database.SoftDelete, *softDelete)
+	if err != nil {
+		return nil, err
+	}
+
+	return config, nil
+}
+
+// LoadFile reads a JSON configuration file, the values it doesn't
+// contain are left unchanged
+func (config *Config) LoadFile(path string) error {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, config)
+}
+
+// LoadEnv overrides the configuration with the environment variables
+// which are set
+func (config *Config) LoadEnv() error {
+	override(&config.Provider.URI, os.Getenv(ENV_PROVIDER_URI))
+	override(&config.Provider.Name, os.Getenv(ENV_PROVIDER_NAME))
+	override(&config.Database.Backend, os.Getenv(ENV_BACKEND))
+	override(&config.Database.DSN, os.Getenv(ENV_DSN))
+	override(&config.Database.DSNFile, os.Getenv(ENV_DSN_FILE))
+	override(&config.Database.Table, os.Getenv(ENV_TABLE))
+	override(&config.Database.ConnMaxLifetime, os.Getenv(ENV_CONN_MAX_LIFETIME))
+	override(&config.LogLevel, os.Getenv(ENV_LOG_LEVEL))
+	override(&config.Retention.Interval, os.Getenv(ENV_RETENTION_INTERVAL))
+	override(&config.Retention.DeletedGracePeriod, os.Getenv(ENV_RETENTION_DELETED_GRACE_PERIOD))
+	err := overrideInt(&config.Provider.QueryChunkObjects, os.Getenv(ENV_QUERY_CHUNK_OBJECTS))
+	if err != nil {
+		return err
+	}
+	err = overrideInt(&config.Provider.QueryChunkBytes, os.Getenv(ENV_QUERY_CHUNK_BYTES))
+	if err != nil {
+		return err
+	}
+	err = overrideInt(&config.Database.MaxOpenConns, os.Getenv(ENV_MAX_OPEN_CONNS))
+	if err != nil {
+		return err
+	}
+	err = overrideInt(&config.Database.MaxIdleConns, os.Getenv(ENV_MAX_IDLE_CONNS))
+	if err != nil {
+		return err
+	}
+	err = overrideBool(&config.Provider.GlobalSortOrder, os.Getenv(ENV_GLOBAL_SORT_ORDER))
+	if err != nil {
+		return err
+	}
+	err = overrideInt(&config.Retention.BatchSize, os.Getenv(ENV_RETENTION_BATCH_SIZE))
+	if err != nil {
+		return err
+	}
+	err = overrideBool(&config.Retention.DryRun, os.Getenv(ENV_RETENTION_DRY_RUN))
+	if err != nil {
+		return err
+	}
+	err = overrideBool(&config.Database.SoftDelete, os.Getenv(ENV_SOFT_DELETE))
+	if err != nil {
+		return err
+	}
+	return overrideBool(&config.Database.Migrate, os.Getenv(ENV_MIGRATE))
+}
+
+// DataSourceName returns the data source name of the database: the
+// content of DSNFile if it's set, DSN otherwise and by default the
+// data source name of the backend
+func (config *Config) DataSourceName() (string, error) {
+	if config.Database.DSNFile != "" {
+		data, err := ioutil.ReadFile(config.Database.DSNFile)
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimSpace(string(data)), nil
+	}
+	if config.Database.DSN != "" {
+		return config.Database.DSN, nil
+	}
+
+	switch config.Database.Backend {
+	case "mysql":
+		return DEFAULT_MYSQL_DSN, nil
+	case "postgres":
+		return DEFAULT_POSTGRES_DSN, nil
+	case "sqlite":
+		return DEFAULT_SQLITE_DSN, nil
+	}
+	return "", nil
+}
+
+// NewBackend creates the storage backend described by the configuration,
+// the migrations of the schema are applied if Migrate is set or if the
+// database is empty (see SQLBackend.MigrateIfEmpty)
+func (config *Config) NewBackend() (storage.ArchiveBackend, error) {
+	backend, err := config.OpenBackend()
+	if err != nil {
+		return nil, err
+	}
+	sqlBackend, ok := backend.(*storage.SQLBackend)
+	if !ok {
+		return backend, nil
+	}
+
+	if config.Database.Migrate {
+		err = sqlBackend.Migrate()
+	} else {
+		err = sqlBackend.MigrateIfEmpty()
+	}
+	if err != nil {
+		sqlBackend.Close()
+		return nil, err
+	}
+
+	return backend, nil
+}
+
+// OpenBackend creates the storage backend described by the configuration
+// without applying the migrations of the schema
+func (config *Config) OpenBackend() (storage.ArchiveBackend, error) {
+	if config.Database.Backend == "memory" {
+		var backend = storage.NewMemoryBackend()
+		backend.SetSoftDelete(config.Database.SoftDelete)
+		return backend, nil
+	}
+
+	dataSourceName, err := config.DataSourceName()
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := config.Pool()
+	if err != nil {
+		return nil, err
+	}
+
+	var backend *storage.SQLBackend
+	switch config.Database.Backend {
+	case "mysql":
+		backend = storage.NewMySQLBackend(dataSourceName, config.Database.Table)
+	case "postgres":
+		backend = storage.NewSQLBackend(storage.PostgresDialect{}, dataSourceName, config.Database.Table)
+	case "sqlite":
+		backend = storage.NewSQLBackend(storage.SQLiteDialect{}, storage.SQLiteDataSourceName(dataSourceName), config.Database.Table)
+	default:
+		return nil, errors.New("unknown backend " + config.Database.Backend)
+	}
+	backend.SetPool(pool)
+	backend.SetSoftDelete(config.Database.SoftDelete)
+
+	return backend, nil
+}
+
+// ChunkLimits returns the limits of the messages sent by the Query
+// operation
+func (config *Config) ChunkLimits() storage.ChunkLimits {
+	return storage.ChunkLimits{
+		MaxObjects: config.Provider.QueryChunkObjects,
+		MaxBytes:   config.Provider.QueryChunkBytes,
+	}
+}
+
+// RetentionPolicy returns the retention rules enforced by the provider, a
+// rule must have a maximum age or a maximum count. The grace period of the
+// deleted objects can't be negative.
+func (config *Config) RetentionPolicy() (provider.RetentionPolicy, error) {
+	var policy = provider.RetentionPolicy{
+		BatchSize: config.Retention.BatchSize,
+		DryRun:    config.Retention.DryRun,
+	}
+	interval, err := time.ParseDuration(config.Retention.Interval)
+	if err != nil {
+		return policy, err
+	}
+	if interval <= 0 {
+		return policy, errors.New("the retention interval must be positive")
+	}
+	policy.Interval = interval
+
+	if config.Retention.DeletedGracePeriod != "" {
+		policy.DeletedGracePeriod, err = time.ParseDuration(config.Retention.DeletedGracePeriod)
+		if err != nil {
+			return policy, err
+		}
+		if policy.DeletedGracePeriod < 0 {
+			return policy, errors.New("the grace period of the deleted objects can't be negative")
+		}
+	}
+
+	for i, ruleConfig := range config.Retention.Rules {
+		var rule = storage.RetentionRule{
+			ObjectType: com.ObjectType{
+				Area:    mal.UShort(ruleConfig.Area),
+				Service: mal.UShort(ruleConfig.Service),
+				Version: mal.UOctet(ruleConfig.Version),
+				Number:  mal.UShort(ruleConfig.Number),
+			},
+			MaxCount: ruleConfig.MaxCount,
+		}
+		if ruleConfig.Domain != "" {
+			rule.Domain = utils.AdaptDomainToIdentifierList(ruleConfig.Domain)
+		}
+		if ruleConfig.MaxAge != "" {
+			rule.MaxAge, err = time.ParseDuration(ruleConfig.MaxAge)
+			if err != nil {
+				return policy, err
+			}
+		}
+		if rule.MaxAge <= 0 && rule.MaxCount <= 0 {
+			return policy, errors.New("the retention rule " + strconv.Itoa(i) + " has no maximum age nor maximum count")
+		}
+		policy.Rules = append(policy.Rules, rule)
+	}
+	return policy, nil
+}
+
+// Pool returns the limits of the connection pool
+func (config *Config) Pool() (storage.PoolConfig, error) {
+	var pool = storage.PoolConfig{
+		MaxOpenConns: config.Database.MaxOpenConns,
+		MaxIdleConns: config.Database.MaxIdleConns,
+	}
+	if config.Database.ConnMaxLifetime != "" {
+		connMaxLifetime, err := time.ParseDuration(config.Database.ConnMaxLifetime)
+		if err != nil {
+			return pool, err
+		}
+		pool.ConnMaxLifetime = connMaxLifetime
+	}
+	return pool, nil
+}
+
+// ConfigureLogging sets the level of the root logger
+func (config *Config) ConfigureLogging() error {
+	return loggo.ConfigureLoggers("<root>=" + config.LogLevel)
+}
+
+// override replaces a value of the configuration if the new one is set
+func override(value *string, newValue string) {
+	if newValue != "" {
+		*value = newValue
+	}
+}
+
+// overrideBool replaces a boolean of the configuration if the new one is set
+func overrideBool(value *bool, newValue string) error {
+	if newValue != "" {
+		boolValue, err := strconv.ParseBool(newValue)
+		if err != nil {
+			return err
+		}
+		*value = boolValue
+	}
+	return nil
+}
+
+// overrideInt replaces an integer of the configuration if the new one is set
+func overrideInt(value *int, newValue string) error {
+	if newValue != "" {
+		intValue, err := strconv.Atoi(newValue)
+		if err != nil {
+			return err
+		}
+		*value = intValue
+	}
+	return nil
+}
@@ -37,6 +37,7 @@ const (
 	ARCHIVE_SERVICE_QUERY_LISTS_SIZE_ERROR                      mal.String = "The size of the two lists must be the same"
 	ARCHIVE_SERVICE_QUERY_SORT_FIELD_NAME_INVALID_ERROR         mal.String = "SortFieldName parameter doesn't reference a defined field"
 	ARCHIVE_SERVICE_QUERY_QUERY_FILTER_ERROR                    mal.String = "QueryFilter contains an error"
+	ARCHIVE_SERVICE_TIMESTAMP_RANGE_ERROR                       mal.String = "Timestamps must be between the years 1678 and 2262"
 	ARCHIVE_SERVICE_UNKNOWN_ELEMENT                             mal.String = "Unknown element, cannot find it in the archive"
 )
 
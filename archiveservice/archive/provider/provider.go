@@ -39,16 +39,32 @@ import (
 
 // Define Provider's implementation structure
 type ProviderImpl struct {
-	uri string
+	uri     string
+	backend arch.ArchiveBackend
+	// limits bounds the Update messages sent by the Query operation
+	limits arch.ChunkLimits
+	// globalSortOrder keeps the sort order of the queries across the
+	// object types and domains of the objects sent by the Query operation
+	globalSortOrder bool
 }
 
-// StartProvider : TODO:
-func StartProvider(url string) (*archive.Provider, error) {
+// Default name of the provider, its URI is the URL of its context
+// followed by this name (e.g. maltcp://127.0.0.1:12400/archiveServiceProvider)
+const (
+	PROVIDER_NAME = "archiveServiceProvider"
+)
+
+// StartProvider starts the archive provider with the given name, all the
+// objects are stored in the given backend and the results of the Query
+// operation are sent in messages bounded by the limits. If globalSortOrder
+// is set, the objects of a query with a sort order are sent in this order
+// instead of being sorted by object type and domain first.
+func StartProvider(url string, name string, backend arch.ArchiveBackend, limits arch.ChunkLimits, globalSortOrder bool) (*archive.Provider, error) {
 	ctx, err := mal.NewContext(url)
 	if err != nil {
 		return nil, err
 	}
-	return archive.NewProvider(ctx, "archiveServiceProvider", &ProviderImpl{"archiveServiceProvider"})
+	return archive.NewProvider(ctx, name, &ProviderImpl{name, backend, limits, globalSortOrder})
 }
 
 func min(a, b int) int {
@@ -61,7 +77,7 @@ func min(a, b int) int {
 //======================================================================//
 //								RETRIEVE								//
 //======================================================================//
-func (*ProviderImpl) Retrieve(opHelper *archive.RetrieveHelper, objType *com.ObjectType, domain *mal.IdentifierList, objInstIds *mal.LongList) error {
+func (provider *ProviderImpl) Retrieve(opHelper *archive.RetrieveHelper, objType *com.ObjectType, domain *mal.IdentifierList, objInstIds *mal.LongList) error {
 	// ----- Verify the parameters -----
 	// Verify ObjectType values (all of its attributes must not be equal to '0')
 	if objType.Area == 0 || objType.Number == 0 || objType.Service == 0 || objType.Version == 0 {
@@ -85,7 +101,7 @@ func (*ProviderImpl) Retrieve(opHelper *archive.RetrieveHelper, objType *com.Obj
 	}
 
 	// Retrieve these objects in the archive
-	archiveDetailsList, elementList, err := arch.RetrieveInArchive(*objType, *domain, *objInstIds)
+	archiveDetailsList, elementList, err := provider.backend.RetrieveInArchive(*objType, *domain, *objInstIds)
 	if err != nil {
 		if err.Error() == string(mal.ERROR_UNKNOWN_MESSAGE) {
 			extraInfo := mal.NewUIntegerList(1)
@@ -101,7 +117,7 @@ func (*ProviderImpl) Retrieve(opHelper *archive.RetrieveHelper, objType *com.Obj
 //======================================================================//
 //								QUERY									//
 //======================================================================//
-func (*ProviderImpl) Query(opHelper *archive.QueryHelper, returnBody *mal.Boolean, objType *com.ObjectType, archiveQuery *archive.ArchiveQueryList, queryFilter archive.QueryFilterList) error {
+func (provider *ProviderImpl) Query(opHelper *archive.QueryHelper, returnBody *mal.Boolean, objType *com.ObjectType, archiveQuery *archive.ArchiveQueryList, queryFilter archive.QueryFilterList) error {
 	// ----- Verify the parameters -----
 	if queryFilter != nil && archiveQuery.Size() != queryFilter.Size() {
 		extraInfo := mal.NewUIntegerList(1)
@@ -115,22 +131,34 @@ func (*ProviderImpl) Query(opHelper *archive.QueryHelper, returnBody *mal.Boolea
 		return malapi.NewMalError(mal.ERROR_INTERNAL, mal.NewString(err.Error()))
 	}
 
-	// Variables to send to the consumer
-	var objTypes []*com.ObjectType
-	var archDetList []*archive.ArchiveDetailsList
-	var idList []*mal.IdentifierList
-	var elementList []mal.ElementList
+	// The objects are sent while they are read from the archive, in
+	// chunks bounded by the limits of the provider. The last chunk must
+	// be sent by the Reply, so a chunk is only sent by an Update once
+	// the next one is ready.
+	var pending *queryChunk
+	var send = func(objectType *com.ObjectType, domain *mal.IdentifierList, archiveDetailsList *archive.ArchiveDetailsList, elementList mal.ElementList) error {
+		if pending != nil {
+			// Call Update operation
+			err := opHelper.Update(pending.objectType, pending.domain, pending.archiveDetailsList, pending.elementList)
+			if err != nil {
+				return err
+			}
+		}
+		pending = &queryChunk{objectType, domain, archiveDetailsList, elementList}
+		return nil
+	}
 
 	for i := 0; i < archiveQuery.Size(); i++ {
 		// Do a query to the archive
+		var filter archive.QueryFilter
 		if queryFilter != nil {
-			objTypes, archDetList, idList, elementList, err = arch.QueryArchive(returnBody, *objType, *(*archiveQuery)[i], queryFilter.GetElementAt(i).(archive.QueryFilter))
-		} else {
-			objTypes, archDetList, idList, elementList, err = arch.QueryArchive(returnBody, *objType, *(*archiveQuery)[i], nil)
+			filter = queryFilter.GetElementAt(i).(archive.QueryFilter)
 		}
+		err = provider.backend.StreamQuery(returnBody, *objType, *(*archiveQuery)[i], filter, provider.limits, provider.globalSortOrder, send)
 		if err != nil {
 			// Send an INVALID error
 			if err.Error() == string(ARCHIVE_SERVICE_QUERY_SORT_FIELD_NAME_INVALID_ERROR) ||
+				err.Error() == string(ARCHIVE_SERVICE_TIMESTAMP_RANGE_ERROR) ||
 				err.Error() == string(ARCHIVE_SERVICE_QUERY_QUERY_FILTER_ERROR) ||
 				strings.Contains(err.Error(), string(ARCHIVE_SERVICE_QUERY_QUERY_FILTER_ERROR)) {
 				extraInfo := mal.NewUIntegerList(1)
@@ -140,28 +168,34 @@ func (*ProviderImpl) Query(opHelper *archive.QueryHelper, returnBody *mal.Boolea
 			// Otherwise, send an INTERNAL error
 			return malapi.NewMalError(mal.ERROR_INTERNAL, mal.NewString(err.Error()))
 		}
-		for j := 0; j < len(archDetList); j++ {
-			if i == archiveQuery.Size()-1 && j == len(archDetList)-1 {
-				// Call Response operation
-				err = opHelper.Reply(objTypes[j], idList[j], archDetList[j], elementList[j])
-			} else {
-				// Call Update operation
-				err = opHelper.Update(objTypes[j], idList[j], archDetList[j], elementList[j])
-			}
-			if err != nil {
-				// Send an INTERNAL error
-				return malapi.NewMalError(mal.ERROR_INTERNAL, mal.NewString(err.Error()))
-			}
-		}
+	}
+
+	// Call Response operation, with nil lists if nothing has been found
+	if pending == nil {
+		var longList *mal.LongList
+		pending = &queryChunk{elementList: longList}
+	}
+	err = opHelper.Reply(pending.objectType, pending.domain, pending.archiveDetailsList, pending.elementList)
+	if err != nil {
+		// Send an INTERNAL error
+		return malapi.NewMalError(mal.ERROR_INTERNAL, mal.NewString(err.Error()))
 	}
 
 	return nil
 }
 
+// queryChunk holds a chunk of the objects sent by the Query operation
+type queryChunk struct {
+	objectType         *com.ObjectType
+	domain             *mal.IdentifierList
+	archiveDetailsList *archive.ArchiveDetailsList
+	elementList        mal.ElementList
+}
+
 //======================================================================//
 //								COUNT									//
 //======================================================================//
-func (*ProviderImpl) Count(opHelper *archive.CountHelper, objType *com.ObjectType, archiveQuery *archive.ArchiveQueryList, queryFilter archive.QueryFilterList) error {
+func (provider *ProviderImpl) Count(opHelper *archive.CountHelper, objType *com.ObjectType, archiveQuery *archive.ArchiveQueryList, queryFilter archive.QueryFilterList) error {
 	// ----- Verify the parameters -----
 	if queryFilter != nil && archiveQuery.Size() != queryFilter.Size() {
 		extraInfo := mal.NewUIntegerList(1)
@@ -176,10 +210,11 @@ func (*ProviderImpl) Count(opHelper *archive.CountHelper, objType *com.ObjectTyp
 	}
 
 	// This variable will be created automatically in the future
-	longList, err := arch.CountInArchive(*objType, *archiveQuery, queryFilter)
+	longList, err := provider.backend.CountInArchive(*objType, *archiveQuery, queryFilter)
 	if err != nil {
 		// Send an INVALID error
 		if err.Error() == string(ARCHIVE_SERVICE_QUERY_SORT_FIELD_NAME_INVALID_ERROR) ||
+			err.Error() == string(ARCHIVE_SERVICE_TIMESTAMP_RANGE_ERROR) ||
 			strings.Contains(err.Error(), string(ARCHIVE_SERVICE_QUERY_QUERY_FILTER_ERROR)) {
 			extraInfo := mal.NewUIntegerList(1)
 			(*extraInfo)[0] = mal.NewUInteger(0)
@@ -200,7 +235,7 @@ func (*ProviderImpl) Count(opHelper *archive.CountHelper, objType *com.ObjectTyp
 //======================================================================//
 //								STORE									//
 //======================================================================//
-func (*ProviderImpl) Store(opHelper *archive.StoreHelper, returnObjInstIds *mal.Boolean, objType *com.ObjectType, domain *mal.IdentifierList, objDetails *archive.ArchiveDetailsList, objBodies mal.ElementList) error {
+func (provider *ProviderImpl) Store(opHelper *archive.StoreHelper, returnObjInstIds *mal.Boolean, objType *com.ObjectType, domain *mal.IdentifierList, objDetails *archive.ArchiveDetailsList, objBodies mal.ElementList) error {
 	// ----- Verify the parameters -----
 	// The fourth and fifth lists must be the same size
 	if objBodies != nil && objBodies.Size() != objDetails.Size() {
@@ -231,12 +266,18 @@ func (*ProviderImpl) Store(opHelper *archive.StoreHelper, returnObjInstIds *mal.
 			(*extraInfo)[0] = mal.NewUInteger(uint32(i + 1))
 			return malapi.NewMalError(com.ERROR_INVALID, extraInfo)
 		}
+		// The timestamp must be encoded in the archive
+		if arch.CheckTimestamp(time.Time(*(*objDetails)[i].Timestamp)) != nil {
+			extraInfo := mal.NewUIntegerList(1)
+			(*extraInfo)[0] = mal.NewUInteger(uint32(i + 1))
+			return malapi.NewMalError(com.ERROR_INVALID, extraInfo)
+		}
 	}
 	// TODO: Raise INVALID error for 3.4.6.2.12
 
 	// Store these objects in the archive
 	var longList *mal.LongList
-	longList, err := arch.StoreInArchive(returnObjInstIds, *objType, *domain, *objDetails, objBodies)
+	longList, err := provider.backend.StoreInArchive(returnObjInstIds, *objType, *domain, *objDetails, objBodies)
 	if err != nil {
 		if err.Error() == string(com.ERROR_DUPLICATE) {
 			extraInfo := mal.NewUIntegerList(1)
@@ -261,7 +302,7 @@ func (*ProviderImpl) Store(opHelper *archive.StoreHelper, returnObjInstIds *mal.
 //======================================================================//
 //								UPDATE									//
 //======================================================================//
-func (*ProviderImpl) Update(opHelper *archive.UpdateHelper, objType *com.ObjectType, domain *mal.IdentifierList, objDetails *archive.ArchiveDetailsList, objBodies mal.ElementList) error {
+func (provider *ProviderImpl) Update(opHelper *archive.UpdateHelper, objType *com.ObjectType, domain *mal.IdentifierList, objDetails *archive.ArchiveDetailsList, objBodies mal.ElementList) error {
 
 	// ----- Verify the parameters -----
 	// Verify ObjectType values (all of its attributes must not be equal to '0')
@@ -285,10 +326,16 @@ func (*ProviderImpl) Update(opHelper *archive.UpdateHelper, objType *com.ObjectT
 			(*extraInfo)[0] = mal.NewUInteger(uint32(i + 1))
 			return malapi.NewMalError(com.ERROR_INVALID, extraInfo)
 		}
+		// The timestamp must be encoded in the archive
+		if (*objDetails)[i].Timestamp != nil && arch.CheckTimestamp(time.Time(*(*objDetails)[i].Timestamp)) != nil {
+			extraInfo := mal.NewUIntegerList(1)
+			(*extraInfo)[0] = mal.NewUInteger(uint32(i + 1))
+			return malapi.NewMalError(com.ERROR_INVALID, extraInfo)
+		}
 	}
 
 	// Update these objects
-	err := arch.UpdateArchive(*objType, *domain, *objDetails, objBodies)
+	err := provider.backend.UpdateArchive(*objType, *domain, *objDetails, objBodies)
 	if err != nil {
 		if err.Error() == string(mal.ERROR_UNKNOWN_MESSAGE) {
 			extraInfo := mal.NewUIntegerList(1)
@@ -313,7 +360,7 @@ func (*ProviderImpl) Update(opHelper *archive.UpdateHelper, objType *com.ObjectT
 //======================================================================//
 //								DELETE									//
 //======================================================================//
-func (*ProviderImpl) Delete(opHelper *archive.DeleteHelper, objType *com.ObjectType, domain *mal.IdentifierList, objInstIds *mal.LongList) error {
+func (provider *ProviderImpl) Delete(opHelper *archive.DeleteHelper, objType *com.ObjectType, domain *mal.IdentifierList, objInstIds *mal.LongList) error {
 
 	// ----- Verify the parameters -----
 	// Verify ObjectType values (all of its attributes must not be equal to '0')
@@ -332,7 +379,7 @@ func (*ProviderImpl) Delete(opHelper *archive.DeleteHelper, objType *com.ObjectT
 	}
 
 	// Delete these objects
-	longListResponse, err := arch.DeleteInArchive(*objType, *domain, *objInstIds)
+	longListResponse, err := provider.backend.DeleteInArchive(*objType, *domain, *objInstIds)
 	if err != nil {
 		if err.Error() == string(mal.ERROR_UNKNOWN_MESSAGE) {
 			extraInfo := mal.NewUIntegerList(1)
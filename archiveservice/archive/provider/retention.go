@@ -0,0 +1,321 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package provider
+
+import (
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/CNES/ccsdsmo-malgo/com"
+	"github.com/CNES/ccsdsmo-malgo/mal"
+	"github.com/CNES/ccsdsmo-malgo/mal/debug"
+
+	arch "github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/storage"
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/utils"
+)
+
+// Default values of a RetentionPolicy
+const (
+	DEFAULT_RETENTION_INTERVAL   = time.Hour
+	DEFAULT_RETENTION_BATCH_SIZE = 1000
+)
+
+// Index of the rule of the reports of the tombstones purged once their
+// grace period is over
+const DELETED_OBJECTS_RULE = -1
+
+var (
+	retentionLogger debug.Logger = debug.GetLogger("archive.retention")
+)
+
+// RetentionPolicy holds the retention rules enforced by a Purger
+type RetentionPolicy struct {
+	// Rules are the retention rules, an object is purged as soon as it
+	// exceeds the limits of one of them
+	Rules []arch.RetentionRule
+	// Interval is the time between the start of two purges
+	Interval time.Duration
+	// BatchSize is the maximum number of objects deleted at once, 0 or
+	// less means no limit
+	BatchSize int
+	// DryRun only reports the objects which would be purged, nothing is
+	// deleted
+	DryRun bool
+	// DeletedGracePeriod is the time the tombstones of the objects deleted
+	// in soft delete mode are kept before being purged, 0 means that they
+	// are never purged
+	DeletedGracePeriod time.Duration
+}
+
+// DefaultRetentionPolicy returns a policy without any rule
+func DefaultRetentionPolicy() RetentionPolicy {
+	return RetentionPolicy{
+		Interval:  DEFAULT_RETENTION_INTERVAL,
+		BatchSize: DEFAULT_RETENTION_BATCH_SIZE,
+	}
+}
+
+// PurgeReport reports the objects deleted by a batch of a purge, or which
+// would be deleted in dry-run mode
+type PurgeReport struct {
+	// Rule is the index of the rule exceeded by the objects, or
+	// DELETED_OBJECTS_RULE for the tombstones
+	Rule int
+	// DryRun is true if the objects have not been deleted
+	DryRun bool
+	// Objects are the objects by object type and domain
+	Objects []*arch.ExpiredObjects
+}
+
+// PurgeHandler receives the reports of the purges, it's a local callback
+// of the provider process: nothing is sent to the consumers (e.g. as a COM
+// event). It's called by the goroutine of the Purger and must not block it.
+type PurgeHandler func(report PurgeReport)
+
+// LogPurgeReport is the default PurgeHandler of the provider, it logs
+// the objects of a report by object type and domain
+func LogPurgeReport(report PurgeReport) {
+	var name = purgeName(report.Rule)
+	for _, expired := range report.Objects {
+		if report.DryRun {
+			retentionLogger.Infof("The %s would purge %d objects of the type %v in the domain %s",
+				name, expired.InstIDs.Size(), expired.ObjectType, utils.AdaptDomainToString(expired.Domain))
+		} else {
+			retentionLogger.Infof("The %s purged %d objects of the type %v in the domain %s",
+				name, expired.InstIDs.Size(), expired.ObjectType, utils.AdaptDomainToString(expired.Domain))
+		}
+	}
+}
+
+// PurgeStatistics counts the objects purged by a purge
+type PurgeStatistics struct {
+	// Objects is the number of objects purged, or which would be purged
+	// in dry-run mode
+	Objects int
+	// Batches is the number of batches of objects
+	Batches int
+	// Duration is the time taken by the purge
+	Duration time.Duration
+}
+
+// Purger enforces a retention policy on the objects of a backend: a
+// background goroutine purges the objects exceeding the rules at each
+// interval, by batches, hands the objects of each batch to its handler and
+// logs the statistics of each purge
+type Purger struct {
+	backend arch.ArchiveBackend
+	policy  RetentionPolicy
+	handle  PurgeHandler
+
+	stop chan struct{}
+	done chan struct{}
+	once sync.Once
+}
+
+// NewPurger creates a purger, the handler may be nil
+func NewPurger(backend arch.ArchiveBackend, policy RetentionPolicy, handle PurgeHandler) *Purger {
+	return &Purger{
+		backend: backend,
+		policy:  policy,
+		handle:  handle,
+		stop:    make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+}
+
+// StartPurger creates a purger and starts its goroutine, the first purge
+// is done immediately
+func StartPurger(backend arch.ArchiveBackend, policy RetentionPolicy, handle PurgeHandler) *Purger {
+	var purger = NewPurger(backend, policy, handle)
+	go purger.run()
+	return purger
+}
+
+// Stop stops the goroutine of the purger and waits for the end of the
+// purge in progress
+func (purger *Purger) Stop() {
+	purger.once.Do(func() {
+		close(purger.stop)
+	})
+	<-purger.done
+}
+
+// run purges the objects at each interval until the purger is stopped
+func (purger *Purger) run() {
+	defer close(purger.done)
+	var interval = purger.policy.Interval
+	if interval <= 0 {
+		interval = DEFAULT_RETENTION_INTERVAL
+	}
+	var ticker = time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		// The errors are logged by Purge, the next purge tries again
+		purger.Purge(time.Now())
+		select {
+		case <-purger.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Purge deletes for good the objects exceeding the rules of the policy at
+// a given time, whatever the soft delete mode, then the tombstones whose
+// grace period is over, or only reports them in dry-run mode. The objects
+// of each rule are deleted by batches until no object exceeds the rule. A
+// rule which fails doesn't stop the others, the first error is returned.
+// The rules require a RetentionBackend and the grace period a
+// SoftDeleteBackend.
+func (purger *Purger) Purge(now time.Time) (PurgeStatistics, error) {
+	var statistics PurgeStatistics
+	var start = time.Now()
+	var firstErr error
+	if len(purger.policy.Rules) != 0 {
+		retention, ok := purger.backend.(arch.RetentionBackend)
+		if ok {
+			for i, rule := range purger.policy.Rules {
+				var rule = rule
+				var selectObjects = func(offset int, limit int) ([]*arch.ExpiredObjects, error) {
+					return retention.SelectExpired(rule, now, offset, limit)
+				}
+				err := purger.purgeBatches(i, selectObjects, retention.DeleteExpired, &statistics)
+				if err != nil && firstErr == nil {
+					firstErr = err
+				}
+			}
+		} else {
+			retentionLogger.Errorf("The retention rules can't be enforced: %s", arch.ErrNoRetention.Error())
+			firstErr = arch.ErrNoRetention
+		}
+	}
+	if purger.policy.DeletedGracePeriod > 0 {
+		softDelete, ok := purger.backend.(arch.SoftDeleteBackend)
+		if ok {
+			var deletedBefore = now.Add(-purger.policy.DeletedGracePeriod)
+			var selectObjects = func(offset int, limit int) ([]*arch.ExpiredObjects, error) {
+				return softDelete.SelectDeleted(deletedBefore, offset, limit)
+			}
+			err := purger.purgeBatches(DELETED_OBJECTS_RULE, selectObjects, softDelete.PurgeDeleted, &statistics)
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		} else {
+			retentionLogger.Errorf("The deleted objects can't be purged: %s", arch.ErrNoSoftDelete.Error())
+			if firstErr == nil {
+				firstErr = arch.ErrNoSoftDelete
+			}
+		}
+	}
+	statistics.Duration = time.Since(start)
+
+	if purger.policy.DryRun {
+		retentionLogger.Infof("Retention dry run: %d objects would be purged", statistics.Objects)
+	} else {
+		retentionLogger.Infof("Retention: %d objects purged in %d batches in %v", statistics.Objects, statistics.Batches, statistics.Duration)
+	}
+	return statistics, firstErr
+}
+
+// purgeName returns the name of a rule in the logs
+func purgeName(rule int) string {
+	if rule == DELETED_OBJECTS_RULE {
+		return "grace period of the deleted objects"
+	}
+	return "retention rule " + strconv.Itoa(rule)
+}
+
+// purgeBatches deletes by batches the objects selected for a rule until
+// there is no object left, or only reports them in dry-run mode. The
+// failure of an object type and domain is logged and the others are
+// purged, the rule stops when no object of a batch can be purged.
+func (purger *Purger) purgeBatches(rule int, selectObjects func(offset int, limit int) ([]*arch.ExpiredObjects, error), deleteObjects func(com.ObjectType, mal.IdentifierList, mal.LongList) (mal.LongList, error), statistics *PurgeStatistics) error {
+	var name = purgeName(rule)
+	var limit = purger.policy.BatchSize
+	// In dry-run mode the objects are not deleted, the next batch skips
+	// the objects already reported
+	var offset = 0
+	for {
+		objects, err := selectObjects(offset, limit)
+		if err != nil {
+			retentionLogger.Errorf("Purge of the %s failed: %s", name, err.Error())
+			return err
+		}
+		var count = 0
+		for _, expired := range objects {
+			count += expired.InstIDs.Size()
+		}
+		if count == 0 {
+			return nil
+		}
+
+		var purged = objects
+		if !purger.policy.DryRun {
+			purged, err = purger.deleteGroups(name, objects, deleteObjects)
+			if len(purged) == 0 {
+				// Nothing can be purged, the same objects would be
+				// selected again
+				return err
+			}
+		}
+		for _, expired := range purged {
+			statistics.Objects += expired.InstIDs.Size()
+		}
+		statistics.Batches++
+		if purger.handle != nil {
+			purger.handle(PurgeReport{rule, purger.policy.DryRun, purged})
+		}
+
+		if limit <= 0 || count < limit {
+			return nil
+		}
+		if purger.policy.DryRun {
+			offset += count
+		}
+	}
+}
+
+// deleteGroups deletes the objects of each object type and domain of a
+// batch, and returns the objects deleted with the last error if any
+func (purger *Purger) deleteGroups(name string, objects []*arch.ExpiredObjects, deleteObjects func(com.ObjectType, mal.IdentifierList, mal.LongList) (mal.LongList, error)) ([]*arch.ExpiredObjects, error) {
+	var purged []*arch.ExpiredObjects
+	var lastErr error
+	for _, expired := range objects {
+		instIDs, err := deleteObjects(expired.ObjectType, expired.Domain, expired.InstIDs)
+		if err != nil {
+			// The objects are selected again by the next batch or purge
+			retentionLogger.Errorf("Purge of the objects of the type %v in the domain %s by the %s failed: %s",
+				expired.ObjectType, utils.AdaptDomainToString(expired.Domain), name, err.Error())
+			lastErr = err
+			continue
+		}
+		if instIDs.Size() != 0 {
+			purged = append(purged, &arch.ExpiredObjects{ObjectType: expired.ObjectType, Domain: expired.Domain, InstIDs: instIDs})
+		}
+	}
+	return purged, lastErr
+}
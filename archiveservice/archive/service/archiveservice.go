@@ -33,6 +33,7 @@ package service
 
 import (
 	"bufio"
+	"errors"
 	"fmt"
 	"os"
 	"strings"
@@ -42,6 +43,7 @@ import (
 	"github.com/CNES/ccsdsmo-malgo/com"
 	"github.com/CNES/ccsdsmo-malgo/com/archive"
 	"github.com/CNES/ccsdsmo-malgo/mal"
+	malapi "github.com/CNES/ccsdsmo-malgo/mal/api"
 
 	// Init TCP transport
 	_ "github.com/CNES/ccsdsmo-malgo/mal/transport/tcp"
@@ -49,7 +51,9 @@ import (
 	// Blank imports to register all the mal and com elements
 	_ "github.com/CNES/ccsdsmo-malgo-examples/archiveservice/testarchivearea/testarchiveservice"
 
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/config"
 	. "github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/provider"
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/storage"
 	. "github.com/CNES/ccsdsmo-malgo-examples/archiveservice/service"
 )
 
@@ -61,8 +65,42 @@ type ArchiveService struct {
 	ServiceNumber     mal.UShort
 	AreaVersion       mal.UOctet
 
+	// Name of the provider, used by the provider and by the consumer
+	// to build the URI of the provider from its URL
+	ProviderName string
+	// Backend used by the provider to store the objects, it may be
+	// replaced before calling StartProvider (the schema of an empty SQL
+	// database is created by StartProvider). The history and the soft
+	// deleted objects have no COM Archive operation, they are read
+	// through it, so these methods fail unless the provider of this
+	// service is started on this backend
+	Backend storage.ArchiveBackend
+	// Limits of the Update messages sent by the Query operation of the
+	// provider
+	QueryChunkLimits storage.ChunkLimits
+	// GlobalSortOrder keeps the sort order of the queries across the
+	// object types and domains: the provider sends the objects in this
+	// order and Query merges the responses in this order
+	GlobalSortOrder bool
+	// Retention rules enforced by the provider in the background, and
+	// the local callback receiving the objects purged (LogPurgeReport by
+	// default, it may be nil), nothing is sent to the consumers
+	Retention        RetentionPolicy
+	RetentionHandler PurgeHandler
+
 	running bool
 	wg      sync.WaitGroup
+
+	// Backend of the provider while it's started, read by the methods
+	// without COM Archive operation
+	startedBackend storage.ArchiveBackend
+	backendMutex   sync.Mutex
+
+	// Paginated queries whose last page hasn't been returned yet, by
+	// continuation token (see QueryPage)
+	queryCursors   map[string]*queryCursor
+	lastQueryToken uint64
+	cursorsMutex   sync.Mutex
 }
 
 // CreateService : TODO:
@@ -73,6 +111,11 @@ func (*ArchiveService) CreateService() Service {
 		AreaNumber:        com.AREA_NUMBER,
 		ServiceNumber:     archive.SERVICE_NUMBER,
 		AreaVersion:       com.AREA_VERSION,
+		ProviderName:      PROVIDER_NAME,
+		Backend:           storage.NewMySQLBackend(config.DEFAULT_MYSQL_DSN, storage.TABLE),
+		QueryChunkLimits:  storage.DefaultChunkLimits(),
+		Retention:         DefaultRetentionPolicy(),
+		RetentionHandler:  LogPurgeReport,
 		running:           true,
 		wg:                *new(sync.WaitGroup),
 	}
@@ -91,7 +134,7 @@ func (archiveService *ArchiveService) Retrieve(providerURL string, objectType co
 	fmt.Println("Creation : Retrieve operation")
 
 	// IN
-	var providerURI = mal.NewURI(providerURL + "/archiveServiceProvider")
+	var providerURI = mal.NewURI(providerURL + "/" + archiveService.ProviderName)
 
 	op, err := archive.NewRetrieveOperation(providerURI)
 	if err != nil {
@@ -111,12 +154,56 @@ func (archiveService *ArchiveService) Retrieve(providerURL string, objectType co
 
 // Query : TODO:
 func (archiveService *ArchiveService) Query(providerURL string, boolean *mal.Boolean, objectType com.ObjectType, archiveQueryList archive.ArchiveQueryList, queryFilterList archive.QueryFilterList) ([]interface{}, error) {
+	// The provider checks that there are as many filters as queries
+	if !archiveService.GlobalSortOrder || (queryFilterList != nil && queryFilterList.Size() != archiveQueryList.Size()) {
+		return archiveService.query(providerURL, boolean, objectType, archiveQueryList, queryFilterList)
+	}
+
+	// The responses of the queries can't be told apart, so each query is
+	// sent alone and its responses are merged in its own sort order
+	var comparators = make([]compareArchiveDetails, archiveQueryList.Size())
+	for i, archiveQuery := range archiveQueryList {
+		compare, err := queryComparator(*archiveQuery)
+		if err != nil {
+			return nil, err
+		}
+		comparators[i] = compare
+	}
+
+	responses := []interface{}{}
+	for i, archiveQuery := range archiveQueryList {
+		var filterList archive.QueryFilterList
+		if queryFilterList != nil {
+			filters := queryFilterList.(mal.ElementList).CreateElement().(mal.ElementList)
+			filters.AppendElement(queryFilterList.GetElementAt(i))
+			filterList = filters.(archive.QueryFilterList)
+		}
+		queryResponses, err := archiveService.query(providerURL, boolean, objectType, archive.ArchiveQueryList{archiveQuery}, filterList)
+		if err != nil {
+			// The index of an invalid query is relative to the whole list
+			if malerr, ok := err.(*malapi.MalError); ok && malerr.Code == com.ERROR_INVALID {
+				extraInfo := mal.NewUIntegerList(1)
+				(*extraInfo)[0] = mal.NewUInteger(uint32(i + 1))
+				err = malapi.NewMalError(com.ERROR_INVALID, extraInfo)
+			}
+			return append(responses, queryResponses...), err
+		}
+		if comparators[i] != nil {
+			queryResponses = mergeResponses(queryResponses, comparators[i])
+		}
+		responses = append(responses, queryResponses...)
+	}
+	return responses, nil
+}
+
+// query invokes the Query operation and returns its responses
+func (archiveService *ArchiveService) query(providerURL string, boolean *mal.Boolean, objectType com.ObjectType, archiveQueryList archive.ArchiveQueryList, queryFilterList archive.QueryFilterList) ([]interface{}, error) {
 	// Start Operation
 	// Maybe we should not have to return an error
 	fmt.Println("Creation : Query operation")
 
 	// IN
-	var providerURI = mal.NewURI(providerURL + "/archiveServiceProvider")
+	var providerURI = mal.NewURI(providerURL + "/" + archiveService.ProviderName)
 	op, err := archive.NewQueryOperation(providerURI)
 	if err != nil {
 		return nil, err
@@ -163,7 +250,7 @@ func (archiveService *ArchiveService) Count(providerURL string, objectType *com.
 	fmt.Println("Creation : Count operation")
 
 	// IN
-	var providerURI = mal.NewURI(providerURL + "/archiveServiceProvider")
+	var providerURI = mal.NewURI(providerURL + "/" + archiveService.ProviderName)
 	op, err := archive.NewCountOperation(providerURI)
 	if err != nil {
 		return nil, err
@@ -187,7 +274,7 @@ func (archiveService *ArchiveService) Store(providerURL string, boolean *mal.Boo
 	fmt.Println("Creation : Store operation")
 
 	// IN
-	var providerURI = mal.NewURI(providerURL + "/archiveServiceProvider")
+	var providerURI = mal.NewURI(providerURL + "/" + archiveService.ProviderName)
 	op, err := archive.NewStoreOperation(providerURI)
 	if err != nil {
 		return nil, err
@@ -207,7 +294,7 @@ func (archiveService *ArchiveService) Update(providerURL string, objectType com.
 	fmt.Println("Creation : Update operation")
 
 	// IN
-	var providerURI = mal.NewURI(providerURL + "/archiveServiceProvider")
+	var providerURI = mal.NewURI(providerURL + "/" + archiveService.ProviderName)
 	op, err := archive.NewUpdateOperation(providerURI)
 	if err != nil {
 		return err
@@ -227,7 +314,7 @@ func (archiveService *ArchiveService) Delete(providerURL string, objectType com.
 	fmt.Println("Creation : Delete Consumer")
 
 	// IN
-	var providerURI = mal.NewURI(providerURL + "/archiveServiceProvider")
+	var providerURI = mal.NewURI(providerURL + "/" + archiveService.ProviderName)
 	op, err := archive.NewDeleteOperation(providerURI)
 	if err != nil {
 		return nil, err
@@ -246,6 +333,15 @@ func (archiveService *ArchiveService) Delete(providerURL string, objectType com.
 
 // StartProvider : TODO:
 func (archiveService *ArchiveService) StartProvider(providerURL string) error {
+	// The default backend isn't migrated when it's created, the schema of
+	// an empty database is created here (see SQLBackend.MigrateIfEmpty)
+	if backend, ok := archiveService.Backend.(*storage.SQLBackend); ok {
+		err := backend.MigrateIfEmpty()
+		if err != nil {
+			return err
+		}
+	}
+
 	archiveService.wg.Add(2)
 	// Start the retrieve provider
 	go archiveService.launchProvider(providerURL)
@@ -275,6 +371,25 @@ func (archiveService *ArchiveService) stopProviders() {
 	}
 }
 
+// setStartedBackend records the backend of the started provider, nil once
+// it's closed
+func (archiveService *ArchiveService) setStartedBackend(backend storage.ArchiveBackend) {
+	archiveService.backendMutex.Lock()
+	defer archiveService.backendMutex.Unlock()
+	archiveService.startedBackend = backend
+}
+
+// providerBackend returns the backend of the provider of the service, an
+// error if the provider isn't started in this process on Backend
+func (archiveService *ArchiveService) providerBackend() (storage.ArchiveBackend, error) {
+	archiveService.backendMutex.Lock()
+	defer archiveService.backendMutex.Unlock()
+	if archiveService.startedBackend == nil || archiveService.startedBackend != archiveService.Backend {
+		return nil, errors.New("the provider isn't started on the backend of the service")
+	}
+	return archiveService.startedBackend, nil
+}
+
 // launchSpecificProvider Start a provider for a specific operation
 func (archiveService *ArchiveService) launchProvider(providerURL string) error {
 	// Inform the WaitGroup that this goroutine is finished at the end of this function
@@ -284,14 +399,26 @@ func (archiveService *ArchiveService) launchProvider(providerURL string) error {
 	var err error
 
 	// Start Operation
-	provider, err = StartProvider(providerURL)
+	provider, err = StartProvider(providerURL, archiveService.ProviderName, archiveService.Backend, archiveService.QueryChunkLimits, archiveService.GlobalSortOrder)
 	if err != nil {
 		return err
 	}
 
-	// Close the provider at the end of the function
+	// Close the backend then the provider at the end of the function
+	defer archiveService.Backend.Close()
 	defer provider.Close()
 
+	// The backend can be read by the service until the provider is closed
+	archiveService.setStartedBackend(archiveService.Backend)
+	defer archiveService.setStartedBackend(nil)
+
+	// Enforce the retention rules and purge the tombstones until the
+	// provider is closed
+	if len(archiveService.Retention.Rules) != 0 || archiveService.Retention.DeletedGracePeriod > 0 {
+		purger := StartPurger(archiveService.Backend, archiveService.Retention, archiveService.RetentionHandler)
+		defer purger.Stop()
+	}
+
 	// Start communication
 	for archiveService.running == true {
 		time.Sleep(1 * time.Second)
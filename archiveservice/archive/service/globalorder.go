@@ -0,0 +1,273 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package service
+
+import (
+	"container/heap"
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/CNES/ccsdsmo-malgo/com"
+	"github.com/CNES/ccsdsmo-malgo/com/archive"
+	"github.com/CNES/ccsdsmo-malgo/mal"
+
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/storage"
+)
+
+// compareArchiveDetails compares two ArchiveDetails on a sort field, it
+// returns a negative number if a < b, 0 if a == b and a positive number if
+// a > b. A null value is lower than any other value.
+type compareArchiveDetails func(a *archive.ArchiveDetails, b *archive.ArchiveDetails) int
+
+// archiveDetailsComparators holds the comparators of the columns of the sort
+// fields which are held by the ArchiveDetails, the responses can only be
+// merged on these fields
+var archiveDetailsComparators = map[string]compareArchiveDetails{
+	"timestamp": func(a *archive.ArchiveDetails, b *archive.ArchiveDetails) int {
+		if a.Timestamp == nil || b.Timestamp == nil {
+			return compareNull(a.Timestamp == nil, b.Timestamp == nil)
+		}
+		return compareTimes(time.Time(*a.Timestamp), time.Time(*b.Timestamp))
+	},
+	"objectInstanceIdentifier": func(a *archive.ArchiveDetails, b *archive.ArchiveDetails) int {
+		return compareLongs(a.InstId, b.InstId)
+	},
+	"details.related": func(a *archive.ArchiveDetails, b *archive.ArchiveDetails) int {
+		if a.Details.Related == nil || b.Details.Related == nil {
+			return compareNull(a.Details.Related == nil, b.Details.Related == nil)
+		}
+		return compareLongs(*a.Details.Related, *b.Details.Related)
+	},
+	"network": func(a *archive.ArchiveDetails, b *archive.ArchiveDetails) int {
+		if a.Network == nil || b.Network == nil {
+			return compareNull(a.Network == nil, b.Network == nil)
+		}
+		return strings.Compare(string(*a.Network), string(*b.Network))
+	},
+	"provider": func(a *archive.ArchiveDetails, b *archive.ArchiveDetails) int {
+		if a.Provider == nil || b.Provider == nil {
+			return compareNull(a.Provider == nil, b.Provider == nil)
+		}
+		return strings.Compare(string(*a.Provider), string(*b.Provider))
+	},
+}
+
+// compareNull compares two values of which one at least is null
+func compareNull(isANull bool, isBNull bool) int {
+	switch {
+	case isANull && isBNull:
+		return 0
+	case isANull:
+		return -1
+	default:
+		return 1
+	}
+}
+
+// compareTimes compares two times
+func compareTimes(a time.Time, b time.Time) int {
+	if a.Before(b) {
+		return -1
+	} else if a.After(b) {
+		return 1
+	}
+	return 0
+}
+
+// compareLongs compares two Long values
+func compareLongs(a mal.Long, b mal.Long) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+// queryComparator returns the comparator of the sort order of a query, nil
+// if the query has no sort order. An error is returned if the objects can't
+// be compared by the consumer, i.e. if a sort field isn't held by the
+// ArchiveDetails.
+func queryComparator(archiveQuery archive.ArchiveQuery) (compareArchiveDetails, error) {
+	if archiveQuery.SortOrder == nil {
+		return nil, nil
+	}
+	var sortOrder = bool(*archiveQuery.SortOrder)
+
+	var comparators []compareArchiveDetails
+	for _, fieldName := range storage.SortFields(archiveQuery) {
+		// The names of a field are compared by their column
+		column, _ := storage.FieldColumn(fieldName)
+		compare, ok := archiveDetailsComparators[column]
+		if !ok {
+			return nil, errors.New("the objects can't be merged on the sort field " + fieldName + ", it isn't held by the ArchiveDetails")
+		}
+		comparators = append(comparators, compare)
+	}
+	return func(a *archive.ArchiveDetails, b *archive.ArchiveDetails) int {
+		for _, compare := range comparators {
+			var cmp = compare(a, b)
+			if cmp != 0 {
+				// If sortOrder is false then the values are sorted in
+				// descending order
+				if !sortOrder {
+					return -cmp
+				}
+				return cmp
+			}
+		}
+		return 0
+	}, nil
+}
+
+// sortedResponse is a response of the Query operation, its objects are
+// sorted by the provider
+type sortedResponse struct {
+	objectType         *com.ObjectType
+	domain             *mal.IdentifierList
+	archiveDetailsList *archive.ArchiveDetailsList
+	elementList        mal.ElementList
+	// Index of the next object to merge
+	next int
+}
+
+// responseHeap is a heap of the responses whose objects are not all merged,
+// ordered by their next object then by their order of arrival
+type responseHeap struct {
+	responses []*sortedResponse
+	indexes   map[*sortedResponse]int
+	compare   compareArchiveDetails
+}
+
+func (h *responseHeap) Len() int {
+	return len(h.responses)
+}
+
+func (h *responseHeap) Less(i, j int) bool {
+	a, b := h.responses[i], h.responses[j]
+	cmp := h.compare((*a.archiveDetailsList)[a.next], (*b.archiveDetailsList)[b.next])
+	if cmp != 0 {
+		return cmp < 0
+	}
+	return h.indexes[a] < h.indexes[b]
+}
+
+func (h *responseHeap) Swap(i, j int) {
+	h.responses[i], h.responses[j] = h.responses[j], h.responses[i]
+}
+
+func (h *responseHeap) Push(x interface{}) {
+	h.responses = append(h.responses, x.(*sortedResponse))
+}
+
+func (h *responseHeap) Pop() interface{} {
+	last := h.responses[len(h.responses)-1]
+	h.responses = h.responses[:len(h.responses)-1]
+	return last
+}
+
+// mergeResponses merges the responses of the Query operation for a single
+// query, in the layout returned by Query, into a single sequence sorted by
+// the comparator of the query: each response is sorted by the provider, even
+// if its objects are grouped by object type and domain. The consecutive
+// objects of the same object type and domain are gathered in a response.
+func mergeResponses(responses []interface{}, compare compareArchiveDetails) []interface{} {
+
+	var h = &responseHeap{indexes: make(map[*sortedResponse]int), compare: compare}
+	for i := 0; i < len(responses)/4; i++ {
+		// The element list is a nil interface if the bodies are not returned
+		elementList, _ := responses[i*4+3].(mal.ElementList)
+		response := &sortedResponse{
+			objectType:         responses[i*4].(*com.ObjectType),
+			domain:             responses[i*4+1].(*mal.IdentifierList),
+			archiveDetailsList: responses[i*4+2].(*archive.ArchiveDetailsList),
+			elementList:        elementList,
+		}
+		if response.archiveDetailsList == nil || response.archiveDetailsList.Size() == 0 {
+			continue
+		}
+		h.indexes[response] = i
+		h.responses = append(h.responses, response)
+	}
+	heap.Init(h)
+
+	merged := []interface{}{}
+	var last *sortedResponse
+	var archiveDetailsList *archive.ArchiveDetailsList
+	var elementList mal.ElementList
+	for h.Len() > 0 {
+		response := h.responses[0]
+		if last == nil || !isSameGroup(last, response) {
+			// Start a new response
+			archiveDetailsList = archive.NewArchiveDetailsList(0)
+			elementList = response.elementList
+			if !isNullList(response.elementList) {
+				elementList = response.elementList.CreateElement().(mal.ElementList)
+			}
+			merged = append(merged, response.objectType, response.domain, archiveDetailsList, elementList)
+		}
+		archiveDetailsList.AppendElement((*response.archiveDetailsList)[response.next])
+		if !isNullList(elementList) {
+			elementList.AppendElement(response.elementList.GetElementAt(response.next))
+		}
+		last = response
+
+		response.next++
+		if response.next == response.archiveDetailsList.Size() {
+			heap.Pop(h)
+		} else {
+			heap.Fix(h, 0)
+		}
+	}
+	return merged
+}
+
+// isNullList returns true if the bodies of the objects are not returned
+func isNullList(elementList mal.ElementList) bool {
+	return elementList == nil || elementList.IsNull()
+}
+
+// isSameGroup returns true if two responses hold objects of the same object
+// type and domain
+func isSameGroup(a *sortedResponse, b *sortedResponse) bool {
+	if (a.objectType == nil) != (b.objectType == nil) || (a.domain == nil) != (b.domain == nil) {
+		return false
+	}
+	if a.objectType != nil && *a.objectType != *b.objectType {
+		return false
+	}
+	if a.domain != nil {
+		if len(*a.domain) != len(*b.domain) {
+			return false
+		}
+		for i := range *a.domain {
+			if *(*a.domain)[i] != *(*b.domain)[i] {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,71 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package service
+
+import (
+	"time"
+
+	"github.com/CNES/ccsdsmo-malgo/com"
+	"github.com/CNES/ccsdsmo-malgo/com/archive"
+	"github.com/CNES/ccsdsmo-malgo/mal"
+
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/storage"
+)
+
+// historyBackend returns the backend of the provider if it keeps the
+// history of the objects
+func (archiveService *ArchiveService) historyBackend() (storage.HistoryBackend, error) {
+	backend, err := archiveService.providerBackend()
+	if err != nil {
+		return nil, err
+	}
+	history, ok := backend.(storage.HistoryBackend)
+	if !ok {
+		return nil, storage.ErrNoHistory
+	}
+	return history, nil
+}
+
+// History returns all the versions of an object, the oldest first
+func (archiveService *ArchiveService) History(objectType com.ObjectType, identifierList mal.IdentifierList, instID mal.Long) ([]*storage.ObjectVersion, error) {
+	history, err := archiveService.historyBackend()
+	if err != nil {
+		return nil, err
+	}
+	return history.ObjectHistory(objectType, identifierList, instID)
+}
+
+// RetrieveAsOf retrieves a set of objects in their version current at asOf
+func (archiveService *ArchiveService) RetrieveAsOf(objectType com.ObjectType, identifierList mal.IdentifierList, longList mal.LongList, asOf time.Time) (*archive.ArchiveDetailsList, mal.ElementList, error) {
+	history, err := archiveService.historyBackend()
+	if err != nil {
+		return nil, nil, err
+	}
+	archiveDetailsList, elementList, err := history.RetrieveAsOf(objectType, identifierList, longList, asOf)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &archiveDetailsList, elementList, nil
+}
@@ -0,0 +1,297 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package service
+
+import (
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/CNES/ccsdsmo-malgo/com"
+	"github.com/CNES/ccsdsmo-malgo/com/archive"
+	"github.com/CNES/ccsdsmo-malgo/mal"
+)
+
+// Duration after which a paginated query whose next page hasn't been
+// requested is abandoned
+const QUERY_PAGE_TIMEOUT = 5 * time.Minute
+
+// Error returned for a continuation token which doesn't match any query,
+// because the query has been closed, has expired or has already returned
+// its last page
+const UNKNOWN_QUERY_TOKEN_ERROR = "unknown query token"
+
+// queryCursor holds the state of a paginated query: the Query operation
+// whose Update messages are not all read yet and the chunk of objects
+// which is partly returned
+type queryCursor struct {
+	op *archive.QueryOperation
+	// areUpdatesRead is true when the Update messages are all read, the
+	// last chunk is then held by the Response message
+	areUpdatesRead bool
+	// isResponseRead is true when the Response message is read
+	isResponseRead bool
+	// isFinished is true when all the objects have been returned
+	isFinished bool
+
+	// Chunk being returned and index of its next object
+	objectType         *com.ObjectType
+	domain             *mal.IdentifierList
+	archiveDetailsList *archive.ArchiveDetailsList
+	elementList        mal.ElementList
+	offset             int
+
+	// expiry abandons the query if its next page isn't requested before
+	// QUERY_PAGE_TIMEOUT, it's stopped while a page is read
+	expiry *time.Timer
+}
+
+// QueryPage starts a query and returns its first page of at most pageSize
+// objects, in the layout of the responses of Query. The next pages are
+// returned by NextQueryPage with the continuation token, which is empty if
+// there is no other page.
+//
+// The pages are read from a single Query operation (PROGRESS interaction)
+// and the provider reads the objects of each query in a single read of the
+// archive, so the objects stored while the pages are requested are not
+// returned and don't shift the pages.
+func (archiveService *ArchiveService) QueryPage(providerURL string, boolean *mal.Boolean, objectType com.ObjectType, archiveQueryList archive.ArchiveQueryList, queryFilterList archive.QueryFilterList, pageSize int) ([]interface{}, string, error) {
+	if pageSize <= 0 {
+		return nil, "", errors.New("invalid page size " + strconv.Itoa(pageSize))
+	}
+
+	// IN
+	var providerURI = mal.NewURI(providerURL + "/" + archiveService.ProviderName)
+	op, err := archive.NewQueryOperation(providerURI)
+	if err != nil {
+		return nil, "", err
+	}
+	err = op.Progress(boolean, &objectType, &archiveQueryList, queryFilterList)
+	if err != nil {
+		return nil, "", err
+	}
+
+	var cursor = &queryCursor{op: op}
+	responses, err := cursor.nextPage(pageSize)
+	if err != nil || cursor.isFinished {
+		return responses, "", err
+	}
+	return responses, archiveService.addCursor(cursor), nil
+}
+
+// NextQueryPage returns the next page of at most pageSize objects of a
+// query started by QueryPage, and the token of the page after it
+func (archiveService *ArchiveService) NextQueryPage(token string, pageSize int) ([]interface{}, string, error) {
+	if pageSize <= 0 {
+		return nil, "", errors.New("invalid page size " + strconv.Itoa(pageSize))
+	}
+
+	// The cursor is removed while it's read so that a token can't be used
+	// twice at the same time
+	cursor := archiveService.removeCursor(token)
+	if cursor == nil {
+		return nil, "", errors.New(UNKNOWN_QUERY_TOKEN_ERROR)
+	}
+
+	responses, err := cursor.nextPage(pageSize)
+	if err != nil || cursor.isFinished {
+		return responses, "", err
+	}
+	archiveService.cursorsMutex.Lock()
+	archiveService.queryCursors[token] = cursor
+	cursor.expiry.Reset(QUERY_PAGE_TIMEOUT)
+	archiveService.cursorsMutex.Unlock()
+	return responses, token, nil
+}
+
+// CloseQueryPage abandons a query started by QueryPage before its last
+// page, the remaining objects sent by the provider are discarded
+func (archiveService *ArchiveService) CloseQueryPage(token string) {
+	cursor := archiveService.removeCursor(token)
+	if cursor != nil {
+		go cursor.discard()
+	}
+}
+
+// addCursor registers the cursor of a query and returns its token, the
+// cursor expires if it's not used before QUERY_PAGE_TIMEOUT
+func (archiveService *ArchiveService) addCursor(cursor *queryCursor) string {
+	archiveService.cursorsMutex.Lock()
+	defer archiveService.cursorsMutex.Unlock()
+
+	if archiveService.queryCursors == nil {
+		archiveService.queryCursors = make(map[string]*queryCursor)
+	}
+	archiveService.lastQueryToken++
+	var token = strconv.FormatUint(archiveService.lastQueryToken, 36)
+	archiveService.queryCursors[token] = cursor
+	cursor.expiry = time.AfterFunc(QUERY_PAGE_TIMEOUT, func() {
+		archiveService.expireCursor(token, cursor)
+	})
+	return token
+}
+
+// expireCursor abandons the query of a cursor which hasn't been used
+// before QUERY_PAGE_TIMEOUT, unless its page is being read
+func (archiveService *ArchiveService) expireCursor(token string, cursor *queryCursor) {
+	archiveService.cursorsMutex.Lock()
+	if archiveService.queryCursors[token] != cursor {
+		archiveService.cursorsMutex.Unlock()
+		return
+	}
+	delete(archiveService.queryCursors, token)
+	archiveService.cursorsMutex.Unlock()
+
+	// The operation ends with its Response message
+	cursor.discard()
+}
+
+// removeCursor removes the cursor of a token and stops its expiry, nil is
+// returned if the token is unknown
+func (archiveService *ArchiveService) removeCursor(token string) *queryCursor {
+	archiveService.cursorsMutex.Lock()
+	defer archiveService.cursorsMutex.Unlock()
+
+	cursor, ok := archiveService.queryCursors[token]
+	if !ok {
+		return nil
+	}
+	delete(archiveService.queryCursors, token)
+	cursor.expiry.Stop()
+	return cursor
+}
+
+// nextPage returns the next objects of the query, at most pageSize. A chunk
+// is split between two pages if it holds more objects than the rest of the
+// page.
+func (cursor *queryCursor) nextPage(pageSize int) ([]interface{}, error) {
+	responses := []interface{}{}
+	for count := 0; count < pageSize; {
+		if cursor.archiveDetailsList == nil || cursor.offset == cursor.archiveDetailsList.Size() {
+			err := cursor.readChunk()
+			if err != nil {
+				return responses, err
+			}
+			if cursor.isFinished {
+				break
+			}
+			continue
+		}
+
+		var size = cursor.archiveDetailsList.Size() - cursor.offset
+		if size > pageSize-count {
+			size = pageSize - count
+		}
+		responses = append(responses, cursor.objectType, cursor.domain,
+			sliceArchiveDetailsList(cursor.archiveDetailsList, cursor.offset, size),
+			sliceElementList(cursor.elementList, cursor.offset, size))
+		cursor.offset += size
+		count += size
+	}
+
+	// Read the next chunk so that the last page has no token
+	if !cursor.isFinished && cursor.offset == cursor.archiveDetailsList.Size() {
+		err := cursor.readChunk()
+		if err != nil {
+			return responses, err
+		}
+	}
+	return responses, nil
+}
+
+// readChunk reads the next non-empty chunk sent by the provider, isFinished
+// is set if there is none
+func (cursor *queryCursor) readChunk() error {
+	for !cursor.isResponseRead {
+		var respObjType *com.ObjectType
+		var respIDList *mal.IdentifierList
+		var respArchDetList *archive.ArchiveDetailsList
+		var respElemList mal.ElementList
+		var err error
+		if !cursor.areUpdatesRead {
+			// Call Update operation
+			respObjType, respIDList, respArchDetList, respElemList, err = cursor.op.GetUpdate()
+			if err != nil {
+				cursor.isFinished = true
+				return err
+			}
+			if respArchDetList == nil {
+				cursor.areUpdatesRead = true
+				continue
+			}
+		} else {
+			// Call Response operation
+			respObjType, respIDList, respArchDetList, respElemList, err = cursor.op.GetResponse()
+			cursor.isResponseRead = true
+			if err != nil {
+				cursor.isFinished = true
+				return err
+			}
+		}
+
+		if respArchDetList != nil && respArchDetList.Size() > 0 {
+			cursor.objectType = respObjType
+			cursor.domain = respIDList
+			cursor.archiveDetailsList = respArchDetList
+			cursor.elementList = respElemList
+			cursor.offset = 0
+			return nil
+		}
+	}
+	cursor.isFinished = true
+	return nil
+}
+
+// discard reads and drops the remaining messages of the query
+func (cursor *queryCursor) discard() {
+	for !cursor.isFinished {
+		if cursor.readChunk() != nil {
+			return
+		}
+	}
+}
+
+// sliceArchiveDetailsList returns count ArchiveDetails of a list starting
+// at offset, the list itself is returned if it's entirely selected
+func sliceArchiveDetailsList(archiveDetailsList *archive.ArchiveDetailsList, offset int, count int) *archive.ArchiveDetailsList {
+	if offset == 0 && count == archiveDetailsList.Size() {
+		return archiveDetailsList
+	}
+	var slice = (*archiveDetailsList)[offset : offset+count]
+	return &slice
+}
+
+// sliceElementList returns count elements of a list starting at offset, a
+// null list (the bodies are not returned) is returned as it is
+func sliceElementList(elementList mal.ElementList, offset int, count int) mal.ElementList {
+	if elementList == nil || elementList.IsNull() || (offset == 0 && count == elementList.Size()) {
+		return elementList
+	}
+	var slice = elementList.CreateElement().(mal.ElementList)
+	for i := offset; i < offset+count; i++ {
+		slice.AppendElement(elementList.GetElementAt(i))
+	}
+	return slice
+}
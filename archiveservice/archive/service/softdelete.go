@@ -0,0 +1,83 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package service
+
+import (
+	"time"
+
+	"github.com/CNES/ccsdsmo-malgo/com"
+	"github.com/CNES/ccsdsmo-malgo/mal"
+
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/storage"
+)
+
+// softDeleteBackend returns the backend of the provider if it keeps the
+// deleted objects
+func (archiveService *ArchiveService) softDeleteBackend() (storage.SoftDeleteBackend, error) {
+	backend, err := archiveService.providerBackend()
+	if err != nil {
+		return nil, err
+	}
+	softDelete, ok := backend.(storage.SoftDeleteBackend)
+	if !ok {
+		return nil, storage.ErrNoSoftDelete
+	}
+	return softDelete, nil
+}
+
+// Restore restores objects deleted in soft delete mode (0 means all)
+func (archiveService *ArchiveService) Restore(objectType com.ObjectType, identifierList mal.IdentifierList, longList mal.LongList) (*mal.LongList, error) {
+	softDelete, err := archiveService.softDeleteBackend()
+	if err != nil {
+		return nil, err
+	}
+	restored, err := softDelete.RestoreInArchive(objectType, identifierList, longList)
+	if err != nil {
+		return nil, err
+	}
+	return &restored, nil
+}
+
+// DeletedObjects returns the objects deleted in soft delete mode before a time
+func (archiveService *ArchiveService) DeletedObjects(deletedBefore time.Time) ([]*storage.ExpiredObjects, error) {
+	softDelete, err := archiveService.softDeleteBackend()
+	if err != nil {
+		return nil, err
+	}
+	return softDelete.SelectDeleted(deletedBefore, 0, 0)
+}
+
+// PurgeDeleted permanently deletes objects deleted in soft delete mode
+func (archiveService *ArchiveService) PurgeDeleted(objectType com.ObjectType, identifierList mal.IdentifierList, longList mal.LongList) (*mal.LongList, error) {
+	softDelete, err := archiveService.softDeleteBackend()
+	if err != nil {
+		return nil, err
+	}
+	purged, err := softDelete.PurgeDeleted(objectType, identifierList, longList)
+	if err != nil {
+		return nil, err
+	}
+	return &purged, nil
+}
@@ -26,34 +26,36 @@ package storage
 
 import (
 	"bytes"
+	"context"
 	"database/sql"
 	"errors"
-	"fmt"
-	"math/rand"
-	"reflect"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/CNES/ccsdsmo-malgo/com"
 	"github.com/CNES/ccsdsmo-malgo/com/archive"
 	"github.com/CNES/ccsdsmo-malgo/mal"
-	"github.com/CNES/ccsdsmo-malgo/mal/encoding/binary"
+	"github.com/CNES/ccsdsmo-malgo/mal/debug"
 
 	. "github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/constants"
 	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/utils"
-
-	// Init mysql driver
-	_ "github.com/go-sql-driver/mysql"
 )
 
-// Database ids
+// Default name of the Archive table
 const (
-	USERNAME = "archiveService"
-	PASSWORD = "1a2B3c4D!@?"
-	DATABASE = "archive"
-	TABLE    = "Archive"
+	TABLE = "Archive"
+)
+
+var (
+	storageLogger debug.Logger = debug.GetLogger("archive.storage")
 )
 
-// Database columns
+// Database columns, the names of the fields in the queries are mapped
+// to them by FieldColumn (the names may also be written with the MySQL
+// quotes, e.g. `details.related`)
 var databaseFields = []string{
 	"id",
 	"objectInstanceIdentifier",
@@ -64,24 +66,154 @@ var databaseFields = []string{
 	"number",
 	"domain",
 	"timestamp",
-	"`details.related`",
+	"details.related",
 	"network",
 	"provider",
-	"`details.source`",
+	"details.source",
+	"details.source.area",
+	"details.source.service",
+	"details.source.version",
+	"details.source.number",
+	"details.source.domain",
+	"details.source.instId",
+}
+
+// SQLBackend is the ArchiveBackend storing the objects in a SQL
+// database accessed through database/sql, the differences between
+// the databases are handled by its Dialect
+type SQLBackend struct {
+	dialect        Dialect
+	dataSourceName string
+	// tableName is the name of the Archive table and table the
+	// same name quoted for the dialect
+	tableName string
+	table     string
+	// queries holds the fixed queries written for the dialect
+	queries sqlQueries
+
+	// pool holds the limits of the connection pool
+	pool PoolConfig
+	// mutex protects db and statements which are created on first use
+	mutex sync.Mutex
+	// db is the pool of connections shared by all the operations
+	db *sql.DB
+	// statements holds the prepared statements of the fixed queries
+	statements map[string]*sql.Stmt
+	// softDelete keeps the deleted objects as tombstones, it's protected
+	// by mutex
+	softDelete bool
+}
+
+// PoolConfig holds the limits of the connection pool of a SQLBackend,
+// a zero value keeps the default of database/sql
+type PoolConfig struct {
+	// MaxOpenConns is the maximum number of open connections
+	MaxOpenConns int
+	// MaxIdleConns is the maximum number of idle connections, a
+	// negative value means that no connection is kept idle
+	MaxIdleConns int
+	// ConnMaxLifetime is the maximum amount of time a connection is reused
+	ConnMaxLifetime time.Duration
+}
+
+// sqlQueries holds the queries which don't depend on the
+// parameters of the operations
+type sqlQueries struct {
+	retrieveAll       string
+	selectInstID      string
+	selectAllInstIDs  string
+	insert            string
+	update            string
+	delete            string
+	deleteAll         string
+	incrementInstID   string
+	selectLastInstID  string
+	selectUsedInstIDs string
+	// Queries of the history table (see history.go)
+	selectLastRevision string
+	selectVersion      string
+	insertVersion      string
+	selectHistory      string
+	deleteHistory      string
+	// Queries of the tombstones (see softdelete.go)
+	softDelete           string
+	softDeleteAll        string
+	selectDeletedInstIDs string
+	restore              string
+	purge                string
+}
+
+// NewSQLBackend creates a backend for a database using the given dialect,
+// dataSourceName is given to the database/sql driver of the dialect and
+// the objects are stored in the given table
+func NewSQLBackend(dialect Dialect, dataSourceName string, table string) *SQLBackend {
+	backend := &SQLBackend{
+		dialect:        dialect,
+		dataSourceName: dataSourceName,
+		tableName:      table,
+		table:          dialect.QuoteIdentifier(table),
+	}
+	backend.createQueries()
+	return backend
+}
+
+// NewMySQLBackend creates a backend connecting to a MySQL (or MariaDB)
+// database, dataSourceName is given to go-sql-driver/mysql
+// (e.g. "user:password@/archive")
+func NewMySQLBackend(dataSourceName string, table string) *SQLBackend {
+	return NewSQLBackend(MySQLDialect{}, dataSourceName, table)
+}
+
+// SetPool sets the limits of the connection pool
+func (backend *SQLBackend) SetPool(pool PoolConfig) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+
+	backend.pool = pool
+	if backend.db != nil {
+		backend.applyPool()
+	}
+}
+
+// Close closes the prepared statements and the connections to the database
+func (backend *SQLBackend) Close() error {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+
+	if backend.db == nil {
+		return nil
+	}
+	for _, statement := range backend.statements {
+		statement.Close()
+	}
+	err := backend.db.Close()
+	backend.db = nil
+	backend.statements = nil
+	return err
 }
 
+// Check that SQLBackend implements the ArchiveBackend interface and all the
+// optional interfaces
+var (
+	_ ArchiveBackend    = (*SQLBackend)(nil)
+	_ HistoryBackend    = (*SQLBackend)(nil)
+	_ SoftDeleteBackend = (*SQLBackend)(nil)
+	_ RetentionBackend  = (*SQLBackend)(nil)
+)
+
 //======================================================================//
 //                            RETRIEVE                                  //
 //======================================================================//
 
 // RetrieveInArchive : TODO:
-func RetrieveInArchive(objectType com.ObjectType, identifierList mal.IdentifierList, objectInstanceIdentifierList mal.LongList) (archive.ArchiveDetailsList, mal.ElementList, error) {
+func (backend *SQLBackend) RetrieveInArchive(objectType com.ObjectType, identifierList mal.IdentifierList, objectInstanceIdentifierList mal.LongList) (archive.ArchiveDetailsList, mal.ElementList, error) {
 	// Create the transaction to execute future queries
-	db, tx, err := createTransaction()
+	tx, err := backend.createReadTransaction()
 	if err != nil {
 		return nil, nil, err
 	}
-	defer db.Close()
+	// Rollback the transaction if it has not been committed
+	defer tx.Rollback()
 
 	// Convert domain
 	domain := utils.AdaptDomainToString(identifierList)
@@ -112,74 +244,25 @@ func RetrieveInArchive(objectType com.ObjectType, identifierList mal.IdentifierL
 	var elementList = element.(mal.ElementList)
 	elementList = elementList.CreateElement().(mal.ElementList)
 	// Then, retrieve these elements and their information
+	var rows *sql.Rows
 	if !isAll {
+		// Retrieve all the objects with a single query
+		var instIDs = make([]int64, objectInstanceIdentifierList.Size())
 		for i := 0; i < objectInstanceIdentifierList.Size(); i++ {
-			// Variables to store the different elements present in the database
-			var encodedObjectId []byte
-			var encodedElement []byte
-			var timestamp time.Time
-			var related mal.Long
-			var network mal.Identifier
-			var provider mal.URI
-
-			// We can retrieve this object
-			err = tx.QueryRow("SELECT element, timestamp, `details.related`, network, provider, `details.source` FROM "+TABLE+" WHERE objectInstanceIdentifier = ? AND area = ? AND service = ? AND version = ? AND number = ? AND domain = ?",
-				*objectInstanceIdentifierList[i],
-				objectType.Area,
-				objectType.Service,
-				objectType.Version,
-				objectType.Number,
-				domain).Scan(&encodedElement,
-				&timestamp,
-				&related,
-				&network,
-				&provider,
-				&encodedObjectId)
-			if err != nil {
-				if err.Error() == "sql: no rows in result set" {
-					return nil, nil, errors.New(string(mal.ERROR_UNKNOWN_MESSAGE))
-				}
-				return nil, nil, err
-			}
-
-			// Decode the Element and the ObjectId for the ArchiveDetails
-			objectId, element, err := utils.DecodeElements(encodedObjectId, encodedElement)
-			if err != nil {
-				return nil, nil, err
-			}
-
-			// Create the ArchiveDetails
-			// First, create the ObjectDetails
-			var prelated = &related
-			if related == 0 {
-				prelated = mal.NullLong
-			}
-			objectDetails := com.ObjectDetails{prelated, objectId}
-			// Create the ArchiveDetails
-			archiveDetails := &archive.ArchiveDetails{
-				*objectInstanceIdentifierList[i],
-				objectDetails,
-				&network,
-				mal.NewFineTime(timestamp),
-				&provider,
-			}
-
-			archiveDetailsList.AppendElement(archiveDetails)
-			elementList.AppendElement(element)
+			instIDs[i] = int64(*objectInstanceIdentifierList[i])
+		}
+		builder, err := backend.keyQuery(retrieveColumns, objectType, domain, instIDs)
+		if err != nil {
+			return nil, nil, err
+		}
+		builder.NotDeletedCondition()
+		rows, err = tx.Query(builder.String(), builder.Args()...)
+		if err != nil {
+			return nil, nil, err
 		}
 	} else {
 		// Retrieve all these elements (no particular object instance identifiers)
-		// Variables to store the different elements present in the database
-		var objectInstanceIdentifier mal.Long
-		var encodedObjectId []byte
-		var encodedElement []byte
-		var timestamp time.Time
-		var related mal.Long
-		var network mal.Identifier
-		var provider mal.URI
-
-		// Retrieve this object and its archive details in the archive
-		rows, err := tx.Query("SELECT objectInstanceIdentifier, element, timestamp, `details.related`, network, provider, `details.source` FROM "+TABLE+" WHERE area = ? AND service = ? AND version = ? AND number = ? AND domain = ?",
+		rows, err = backend.query(tx, backend.queries.retrieveAll,
 			objectType.Area,
 			objectType.Service,
 			objectType.Version,
@@ -188,49 +271,42 @@ func RetrieveInArchive(objectType com.ObjectType, identifierList mal.IdentifierL
 		if err != nil {
 			return nil, nil, err
 		}
+	}
+	defer rows.Close()
 
-		var countElements int
-		for rows.Next() {
-			if err = rows.Scan(&objectInstanceIdentifier,
-				&encodedElement,
-				&timestamp,
-				&related,
-				&network,
-				&provider,
-				&encodedObjectId); err != nil {
-				return nil, nil, err
-			}
-
-			// Decode the Element and the ObjectId for the ArchiveDetails
-			objectId, element, err := utils.DecodeElements(encodedObjectId, encodedElement)
-			if err != nil {
-				return nil, nil, err
-			}
-
-			// Create the ArchiveDetails
-			// First, create the ObjectDetails
-			var prelated = &related
-			if related == 0 {
-				prelated = mal.NullLong
-			}
-			objectDetails := com.ObjectDetails{prelated, objectId}
-			// Create the ArchiveDetails
-			archiveDetails := &archive.ArchiveDetails{
-				objectInstanceIdentifier,
-				objectDetails,
-				&network,
-				mal.NewFineTime(timestamp),
-				&provider,
-			}
-
+	var retrievedDetails = make(map[mal.Long]*archive.ArchiveDetails)
+	var retrievedElements = make(map[mal.Long]mal.Element)
+	for rows.Next() {
+		archiveDetails, element, err := scanRetrievedObject(rows)
+		if err != nil {
+			return nil, nil, err
+		}
+		if isAll {
 			archiveDetailsList.AppendElement(archiveDetails)
 			elementList.AppendElement(element)
-			countElements++
+		} else {
+			retrievedDetails[archiveDetails.InstId] = archiveDetails
+			retrievedElements[archiveDetails.InstId] = element
 		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
 
-		if countElements == 0 {
+	if isAll {
+		if archiveDetailsList.Size() == 0 {
 			return nil, nil, errors.New(string(mal.ERROR_UNKNOWN_MESSAGE))
 		}
+	} else {
+		// The objects are returned in the order of the request
+		for i := 0; i < objectInstanceIdentifierList.Size(); i++ {
+			archiveDetails, ok := retrievedDetails[*objectInstanceIdentifierList[i]]
+			if !ok {
+				return nil, nil, errors.New(string(mal.ERROR_UNKNOWN_MESSAGE))
+			}
+			archiveDetailsList.AppendElement(archiveDetails)
+			elementList.AppendElement(retrievedElements[*objectInstanceIdentifierList[i]])
+		}
 	}
 
 	// Commit changes
@@ -239,449 +315,335 @@ func RetrieveInArchive(objectType com.ObjectType, identifierList mal.IdentifierL
 	return archiveDetailsList, elementList, nil
 }
 
+// Columns of the objects returned by the Retrieve operation
+var retrieveColumns = []string{"objectInstanceIdentifier", "element", "timestamp", "details.related", "network", "provider", "details.source"}
+
+// scanRetrievedObject reads an object selected with the retrieveColumns,
+// the extra destinations receive the columns selected after them
+func scanRetrievedObject(rows *sql.Rows, extra ...interface{}) (*archive.ArchiveDetails, mal.Element, error) {
+	// Variables to store the different elements present in the database
+	var objectInstanceIdentifier mal.Long
+	var encodedObjectId []byte
+	var encodedElement []byte
+	// Nanoseconds since the epoch (see encodeTimestamp)
+	var timestamp int64
+	var related sql.NullInt64
+	var network mal.Identifier
+	var provider mal.URI
+	var dest = []interface{}{&objectInstanceIdentifier, &encodedElement, &timestamp, &related, &network, &provider, &encodedObjectId}
+	if err := rows.Scan(append(dest, extra...)...); err != nil {
+		return nil, nil, err
+	}
+
+	// Decode the Element and the ObjectId for the ArchiveDetails
+	objectId, element, err := utils.DecodeElements(encodedObjectId, encodedElement)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Create the ArchiveDetails
+	// First, create the ObjectDetails
+	// A NULL related is a null Long
+	var prelated = mal.NullLong
+	if related.Valid {
+		prelated = mal.NewLong(related.Int64)
+	}
+	objectDetails := com.ObjectDetails{prelated, objectId}
+	// Create the ArchiveDetails
+	archiveDetails := &archive.ArchiveDetails{
+		objectInstanceIdentifier,
+		objectDetails,
+		&network,
+		mal.NewFineTime(decodeTimestamp(timestamp)),
+		&provider,
+	}
+	return archiveDetails, element, nil
+}
+
 //======================================================================//
 //                              QUERY                                   //
 //======================================================================//
 
 // QueryArchive : TODO:
-func QueryArchive(boolean *mal.Boolean, objectType com.ObjectType, archiveQuery archive.ArchiveQuery, queryFilter archive.QueryFilter) ([]*com.ObjectType, []*archive.ArchiveDetailsList, []*mal.IdentifierList, []mal.ElementList, error) {
+func (backend *SQLBackend) QueryArchive(boolean *mal.Boolean, objectType com.ObjectType, archiveQuery archive.ArchiveQuery, queryFilter archive.QueryFilter) ([]*com.ObjectType, []*archive.ArchiveDetailsList, []*mal.IdentifierList, []mal.ElementList, error) {
 	// Create the transaction to execute future queries
-	db, tx, err := createTransaction()
+	tx, err := backend.createReadTransaction()
 	if err != nil {
 		return nil, nil, nil, nil, err
 	}
-	defer db.Close()
+	// Rollback the transaction if it has not been committed
+	defer tx.Rollback()
 
 	// Verify the parameters
-	err = verifyParameters(archiveQuery, queryFilter)
+	err = verifyParameters(objectType, archiveQuery, queryFilter)
 	if err != nil {
 		return nil, nil, nil, nil, err
 	}
 
-	var isObjectTypeEqualToZero = objectType.Area == 0 || objectType.Number == 0 || objectType.Service == 0 || objectType.Version == 0
-
-	// First of all we have to create the query
-	query, err := createQuery(boolean, objectType, isObjectTypeEqualToZero, archiveQuery, queryFilter)
-	if err != nil {
-		return nil, nil, nil, nil, err
+	var groups = newQueryGroups(boolean, objectType)
+	var addObject = func(object *queriedObject) error {
+		// Decode the element
+		var element mal.Element
+		if groups.isReturnBody {
+			var err error
+			element, err = utils.DecodeElement(object.encodedElement)
+			if err != nil {
+				return err
+			}
+		}
+		return groups.add(object.objectType, object.domain, object.archiveDetails, element)
 	}
 
-	// Variables to return
-	var objectTypeToReturn []*com.ObjectType
-	var identifierListToReturn []*mal.IdentifierList
-	var archiveDetailsListToReturn []*archive.ArchiveDetailsList
-	var elementListToReturn []mal.ElementList
-
-	if boolean != nil && *boolean == true && isObjectTypeEqualToZero == true {
-		// Retrieve all of the elements
-		// Variables to store the different elements present in the database
-		var objectInstanceIdentifier mal.Long
-		var encodedObjectId []byte
-		var encodedElement []byte
-		var timestamp time.Time
-		var related mal.Long
-		var network mal.Identifier
-		var provider mal.URI
-		var area mal.UShort
-		var service mal.UShort
-		var version mal.UOctet
-		var number mal.UShort
-		var domain string
-
-		rows, err := tx.Query(query)
+	columnFilters, bodyFilters := splitFilters(queryFilter)
+	if isAnyBodyField(sortFields(archiveQuery)) {
+		// The objects are sorted on their decoded bodies, then read in
+		// this order
+		ids, err := backend.selectSortedIDs(tx, objectType, archiveQuery, columnFilters, bodyFilters, nil)
 		if err != nil {
 			return nil, nil, nil, nil, err
 		}
-
-		// Define a slice to sort on the differents values to return
-		// TODO: find a name for this attribute
-		var findASmartName []interface{}
-		// Map for the different object types
-		var objectTypeMap = make(map[com.ObjectType]uint)
-		var countObjectType uint
-		// Map for the different domains
-		var domainMap = make(map[string]uint)
-		var countDomain uint
-
-		for rows.Next() {
-			if err = rows.Scan(&objectInstanceIdentifier, &timestamp, &related, &network, &provider, &encodedObjectId, &encodedElement, &domain, &area, &service, &version, &number); err != nil {
-				return nil, nil, nil, nil, err
-			}
-			var prelated = &related
-			if related == 0 {
-				prelated = mal.NullLong
-			}
-
-			//
-			var isAlreadyUsed = true
-			// Verify the object type value
-			objectTypeFromDB := com.ObjectType{area, service, version, number}
-			if _, ok := objectTypeMap[objectTypeFromDB]; !ok {
-				objectTypeMap[objectTypeFromDB] = countObjectType
-				countObjectType++
-				isAlreadyUsed = false
-			}
-			// Verify the domain value
-			if _, ok := domainMap[domain]; !ok {
-				domainMap[domain] = countDomain
-				countDomain++
-				isAlreadyUsed = false
-			}
-
-			if isAlreadyUsed {
-				var index uint
-				// Retrieve the index in the general slice
-				duo := []interface{}{objectTypeFromDB, domain}
-				for i := 0; i < len(findASmartName)/2; i++ {
-					if reflect.DeepEqual(duo, findASmartName[i]) {
-						index = uint(i)
-						break
-					}
-				}
-
-				// ArchiveDetailsList
-				// Decode the object id
-				objId, err := utils.DecodeObjectID(encodedObjectId)
-				if err != nil {
-					return nil, nil, nil, nil, err
-				}
-				objectDet := com.ObjectDetails{
-					prelated,
-					objId,
-				}
-				archDetails := &archive.ArchiveDetails{objectInstanceIdentifier, objectDet, &network, mal.NewFineTime(timestamp), &provider}
-				// Append this ArchiveDetails to the desired ArchiveDetailsList
-				archiveDetailsListToReturn[index].AppendElement(archDetails)
-
-				// ElementList
-				// Decode the element
-				elem, err := utils.DecodeElement(encodedElement)
-				if err != nil {
-					return nil, nil, nil, nil, err
-				}
-				elementListToReturn[index].AppendElement(elem)
-			} else {
-				// First, append the objectType and the domain in the general slice
-				findASmartName = append(findASmartName, objectTypeFromDB, domain)
-
-				// IdentifierList
-				idList := utils.AdaptDomainToIdentifierList(domain)
-				identifierListToReturn = append(identifierListToReturn, &idList)
-
-				// ObjectType
-				objectTypeToReturn = append(objectTypeToReturn, &objectTypeFromDB)
-
-				// ArchiveDetailsList
-				archDetailsList := archive.NewArchiveDetailsList(0)
-				// Decode the object id
-				objId, err := utils.DecodeObjectID(encodedObjectId)
-				if err != nil {
-					return nil, nil, nil, nil, err
-				}
-				objectDet := com.ObjectDetails{
-					prelated,
-					objId,
-				}
-				archDetails := &archive.ArchiveDetails{objectInstanceIdentifier, objectDet, &network, mal.NewFineTime(timestamp), &provider}
-				archDetailsList.AppendElement(archDetails)
-				archiveDetailsListToReturn = append(archiveDetailsListToReturn, archDetailsList)
-
-				// ElementList
-				// Decode the element
-				elem, err := utils.DecodeElement(encodedElement)
-				if err != nil {
-					return nil, nil, nil, nil, err
-				}
-
-				// Transform Type Short Form to List Short Form
-				listShortForm := utils.ConvertToListShortForm(objectTypeFromDB)
-				// Get Element in the MAL Registry
-				element, err := mal.LookupMALElement(listShortForm)
-				var elementList = element.(mal.ElementList)
-				elementList = elementList.CreateElement().(mal.ElementList)
-
-				elementList.AppendElement(elem)
-				elementListToReturn = append(elementListToReturn, elementList)
-			}
+		err = backend.readObjects(tx, ids, groups.isReturnBody, addObject)
+		if err != nil {
+			return nil, nil, nil, nil, err
 		}
-	} else if boolean != nil && *boolean == true && isObjectTypeEqualToZero == false {
-		// Retrieve all of the elements unless the object type
-		// Variables to store the different elements present in the database
-		var objectInstanceIdentifier mal.Long
-		var encodedObjectId []byte
-		var encodedElement []byte
-		var timestamp time.Time
-		var related mal.Long
-		var network mal.Identifier
-		var provider mal.URI
-		var domain string
-		var area mal.UShort
-		var service mal.UShort
-		var version mal.UOctet
-		var number mal.UShort
-
-		rows, err := tx.Query(query)
+	} else {
+		// The filters on the fields of the body are evaluated on each row
+		// read by the query
+		err = backend.streamObjects(tx, objectType, archiveQuery, columnFilters, bodyFilters, nil, groups.isReturnBody, addObject)
 		if err != nil {
 			return nil, nil, nil, nil, err
 		}
+	}
 
-		// Map for the different domains
-		var domainMap = make(map[string]uint)
-		var countDomain uint
-
-		for rows.Next() {
-			if err = rows.Scan(&objectInstanceIdentifier, &timestamp, &related, &network, &provider, &encodedObjectId, &encodedElement, &domain, &area, &service, &version, &number); err != nil {
-				return nil, nil, nil, nil, err
-			}
-			var prelated = &related
-			if related == 0 {
-				prelated = mal.NullLong
-			}
-
-			//
-			var isAlreadyUsed = true
-			// Verify the domain value
-			if _, ok := domainMap[domain]; !ok {
-				domainMap[domain] = countDomain
-				countDomain++
-				isAlreadyUsed = false
-			}
-
-			if isAlreadyUsed {
-				// ArchiveDetailsList
-				// Decode the object id
-				objID, err := utils.DecodeObjectID(encodedObjectId)
-				if err != nil {
-					return nil, nil, nil, nil, err
-				}
-				objectDet := com.ObjectDetails{
-					Related: prelated,
-					Source:  objID,
-				}
-				archDetails := &archive.ArchiveDetails{objectInstanceIdentifier, objectDet, &network, mal.NewFineTime(timestamp), &provider}
-				// Append this ArchiveDetails to the desired ArchiveDetailsList
-				archiveDetailsListToReturn[domainMap[domain]].AppendElement(archDetails)
+	// Commit changes
+	tx.Commit()
 
-				// ElementList
-				// Decode the element
-				elem, err := utils.DecodeElement(encodedElement)
-				if err != nil {
-					return nil, nil, nil, nil, err
-				}
-				elementListToReturn[domainMap[domain]].AppendElement(elem)
-			} else {
-				// IdentifierList
-				idList := utils.AdaptDomainToIdentifierList(domain)
-				identifierListToReturn = append(identifierListToReturn, &idList)
+	objectTypeToReturn, archiveDetailsListToReturn, identifierListToReturn, elementListToReturn := groups.lists()
+	return objectTypeToReturn, archiveDetailsListToReturn, identifierListToReturn, elementListToReturn, nil
+}
 
-				// ObjectType
-				objectTypeToReturn = append(objectTypeToReturn, nil)
+// StreamQuery sends the objects matching a query while they are read from
+// the cursor of the database, the memory used doesn't depend on the number
+// of objects. The rows are sorted by group first so that the objects of a
+// group are read consecutively, unless the sort order of the query is
+// global. The filters on the fields of the body are evaluated on each row.
+// When a sort field is a field of the body, the ids of the objects are
+// sorted first and the objects are then read by batches in this order: the
+// memory used then grows with the number of matching objects (see
+// selectSortedIDs).
+func (backend *SQLBackend) StreamQuery(boolean *mal.Boolean, objectType com.ObjectType, archiveQuery archive.ArchiveQuery, queryFilter archive.QueryFilter, limits ChunkLimits, globalOrder bool, send QuerySender) error {
+	// Create the transaction to execute future queries
+	tx, err := backend.createReadTransaction()
+	if err != nil {
+		return err
+	}
+	// Rollback the transaction if it has not been committed
+	defer tx.Rollback()
 
-				// ArchiveDetailsList
-				archDetailsList := archive.NewArchiveDetailsList(0)
-				// Decode the object id
-				objID, err := utils.DecodeObjectID(encodedObjectId)
-				if err != nil {
-					return nil, nil, nil, nil, err
-				}
-				objectDet := com.ObjectDetails{
-					Related: prelated,
-					Source:  objID,
-				}
-				archDetails := &archive.ArchiveDetails{objectInstanceIdentifier, objectDet, &network, mal.NewFineTime(timestamp), &provider}
-				archDetailsList.AppendElement(archDetails)
-				archiveDetailsListToReturn = append(archiveDetailsListToReturn, archDetailsList)
+	// Verify the parameters
+	err = verifyParameters(objectType, archiveQuery, queryFilter)
+	if err != nil {
+		return err
+	}
 
-				// ElementList
-				// Decode the element
-				elem, err := utils.DecodeElement(encodedElement)
-				if err != nil {
-					return nil, nil, nil, nil, err
-				}
-				// Transform Type Short Form to List Short Form
-				listShortForm := utils.ConvertToListShortForm(com.ObjectType{Area: area, Service: service, Version: version, Number: number})
-				// Get Element in the MAL Registry
-				element, err := mal.LookupMALElement(listShortForm)
-				var elementList = element.(mal.ElementList)
-				elementList = elementList.CreateElement().(mal.ElementList)
-
-				elementList.AppendElement(elem)
-				elementListToReturn = append(elementListToReturn, elementList)
+	var chunker = newQueryChunker(boolean, objectType, limits, send)
+	columnFilters, bodyFilters := splitFilters(queryFilter)
+	var groupColumns []string
+	if chunker.isObjectTypeEqualToZero && isSortedByGroup(archiveQuery, globalOrder) {
+		groupColumns = append(groupColumns, "area", "service", "version", "number")
+	}
+	if chunker.isReturnBody && isSortedByGroup(archiveQuery, globalOrder) {
+		groupColumns = append(groupColumns, "domain")
+	}
+	var addObject = func(object *queriedObject) error {
+		var element mal.Element
+		if chunker.isReturnBody {
+			var err error
+			element, err = utils.DecodeElement(object.encodedElement)
+			if err != nil {
+				return err
 			}
 		}
-	} else if (boolean == nil || *boolean == false) && isObjectTypeEqualToZero == true {
-		// Retrieve only the object type and the archive details
-		// Variables to store the different elements present in the database
-		var objectInstanceIdentifier mal.Long
-		var encodedObjectId []byte
-		var timestamp time.Time
-		var related mal.Long
-		var network mal.Identifier
-		var provider mal.URI
-		var area mal.UShort
-		var service mal.UShort
-		var version mal.UOctet
-		var number mal.UShort
-
-		rows, err := tx.Query(query)
+		return chunker.add(object.objectType, object.domain, object.archiveDetails, element, object.size())
+	}
+
+	if isAnyBodyField(sortFields(archiveQuery)) {
+		ids, err := backend.selectSortedIDs(tx, objectType, archiveQuery, columnFilters, bodyFilters, groupColumns)
 		if err != nil {
-			return nil, nil, nil, nil, err
+			return err
 		}
+		err = backend.readObjects(tx, ids, chunker.isReturnBody, addObject)
+		if err != nil {
+			return err
+		}
+	} else {
+		err = backend.streamObjects(tx, objectType, archiveQuery, columnFilters, bodyFilters, groupColumns, chunker.isReturnBody, addObject)
+		if err != nil {
+			return err
+		}
+	}
 
-		// Map for the different object types
-		var objectTypeMap = make(map[com.ObjectType]uint)
-		var countObjectType uint
-
-		for rows.Next() {
-			if err = rows.Scan(&objectInstanceIdentifier, &timestamp, &related, &network, &provider, &encodedObjectId, &area, &service, &version, &number); err != nil {
-				return nil, nil, nil, nil, err
-			}
-			var prelated = &related
-			if related == 0 {
-				prelated = mal.NullLong
-			}
-
-			//
-			var isAlreadyUsed = true
-			// Verify the object type value
-			objectTypeFromDB := com.ObjectType{area, service, version, number}
-			if _, ok := objectTypeMap[objectTypeFromDB]; !ok {
-				objectTypeMap[objectTypeFromDB] = countObjectType
-				countObjectType++
-				isAlreadyUsed = false
-			}
-
-			if isAlreadyUsed {
-				// ArchiveDetailsList
-				// Decode the object id
-				objId, err := utils.DecodeObjectID(encodedObjectId)
-				if err != nil {
-					return nil, nil, nil, nil, err
-				}
-				objectDet := com.ObjectDetails{
-					prelated,
-					objId,
-				}
-				archDetails := &archive.ArchiveDetails{objectInstanceIdentifier, objectDet, &network, mal.NewFineTime(timestamp), &provider}
-				// Append this ArchiveDetails to the desired ArchiveDetailsList
-				archiveDetailsListToReturn[objectTypeMap[objectTypeFromDB]].AppendElement(archDetails)
+	// Send the last chunk
+	err = chunker.flush()
+	if err != nil {
+		return err
+	}
 
-			} else {
-				// IdentifierList
-				identifierListToReturn = append(identifierListToReturn, nil)
+	// Commit changes
+	return tx.Commit()
+}
 
-				// ObjectType
-				objectTypeToReturn = append(objectTypeToReturn, &objectTypeFromDB)
+// streamObjects reads the objects matching a query from the cursor of the
+// database, sorted by the group columns first, and gives them to a function.
+// The filters on the fields of the body are evaluated on each row.
+func (backend *SQLBackend) streamObjects(tx *sql.Tx, objectType com.ObjectType, archiveQuery archive.ArchiveQuery, columnFilters archive.QueryFilter, bodyFilters []*archive.CompositeFilter, groupColumns []string, isReturnBody bool, visit func(*queriedObject) error) error {
+	var isElementRead = isReturnBody || len(bodyFilters) != 0
+
+	var builder = newQueryBuilder(backend.dialect)
+	builder.WriteString("SELECT " + backend.queryColumns(isElementRead))
+	// The rows are sorted after the conditions, by group first
+	var conditions = archiveQuery
+	conditions.SortOrder = nil
+	err := backend.createCommonQuery(builder, objectType, conditions, columnFilters)
+	if err != nil {
+		return err
+	}
+	err = backend.orderBy(builder, archiveQuery, groupColumns)
+	if err != nil {
+		return err
+	}
 
-				// ArchiveDetailsList
-				archDetailsList := archive.NewArchiveDetailsList(0)
-				// Decode the object id
-				objId, err := utils.DecodeObjectID(encodedObjectId)
-				if err != nil {
-					return nil, nil, nil, nil, err
-				}
-				objectDet := com.ObjectDetails{
-					prelated,
-					objId,
-				}
-				archDetails := &archive.ArchiveDetails{objectInstanceIdentifier, objectDet, &network, mal.NewFineTime(timestamp), &provider}
-				archDetailsList.AppendElement(archDetails)
-				archiveDetailsListToReturn = append(archiveDetailsListToReturn, archDetailsList)
+	rows, err := tx.Query(builder.String(), builder.Args()...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
 
-				// ElementList
-				var longList *mal.LongList
-				elementListToReturn = append(elementListToReturn, longList)
-			}
-		}
-	} else { // (*boolean == false or boolean == nil) and isObjectTypeEqualToZero == false
-		// Retrieve only the archive details
-		// Variables to store the different elements present in the database
-		var objectInstanceIdentifier mal.Long
-		var encodedObjectId []byte
-		var timestamp time.Time
-		var related mal.Long
-		var network mal.Identifier
-		var provider mal.URI
-
-		rows, err := tx.Query(query)
+	for rows.Next() {
+		object, err := scanQueriedObject(rows)
 		if err != nil {
-			return nil, nil, nil, nil, err
+			return err
 		}
 
-		// Set the identifierListToReturn to null
-		identifierListToReturn = append(identifierListToReturn, nil)
-		// Set the objectTypeToReturn to null
-		objectTypeToReturn = append(objectTypeToReturn, nil)
-		// Set the ElementList to null
-		var longList *mal.LongList
-		elementListToReturn = append(elementListToReturn, longList)
-
-		var isAlreadyUsed = false
-		for rows.Next() {
-			if err = rows.Scan(&objectInstanceIdentifier, &timestamp, &related, &network, &provider, &encodedObjectId); err != nil {
-				return nil, nil, nil, nil, err
-			}
-			var prelated = &related
-			if related == 0 {
-				prelated = mal.NullLong
-			}
-
-			// ArchiveDetailsList
-			// Decode the object id
-			objId, err := utils.DecodeObjectID(encodedObjectId)
+		if len(bodyFilters) != 0 {
+			element, err := utils.DecodeElement(object.encodedElement)
 			if err != nil {
-				return nil, nil, nil, nil, err
+				return err
 			}
-			objectDet := com.ObjectDetails{
-				prelated,
-				objId,
+			match, err := matchBodyFilters(element, bodyFilters)
+			if err != nil {
+				return err
 			}
-			archDetails := &archive.ArchiveDetails{objectInstanceIdentifier, objectDet, &network, mal.NewFineTime(timestamp), &provider}
-			// Append this ArchiveDetails to the desired ArchiveDetailsList
-			if !isAlreadyUsed {
-				// ArchiveDetailsList
-				archDetailsList := archive.NewArchiveDetailsList(0)
-				archDetailsList.AppendElement(archDetails)
-				archiveDetailsListToReturn = append(archiveDetailsListToReturn, archDetailsList)
-				isAlreadyUsed = true
-			} else {
-				archiveDetailsListToReturn[0].AppendElement(archDetails)
+			if !match {
+				continue
 			}
 		}
+		if !isReturnBody {
+			// The element has only been read for the filters
+			object.encodedElement = nil
+		}
+
+		err = visit(object)
+		if err != nil {
+			return err
+		}
 	}
+	return rows.Err()
+}
+
+// queriedObject is an object read by a query of the Query operation, its
+// element is left encoded as it's not always needed
+type queriedObject struct {
+	objectType      com.ObjectType
+	domain          mal.String
+	archiveDetails  *archive.ArchiveDetails
+	encodedElement  []byte
+	encodedObjectID []byte
+}
+
+// size estimates the encoded size of the object in a message
+func (object *queriedObject) size() int {
+	return objectSize(object.encodedElement, object.encodedObjectID, *object.archiveDetails.Network, *object.archiveDetails.Provider)
+}
 
-	// Finally, it is useful to verify the size of the archive details
-	// list (if it is equal to 0 we have to append a nil element to
-	// each list)
-	if len(archiveDetailsListToReturn) == 0 {
-		var longList *mal.LongList
-		objectTypeToReturn = append(objectTypeToReturn, nil)
-		archiveDetailsListToReturn = append(archiveDetailsListToReturn, nil)
-		identifierListToReturn = append(identifierListToReturn, nil)
-		elementListToReturn = append(elementListToReturn, longList)
-		// TODO: maybe find another way to initialize elementListToReturn
+// queryColumns returns the columns of the objects returned by the Query
+// operation: the element is only selected if it's read, the domain and
+// the object type are always selected to group the objects
+func (backend *SQLBackend) queryColumns(isElementRead bool) string {
+	var columns = backend.columns("objectInstanceIdentifier", "timestamp", "details.related", "network", "provider", "details.source")
+	if isElementRead {
+		columns += ", " + backend.quote("element")
+	} else {
+		columns += ", NULL"
 	}
+	return columns + ", " + backend.columns("domain", "area", "service", "version", "number")
+}
 
-	// Commit changes
-	tx.Commit()
+// scanQueriedObject reads an object selected with the queryColumns, the
+// columns selected after them are read into the extra destinations
+func scanQueriedObject(rows *sql.Rows, extra ...interface{}) (*queriedObject, error) {
+	// Variables to store the different elements present in the database
+	var objectInstanceIdentifier mal.Long
+	var encodedObjectId []byte
+	var encodedElement []byte
+	// Nanoseconds since the epoch (see encodeTimestamp)
+	var timestamp int64
+	var related sql.NullInt64
+	var network mal.Identifier
+	var provider mal.URI
+	var domain string
+	var area mal.UShort
+	var service mal.UShort
+	var version mal.UOctet
+	var number mal.UShort
+	var dest = []interface{}{&objectInstanceIdentifier, &timestamp, &related, &network, &provider, &encodedObjectId, &encodedElement, &domain, &area, &service, &version, &number}
+	if err := rows.Scan(append(dest, extra...)...); err != nil {
+		return nil, err
+	}
 
-	return objectTypeToReturn, archiveDetailsListToReturn, identifierListToReturn, elementListToReturn, nil
+	// A NULL related is a null Long
+	var prelated = mal.NullLong
+	if related.Valid {
+		prelated = mal.NewLong(related.Int64)
+	}
+	// Decode the object id
+	objID, err := utils.DecodeObjectID(encodedObjectId)
+	if err != nil {
+		return nil, err
+	}
+	objectDet := com.ObjectDetails{
+		Related: prelated,
+		Source:  objID,
+	}
+	return &queriedObject{
+		objectType:      com.ObjectType{area, service, version, number},
+		domain:          mal.String(domain),
+		archiveDetails:  &archive.ArchiveDetails{objectInstanceIdentifier, objectDet, &network, mal.NewFineTime(decodeTimestamp(timestamp)), &provider},
+		encodedElement:  encodedElement,
+		encodedObjectID: encodedObjectId,
+	}, nil
 }
 
 // verifyParameters : TODO:
-func verifyParameters(archiveQuery archive.ArchiveQuery, queryFilter archive.QueryFilter) error {
+func verifyParameters(objectType com.ObjectType, archiveQuery archive.ArchiveQuery, queryFilter archive.QueryFilter) error {
 	// Check sortFieldName value
-	var isSortFieldNameADefinedField = false
-	for i := 0; i < len(databaseFields); i++ {
-		if (archiveQuery.SortFieldName != nil && string(*archiveQuery.SortFieldName) == databaseFields[i]) ||
-			archiveQuery.SortFieldName == nil {
-			isSortFieldNameADefinedField = true
-			break
+	err := verifySortFields(objectType, archiveQuery)
+	if err != nil {
+		return err
+	}
+
+	// Check the bounds of the time window
+	if archiveQuery.StartTime != nil {
+		err = CheckTimestamp(time.Time(*archiveQuery.StartTime))
+		if err != nil {
+			return err
 		}
 	}
-	if !isSortFieldNameADefinedField {
-		// Return a new error
-		return errors.New(string(ARCHIVE_SERVICE_QUERY_SORT_FIELD_NAME_INVALID_ERROR))
+	if archiveQuery.EndTime != nil {
+		err = CheckTimestamp(time.Time(*archiveQuery.EndTime))
+		if err != nil {
+			return err
+		}
 	}
 
 	// Check if QueryFilter doesn't contain an error
@@ -690,6 +652,17 @@ func verifyParameters(archiveQuery archive.ArchiveQuery, queryFilter archive.Que
 
 		for i := 0; i < compositerFilterSet.Filters.Size(); i++ {
 			var filter = compositerFilterSet.Filters.GetElementAt(i).(*archive.CompositeFilter)
+			if isBodyField(string(filter.FieldName)) {
+				// The fields of the body are looked up in the MAL registry
+				if err := verifyBodyField(objectType, string(filter.FieldName)); err != nil {
+					return err
+				}
+			}
+			// The times compared to the columns are encoded like the
+			// timestamps
+			if !isBodyField(string(filter.FieldName)) && filterTimestampError(filter.FieldValue) != nil {
+				return errors.New(string(ARCHIVE_SERVICE_QUERY_QUERY_FILTER_ERROR) + ": " + string(ARCHIVE_SERVICE_TIMESTAMP_RANGE_ERROR))
+			}
 			if (filter.Type == archive.EXPRESSIONOPERATOR_CONTAINS || filter.Type == archive.EXPRESSIONOPERATOR_ICONTAINS || filter.Type == archive.EXPRESSIONOPERATOR_GREATER || filter.Type == archive.EXPRESSIONOPERATOR_GREATER_OR_EQUAL || filter.Type == archive.EXPRESSIONOPERATOR_LESS || filter.Type == archive.EXPRESSIONOPERATOR_LESS_OR_EQUAL) && filter.FieldValue == nil {
 				return errors.New(string(ARCHIVE_SERVICE_QUERY_QUERY_FILTER_ERROR) + ": must not contain NULL value")
 			} else if _, ok := filter.FieldValue.(*mal.Blob); ok {
@@ -712,34 +685,50 @@ func verifyParameters(archiveQuery archive.ArchiveQuery, queryFilter archive.Que
 //======================================================================//
 
 // CountInArchive : TODO:
-func CountInArchive(objectType com.ObjectType, archiveQueryList archive.ArchiveQueryList, queryFilterList archive.QueryFilterList) (*mal.LongList, error) {
+func (backend *SQLBackend) CountInArchive(objectType com.ObjectType, archiveQueryList archive.ArchiveQueryList, queryFilterList archive.QueryFilterList) (*mal.LongList, error) {
 	// Create the transaction to execute future queries
-	db, tx, err := createTransaction()
+	tx, err := backend.createReadTransaction()
 	if err != nil {
 		return nil, err
 	}
-	defer db.Close()
+	// Rollback the transaction if it has not been committed
+	defer tx.Rollback()
 
 	//
 	var longList = mal.NewLongList(0)
 
 	for i := 0; i < archiveQueryList.Size(); i++ {
-		// Verify the parameters
+		var queryFilter archive.QueryFilter
 		if queryFilterList != nil {
-			err = verifyParameters(*archiveQueryList[i], queryFilterList.GetElementAt(i).(archive.QueryFilter))
-		} else {
-			err = verifyParameters(*archiveQueryList[i], nil)
+			queryFilter = queryFilterList.GetElementAt(i).(archive.QueryFilter)
 		}
+		// Verify the parameters
+		err = verifyParameters(objectType, *archiveQueryList[i], queryFilter)
 		if err != nil {
 			return nil, err
 		}
-		// Create the query
-		var query string
-		if queryFilterList != nil {
-			query, err = createCountQuery(objectType, *archiveQueryList[i], queryFilterList.GetElementAt(i).(archive.QueryFilter))
-		} else {
-			query, err = createCountQuery(objectType, *archiveQueryList[i], nil)
+
+		// The filters on the fields of the body are evaluated on the
+		// decoded elements, the matching objects are counted while they
+		// are read
+		columnFilters, bodyFilters := splitFilters(queryFilter)
+		if len(bodyFilters) != 0 {
+			var conditions = *archiveQueryList[i]
+			conditions.SortOrder = nil
+			var count int64
+			err = backend.streamObjects(tx, objectType, conditions, columnFilters, bodyFilters, nil, false, func(*queriedObject) error {
+				count++
+				return nil
+			})
+			if err != nil {
+				return nil, err
+			}
+			longList.AppendElement(mal.NewLong(count))
+			continue
 		}
+
+		// Create the query
+		query, args, err := backend.createCountQuery(objectType, *archiveQueryList[i], columnFilters)
 		if err != nil {
 			return nil, err
 		}
@@ -747,7 +736,7 @@ func CountInArchive(objectType com.ObjectType, archiveQueryList archive.ArchiveQ
 		// Create a variable to Store the response
 		var response int64
 		// Execute the query
-		err = tx.QueryRow(query).Scan(&response)
+		err = tx.QueryRow(query, args...).Scan(&response)
 		if err != nil {
 			return nil, err
 		}
@@ -767,15 +756,14 @@ func CountInArchive(objectType com.ObjectType, archiveQueryList archive.ArchiveQ
 //======================================================================//
 
 // StoreInArchive : Use this function to store objects in an COM archive
-func StoreInArchive(boolean *mal.Boolean, objectType com.ObjectType, identifierList mal.IdentifierList, archiveDetailsList archive.ArchiveDetailsList, elementList mal.ElementList) (*mal.LongList, error) {
-	rand.Seed(time.Now().UnixNano())
-
+func (backend *SQLBackend) StoreInArchive(boolean *mal.Boolean, objectType com.ObjectType, identifierList mal.IdentifierList, archiveDetailsList archive.ArchiveDetailsList, elementList mal.ElementList) (*mal.LongList, error) {
 	// Create the transaction to execute future queries
-	db, tx, err := createTransaction()
+	tx, err := backend.createTransaction()
 	if err != nil {
 		return nil, err
 	}
-	defer db.Close()
+	// Rollback the transaction if it has not been committed
+	defer tx.Rollback()
 
 	// Variable to return all the object instance identifiers
 	var longList *mal.LongList
@@ -787,61 +775,80 @@ func StoreInArchive(boolean *mal.Boolean, objectType com.ObjectType, identifierL
 	if boolean != nil && *boolean {
 		longList = mal.NewLongList(0)
 	}
+	// Check the object instance identifiers given in the request at once,
+	// they must be used only once in the request and in the archive
+	var count int
+	var givenInstIDs = make(map[int64]bool)
+	var givenInstIDList []int64
 	for i := 0; i < archiveDetailsList.Size(); i++ {
-		if archiveDetailsList[i].InstId == 0 {
-			// We have to create a new and unused object instance identifier
-			for {
-				var objectInstanceIdentifier = rand.Int63n(int64(mal.LONG_MAX))
-				isObjInstIDInDB, err := isObjectInstanceIdentifierInDatabase(tx, objectInstanceIdentifier)
-				if err != nil {
-					// An error occurred, do a rollback
-					tx.Rollback()
-					return nil, err
-				}
-				if !isObjInstIDInDB {
-					// OK, we can insert the object with this instance identifier
-					err := insertInDatabase(tx, objectInstanceIdentifier, elementList.GetElementAt(i), objectType, domain, *archiveDetailsList[i])
-					if err != nil {
-						// An error occurred, do a rollback
-						tx.Rollback()
-						return nil, err
-					}
-
-					if boolean != nil && *boolean {
-						// Insert this new object instance identifier in the returned list
-						longList.AppendElement(mal.NewLong(objectInstanceIdentifier))
-					}
-
-					break
-				}
-			}
-		} else {
-			// We must verify if the object instance identifier is not already present in the table
-			isObjInstIDInDB, err := isObjectInstanceIdentifierInDatabase(tx, int64(archiveDetailsList[i].InstId))
-			if err != nil {
-				// An error occurred, do a rollback
-				tx.Rollback()
-				return nil, err
-			}
-			if isObjInstIDInDB {
-				// This object is already in the database, do a rollback and raise a DUPLICATE error
-				tx.Rollback()
-				return nil, errors.New(string(com.ERROR_DUPLICATE))
-			}
+		var objectInstanceIdentifier = int64(archiveDetailsList[i].InstId)
+		if objectInstanceIdentifier == 0 {
+			count++
+			continue
+		}
+		if givenInstIDs[objectInstanceIdentifier] {
+			// This object is already in the request, raise a DUPLICATE error
+			tx.Rollback()
+			return nil, errors.New(string(com.ERROR_DUPLICATE))
+		}
+		givenInstIDs[objectInstanceIdentifier] = true
+		givenInstIDList = append(givenInstIDList, objectInstanceIdentifier)
+	}
+	isDuplicate, err := backend.isAnyInstIDInDatabase(tx, objectType, domain, givenInstIDList)
+	if err != nil {
+		// An error occurred, do a rollback
+		tx.Rollback()
+		return nil, err
+	}
+	if isDuplicate {
+		// This object is already in the database, do a rollback and raise a DUPLICATE error
+		tx.Rollback()
+		return nil, errors.New(string(com.ERROR_DUPLICATE))
+	}
 
-			// This object is not present in the archive
-			err = insertInDatabase(tx, int64(archiveDetailsList[i].InstId), elementList.GetElementAt(i), objectType, domain, *archiveDetailsList[i])
-			if err != nil {
-				// An error occurred, do a rollback
-				tx.Rollback()
-				return nil, err
-			}
+	// Allocate the object instance identifiers of the objects stored
+	// without identifier, skipping the ones given in the request
+	newInstIDs, err := backend.allocateInstIDs(tx, objectType, domain, count, givenInstIDs)
+	if err != nil {
+		// An error occurred, do a rollback
+		tx.Rollback()
+		return nil, err
+	}
 
-			if boolean != nil && *boolean {
-				// Insert this new object instance identifier in the returned list
-				longList.AppendElement(mal.NewLong(int64(archiveDetailsList[i].InstId)))
-			}
+	var rows = make([][]interface{}, 0, archiveDetailsList.Size())
+	var stored = time.Now()
+	for i := 0; i < archiveDetailsList.Size(); i++ {
+		var objectInstanceIdentifier = int64(archiveDetailsList[i].InstId)
+		if objectInstanceIdentifier == 0 {
+			// Take the next allocated object instance identifier
+			objectInstanceIdentifier, newInstIDs = newInstIDs[0], newInstIDs[1:]
+		}
+
+		row, err := insertValues(objectInstanceIdentifier, elementList.GetElementAt(i), objectType, domain, *archiveDetailsList[i], stored)
+		if err != nil {
+			// An error occurred, do a rollback
+			tx.Rollback()
+			return nil, err
+		}
+		rows = append(rows, row)
+
+		if boolean != nil && *boolean {
+			// Insert this new object instance identifier in the returned list
+			longList.AppendElement(mal.NewLong(objectInstanceIdentifier))
+		}
+	}
+
+	// Insert all the objects, the unique index of the table still rejects
+	// an object stored at the same time by another operation
+	err = backend.insertInDatabase(tx, rows)
+	if err != nil {
+		// An error occurred, do a rollback
+		tx.Rollback()
+		if backend.dialect.IsUniqueViolation(err) {
+			// This object is already in the database, raise a DUPLICATE error
+			return nil, errors.New(string(com.ERROR_DUPLICATE))
 		}
+		return nil, err
 	}
 
 	// Commit changes
@@ -855,22 +862,30 @@ func StoreInArchive(boolean *mal.Boolean, objectType com.ObjectType, identifierL
 //======================================================================//
 
 // UpdateArchive : TODO:
-func UpdateArchive(objectType com.ObjectType, identifierList mal.IdentifierList, archiveDetailsList archive.ArchiveDetailsList, elementList mal.ElementList) error {
+func (backend *SQLBackend) UpdateArchive(objectType com.ObjectType, identifierList mal.IdentifierList, archiveDetailsList archive.ArchiveDetailsList, elementList mal.ElementList) error {
 	// Create the transaction to execute future queries
-	db, tx, err := createTransaction()
+	tx, err := backend.createTransaction()
 	if err != nil {
 		return err
 	}
-	defer db.Close()
+	// Rollback the transaction if it has not been committed
+	defer tx.Rollback()
 
 	// Create the domain (It might change in the future)
 	domain := utils.AdaptDomainToString(identifierList)
+	// Time at which the previous versions are replaced
+	var updated = time.Now()
 
 	for i := 0; i < elementList.Size(); i++ {
+		err := CheckTimestamp(time.Time(*archiveDetailsList[i].Timestamp))
+		if err != nil {
+			return err
+		}
+
 		// First of all, we need to verify if the object instance identifier, combined
 		// with the object type and the domain which are in the archive
 		var queryReturn int
-		err := tx.QueryRow("SELECT objectInstanceIdentifier FROM "+TABLE+" WHERE objectInstanceIdentifier = ? AND area = ? AND service = ? AND version = ? AND number = ? AND domain = ?",
+		err = backend.queryRow(tx, backend.queries.selectInstID,
 			archiveDetailsList[i].InstId,
 			objectType.Area,
 			objectType.Service,
@@ -885,23 +900,38 @@ func UpdateArchive(objectType com.ObjectType, identifierList mal.IdentifierList,
 			return err
 		}
 
+		// Keep the version being replaced in the history
+		err = backend.archiveVersion(tx, objectType, domain, archiveDetailsList[i].InstId, updated)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+
 		encodedElement, encodedObjectId, err := utils.EncodeElements(elementList.GetElementAt(i), archiveDetailsList[i].Details.Source)
 		if err != nil {
 			tx.Rollback()
 			return err
 		}
-		var related mal.Long = 0
+		// A null related is stored as NULL
+		var related interface{}
 		if !archiveDetailsList[i].Details.Related.IsNull() {
-			related = *archiveDetailsList[i].Details.Related
+			related = int64(*archiveDetailsList[i].Details.Related)
 		}
+		var sourceID = newSourceValues(archiveDetailsList[i].Details.Source)
 		// If no error, the object is in the archive and we can update it
-		_, err = tx.Exec("UPDATE "+TABLE+" SET element = ?, timestamp = ?, `details.related` = ?, network = ?, provider = ?, `details.source` = ? WHERE objectInstanceIdentifier = ? AND area = ? AND service = ? AND version = ? AND number = ? AND domain = ?",
+		_, err = backend.exec(tx, backend.queries.update,
 			encodedElement,
-			time.Time(*archiveDetailsList[i].Timestamp),
+			encodeTimestamp(time.Time(*archiveDetailsList[i].Timestamp)),
 			related,
 			*archiveDetailsList[i].Network,
 			*archiveDetailsList[i].Provider,
 			encodedObjectId,
+			sourceID.area,
+			sourceID.service,
+			sourceID.version,
+			sourceID.number,
+			sourceID.domain,
+			sourceID.instID,
 			archiveDetailsList[i].InstId,
 			objectType.Area,
 			objectType.Service,
@@ -924,14 +954,16 @@ func UpdateArchive(objectType com.ObjectType, identifierList mal.IdentifierList,
 //                              DELETE                                  //
 //======================================================================//
 
-// DeleteInArchive : TODO:
-func DeleteInArchive(objectType com.ObjectType, identifierList mal.IdentifierList, longListRequest mal.LongList) (mal.LongList, error) {
+// DeleteInArchive deletes a set of objects, or turns them into tombstones
+// in soft delete mode
+func (backend *SQLBackend) DeleteInArchive(objectType com.ObjectType, identifierList mal.IdentifierList, longListRequest mal.LongList) (mal.LongList, error) {
 	// Create the transaction to execute future queries
-	db, tx, err := createTransaction()
+	tx, err := backend.createTransaction()
 	if err != nil {
 		return nil, err
 	}
-	defer db.Close()
+	// Rollback the transaction if it has not been committed
+	defer tx.Rollback()
 
 	// Variable to return
 	//longList := NewLongList(0)
@@ -939,6 +971,9 @@ func DeleteInArchive(objectType com.ObjectType, identifierList mal.IdentifierLis
 
 	// Create the domain (It might change in the future)
 	domain := utils.AdaptDomainToString(identifierList)
+	// Time of the deletion of the tombstones in soft delete mode
+	var deleted = time.Now()
+	var isSoftDelete = backend.isSoftDelete()
 
 	// Variable to say if we have to delete all of the objects or not
 	var isAll = false
@@ -951,7 +986,7 @@ func DeleteInArchive(objectType com.ObjectType, identifierList mal.IdentifierLis
 
 	if isAll {
 		// Retrieve the objectInstanceIdentifier
-		rows, err := tx.Query("SELECT objectInstanceIdentifier FROM "+TABLE+" WHERE area = ? AND service = ? AND version = ? AND number = ? AND domain = ?",
+		rows, err := backend.query(tx, backend.queries.selectAllInstIDs,
 			objectType.Area,
 			objectType.Service,
 			objectType.Version,
@@ -976,29 +1011,42 @@ func DeleteInArchive(objectType com.ObjectType, identifierList mal.IdentifierLis
 			return nil, errors.New(string(mal.ERROR_UNKNOWN_MESSAGE))
 		}
 
-		// Delete all these objects
-		_, err = tx.Exec("DELETE FROM "+TABLE+" WHERE area = ? AND service = ? AND version = ? AND number = ? AND domain = ?",
-			objectType.Area,
-			objectType.Service,
-			objectType.Version,
-			objectType.Number,
-			domain)
-		if err != nil {
-			tx.Rollback()
-			return nil, err
-		}
-
-		// Set AUTO_INCREMENT to max(id)+1
-		err = resetAutoIncrement(tx)
-		if err != nil {
-			tx.Rollback()
-			return nil, err
+		if isSoftDelete {
+			// Keep all these objects as tombstones
+			_, err = backend.exec(tx, backend.queries.softDeleteAll,
+				encodeTimestamp(deleted),
+				objectType.Area,
+				objectType.Service,
+				objectType.Version,
+				objectType.Number,
+				domain)
+			if err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+		} else {
+			// Delete all these objects and their history
+			_, err = backend.exec(tx, backend.queries.deleteAll,
+				objectType.Area,
+				objectType.Service,
+				objectType.Version,
+				objectType.Number,
+				domain)
+			if err != nil {
+				tx.Rollback()
+				return nil, err
+			}
+			err = backend.deleteHistory(tx, objectType, domain, longList)
+			if err != nil {
+				tx.Rollback()
+				return nil, err
+			}
 		}
 	} else {
 		for i := 0; i < longListRequest.Size(); i++ {
 			// Check if the object is in the archive
 			var objInstID int
-			err := tx.QueryRow("SELECT objectInstanceIdentifier FROM "+TABLE+" WHERE objectInstanceIdentifier = ? AND area = ? AND service = ? AND version = ? AND number = ? AND domain = ?",
+			err := backend.queryRow(tx, backend.queries.selectInstID,
 				*longListRequest[i],
 				objectType.Area,
 				objectType.Service,
@@ -1013,13 +1061,25 @@ func DeleteInArchive(objectType com.ObjectType, identifierList mal.IdentifierLis
 				return nil, err
 			}
 
-			_, err = tx.Exec("DELETE FROM "+TABLE+" WHERE objectInstanceIdentifier = ? AND area = ? AND service = ? AND version = ? AND number = ? AND domain = ?",
-				*longListRequest[i],
-				objectType.Area,
-				objectType.Service,
-				objectType.Version,
-				objectType.Number,
-				domain)
+			if isSoftDelete {
+				// Keep the object as a tombstone
+				_, err = backend.exec(tx, backend.queries.softDelete,
+					encodeTimestamp(deleted),
+					*longListRequest[i],
+					objectType.Area,
+					objectType.Service,
+					objectType.Version,
+					objectType.Number,
+					domain)
+			} else {
+				_, err = backend.exec(tx, backend.queries.delete,
+					*longListRequest[i],
+					objectType.Area,
+					objectType.Service,
+					objectType.Version,
+					objectType.Number,
+					domain)
+			}
 			if err != nil {
 				tx.Rollback()
 				return nil, err
@@ -1028,254 +1088,961 @@ func DeleteInArchive(objectType com.ObjectType, identifierList mal.IdentifierLis
 			longList.AppendElement(longListRequest.GetElementAt(i))
 		}
 
-		// Set AUTO_INCREMENT to max(id)+1
-		err = resetAutoIncrement(tx)
-		if err != nil {
-			tx.Rollback()
-			return nil, err
+		if !isSoftDelete {
+			err = backend.deleteHistory(tx, objectType, domain, longList)
+			if err != nil {
+				tx.Rollback()
+				return nil, err
+			}
 		}
 	}
 
 	// Commit changes
-	tx.Commit()
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
 
+	if !isSoftDelete {
+		backend.resetSequence()
+	}
 	return longList, nil
 }
 
-//======================================================================//
-//                           LOCAL FUNCTIONS                            //
-//======================================================================//
-// createTransaction : TODO:
-func createTransaction() (*sql.DB, *sql.Tx, error) {
-	// Open the database
-	db, err := sql.Open("mysql", USERNAME+":"+PASSWORD+"@/"+DATABASE+"?parseTime=true")
-	if err != nil {
-		return nil, nil, err
+// resetSequence resets the sequence of the ids to max(id)+1 after a
+// deletion, in its own transaction as MySQL commits the transaction of the
+// ALTER TABLE it executes. A failure is only logged, the objects are
+// already deleted.
+func (backend *SQLBackend) resetSequence() {
+	tx, err := backend.createTransaction()
+	if err == nil {
+		err = backend.dialect.ResetSequence(tx, backend.tableName)
+		if err == nil {
+			err = tx.Commit()
+		} else {
+			tx.Rollback()
+		}
 	}
-
-	// Validate the connection by pinging it
-	err = db.Ping()
 	if err != nil {
-		return nil, nil, err
+		storageLogger.Errorf("Reset of the sequence of the ids of %s failed: %s", backend.tableName, err.Error())
 	}
+}
 
-	// Create the transaction (we have to use this method to use rollback and commit)
-	tx, err := db.Begin()
+//======================================================================//
+//                             RETENTION                                //
+//======================================================================//
+
+// SelectExpired returns the objects exceeding the limits of a retention
+// rule, oldest first: the objects older than its maximum age are selected
+// by a single query, then the groups holding more objects than its maximum
+// count are counted and their oldest objects are selected. The offset is
+// applied to the objects older than the maximum age, then to each group.
+func (backend *SQLBackend) SelectExpired(rule RetentionRule, now time.Time, offset int, limit int) ([]*ExpiredObjects, error) {
+	// Create the transaction to execute future queries
+	tx, err := backend.createReadTransaction()
 	if err != nil {
-		return nil, nil, err
+		return nil, err
 	}
+	// Rollback the transaction if it has not been committed
+	defer tx.Rollback()
+
+	var expired = newExpiredGroups()
+	var cutoff = rule.cutoff(now)
+	var groupColumns = []string{"area", "service", "version", "number", "domain"}
+
+	// Objects older than the maximum age
+	if rule.MaxAge > 0 {
+		var builder = newQueryBuilder(backend.dialect)
+		builder.WriteString("SELECT " + backend.columns(append(groupColumns, "objectInstanceIdentifier")...))
+		err = backend.retentionConditions(builder, rule)
+		if err != nil {
+			return nil, err
+		}
+		err = builder.Condition("timestamp", "<", encodeTimestamp(cutoff))
+		if err != nil {
+			return nil, err
+		}
+		builder.WriteString(" ORDER BY " + backend.columns("timestamp", "id"))
+		backend.limit(builder, expired.remaining(limit), offset)
 
-	return db, tx, nil
-}
+		err = backend.scanExpired(tx, builder, expired)
+		if err != nil {
+			return nil, err
+		}
 
-// isObjectInstanceIdentifierInDatabase: This function allows to verify if an instance of
-// an object is already in the archive
-func isObjectInstanceIdentifierInDatabase(tx *sql.Tx, objectInstanceIdentifier int64) (bool, error) {
-	// Execute the query
-	// Before, create a variable to retrieve the result
-	var queryReturn int
-	// Then, execute the query
-	err := tx.QueryRow("SELECT objectInstanceIdentifier FROM "+TABLE+" WHERE objectInstanceIdentifier = ? ", objectInstanceIdentifier).Scan(&queryReturn)
-	if err != nil {
-		if err.Error() != "sql: no rows in result set" {
-			return false, err
+		// The objects skipped are counted to skip the rest of the offset
+		// in the groups
+		if offset > 0 && expired.count == 0 {
+			count, err := backend.countExpired(tx, rule, cutoff)
+			if err != nil {
+				return nil, err
+			}
+			offset -= count
+		} else {
+			offset = 0
 		}
-		return false, nil
 	}
-	return true, nil
-}
 
-// insertInDatabase: This function allows to insert an element in the archive
-func insertInDatabase(tx *sql.Tx, objectInstanceIdentifier int64, element mal.Element, objectType com.ObjectType, domain mal.String, archiveDetails archive.ArchiveDetails) error {
-	// Encode the Element and the ObjectId from the ArchiveDetails
-	encodedElement, encodedObjectID, err := utils.EncodeElements(element, archiveDetails.Details.Source)
-	if err != nil {
-		return err
-	}
-	var related mal.Long = 0
-	if !archiveDetails.Details.Related.IsNull() {
-		related = *archiveDetails.Details.Related
+	// Oldest objects beyond the maximum count of each group, the objects
+	// older than the maximum age are not counted
+	if rule.MaxCount > 0 && !expired.isFull(limit) {
+		var builder = newQueryBuilder(backend.dialect)
+		builder.WriteString("SELECT " + backend.columns(groupColumns...) + ", COUNT(" + backend.quote("id") + ")")
+		err = backend.retentionConditions(builder, rule)
+		if err != nil {
+			return nil, err
+		}
+		if rule.MaxAge > 0 {
+			err = builder.Condition("timestamp", ">=", encodeTimestamp(cutoff))
+			if err != nil {
+				return nil, err
+			}
+		}
+		builder.WriteString(" GROUP BY " + backend.columns(groupColumns...) + " HAVING COUNT(" + backend.quote("id") + ") > ")
+		builder.Arg(int64(rule.MaxCount))
+
+		rows, err := tx.Query(builder.String(), builder.Args()...)
+		if err != nil {
+			return nil, err
+		}
+		type exceedingGroup struct {
+			objectType com.ObjectType
+			domain     string
+			count      int
+		}
+		var groups []exceedingGroup
+		for rows.Next() {
+			var group exceedingGroup
+			var area, service, version, number int64
+			if err = rows.Scan(&area, &service, &version, &number, &group.domain, &group.count); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			group.objectType = com.ObjectType{mal.UShort(area), mal.UShort(service), mal.UOctet(version), mal.UShort(number)}
+			groups = append(groups, group)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return nil, err
+		}
+
+		for _, group := range groups {
+			if expired.isFull(limit) {
+				break
+			}
+			var builder = newQueryBuilder(backend.dialect)
+			builder.WriteString("SELECT " + backend.columns(append(groupColumns, "objectInstanceIdentifier")...) + " FROM " + backend.table)
+			builder.Where()
+			builder.NotDeletedCondition()
+			err = builder.Condition("area", "=", int64(group.objectType.Area))
+			if err != nil {
+				return nil, err
+			}
+			err = builder.Condition("service", "=", int64(group.objectType.Service))
+			if err != nil {
+				return nil, err
+			}
+			err = builder.Condition("version", "=", int64(group.objectType.Version))
+			if err != nil {
+				return nil, err
+			}
+			err = builder.Condition("number", "=", int64(group.objectType.Number))
+			if err != nil {
+				return nil, err
+			}
+			err = builder.Condition("domain", "=", group.domain)
+			if err != nil {
+				return nil, err
+			}
+			if rule.MaxAge > 0 {
+				err = builder.Condition("timestamp", ">=", encodeTimestamp(cutoff))
+				if err != nil {
+					return nil, err
+				}
+			}
+			builder.WriteString(" ORDER BY " + backend.columns("timestamp", "id"))
+			var count = group.count - rule.MaxCount
+			if offset >= count {
+				offset -= count
+				continue
+			}
+			count -= offset
+			if remaining := expired.remaining(limit); remaining > 0 && remaining < count {
+				count = remaining
+			}
+			backend.limit(builder, count, offset)
+			offset = 0
+
+			err = backend.scanExpired(tx, builder, expired)
+			if err != nil {
+				return nil, err
+			}
+		}
 	}
 
-	// Execute the query to insert all the values in the database
-	_, err = tx.Exec("INSERT INTO "+TABLE+" VALUES ( NULL , ? , ? , ? , ? , ? , ? , ? , ? , ? , ? , ? , ? )",
-		objectInstanceIdentifier,
-		encodedElement,
-		objectType.Area,
-		objectType.Service,
-		objectType.Version,
-		objectType.Number,
-		domain,
-		time.Time(*archiveDetails.Timestamp),
-		related,
-		*archiveDetails.Network,
-		*archiveDetails.Provider,
-		encodedObjectID)
+	// Commit changes
+	err = tx.Commit()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	return nil
+	return expired.groups, nil
 }
 
-// resetAutoIncrement takes the maximum id in the database and set the
-// AUTO_INCREMENT at this value (actually it's this value to which we added 1)
-func resetAutoIncrement(tx *sql.Tx) error {
-	// Create a value to store the maximum id (to which we added 1)
-	_, err := tx.Exec("SELECT @max := max(id)+1 FROM " + TABLE)
+// DeleteExpired deletes for good the objects selected by SelectExpired,
+// the sequence of the ids isn't reset as it is by DeleteInArchive
+func (backend *SQLBackend) DeleteExpired(objectType com.ObjectType, identifierList mal.IdentifierList, objectInstanceIdentifierList mal.LongList) (mal.LongList, error) {
+	// Create the transaction to execute future queries
+	tx, err := backend.createTransaction()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	// Create the statement (in our case, we use an "alter table" statement)
-	_, err = tx.Exec("SET @alter_statement = CONCAT('ALTER TABLE " + TABLE + " AUTO_INCREMENT = ', @max)")
-	if err != nil {
-		return err
+	// Rollback the transaction if it has not been committed
+	defer tx.Rollback()
+
+	domain := utils.AdaptDomainToString(identifierList)
+	var longList = mal.NewLongList(0)
+	for _, instID := range objectInstanceIdentifierList {
+		result, err := backend.exec(tx, backend.queries.delete,
+			*instID,
+			objectType.Area,
+			objectType.Service,
+			objectType.Version,
+			objectType.Number,
+			domain)
+		if err != nil {
+			return nil, err
+		}
+		deleted, err := result.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+		if deleted != 0 {
+			longList.AppendElement(mal.NewLong(int64(*instID)))
+		}
 	}
-	// Prepare the statement
-	_, err = tx.Exec("PREPARE stmt1 FROM @alter_statement;")
+	err = backend.deleteHistory(tx, objectType, domain, *longList)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	// Then execute the statement
-	_, err = tx.Exec("EXECUTE stmt1")
+
+	// Commit changes
+	err = tx.Commit()
 	if err != nil {
-		return err
+		return nil, err
 	}
-	// Finally, deallocate the statement
-	_, err = tx.Exec("DEALLOCATE PREPARE stmt1;")
-	if err != nil {
-		return err
+	return *longList, nil
+}
+
+// retentionConditions writes the FROM clause and the conditions selecting
+// the objects of the object types and domains of a retention rule
+func (backend *SQLBackend) retentionConditions(builder *queryBuilder, rule RetentionRule) error {
+	var archiveQuery = archive.ArchiveQuery{Related: mal.Long(0)}
+	if len(rule.Domain) != 0 {
+		archiveQuery.Domain = &rule.Domain
 	}
-	return nil
+	return backend.createCommonQuery(builder, rule.ObjectType, archiveQuery, nil)
 }
 
-// createCountQuery allows the provider to create automatically a query for the Count operation
-func createCountQuery(objectType com.ObjectType, archiveQuery archive.ArchiveQuery, queryFilter archive.QueryFilter) (string, error) {
-	var queryBuffer bytes.Buffer
-	// Only CompositeFilterSet type should be used
-	queryBuffer.WriteString("SELECT COUNT(id)")
+// countExpired counts the objects of a retention rule older than its
+// maximum age
+func (backend *SQLBackend) countExpired(tx *sql.Tx, rule RetentionRule, cutoff time.Time) (int, error) {
+	var builder = newQueryBuilder(backend.dialect)
+	builder.WriteString("SELECT COUNT(" + backend.quote("id") + ")")
+	err := backend.retentionConditions(builder, rule)
+	if err != nil {
+		return 0, err
+	}
+	err = builder.Condition("timestamp", "<", encodeTimestamp(cutoff))
+	if err != nil {
+		return 0, err
+	}
+
+	var count int
+	err = tx.QueryRow(builder.String(), builder.Args()...).Scan(&count)
+	return count, err
+}
+
+// limit writes the LIMIT and OFFSET clauses of a query, a limit lower or
+// equal to 0 means no limit and an offset lower or equal to 0 no offset
+func (backend *SQLBackend) limit(builder *queryBuilder, limit int, offset int) {
+	if limit > 0 {
+		builder.WriteString(" LIMIT " + strconv.Itoa(limit))
+	} else if offset > 0 {
+		// MySQL has no OFFSET without LIMIT
+		builder.WriteString(" LIMIT " + strconv.FormatInt(math.MaxInt64, 10))
+	}
+	if offset > 0 {
+		builder.WriteString(" OFFSET " + strconv.Itoa(offset))
+	}
+}
 
-	err := createCommonQuery(&queryBuffer, objectType, archiveQuery, queryFilter)
+// scanExpired adds the objects selected by a query to the expired objects,
+// the query selects the object type, the domain and the object instance
+// identifier of the objects
+func (backend *SQLBackend) scanExpired(tx *sql.Tx, builder *queryBuilder, expired *expiredGroups) error {
+	rows, err := tx.Query(builder.String(), builder.Args()...)
 	if err != nil {
-		return "", err
+		return err
 	}
+	defer rows.Close()
 
-	return queryBuffer.String(), nil
+	for rows.Next() {
+		var area, service, version, number int64
+		var domain string
+		var instID int64
+		if err = rows.Scan(&area, &service, &version, &number, &domain, &instID); err != nil {
+			return err
+		}
+		var objectType = com.ObjectType{mal.UShort(area), mal.UShort(service), mal.UOctet(version), mal.UShort(number)}
+		expired.add(objectType, mal.String(domain), mal.Long(instID))
+	}
+	return rows.Err()
 }
 
-// createQuery allows the provider to create automatically a query for the Query operation
-func createQuery(boolean *mal.Boolean, objectType com.ObjectType, isObjectTypeEqualToZero bool, archiveQuery archive.ArchiveQuery, queryFilter archive.QueryFilter) (string, error) {
-	var queryBuffer bytes.Buffer
-	// Only CompositeFilterSet type should be used
-	queryBuffer.WriteString("SELECT objectInstanceIdentifier, timestamp, `details.related`, network, provider, `details.source`")
-	// Check if we need to retrieve the element and its domain
-	if boolean != nil && *boolean == true {
-		queryBuffer.WriteString(", element, domain")
+//======================================================================//
+//                           LOCAL FUNCTIONS                            //
+//======================================================================//
+// createTransaction creates a transaction on a connection of the pool,
+// the pool and the prepared statements are created on the first call
+func (backend *SQLBackend) createTransaction() (*sql.Tx, error) {
+	return backend.beginTransaction(nil)
+}
+
+// createReadTransaction creates a transaction which only reads the
+// database, with SQLite it doesn't take the lock of the writers (see
+// SQLiteDataSourceName)
+func (backend *SQLBackend) createReadTransaction() (*sql.Tx, error) {
+	return backend.beginTransaction(&sql.TxOptions{ReadOnly: true})
+}
+
+// beginTransaction creates a transaction with the given options on a
+// connection of the pool
+func (backend *SQLBackend) beginTransaction(options *sql.TxOptions) (*sql.Tx, error) {
+	db, err := backend.open()
+	if err != nil {
+		return nil, err
+	}
+
+	// Prepare the statements of the fixed queries
+	err = backend.prepareStatements()
+	if err != nil {
+		return nil, err
+	}
+
+	// Create the transaction (we have to use this method to use rollback and commit)
+	tx, err := db.BeginTx(context.Background(), options)
+	if err != nil {
+		return nil, err
+	}
+
+	return tx, nil
+}
+
+// open returns the pool of connections, opening it if needed
+func (backend *SQLBackend) open() (*sql.DB, error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+
+	if backend.db != nil {
+		return backend.db, nil
+	}
+
+	// Open the database
+	db, err := sql.Open(backend.dialect.DriverName(), backend.dataSourceName)
+	if err != nil {
+		return nil, err
+	}
+
+	// Validate the connection by pinging it
+	err = db.Ping()
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	backend.db = db
+	backend.applyPool()
+	return db, nil
+}
+
+// applyPool applies the limits of the pool to the opened database
+func (backend *SQLBackend) applyPool() {
+	if backend.pool.MaxOpenConns != 0 {
+		backend.db.SetMaxOpenConns(backend.pool.MaxOpenConns)
+	}
+	if backend.pool.MaxIdleConns != 0 {
+		backend.db.SetMaxIdleConns(backend.pool.MaxIdleConns)
+	}
+	if backend.pool.ConnMaxLifetime != 0 {
+		backend.db.SetConnMaxLifetime(backend.pool.ConnMaxLifetime)
+	}
+}
+
+// prepareStatements prepares the statements of the fixed queries
+// if they are not prepared yet
+func (backend *SQLBackend) prepareStatements() error {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+
+	if backend.statements != nil {
+		return nil
+	}
+
+	var statements = make(map[string]*sql.Stmt)
+	for _, query := range []string{
+		backend.queries.retrieveAll,
+		backend.queries.selectInstID,
+		backend.queries.selectAllInstIDs,
+		backend.queries.insert,
+		backend.queries.update,
+		backend.queries.delete,
+		backend.queries.deleteAll,
+		backend.queries.incrementInstID,
+		backend.queries.selectLastInstID,
+		backend.queries.selectUsedInstIDs,
+		backend.queries.selectLastRevision,
+		backend.queries.selectVersion,
+		backend.queries.insertVersion,
+		backend.queries.selectHistory,
+		backend.queries.deleteHistory,
+		backend.queries.softDelete,
+		backend.queries.softDeleteAll,
+		backend.queries.selectDeletedInstIDs,
+		backend.queries.restore,
+		backend.queries.purge,
+	} {
+		statement, err := backend.db.Prepare(query)
+		if err != nil {
+			for _, statement := range statements {
+				statement.Close()
+			}
+			return err
+		}
+		statements[query] = statement
 	}
-	// If there's a wildcard value in one of the object type
-	// fields then we have to retrieve the entire object type
-	if isObjectTypeEqualToZero == true || (isObjectTypeEqualToZero == false && (boolean != nil && *boolean == true)) {
-		queryBuffer.WriteString(", area, service, version, number")
+
+	backend.statements = statements
+	return nil
+}
+
+// statement returns the prepared statement of a fixed query for a transaction
+func (backend *SQLBackend) statement(tx *sql.Tx, query string) (*sql.Stmt, error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+
+	statement, ok := backend.statements[query]
+	if !ok {
+		return nil, errors.New("query not prepared: " + query)
 	}
+	return tx.Stmt(statement), nil
+}
 
-	err := createCommonQuery(&queryBuffer, objectType, archiveQuery, queryFilter)
+// exec executes a fixed query in a transaction
+func (backend *SQLBackend) exec(tx *sql.Tx, query string, args ...interface{}) (sql.Result, error) {
+	statement, err := backend.statement(tx, query)
 	if err != nil {
-		return "", err
+		return nil, err
+	}
+	return statement.Exec(args...)
+}
+
+// query executes a fixed query returning rows in a transaction
+func (backend *SQLBackend) query(tx *sql.Tx, query string, args ...interface{}) (*sql.Rows, error) {
+	statement, err := backend.statement(tx, query)
+	if err != nil {
+		return nil, err
 	}
+	return statement.Query(args...)
+}
 
-	return queryBuffer.String(), nil
+// statementRow is the row returned by queryRow, it keeps the error
+// of the statement until the row is scanned
+type statementRow struct {
+	row *sql.Row
+	err error
 }
 
-// createCommonQuery is a common way of generating a part of a query
-func createCommonQuery(queryBuffer *bytes.Buffer, objectType com.ObjectType, archiveQuery archive.ArchiveQuery, queryFilter archive.QueryFilter) error {
-	// Prepare the query for the conditions
-	queryBuffer.WriteString(" FROM " + TABLE + " WHERE")
+// Scan copies the columns of the row into the values pointed at by dest
+func (row statementRow) Scan(dest ...interface{}) error {
+	if row.err != nil {
+		return row.err
+	}
+	return row.row.Scan(dest...)
+}
 
-	// Attribute to check if there is already a condition before
-	var isThereAlreadyACondition = false
+// queryRow executes a fixed query returning at most one row in a transaction
+func (backend *SQLBackend) queryRow(tx *sql.Tx, query string, args ...interface{}) statementRow {
+	statement, err := backend.statement(tx, query)
+	if err != nil {
+		return statementRow{err: err}
+	}
+	return statementRow{row: statement.QueryRow(args...)}
+}
+
+// Maximum number of rows inserted by a statement, the statement has 19
+// parameters per row and the number of parameters is limited by the
+// databases (32766 for SQLite, 65535 for MySQL and PostgreSQL)
+const MAX_INSERT_ROWS = 1000
+
+// insertInDatabase: This function allows to insert elements in the archive, the
+// rows (see insertValues) are inserted by multi-row statements
+func (backend *SQLBackend) insertInDatabase(tx *sql.Tx, rows [][]interface{}) error {
+	for len(rows) > 0 {
+		var chunk = rows
+		if len(chunk) > MAX_INSERT_ROWS {
+			chunk = rows[:MAX_INSERT_ROWS]
+		}
+		rows = rows[len(chunk):]
+
+		if len(chunk) == 1 {
+			// A single object is inserted by the prepared statement
+			_, err := backend.exec(tx, backend.queries.insert, chunk[0]...)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		var args = make([]interface{}, 0, len(chunk)*len(chunk[0]))
+		for _, row := range chunk {
+			args = append(args, row...)
+		}
+		_, err := tx.Exec(backend.insertQuery(len(chunk)), args...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// insertQuery returns the statement inserting a number of rows
+func (backend *SQLBackend) insertQuery(rows int) string {
+	var values = " ( ? , ? , ? , ? , ? , ? , ? , ? , ? , ? , ? , ? , ? , ? , ? , ? , ? , ? , ? )"
+	return backend.rebind("INSERT INTO " + backend.table + " (" +
+		backend.columns("objectInstanceIdentifier", "element", "area", "service", "version", "number", "domain", "timestamp", "details.related", "network", "provider", "details.source") + ", " +
+		backend.columns(sourceColumns...) + ", " + backend.quote(STORED_COLUMN) +
+		") VALUES" + values + strings.Repeat(","+values, rows-1))
+}
+
+// insertValues returns the values of the row of an object stored at a
+// given time, in the order of the columns of insertQuery
+func insertValues(objectInstanceIdentifier int64, element mal.Element, objectType com.ObjectType, domain mal.String, archiveDetails archive.ArchiveDetails, stored time.Time) ([]interface{}, error) {
+	err := CheckTimestamp(time.Time(*archiveDetails.Timestamp))
+	if err != nil {
+		return nil, err
+	}
+	// Encode the Element and the ObjectId from the ArchiveDetails
+	encodedElement, encodedObjectID, err := utils.EncodeElements(element, archiveDetails.Details.Source)
+	if err != nil {
+		return nil, err
+	}
+	// A null related is stored as NULL
+	var related interface{}
+	if !archiveDetails.Details.Related.IsNull() {
+		related = int64(*archiveDetails.Details.Related)
+	}
+	var sourceID = newSourceValues(archiveDetails.Details.Source)
+
+	return []interface{}{
+		objectInstanceIdentifier,
+		encodedElement,
+		objectType.Area,
+		objectType.Service,
+		objectType.Version,
+		objectType.Number,
+		domain,
+		encodeTimestamp(time.Time(*archiveDetails.Timestamp)),
+		related,
+		*archiveDetails.Network,
+		*archiveDetails.Provider,
+		encodedObjectID,
+		sourceID.area,
+		sourceID.service,
+		sourceID.version,
+		sourceID.number,
+		sourceID.domain,
+		sourceID.instID,
+		encodeTimestamp(stored),
+	}, nil
+}
+
+// isAnyInstIDInDatabase returns true if one of the object instance identifiers
+// is already used by an object of the type in the domain
+func (backend *SQLBackend) isAnyInstIDInDatabase(tx *sql.Tx, objectType com.ObjectType, domain mal.String, instIDs []int64) (bool, error) {
+	if len(instIDs) == 0 {
+		return false, nil
+	}
+	builder, err := backend.keyQuery([]string{"objectInstanceIdentifier"}, objectType, domain, instIDs)
+	if err != nil {
+		return false, err
+	}
+	rows, err := tx.Query(builder.String()+" LIMIT 1", builder.Args()...)
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	var isUsed = rows.Next()
+	return isUsed, rows.Err()
+}
+
+// keyQuery writes the query selecting columns of the objects of a type in a
+// domain whose object instance identifiers are in a list
+func (backend *SQLBackend) keyQuery(columns []string, objectType com.ObjectType, domain mal.String, instIDs []int64) (*queryBuilder, error) {
+	return backend.tableKeyQuery(backend.table, columns, objectType, domain, instIDs)
+}
+
+// tableKeyQuery writes the query of keyQuery on another table holding
+// the same key columns (e.g. the history table), instIDs is not used if
+// it's nil
+func (backend *SQLBackend) tableKeyQuery(table string, columns []string, objectType com.ObjectType, domain mal.String, instIDs []int64) (*queryBuilder, error) {
+	var builder = newQueryBuilder(backend.dialect)
+	builder.WriteString("SELECT " + backend.columns(columns...) + " FROM " + table)
+	builder.Where()
+	for _, condition := range []struct {
+		column string
+		value  interface{}
+	}{
+		{"area", objectType.Area},
+		{"service", objectType.Service},
+		{"version", objectType.Version},
+		{"number", objectType.Number},
+		{"domain", domain},
+	} {
+		err := builder.Condition(condition.column, "=", condition.value)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if instIDs == nil {
+		return builder, nil
+	}
+	err := builder.InCondition("objectInstanceIdentifier", instIDs)
+	if err != nil {
+		return nil, err
+	}
+	return builder, nil
+}
+
+// Columns holding the attributes of the source of an object, so that it
+// can be matched by a query (see sourceValues)
+var sourceColumns = []string{
+	"details.source.area",
+	"details.source.service",
+	"details.source.version",
+	"details.source.number",
+	"details.source.domain",
+	"details.source.instId",
+}
+
+// sourceValues holds the values of the source columns, they are all
+// NULL when the object has no source
+type sourceValues struct {
+	area    interface{}
+	service interface{}
+	version interface{}
+	number  interface{}
+	domain  interface{}
+	instID  interface{}
+}
+
+// newSourceValues creates the values of the source columns for an object
+func newSourceValues(source *com.ObjectId) sourceValues {
+	if source == nil {
+		return sourceValues{}
+	}
+	return sourceValues{
+		area:    int64(source.Type.Area),
+		service: int64(source.Type.Service),
+		version: int64(source.Type.Version),
+		number:  int64(source.Type.Number),
+		domain:  string(utils.AdaptDomainToString(source.Key.Domain)),
+		instID:  int64(source.Key.InstId),
+	}
+}
+
+// encodeTimestamp converts a timestamp to the value stored in the
+// timestamp column: the number of nanoseconds since the epoch, so that
+// the FineTime is kept exactly whatever the database and its time zone
+// (the timestamps must be between the years 1678 and 2262, see
+// CheckTimestamp)
+func encodeTimestamp(timestamp time.Time) int64 {
+	return timestamp.UnixNano()
+}
+
+// filterTimestampError checks the value of a filter if it's a time
+func filterTimestampError(fieldValue interface{}) error {
+	switch value := fieldValue.(type) {
+	case *mal.Time:
+		return CheckTimestamp(time.Time(*value))
+	case *mal.FineTime:
+		return CheckTimestamp(time.Time(*value))
+	}
+	return nil
+}
+
+// Bounds of the timestamps whose number of nanoseconds since the epoch fits
+// in an int64
+var (
+	minTimestamp = time.Unix(0, math.MinInt64)
+	maxTimestamp = time.Unix(0, math.MaxInt64)
+)
+
+// CheckTimestamp returns an error if a timestamp can't be encoded in the
+// timestamp column, UnixNano overflowing outside of this range
+func CheckTimestamp(timestamp time.Time) error {
+	if timestamp.Before(minTimestamp) || timestamp.After(maxTimestamp) {
+		return errors.New(string(ARCHIVE_SERVICE_TIMESTAMP_RANGE_ERROR))
+	}
+	return nil
+}
+
+// decodeTimestamp converts a value of the timestamp column to a UTC time
+func decodeTimestamp(timestamp int64) time.Time {
+	return time.Unix(0, timestamp).UTC()
+}
+
+// createQueries writes the fixed queries for the dialect of the backend
+func (backend *SQLBackend) createQueries() {
+	// Condition selecting the objects of a type in a domain
+	var keyCondition = backend.quote("area") + " = ? AND " +
+		backend.quote("service") + " = ? AND " +
+		backend.quote("version") + " = ? AND " +
+		backend.quote("number") + " = ? AND " +
+		backend.quote("domain") + " = ?"
+	// Condition selecting one object
+	var instIDCondition = backend.quote("objectInstanceIdentifier") + " = ? AND " + keyCondition
+	// Conditions selecting the objects which are not tombstones, or only
+	// the tombstones
+	var notDeleted = " AND " + backend.quote(DELETED_COLUMN) + " IS NULL"
+	var isDeleted = " AND " + backend.quote(DELETED_COLUMN) + " IS NOT NULL"
+
+	backend.queries = sqlQueries{
+		retrieveAll: backend.rebind("SELECT " + backend.columns(retrieveColumns...) +
+			" FROM " + backend.table + " WHERE " + keyCondition + notDeleted),
+		selectInstID: backend.rebind("SELECT " + backend.quote("objectInstanceIdentifier") +
+			" FROM " + backend.table + " WHERE " + instIDCondition + notDeleted),
+		selectAllInstIDs: backend.rebind("SELECT " + backend.quote("objectInstanceIdentifier") +
+			" FROM " + backend.table + " WHERE " + keyCondition + notDeleted),
+		insert: backend.insertQuery(1),
+		update: backend.rebind("UPDATE " + backend.table + " SET " +
+			backend.quote("element") + " = ?, " +
+			backend.quote("timestamp") + " = ?, " +
+			backend.quote("details.related") + " = ?, " +
+			backend.quote("network") + " = ?, " +
+			backend.quote("provider") + " = ?, " +
+			backend.quote("details.source") + " = ?, " +
+			strings.Join(backend.quoteAll(sourceColumns), " = ?, ") + " = ? WHERE " + instIDCondition),
+		delete:    backend.rebind("DELETE FROM " + backend.table + " WHERE " + instIDCondition + notDeleted),
+		deleteAll: backend.rebind("DELETE FROM " + backend.table + " WHERE " + keyCondition + notDeleted),
+		incrementInstID: backend.rebind(backend.dialect.IncrementStatement(backend.tableName+INSTID_SEQUENCE_SUFFIX,
+			sequenceKeyColumns, "lastInstID")),
+		selectLastInstID: backend.rebind("SELECT " + backend.quote("lastInstID") +
+			" FROM " + backend.sequenceTable() + " WHERE " + keyCondition),
+		selectUsedInstIDs: backend.rebind("SELECT " + backend.quote("objectInstanceIdentifier") +
+			" FROM " + backend.table + " WHERE " + keyCondition + " AND " +
+			backend.quote("objectInstanceIdentifier") + " BETWEEN ? AND ?"),
+		selectLastRevision: backend.rebind("SELECT COALESCE(MAX(" + backend.quote("revision") + "), 0)" +
+			" FROM " + backend.historyTable() + " WHERE " + instIDCondition),
+		selectVersion: backend.rebind("SELECT " + backend.columns(versionColumns...) +
+			" FROM " + backend.table + " WHERE " + instIDCondition),
+		insertVersion: backend.rebind("INSERT INTO " + backend.historyTable() + " (" +
+			backend.columns(historyKeyColumns...) + ", " + backend.columns(versionColumns...) + ") VALUES (" +
+			strings.TrimSuffix(strings.Repeat("?, ", len(historyKeyColumns)+len(versionColumns)), ", ") + ")"),
+		selectHistory: backend.rebind("SELECT " + backend.columns(historyColumns...) +
+			" FROM " + backend.historyTable() + " WHERE " + instIDCondition +
+			" ORDER BY " + backend.quote("revision")),
+		deleteHistory: backend.rebind("DELETE FROM " + backend.historyTable() + " WHERE " + instIDCondition),
+		softDelete: backend.rebind("UPDATE " + backend.table + " SET " + backend.quote(DELETED_COLUMN) + " = ?" +
+			" WHERE " + instIDCondition + notDeleted),
+		softDeleteAll: backend.rebind("UPDATE " + backend.table + " SET " + backend.quote(DELETED_COLUMN) + " = ?" +
+			" WHERE " + keyCondition + notDeleted),
+		selectDeletedInstIDs: backend.rebind("SELECT " + backend.quote("objectInstanceIdentifier") +
+			" FROM " + backend.table + " WHERE " + keyCondition + isDeleted + " ORDER BY " + backend.quote("id")),
+		restore: backend.rebind("UPDATE " + backend.table + " SET " + backend.quote(DELETED_COLUMN) + " = NULL" +
+			" WHERE " + instIDCondition + isDeleted),
+		purge: backend.rebind("DELETE FROM " + backend.table + " WHERE " + instIDCondition + isDeleted),
+	}
+}
+
+// quote quotes the name of a column
+func (backend *SQLBackend) quote(column string) string {
+	return backend.dialect.QuoteIdentifier(column)
+}
+
+// columns quotes a list of columns and separates them with commas
+func (backend *SQLBackend) columns(columns ...string) string {
+	return strings.Join(backend.quoteAll(columns), ", ")
+}
+
+// quoteAll quotes a list of columns
+func (backend *SQLBackend) quoteAll(columns []string) []string {
+	var quotedColumns = make([]string, len(columns))
+	for i, column := range columns {
+		quotedColumns[i] = backend.quote(column)
+	}
+	return quotedColumns
+}
+
+// rebind replaces the '?' placeholders of a query by the placeholders of
+// the dialect, the query must not contain any other '?' character
+func (backend *SQLBackend) rebind(query string) string {
+	var queryBuffer bytes.Buffer
+	var n int
+	for _, c := range query {
+		if c == '?' {
+			n++
+			queryBuffer.WriteString(backend.dialect.Placeholder(n))
+		} else {
+			queryBuffer.WriteRune(c)
+		}
+	}
+	return queryBuffer.String()
+}
+
+// createCountQuery allows the provider to create automatically a query for the Count operation
+func (backend *SQLBackend) createCountQuery(objectType com.ObjectType, archiveQuery archive.ArchiveQuery, queryFilter archive.QueryFilter) (string, []interface{}, error) {
+	var builder = newQueryBuilder(backend.dialect)
+	// Only CompositeFilterSet type should be used
+	builder.WriteString("SELECT COUNT(" + backend.quote("id") + ")")
+
+	err := backend.createCommonQuery(builder, objectType, archiveQuery, queryFilter)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return builder.String(), builder.Args(), nil
+}
+
+// createCommonQuery is a common way of generating a part of a query,
+// all the values are given as parameters of the query
+func (backend *SQLBackend) createCommonQuery(builder *queryBuilder, objectType com.ObjectType, archiveQuery archive.ArchiveQuery, queryFilter archive.QueryFilter) error {
+	// Prepare the query for the conditions, the tombstones are hidden
+	builder.WriteString(" FROM " + backend.table)
+	builder.Where()
+	builder.NotDeletedCondition()
+	var err error
 
 	// Conditions on the object type attributes
 	// Area
 	if objectType.Area != 0 {
-		queryBuffer.WriteString(fmt.Sprintf(" area = %d", objectType.Area))
-		isThereAlreadyACondition = true
+		err = builder.Condition("area", "=", int64(objectType.Area))
+		if err != nil {
+			return err
+		}
 	}
 	// Service
 	if objectType.Service != 0 {
-		utils.CheckCondition(&isThereAlreadyACondition, queryBuffer)
-		queryBuffer.WriteString(fmt.Sprintf(" service = %d", objectType.Service))
+		err = builder.Condition("service", "=", int64(objectType.Service))
+		if err != nil {
+			return err
+		}
 	}
 	// Version
 	if objectType.Version != 0 {
-		utils.CheckCondition(&isThereAlreadyACondition, queryBuffer)
-		queryBuffer.WriteString(fmt.Sprintf(" version = %d", objectType.Version))
+		err = builder.Condition("version", "=", int64(objectType.Version))
+		if err != nil {
+			return err
+		}
 	}
 	// Number
 	if objectType.Number != 0 {
-		utils.CheckCondition(&isThereAlreadyACondition, queryBuffer)
-		queryBuffer.WriteString(fmt.Sprintf(" number = %d", objectType.Number))
+		err = builder.Condition("number", "=", int64(objectType.Number))
+		if err != nil {
+			return err
+		}
 	}
 
 	// Add archive query conditions
-	// Domain
+	// Domain: the '*' identifiers are wildcards
 	if archiveQuery.Domain != nil {
-		utils.CheckCondition(&isThereAlreadyACondition, queryBuffer)
-		domain := utils.AdaptDomainToString(*archiveQuery.Domain)
-		queryBuffer.WriteString(fmt.Sprintf(" domain = '%s'", domain))
+		err = builder.DomainCondition("domain", *archiveQuery.Domain)
+		if err != nil {
+			return err
+		}
 	}
 
 	// Network
 	if archiveQuery.Network != nil {
-		utils.CheckCondition(&isThereAlreadyACondition, queryBuffer)
-		queryBuffer.WriteString(fmt.Sprintf(" network = '%s'", *archiveQuery.Network))
+		err = builder.Condition("network", "=", string(*archiveQuery.Network))
+		if err != nil {
+			return err
+		}
 	}
 
 	// Provider
 	if archiveQuery.Provider != nil {
-		utils.CheckCondition(&isThereAlreadyACondition, queryBuffer)
-		queryBuffer.WriteString(fmt.Sprintf(" provider = '%s'", *archiveQuery.Provider))
+		err = builder.Condition("provider", "=", string(*archiveQuery.Provider))
+		if err != nil {
+			return err
+		}
 	}
 
-	// Related (always have to do a query with this condition)
-	// TODO handle null related field ?
-	utils.CheckCondition(&isThereAlreadyACondition, queryBuffer)
-	var relatedOp string
-	if archiveQuery.Related == 0 {
-		// catch all
-		relatedOp = ">="
-	} else {
-		relatedOp = "="
+	// Related: 0 is a catch all value, the objects without related object
+	// are selected by a filter comparing details.related with NULL
+	if archiveQuery.Related != 0 {
+		err = builder.Condition("details.related", "=", int64(archiveQuery.Related))
+		if err != nil {
+			return err
+		}
 	}
-	queryBuffer.WriteString(fmt.Sprintf(" `details.related` %s %d", relatedOp, archiveQuery.Related))
 
-	// Source
+	// Source: the attributes of the object type and the object instance
+	// identifier equal to 0 are wildcards, like the '*' of the domain
 	if archiveQuery.Source != nil {
-		utils.CheckCondition(&isThereAlreadyACondition, queryBuffer)
-
-		// Encode the ObjectId
-		// Create the factory
-		factory := new(binary.FixedBinaryEncoding)
-
-		// Create the encoder
-		encoder := factory.NewEncoder(make([]byte, 0, 8192))
-
-		// Encode it
-		err := archiveQuery.Source.Encode(encoder)
+		err = builder.NullCondition("details.source.instId", "IS NOT")
 		if err != nil {
 			return err
 		}
-		queryBuffer.WriteString(fmt.Sprintf(" `details.source` = %s", encoder.Body()))
+		if archiveQuery.Source.Type.Area != 0 {
+			err = builder.Condition("details.source.area", "=", int64(archiveQuery.Source.Type.Area))
+			if err != nil {
+				return err
+			}
+		}
+		if archiveQuery.Source.Type.Service != 0 {
+			err = builder.Condition("details.source.service", "=", int64(archiveQuery.Source.Type.Service))
+			if err != nil {
+				return err
+			}
+		}
+		if archiveQuery.Source.Type.Version != 0 {
+			err = builder.Condition("details.source.version", "=", int64(archiveQuery.Source.Type.Version))
+			if err != nil {
+				return err
+			}
+		}
+		if archiveQuery.Source.Type.Number != 0 {
+			err = builder.Condition("details.source.number", "=", int64(archiveQuery.Source.Type.Number))
+			if err != nil {
+				return err
+			}
+		}
+		err = builder.DomainCondition("details.source.domain", archiveQuery.Source.Key.Domain)
+		if err != nil {
+			return err
+		}
+		if archiveQuery.Source.Key.InstId != 0 {
+			err = builder.Condition("details.source.instId", "=", int64(archiveQuery.Source.Key.InstId))
+			if err != nil {
+				return err
+			}
+		}
 	}
 
 	// StartTime
 	if archiveQuery.StartTime != nil {
-		utils.CheckCondition(&isThereAlreadyACondition, queryBuffer)
-		queryBuffer.WriteString(fmt.Sprintf(" timestamp >= %s", time.Time(*archiveQuery.StartTime)))
+		err = builder.Condition("timestamp", ">=", encodeTimestamp(time.Time(*archiveQuery.StartTime)))
+		if err != nil {
+			return err
+		}
 	}
 
 	// EndTime
 	if archiveQuery.EndTime != nil {
-		utils.CheckCondition(&isThereAlreadyACondition, queryBuffer)
-		queryBuffer.WriteString(fmt.Sprintf(" timestamp <= %s", time.Time(*archiveQuery.EndTime)))
+		err = builder.Condition("timestamp", "<=", encodeTimestamp(time.Time(*archiveQuery.EndTime)))
+		if err != nil {
+			return err
+		}
 	}
 
 	// Add query filter conditions
@@ -1283,48 +2050,225 @@ func createCommonQuery(queryBuffer *bytes.Buffer, objectType com.ObjectType, arc
 		compositerFilterSet := queryFilter.(*archive.CompositeFilterSet)
 
 		for i := 0; i < compositerFilterSet.Filters.Size(); i++ {
-			utils.CheckCondition(&isThereAlreadyACondition, queryBuffer)
-			var fieldValue = compositerFilterSet.Filters[i].FieldValue
-			// Transform the expresion operator
-			expressionOperator := TransformOperator(compositerFilterSet.Filters[i].Type)
-			if compositerFilterSet.Filters[i].Type == archive.EXPRESSIONOPERATOR_CONTAINS || compositerFilterSet.Filters[i].Type == archive.EXPRESSIONOPERATOR_ICONTAINS {
-				queryBuffer.WriteString(fmt.Sprintf(" %s %s", compositerFilterSet.Filters[i].FieldName,
-					expressionOperator))
-				queryBuffer.WriteString(fmt.Sprintf("%v", reflect.ValueOf(fieldValue).Elem().Interface()))
-				queryBuffer.WriteString("%'")
-			} else {
-				if fieldValue == nil {
-					queryBuffer.WriteString(fmt.Sprintf(" %s %s %s", compositerFilterSet.Filters[i].FieldName,
-						expressionOperator,
-						"NULL"))
-				} else {
-					queryBuffer.WriteString(fmt.Sprintf(" %s %s", compositerFilterSet.Filters[i].FieldName,
-						expressionOperator))
-					queryBuffer.WriteString(fmt.Sprintf(" %v", reflect.ValueOf(fieldValue).Elem().Interface()))
-				}
+			err = builder.FilterCondition(compositerFilterSet.Filters[i])
+			if err != nil {
+				return err
 			}
 		}
 	}
 
 	// SortOrder
-	if archiveQuery.SortOrder != nil {
-		// SortFieldName
-		if archiveQuery.SortFieldName != nil {
-			queryBuffer.WriteString(fmt.Sprintf(" ORDER BY %s", *archiveQuery.SortFieldName))
-		} else {
-			queryBuffer.WriteString(" ORDER BY timestamp")
+	return backend.orderBy(builder, archiveQuery, nil)
+}
+
+// orderBy writes the ORDER BY clause of a query: the rows are sorted by the
+// group columns, then by the sort fields of the archive query if it has a
+// sort order. Nothing is written if there is no column to sort by, the
+// sort fields must not hold fields of the body (see selectSortedIDs).
+func (backend *SQLBackend) orderBy(builder *queryBuilder, archiveQuery archive.ArchiveQuery, groupColumns []string) error {
+	if len(groupColumns) == 0 && archiveQuery.SortOrder == nil {
+		return nil
+	}
+	builder.WriteString(" ORDER BY ")
+	for i, column := range groupColumns {
+		if i > 0 {
+			builder.WriteString(", ")
+		}
+		err := builder.Column(column)
+		if err != nil {
+			return err
+		}
+	}
+
+	for i, field := range sortFields(archiveQuery) {
+		if i > 0 || len(groupColumns) > 0 {
+			builder.WriteString(", ")
+		}
+		if field.column == "" {
+			return errors.New(string(ARCHIVE_SERVICE_QUERY_SORT_FIELD_NAME_INVALID_ERROR))
+		}
+		err := builder.Column(field.column)
+		if err != nil {
+			return err
 		}
 		// If sortOrder is false then returned values shall be sorted
 		// in descending order (ascending order is the default value)
 		if *archiveQuery.SortOrder == false {
-			queryBuffer.WriteString(" DESC")
+			builder.WriteString(" DESC")
 		}
 	}
+	return nil
+}
+
+// Maximum number of objects read by a query of readObjects
+const READ_OBJECTS_BATCH = 1000
+
+// selectSortedIDs returns the ids of the rows matching a query, sorted by
+// the group columns then by the sort fields of the query. It's used when a
+// sort field is a field of the body: the bodies are stored encoded, so the
+// rows are sorted on their decoded elements. The id, the sort values and
+// the group values of every matching row are kept in memory until the end
+// of the sort, so the memory used grows with the number of matching rows.
+// The filters on the fields of the body are evaluated on the same elements.
+func (backend *SQLBackend) selectSortedIDs(tx *sql.Tx, objectType com.ObjectType, archiveQuery archive.ArchiveQuery, columnFilters archive.QueryFilter, bodyFilters []*archive.CompositeFilter, groupColumns []string) ([]int64, error) {
+	var fields = sortFields(archiveQuery)
+	// The group columns and the columns of the sort fields are selected
+	// after the id and the element
+	var valueColumns = append([]string{}, groupColumns...)
+	for _, field := range fields {
+		if field.column != "" {
+			valueColumns = append(valueColumns, field.column)
+		}
+	}
+	var indexes = make(map[string]int)
+	for i := len(valueColumns) - 1; i >= 0; i-- {
+		indexes[valueColumns[i]] = i
+	}
+
+	var builder = newQueryBuilder(backend.dialect)
+	builder.WriteString("SELECT " + backend.columns(append([]string{"id", "element"}, valueColumns...)...))
+	var conditions = archiveQuery
+	conditions.SortOrder = nil
+	err := backend.createCommonQuery(builder, objectType, conditions, columnFilters)
+	if err != nil {
+		return nil, err
+	}
+	// The objects with the same values keep their insertion order
+	builder.WriteString(" ORDER BY " + backend.quote("id"))
 
+	rows, err := tx.Query(builder.String(), builder.Args()...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sorted []sortedObject
+	var groupValues = make(map[int64][]interface{})
+	for rows.Next() {
+		var id int64
+		var encodedElement []byte
+		var values = make([]interface{}, len(valueColumns))
+		var dest = []interface{}{&id, &encodedElement}
+		for i := range values {
+			dest = append(dest, &values[i])
+		}
+		if err = rows.Scan(dest...); err != nil {
+			return nil, err
+		}
+		for i, value := range values {
+			// The strings may be read as bytes (e.g. by MySQL)
+			if b, ok := value.([]byte); ok {
+				values[i] = string(b)
+			}
+		}
+
+		element, err := utils.DecodeElement(encodedElement)
+		if err != nil {
+			return nil, err
+		}
+		match, err := matchBodyFilters(element, bodyFilters)
+		if err != nil {
+			return nil, err
+		}
+		if !match {
+			continue
+		}
+
+		keyValues, err := sortValues(fields, func(column string) (interface{}, error) {
+			return values[indexes[column]], nil
+		}, element)
+		if err != nil {
+			return nil, err
+		}
+		sorted = append(sorted, sortedObject{id, keyValues})
+		groupValues[id] = values[:len(groupColumns)]
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// Sort by the sort fields, then by the groups in ascending order
+	err = sortObjects(sorted, bool(*archiveQuery.SortOrder))
+	if err != nil {
+		return nil, err
+	}
+	if len(groupColumns) != 0 {
+		for i := range sorted {
+			sorted[i].values = groupValues[sorted[i].object.(int64)]
+		}
+		err = sortObjects(sorted, true)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var ids = make([]int64, len(sorted))
+	for i := range sorted {
+		ids[i] = sorted[i].object.(int64)
+	}
+	return ids, nil
+}
+
+// readObjects reads the objects of a list of ids by batches of
+// READ_OBJECTS_BATCH objects and gives them to a function in the order of
+// the list, the element is only read if it's returned
+func (backend *SQLBackend) readObjects(tx *sql.Tx, ids []int64, isReturnBody bool, visit func(*queriedObject) error) error {
+	for start := 0; start < len(ids); start += READ_OBJECTS_BATCH {
+		var end = start + READ_OBJECTS_BATCH
+		if end > len(ids) {
+			end = len(ids)
+		}
+		var batch = ids[start:end]
+
+		var builder = newQueryBuilder(backend.dialect)
+		builder.WriteString("SELECT " + backend.queryColumns(isReturnBody) + ", " + backend.quote("id") + " FROM " + backend.table)
+		builder.Where()
+		err := builder.InCondition("id", batch)
+		if err != nil {
+			return err
+		}
+		objects, err := backend.queryObjectsByID(tx, builder, len(batch))
+		if err != nil {
+			return err
+		}
+
+		for _, id := range batch {
+			object, ok := objects[id]
+			if !ok {
+				continue
+			}
+			err = visit(object)
+			if err != nil {
+				return err
+			}
+		}
+	}
 	return nil
 }
 
-// TransformOperator transforms an ExpressionOperator to a String
+// queryObjectsByID executes a query selecting the queryColumns then the id
+// of the objects, and returns the objects by id
+func (backend *SQLBackend) queryObjectsByID(tx *sql.Tx, builder *queryBuilder, count int) (map[int64]*queriedObject, error) {
+	rows, err := tx.Query(builder.String(), builder.Args()...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var objects = make(map[int64]*queriedObject, count)
+	for rows.Next() {
+		var id int64
+		object, err := scanQueriedObject(rows, &id)
+		if err != nil {
+			return nil, err
+		}
+		objects[id] = object
+	}
+	return objects, rows.Err()
+}
+
+// TransformOperator transforms an ExpressionOperator to a String, the
+// column of ICONTAINS must be compared in lower case (see FilterCondition)
 func TransformOperator(e archive.ExpressionOperator) string {
 	switch e {
 	case archive.EXPRESSIONOPERATOR_EQUAL:
@@ -1340,9 +2284,9 @@ func TransformOperator(e archive.ExpressionOperator) string {
 	case archive.EXPRESSIONOPERATOR_LESS_OR_EQUAL:
 		return "<="
 	case archive.EXPRESSIONOPERATOR_CONTAINS:
-		return "LIKE '%"
+		return "LIKE"
 	case archive.EXPRESSIONOPERATOR_ICONTAINS:
-		return "NOT LIKE '%"
+		return "LIKE"
 	default:
 		return ""
 	}
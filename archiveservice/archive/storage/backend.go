@@ -0,0 +1,146 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package storage
+
+import (
+	"errors"
+	"time"
+
+	"github.com/CNES/ccsdsmo-malgo/com"
+	"github.com/CNES/ccsdsmo-malgo/com/archive"
+	"github.com/CNES/ccsdsmo-malgo/mal"
+)
+
+// Errors returned when a backend doesn't implement an optional interface
+var (
+	ErrNoHistory    = errors.New("the backend doesn't keep the history of the objects")
+	ErrNoSoftDelete = errors.New("the backend doesn't keep the deleted objects")
+	ErrNoRetention  = errors.New("the backend doesn't enforce retention rules")
+)
+
+// ArchiveBackend defines the operations a store must implement to be used
+// by the archive provider. Errors must be reported the same way for every
+// backend: an unknown object is signaled with mal.ERROR_UNKNOWN_MESSAGE, an
+// already existing object with com.ERROR_DUPLICATE and an invalid query with
+// one of the ARCHIVE_SERVICE_QUERY_* messages. The history, the soft delete
+// and the retention are optional, a backend provides them by implementing
+// HistoryBackend, SoftDeleteBackend and RetentionBackend.
+type ArchiveBackend interface {
+	// RetrieveInArchive retrieves a set of objects identified by their
+	// object instance identifiers (0 means all the objects)
+	RetrieveInArchive(objectType com.ObjectType, identifierList mal.IdentifierList, objectInstanceIdentifierList mal.LongList) (archive.ArchiveDetailsList, mal.ElementList, error)
+
+	// QueryArchive retrieves the objects matching a query, grouped by
+	// object type and domain
+	QueryArchive(boolean *mal.Boolean, objectType com.ObjectType, archiveQuery archive.ArchiveQuery, queryFilter archive.QueryFilter) ([]*com.ObjectType, []*archive.ArchiveDetailsList, []*mal.IdentifierList, []mal.ElementList, error)
+
+	// StreamQuery sends the objects matching a query while they are read,
+	// in chunks bounded by the limits. The objects of a chunk are in the
+	// same group as in QueryArchive and the chunks of a group are sent
+	// consecutively, unless globalOrder is set and the query has a sort
+	// order: the objects are then sent in this order whatever their group
+	// and a chunk holds consecutive objects of the same group. Nothing is
+	// sent if no object matches the query. The memory used doesn't depend
+	// on the number of objects, except when a sort field is a field of the
+	// body: all the matching objects are then sorted before being sent.
+	StreamQuery(boolean *mal.Boolean, objectType com.ObjectType, archiveQuery archive.ArchiveQuery, queryFilter archive.QueryFilter, limits ChunkLimits, globalOrder bool, send QuerySender) error
+
+	// CountInArchive counts the objects matching each query of the list
+	CountInArchive(objectType com.ObjectType, archiveQueryList archive.ArchiveQueryList, queryFilterList archive.QueryFilterList) (*mal.LongList, error)
+
+	// StoreInArchive stores new objects, allocating an object instance
+	// identifier for each object whose identifier is 0
+	StoreInArchive(boolean *mal.Boolean, objectType com.ObjectType, identifierList mal.IdentifierList, archiveDetailsList archive.ArchiveDetailsList, elementList mal.ElementList) (*mal.LongList, error)
+
+	// UpdateArchive updates objects already present in the archive, a
+	// backend implementing HistoryBackend keeps the versions replaced
+	UpdateArchive(objectType com.ObjectType, identifierList mal.IdentifierList, archiveDetailsList archive.ArchiveDetailsList, elementList mal.ElementList) error
+
+	// DeleteInArchive deletes a set of objects (0 means all the objects)
+	// with their history. In the soft delete mode of a SoftDeleteBackend
+	// the objects are kept as tombstones instead, with the time of their
+	// deletion: they are hidden from the other operations but keep their
+	// object instance identifier until they are restored or purged.
+	DeleteInArchive(objectType com.ObjectType, identifierList mal.IdentifierList, longListRequest mal.LongList) (mal.LongList, error)
+
+	// Close releases the resources of the backend (e.g. the connections
+	// to the database), it must not be used afterwards
+	Close() error
+}
+
+// HistoryBackend is implemented by the backends keeping the versions of
+// the objects replaced by UpdateArchive
+type HistoryBackend interface {
+	// ObjectHistory returns all the versions of an object, from the version
+	// stored to the current version, the versions replaced by UpdateArchive
+	// being kept with the time of the update
+	ObjectHistory(objectType com.ObjectType, identifierList mal.IdentifierList, instID mal.Long) ([]*ObjectVersion, error)
+
+	// RetrieveAsOf retrieves a set of objects as RetrieveInArchive, each
+	// one in the version which was current at a given time. An object
+	// stored after this time is unknown, it's left out when all the
+	// objects are retrieved (0).
+	RetrieveAsOf(objectType com.ObjectType, identifierList mal.IdentifierList, objectInstanceIdentifierList mal.LongList, asOf time.Time) (archive.ArchiveDetailsList, mal.ElementList, error)
+}
+
+// SoftDeleteBackend is implemented by the backends which can keep the
+// deleted objects as tombstones
+type SoftDeleteBackend interface {
+	// SetSoftDelete enables or disables the soft delete mode, the existing
+	// tombstones are kept when it's disabled
+	SetSoftDelete(enabled bool)
+
+	// RestoreInArchive restores a set of tombstones (0 means all the
+	// tombstones of the type in the domain) with their history
+	RestoreInArchive(objectType com.ObjectType, identifierList mal.IdentifierList, longListRequest mal.LongList) (mal.LongList, error)
+
+	// SelectDeleted returns the tombstones deleted before a time, by object
+	// type and domain. The oldest deletions are returned first, the first
+	// offset tombstones are skipped and at most limit tombstones are
+	// returned (0 means no limit).
+	SelectDeleted(deletedBefore time.Time, offset int, limit int) ([]*ExpiredObjects, error)
+
+	// PurgeDeleted permanently deletes a set of tombstones (0 means all the
+	// tombstones of the type in the domain) with their history
+	PurgeDeleted(objectType com.ObjectType, identifierList mal.IdentifierList, longListRequest mal.LongList) (mal.LongList, error)
+}
+
+// RetentionBackend is implemented by the backends on which the retention
+// rules of a provider can be enforced
+type RetentionBackend interface {
+	// SelectExpired returns the objects exceeding the limits of a retention
+	// rule at a given time, by object type and domain: the objects older
+	// than its maximum age, then the oldest objects beyond its maximum count
+	// of each object type and domain. The oldest objects are returned first,
+	// the first offset objects are skipped (e.g. to page the objects which
+	// are not deleted) and at most limit objects are returned (0 means no
+	// limit).
+	SelectExpired(rule RetentionRule, now time.Time, offset int, limit int) ([]*ExpiredObjects, error)
+
+	// DeleteExpired deletes for good objects selected by SelectExpired,
+	// with their history, whatever the soft delete mode. The objects which
+	// no longer exist are skipped, the objects deleted are returned.
+	DeleteExpired(objectType com.ObjectType, identifierList mal.IdentifierList, objectInstanceIdentifierList mal.LongList) (mal.LongList, error)
+}
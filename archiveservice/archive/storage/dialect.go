@@ -0,0 +1,222 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package storage
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+
+	// Init mysql driver
+	"github.com/go-sql-driver/mysql"
+)
+
+// Dialect holds what differs from one SQL database to another
+// for the queries sent by the SQLBackend
+type Dialect interface {
+	// DriverName returns the name of the database/sql driver to use
+	DriverName() string
+
+	// QuoteIdentifier quotes the name of a table or of a column,
+	// the names of some columns contain a dot (e.g. details.related)
+	QuoteIdentifier(name string) string
+
+	// Placeholder returns the placeholder of the n-th parameter
+	// of a query (starting at 1)
+	Placeholder(n int) string
+
+	// CaseSensitive returns an expression of a string column whose
+	// comparisons (=, <, LIKE...) take the case into account
+	CaseSensitive(column string) string
+
+	// SchemaStatements returns the statements creating the table
+	// if it doesn't exist yet, they are applied by the first migration
+	SchemaStatements(table string) []string
+
+	// ResetSequence resets the sequence used to generate the ids
+	// of the table to max(id)+1, it's called once a deletion is
+	// committed as it may commit the transaction (e.g. with MySQL)
+	ResetSequence(tx *sql.Tx, table string) error
+
+	// IsUniqueViolation returns true if an error is raised by the
+	// driver because a row breaks a unique index of the table
+	IsUniqueViolation(err error) bool
+
+	// IncrementStatement returns the statement inserting a row with the
+	// keys and the counter, or adding the counter to the counter of the
+	// row already holding the keys. Its parameters ('?') are the keys
+	// followed by the counter.
+	IncrementStatement(table string, keys []string, counter string) string
+
+	// ColumnType returns the type of a column of a table in lower case
+	// (e.g. bigint), or an empty string if the table has no such column
+	ColumnType(tx *sql.Tx, table string, column string) (string, error)
+
+	// DomainPrefix returns an expression of the first levels of a domain
+	// column, i.e. the part of the column before its levels-th dot
+	DomainPrefix(column string, levels int) string
+}
+
+// Number of the MySQL error raised on a duplicate entry of a unique index
+const MYSQL_ER_DUP_ENTRY = 1062
+
+// MySQLDialect is the Dialect of MySQL and MariaDB
+type MySQLDialect struct{}
+
+// DriverName returns the name of the mysql driver
+func (MySQLDialect) DriverName() string {
+	return "mysql"
+}
+
+// QuoteIdentifier quotes a name with backquotes
+func (MySQLDialect) QuoteIdentifier(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
+
+// Placeholder returns '?' whatever the position of the parameter
+func (MySQLDialect) Placeholder(n int) string {
+	return "?"
+}
+
+// CaseSensitive compares the column as a binary string, the default
+// collations of MySQL ignore the case
+func (MySQLDialect) CaseSensitive(column string) string {
+	return "BINARY " + column
+}
+
+// SchemaStatements returns the statement creating the table (see archive.sql)
+func (dialect MySQLDialect) SchemaStatements(table string) []string {
+	return []string{
+		"CREATE TABLE IF NOT EXISTS " + dialect.QuoteIdentifier(table) + " (" +
+			"`id` int(10) unsigned NOT NULL AUTO_INCREMENT, " +
+			"`objectInstanceIdentifier` bigint(20) unsigned DEFAULT NULL, " +
+			"`element` blob, " +
+			"`area` smallint(6) DEFAULT NULL, " +
+			"`service` smallint(6) DEFAULT NULL, " +
+			"`version` tinyint(4) DEFAULT NULL, " +
+			"`number` smallint(6) DEFAULT NULL, " +
+			"`domain` text, " +
+			"`timestamp` bigint(20) DEFAULT NULL, " +
+			"`details.related` bigint(20) DEFAULT NULL, " +
+			"`network` text, " +
+			"`provider` text, " +
+			"`details.source` blob, " +
+			"`details.source.area` smallint(6) DEFAULT NULL, " +
+			"`details.source.service` smallint(6) DEFAULT NULL, " +
+			"`details.source.version` tinyint(4) DEFAULT NULL, " +
+			"`details.source.number` smallint(6) DEFAULT NULL, " +
+			"`details.source.domain` text, " +
+			"`details.source.instId` bigint(20) DEFAULT NULL, " +
+			"PRIMARY KEY (`id`)" +
+			") ENGINE=InnoDB DEFAULT CHARSET=utf8",
+	}
+}
+
+// ResetSequence takes the maximum id in the database and set the
+// AUTO_INCREMENT at this value (actually it's this value to which we added 1)
+func (dialect MySQLDialect) ResetSequence(tx *sql.Tx, table string) error {
+	table = dialect.QuoteIdentifier(table)
+	// Create a value to store the maximum id (to which we added 1)
+	_, err := tx.Exec("SELECT @max := max(id)+1 FROM " + table)
+	if err != nil {
+		return err
+	}
+	// Create the statement (in our case, we use an "alter table" statement)
+	_, err = tx.Exec("SET @alter_statement = CONCAT('ALTER TABLE " + table + " AUTO_INCREMENT = ', @max)")
+	if err != nil {
+		return err
+	}
+	// Prepare the statement
+	_, err = tx.Exec("PREPARE stmt1 FROM @alter_statement;")
+	if err != nil {
+		return err
+	}
+	// Then execute the statement
+	_, err = tx.Exec("EXECUTE stmt1")
+	if err != nil {
+		return err
+	}
+	// Finally, deallocate the statement
+	_, err = tx.Exec("DEALLOCATE PREPARE stmt1;")
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// IsUniqueViolation returns true if the error is a duplicate entry error
+func (MySQLDialect) IsUniqueViolation(err error) bool {
+	mysqlErr, ok := err.(*mysql.MySQLError)
+	return ok && mysqlErr.Number == MYSQL_ER_DUP_ENTRY
+}
+
+// ColumnType reads the type of the column in the information schema
+// of the current database
+func (MySQLDialect) ColumnType(tx *sql.Tx, table string, column string) (string, error) {
+	return scanColumnType(tx.QueryRow("SELECT DATA_TYPE FROM information_schema.COLUMNS"+
+		" WHERE TABLE_SCHEMA = DATABASE() AND TABLE_NAME = ? AND COLUMN_NAME = ?", table, column))
+}
+
+// DomainPrefix keeps the part of the column before its levels-th dot
+func (MySQLDialect) DomainPrefix(column string, levels int) string {
+	return "SUBSTRING_INDEX(" + column + ", '.', " + strconv.Itoa(levels) + ")"
+}
+
+// scanColumnType reads the type of a column returned by the query of
+// ColumnType, the type is empty if the query returns no row
+func scanColumnType(row *sql.Row) (string, error) {
+	var columnType string
+	err := row.Scan(&columnType)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	return strings.ToLower(columnType), nil
+}
+
+// IncrementStatement returns an INSERT ... ON DUPLICATE KEY UPDATE statement
+func (dialect MySQLDialect) IncrementStatement(table string, keys []string, counter string) string {
+	counter = dialect.QuoteIdentifier(counter)
+	return insertStatement(dialect, table, keys, counter) +
+		" ON DUPLICATE KEY UPDATE " + counter + " = " + counter + " + VALUES(" + counter + ")"
+}
+
+// onConflictIncrement returns the INSERT ... ON CONFLICT DO UPDATE statement
+// of IncrementStatement, shared by PostgreSQL and SQLite
+func onConflictIncrement(dialect Dialect, table string, keys []string, counter string) string {
+	counter = dialect.QuoteIdentifier(counter)
+	return insertStatement(dialect, table, keys, counter) +
+		" ON CONFLICT (" + quoteColumns(dialect, keys...) + ") DO UPDATE SET " +
+		counter + " = " + dialect.QuoteIdentifier(table) + "." + counter + " + excluded." + counter
+}
+
+// insertStatement returns the statement inserting the keys and the
+// quoted counter in a table
+func insertStatement(dialect Dialect, table string, keys []string, counter string) string {
+	return "INSERT INTO " + dialect.QuoteIdentifier(table) + " (" + quoteColumns(dialect, keys...) + ", " + counter + ")" +
+		" VALUES (" + strings.Repeat("?, ", len(keys)) + "?)"
+}
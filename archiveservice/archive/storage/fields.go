@@ -0,0 +1,195 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package storage
+
+import (
+	"errors"
+	"sort"
+	"strings"
+
+	"github.com/CNES/ccsdsmo-malgo/com"
+	"github.com/CNES/ccsdsmo-malgo/com/archive"
+	"github.com/CNES/ccsdsmo-malgo/mal"
+
+	. "github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/constants"
+)
+
+// Separator of the fields of a SortFieldName sorting by several fields
+// (e.g. "details.related, timestamp")
+const SORT_FIELD_SEPARATOR = ","
+
+// archiveDetailsFields maps the names of the fields of the ArchiveDetails,
+// as written in the COM specification, to the columns of the Archive table
+// holding them
+var archiveDetailsFields = map[string]string{
+	"instId":                      "objectInstanceIdentifier",
+	"details.related":             "details.related",
+	"details.source":              "details.source",
+	"details.source.type.area":    "details.source.area",
+	"details.source.type.service": "details.source.service",
+	"details.source.type.version": "details.source.version",
+	"details.source.type.number":  "details.source.number",
+	"details.source.key.domain":   "details.source.domain",
+	"details.source.key.instId":   "details.source.instId",
+	"network":                     "network",
+	"timestamp":                   "timestamp",
+	"provider":                    "provider",
+}
+
+// FieldColumn returns the column of the Archive table holding a field named
+// in a query (a filter or a sort field). The names of the fields of the
+// ArchiveDetails (e.g. instId, details.source.key.domain) and, for the
+// consumers written before them, the names of the columns are accepted,
+// the names may be written with the MySQL quotes. The id and the element
+// are internal columns, false is returned for them and for the fields of
+// the body of the objects.
+func FieldColumn(fieldName string) (string, bool) {
+	if strings.HasPrefix(fieldName, BODY_FIELD_PREFIX) {
+		return "", false
+	}
+	var name = strings.Trim(fieldName, "`")
+	if column, ok := archiveDetailsFields[name]; ok {
+		return column, true
+	}
+	if name == "id" || name == "element" {
+		return "", false
+	}
+	return databaseField(name)
+}
+
+// SortFields returns the names of the fields sorting the objects of a query,
+// in order of precedence: the fields of its SortFieldName separated by
+// SORT_FIELD_SEPARATOR, or the timestamp by default
+func SortFields(archiveQuery archive.ArchiveQuery) []string {
+	if archiveQuery.SortFieldName == nil {
+		return []string{"timestamp"}
+	}
+	var fieldNames = strings.Split(string(*archiveQuery.SortFieldName), SORT_FIELD_SEPARATOR)
+	for i := range fieldNames {
+		fieldNames[i] = strings.TrimSpace(fieldNames[i])
+	}
+	return fieldNames
+}
+
+// sortField is a field sorting the objects of a query
+type sortField struct {
+	name string
+	// column holding the field, empty for a field of the body
+	column string
+}
+
+// sortFields resolves the fields sorting the objects of a query, nil is
+// returned if the query has no sort order
+func sortFields(archiveQuery archive.ArchiveQuery) []sortField {
+	if archiveQuery.SortOrder == nil {
+		return nil
+	}
+	var fields []sortField
+	for _, name := range SortFields(archiveQuery) {
+		column, _ := FieldColumn(name)
+		fields = append(fields, sortField{name, column})
+	}
+	return fields
+}
+
+// isAnyBodyField returns true if one of the sort fields is a field of the
+// body, the objects must then be sorted after decoding their body
+func isAnyBodyField(fields []sortField) bool {
+	for _, field := range fields {
+		if field.column == "" {
+			return true
+		}
+	}
+	return false
+}
+
+// verifySortFields checks the fields sorting the objects of a query: they
+// must be columns or fields of the body of the object type
+func verifySortFields(objectType com.ObjectType, archiveQuery archive.ArchiveQuery) error {
+	if archiveQuery.SortFieldName == nil {
+		return nil
+	}
+	for _, fieldName := range SortFields(archiveQuery) {
+		if fieldName == "" {
+			return errors.New(string(ARCHIVE_SERVICE_QUERY_SORT_FIELD_NAME_INVALID_ERROR))
+		}
+		if _, ok := FieldColumn(fieldName); !ok {
+			// The fields of the body are looked up in the MAL registry
+			if verifyBodyField(objectType, fieldName) != nil {
+				return errors.New(string(ARCHIVE_SERVICE_QUERY_SORT_FIELD_NAME_INVALID_ERROR))
+			}
+		}
+	}
+	return nil
+}
+
+// sortValues returns the values of the sort fields of an object, the values
+// of the columns are given by a function and those of the body are read in
+// the decoded element. A field missing from the body is a NULL value.
+func sortValues(fields []sortField, column func(string) (interface{}, error), element mal.Element) ([]interface{}, error) {
+	var values = make([]interface{}, len(fields))
+	for i, field := range fields {
+		if field.column == "" {
+			values[i], _ = bodyField(element, field.name)
+			continue
+		}
+		value, err := column(field.column)
+		if err != nil {
+			return nil, err
+		}
+		values[i] = value
+	}
+	return values, nil
+}
+
+// sortedObject is an object sorted by the values of the sort fields of a
+// query, the object itself is held by the backend
+type sortedObject struct {
+	object interface{}
+	values []interface{}
+}
+
+// sortObjects sorts objects by the values of their sort fields, in
+// ascending order unless the sort order is false. The objects with the
+// same values keep their order.
+func sortObjects(objects []sortedObject, sortOrder bool) error {
+	var sortErr error
+	sort.SliceStable(objects, func(i, j int) bool {
+		for k := range objects[i].values {
+			cmp, err := compareValues(objects[i].values[k], objects[j].values[k])
+			if err != nil {
+				sortErr = err
+				return false
+			}
+			if cmp != 0 {
+				// If sortOrder is false then returned values shall be
+				// sorted in descending order
+				return (cmp < 0) == sortOrder
+			}
+		}
+		return false
+	})
+	return sortErr
+}
@@ -0,0 +1,382 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/CNES/ccsdsmo-malgo/com"
+	"github.com/CNES/ccsdsmo-malgo/com/archive"
+	"github.com/CNES/ccsdsmo-malgo/mal"
+
+	. "github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/constants"
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/utils"
+)
+
+// Prefix of the names of the fields of the body of the archived objects,
+// it is optional and only needed when a field of the body has the same
+// name as a field of the ArchiveDetails or a column of the Archive table
+// (e.g. element.domain)
+const BODY_FIELD_PREFIX = "element."
+
+// splitFilters separates the filters on the columns of the Archive table,
+// which can be evaluated by the database, from the filters on the fields
+// of the body of the objects, which are evaluated on the decoded bodies
+func splitFilters(queryFilter archive.QueryFilter) (archive.QueryFilter, []*archive.CompositeFilter) {
+	compositeFilterSet, ok := queryFilter.(*archive.CompositeFilterSet)
+	if !ok || compositeFilterSet == nil {
+		return nil, nil
+	}
+
+	var columnFilters = &archive.CompositeFilterSet{Filters: archive.CompositeFilterList{}}
+	var bodyFilters []*archive.CompositeFilter
+	for _, filter := range compositeFilterSet.Filters {
+		if isBodyField(string(filter.FieldName)) {
+			bodyFilters = append(bodyFilters, filter)
+		} else {
+			columnFilters.Filters = append(columnFilters.Filters, filter)
+		}
+	}
+	return columnFilters, bodyFilters
+}
+
+// isBodyField returns true if a field name designates a field of the body
+// of the objects rather than a column of the Archive table
+func isBodyField(fieldName string) bool {
+	_, ok := FieldColumn(fieldName)
+	return !ok
+}
+
+// bodyFieldPath splits the name of a field of the body in the names of
+// the fields of the nested composites (e.g. position.x)
+func bodyFieldPath(fieldName string) []string {
+	return strings.Split(strings.TrimPrefix(fieldName, BODY_FIELD_PREFIX), ".")
+}
+
+// verifyBodyField checks that a field of the body exists in the type of
+// the body of an object type, the type is looked up in the MAL registry.
+// The check is only done when the object type has no wildcard, otherwise
+// the objects whose body doesn't hold the field are not selected.
+func verifyBodyField(objectType com.ObjectType, fieldName string) error {
+	if objectType.Area == 0 || objectType.Service == 0 || objectType.Version == 0 || objectType.Number == 0 {
+		return nil
+	}
+
+	var unknownField = errors.New(string(ARCHIVE_SERVICE_QUERY_QUERY_FILTER_ERROR) + ": unknown field " + fieldName)
+	element, err := mal.LookupMALElement(utils.TypeShortFormToShortForm(objectType))
+	if err != nil {
+		return unknownField
+	}
+
+	var fieldType = reflect.TypeOf(element)
+	for _, name := range bodyFieldPath(fieldName) {
+		for fieldType.Kind() == reflect.Ptr {
+			fieldType = fieldType.Elem()
+		}
+		if fieldType.Kind() == reflect.Interface {
+			// An abstract field, its actual type is only known
+			// from the archived objects
+			return nil
+		}
+		if fieldType.Kind() != reflect.Struct || isTime(fieldType) {
+			return unknownField
+		}
+		field, ok := malField(fieldType, name)
+		if !ok {
+			return unknownField
+		}
+		fieldType = field.Type
+	}
+
+	// The field must be an attribute
+	for fieldType.Kind() == reflect.Ptr {
+		fieldType = fieldType.Elem()
+	}
+	if !isAttribute(fieldType) {
+		return unknownField
+	}
+	return nil
+}
+
+// bodyField returns the value of a field of the body of an object, nil
+// is returned for a NULL value. false is returned when the body doesn't
+// hold the field.
+func bodyField(element mal.Element, fieldName string) (interface{}, bool) {
+	var value = reflect.ValueOf(element)
+	for _, name := range bodyFieldPath(fieldName) {
+		for value.Kind() == reflect.Ptr || value.Kind() == reflect.Interface {
+			if value.IsNil() {
+				// A NULL composite, its fields are NULL too
+				return nil, true
+			}
+			value = value.Elem()
+		}
+		if value.Kind() != reflect.Struct || isTime(value.Type()) {
+			return nil, false
+		}
+		field, ok := malField(value.Type(), name)
+		if !ok {
+			return nil, false
+		}
+		value = value.FieldByIndex(field.Index)
+	}
+
+	for value.Kind() == reflect.Ptr || value.Kind() == reflect.Interface {
+		if value.IsNil() {
+			return nil, true
+		}
+		value = value.Elem()
+	}
+	if !isAttribute(value.Type()) {
+		return nil, false
+	}
+	return normalizeValue(value.Interface()), true
+}
+
+// malField returns the field of a composite from its name in the MAL
+// specification, the Go fields are the exported version of this name
+// (e.g. value is the field Value of ValueOfSine)
+func malField(composite reflect.Type, name string) (reflect.StructField, bool) {
+	if name == "" {
+		return reflect.StructField{}, false
+	}
+	var runes = []rune(name)
+	runes[0] = unicode.ToUpper(runes[0])
+	field, ok := composite.FieldByName(string(runes))
+	if !ok || field.PkgPath != "" {
+		return reflect.StructField{}, false
+	}
+	return field, true
+}
+
+// isAttribute returns true if a type is a MAL attribute, i.e. a type
+// which can be compared by a filter
+func isAttribute(t reflect.Type) bool {
+	switch t.Kind() {
+	case reflect.Bool, reflect.String, reflect.Float32, reflect.Float64,
+		reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return true
+	case reflect.Slice:
+		// Blob
+		return t.Elem().Kind() == reflect.Uint8
+	case reflect.Struct:
+		return isTime(t)
+	}
+	return false
+}
+
+// isTime returns true for the Time and FineTime attributes
+func isTime(t reflect.Type) bool {
+	return t.Kind() == reflect.Struct && t.ConvertibleTo(reflect.TypeOf(time.Time{}))
+}
+
+// matchBodyFilters evaluates the filters on the fields of the body of an
+// object, a body which doesn't hold one of the fields doesn't match
+func matchBodyFilters(element mal.Element, filters []*archive.CompositeFilter) (bool, error) {
+	for _, filter := range filters {
+		value, ok := bodyField(element, string(filter.FieldName))
+		if !ok {
+			return false, nil
+		}
+		match, err := matchValue(value, filter)
+		if err != nil || !match {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// matchValue evaluates a filter of a CompositeFilterSet on the normalized
+// value of a field, nil being a NULL value
+func matchValue(value interface{}, filter *archive.CompositeFilter) (bool, error) {
+	// Comparison with a NULL value
+	if filter.FieldValue == nil || reflect.ValueOf(filter.FieldValue).IsNil() {
+		switch filter.Type {
+		case archive.EXPRESSIONOPERATOR_EQUAL:
+			return value == nil, nil
+		case archive.EXPRESSIONOPERATOR_DIFFER:
+			return value != nil, nil
+		default:
+			return false, errors.New(string(ARCHIVE_SERVICE_QUERY_QUERY_FILTER_ERROR) + ": must not contain NULL value")
+		}
+	}
+	if value == nil {
+		// A NULL field never matches a non NULL value
+		return false, nil
+	}
+	fieldValue := normalizeValue(reflect.ValueOf(filter.FieldValue).Elem().Interface())
+
+	switch filter.Type {
+	case archive.EXPRESSIONOPERATOR_CONTAINS, archive.EXPRESSIONOPERATOR_ICONTAINS:
+		str, ok := value.(string)
+		pattern, isString := fieldValue.(string)
+		if !ok || !isString {
+			return false, errors.New(string(ARCHIVE_SERVICE_QUERY_QUERY_FILTER_ERROR) + ": must not use this expression operator for a non-String")
+		}
+		if filter.Type == archive.EXPRESSIONOPERATOR_ICONTAINS {
+			return strings.Contains(strings.ToLower(str), strings.ToLower(pattern)), nil
+		}
+		return strings.Contains(str, pattern), nil
+	}
+
+	cmp, err := compareValues(value, fieldValue)
+	if err != nil {
+		return false, err
+	}
+	switch filter.Type {
+	case archive.EXPRESSIONOPERATOR_EQUAL:
+		return cmp == 0, nil
+	case archive.EXPRESSIONOPERATOR_DIFFER:
+		return cmp != 0, nil
+	case archive.EXPRESSIONOPERATOR_GREATER:
+		return cmp > 0, nil
+	case archive.EXPRESSIONOPERATOR_GREATER_OR_EQUAL:
+		return cmp >= 0, nil
+	case archive.EXPRESSIONOPERATOR_LESS:
+		return cmp < 0, nil
+	case archive.EXPRESSIONOPERATOR_LESS_OR_EQUAL:
+		return cmp <= 0, nil
+	default:
+		return false, errors.New(string(ARCHIVE_SERVICE_QUERY_QUERY_FILTER_ERROR) + ": unknown expression operator")
+	}
+}
+
+// normalizeValue converts a MAL attribute value to a basic go type
+// (int64, float64, bool, string, []byte or time.Time)
+func normalizeValue(value interface{}) interface{} {
+	var v = reflect.ValueOf(value)
+	switch v.Kind() {
+	case reflect.Bool:
+		return v.Bool()
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return v.Int()
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if v.Uint() > uint64(mal.LONG_MAX) {
+			return float64(v.Uint())
+		}
+		return int64(v.Uint())
+	case reflect.Float32, reflect.Float64:
+		return v.Float()
+	case reflect.String:
+		return v.String()
+	case reflect.Slice:
+		if v.Type().Elem().Kind() == reflect.Uint8 {
+			return v.Bytes()
+		}
+	case reflect.Struct:
+		var timeType = reflect.TypeOf(time.Time{})
+		if v.Type().ConvertibleTo(timeType) {
+			return v.Convert(timeType).Interface()
+		}
+	}
+	return value
+}
+
+// compareValues compares two normalized values, it returns a negative
+// number if a < b, 0 if a == b and a positive number if a > b. A NULL
+// value is lower than any other value.
+func compareValues(a interface{}, b interface{}) (int, error) {
+	if a == nil || b == nil {
+		switch {
+		case a == nil && b == nil:
+			return 0, nil
+		case a == nil:
+			return -1, nil
+		default:
+			return 1, nil
+		}
+	}
+
+	switch va := a.(type) {
+	case int64:
+		switch vb := b.(type) {
+		case int64:
+			return compareInts(va, vb), nil
+		case float64:
+			return compareFloats(float64(va), vb), nil
+		}
+	case float64:
+		switch vb := b.(type) {
+		case int64:
+			return compareFloats(va, float64(vb)), nil
+		case float64:
+			return compareFloats(va, vb), nil
+		}
+	case bool:
+		if vb, ok := b.(bool); ok {
+			if va == vb {
+				return 0, nil
+			} else if vb {
+				return -1, nil
+			}
+			return 1, nil
+		}
+	case string:
+		if vb, ok := b.(string); ok {
+			return strings.Compare(va, vb), nil
+		}
+	case []byte:
+		if vb, ok := b.([]byte); ok {
+			return bytes.Compare(va, vb), nil
+		}
+	case time.Time:
+		if vb, ok := b.(time.Time); ok {
+			if va.Before(vb) {
+				return -1, nil
+			} else if va.After(vb) {
+				return 1, nil
+			}
+			return 0, nil
+		}
+	}
+	return 0, errors.New(string(ARCHIVE_SERVICE_QUERY_QUERY_FILTER_ERROR) + ": cannot compare values of different types")
+}
+
+// compareInts compares two integers, the Long values above 2^53 can't
+// be compared as floats without a loss of precision
+func compareInts(a int64, b int64) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
+
+// compareFloats compares two numbers
+func compareFloats(a float64, b float64) int {
+	if a < b {
+		return -1
+	} else if a > b {
+		return 1
+	}
+	return 0
+}
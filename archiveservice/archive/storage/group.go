@@ -0,0 +1,127 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package storage
+
+import (
+	"github.com/CNES/ccsdsmo-malgo/com"
+	"github.com/CNES/ccsdsmo-malgo/com/archive"
+	"github.com/CNES/ccsdsmo-malgo/mal"
+
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/utils"
+)
+
+// queryGroupKey identifies a group of objects returned by QueryArchive, the
+// object type and the domain are left empty when they don't split the
+// objects into groups
+type queryGroupKey struct {
+	objectType com.ObjectType
+	domain     mal.String
+}
+
+// queryGroups gathers the objects matching a query into the lists returned
+// by QueryArchive: the objects are grouped by object type if the query has
+// a wildcard in its object type, and by domain if the bodies are returned.
+// The group of an object is found in a map, so the objects are grouped in
+// linear time whatever the number of groups.
+type queryGroups struct {
+	isObjectTypeEqualToZero bool
+	isReturnBody            bool
+	indexes                 map[queryGroupKey]int
+
+	// Lists to return, a group has the same index in each of them
+	objectTypes         []*com.ObjectType
+	archiveDetailsLists []*archive.ArchiveDetailsList
+	domains             []*mal.IdentifierList
+	elementLists        []mal.ElementList
+}
+
+// newQueryGroups creates empty groups for the results of a query
+func newQueryGroups(boolean *mal.Boolean, objectType com.ObjectType) *queryGroups {
+	return &queryGroups{
+		isObjectTypeEqualToZero: objectType.Area == 0 || objectType.Number == 0 || objectType.Service == 0 || objectType.Version == 0,
+		isReturnBody:            boolean != nil && *boolean,
+		indexes:                 make(map[queryGroupKey]int),
+	}
+}
+
+// add appends an object to its group, the group is created if it's the
+// first object of the group. The element is ignored if the bodies are not
+// returned.
+func (groups *queryGroups) add(objectType com.ObjectType, domain mal.String, archiveDetails *archive.ArchiveDetails, element mal.Element) error {
+	var key queryGroupKey
+	if groups.isObjectTypeEqualToZero {
+		key.objectType = objectType
+	}
+	if groups.isReturnBody {
+		key.domain = domain
+	}
+
+	index, ok := groups.indexes[key]
+	if !ok {
+		// Create a new group
+		index = len(groups.archiveDetailsLists)
+		groups.indexes[key] = index
+
+		// ObjectType
+		if groups.isObjectTypeEqualToZero {
+			objType := objectType
+			groups.objectTypes = append(groups.objectTypes, &objType)
+		} else {
+			groups.objectTypes = append(groups.objectTypes, nil)
+		}
+		// IdentifierList and ElementList
+		if groups.isReturnBody {
+			idList := utils.AdaptDomainToIdentifierList(string(domain))
+			groups.domains = append(groups.domains, &idList)
+			elementList, err := newElementList(objectType)
+			if err != nil {
+				return err
+			}
+			groups.elementLists = append(groups.elementLists, elementList)
+		} else {
+			var longList *mal.LongList
+			groups.domains = append(groups.domains, nil)
+			groups.elementLists = append(groups.elementLists, longList)
+		}
+		// ArchiveDetailsList
+		groups.archiveDetailsLists = append(groups.archiveDetailsLists, archive.NewArchiveDetailsList(0))
+	}
+
+	groups.archiveDetailsLists[index].AppendElement(archiveDetails)
+	if groups.isReturnBody {
+		groups.elementLists[index].AppendElement(element)
+	}
+	return nil
+}
+
+// lists returns the lists of QueryArchive. If nothing has been found, a nil
+// element is appended to each list.
+func (groups *queryGroups) lists() ([]*com.ObjectType, []*archive.ArchiveDetailsList, []*mal.IdentifierList, []mal.ElementList) {
+	if len(groups.archiveDetailsLists) == 0 {
+		var longList *mal.LongList
+		return []*com.ObjectType{nil}, []*archive.ArchiveDetailsList{nil}, []*mal.IdentifierList{nil}, []mal.ElementList{longList}
+	}
+	return groups.objectTypes, groups.archiveDetailsLists, groups.domains, groups.elementLists
+}
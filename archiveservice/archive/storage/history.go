@@ -0,0 +1,415 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"time"
+
+	"github.com/CNES/ccsdsmo-malgo/com"
+	"github.com/CNES/ccsdsmo-malgo/com/archive"
+	"github.com/CNES/ccsdsmo-malgo/mal"
+
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/utils"
+)
+
+// Suffix of the name of the table holding the previous versions of the
+// updated objects (e.g. ArchiveHistory)
+const HISTORY_SUFFIX = "History"
+
+// Column of the Archive table holding the time at which an object has
+// been stored, it's NULL for the objects stored before the ninth migration
+const STORED_COLUMN = "stored"
+
+// ObjectVersion is a version of an archived object. The Update operation
+// keeps the version it replaces in the history of the object, the history
+// is deleted with the object.
+type ObjectVersion struct {
+	// Revision numbers the versions of an object from 1, the version
+	// stored by the Store operation
+	Revision int
+	// Updated is the time at which the version has been replaced by an
+	// Update operation, it's zero for the current version
+	Updated time.Time
+	// ArchiveDetails and Element are the object as it was stored
+	ArchiveDetails *archive.ArchiveDetails
+	Element        mal.Element
+}
+
+// IsCurrent returns true if the version hasn't been replaced
+func (version *ObjectVersion) IsCurrent() bool {
+	return version.Updated.IsZero()
+}
+
+// Columns identifying a version in the history table
+var historyKeyColumns = []string{"area", "service", "version", "number", "domain", "objectInstanceIdentifier", "revision", "updated"}
+
+// Columns of the Archive table copied to the history table
+var versionColumns = []string{"element", "timestamp", "details.related", "network", "provider", "details.source"}
+
+// Columns of the versions read from the history table, the retrieveColumns
+// followed by the revision and the time of the update
+var historyColumns = []string{"objectInstanceIdentifier", "element", "timestamp", "details.related", "network", "provider", "details.source", "revision", "updated"}
+
+// storedStatements returns the statement adding the time at which the
+// objects are stored to the Archive table
+func storedStatements(dialect Dialect, table string) []string {
+	var columnType = "BIGINT"
+	if _, ok := dialect.(MySQLDialect); ok {
+		columnType = "bigint(20) DEFAULT NULL"
+	}
+	return []string{
+		"ALTER TABLE " + dialect.QuoteIdentifier(table) + " ADD COLUMN " + dialect.QuoteIdentifier(STORED_COLUMN) + " " + columnType,
+	}
+}
+
+// historyStatements returns the statements creating the history table,
+// the object is identified as in the Archive table and its version by
+// its revision
+func historyStatements(dialect Dialect, table string) []string {
+	// The domain is the same as in the Archive table
+	var domainType, blobType, options = "TEXT", "BLOB", ""
+	switch dialect.(type) {
+	case MySQLDialect:
+		domainType = "varchar(255) CHARACTER SET utf8 COLLATE utf8_bin"
+		options = " ENGINE=InnoDB DEFAULT CHARSET=utf8"
+	case PostgresDialect:
+		blobType = "BYTEA"
+	}
+	return []string{
+		"CREATE TABLE IF NOT EXISTS " + dialect.QuoteIdentifier(table+HISTORY_SUFFIX) + " (" +
+			dialect.QuoteIdentifier("area") + " INTEGER NOT NULL, " +
+			dialect.QuoteIdentifier("service") + " INTEGER NOT NULL, " +
+			dialect.QuoteIdentifier("version") + " INTEGER NOT NULL, " +
+			dialect.QuoteIdentifier("number") + " INTEGER NOT NULL, " +
+			dialect.QuoteIdentifier("domain") + " " + domainType + " NOT NULL, " +
+			dialect.QuoteIdentifier("objectInstanceIdentifier") + " BIGINT NOT NULL, " +
+			dialect.QuoteIdentifier("revision") + " INTEGER NOT NULL, " +
+			dialect.QuoteIdentifier("updated") + " BIGINT NOT NULL, " +
+			dialect.QuoteIdentifier("element") + " " + blobType + ", " +
+			dialect.QuoteIdentifier("timestamp") + " BIGINT, " +
+			dialect.QuoteIdentifier("details.related") + " BIGINT, " +
+			dialect.QuoteIdentifier("network") + " TEXT, " +
+			dialect.QuoteIdentifier("provider") + " TEXT, " +
+			dialect.QuoteIdentifier("details.source") + " " + blobType + ", " +
+			"PRIMARY KEY (" + quoteColumns(dialect, historyKeyColumns[:7]...) + "))" + options,
+	}
+}
+
+// historyTable returns the quoted name of the history table
+func (backend *SQLBackend) historyTable() string {
+	return backend.dialect.QuoteIdentifier(backend.tableName + HISTORY_SUFFIX)
+}
+
+// archiveVersion copies the current version of an object to the history
+// table before it's replaced by an update
+func (backend *SQLBackend) archiveVersion(tx *sql.Tx, objectType com.ObjectType, domain mal.String, instID mal.Long, updated time.Time) error {
+	var key = []interface{}{instID, objectType.Area, objectType.Service, objectType.Version, objectType.Number, domain}
+
+	var revision int64
+	err := backend.queryRow(tx, backend.queries.selectLastRevision, key...).Scan(&revision)
+	if err != nil {
+		return err
+	}
+
+	// The columns are copied as they are read
+	var values = make([]interface{}, len(versionColumns))
+	var dest = make([]interface{}, len(versionColumns))
+	for i := range values {
+		dest[i] = &values[i]
+	}
+	err = backend.queryRow(tx, backend.queries.selectVersion, key...).Scan(dest...)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return errors.New(string(mal.ERROR_UNKNOWN_MESSAGE))
+		}
+		return err
+	}
+
+	var args = []interface{}{
+		objectType.Area,
+		objectType.Service,
+		objectType.Version,
+		objectType.Number,
+		domain,
+		instID,
+		revision + 1,
+		encodeTimestamp(updated),
+	}
+	_, err = backend.exec(tx, backend.queries.insertVersion, append(args, values...)...)
+	return err
+}
+
+// deleteHistory deletes the history of a set of objects
+func (backend *SQLBackend) deleteHistory(tx *sql.Tx, objectType com.ObjectType, domain mal.String, instIDs mal.LongList) error {
+	for _, instID := range instIDs {
+		_, err := backend.exec(tx, backend.queries.deleteHistory,
+			*instID,
+			objectType.Area,
+			objectType.Service,
+			objectType.Version,
+			objectType.Number,
+			domain)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scanVersion reads a version selected with the historyColumns
+func scanVersion(rows *sql.Rows) (*ObjectVersion, error) {
+	var revision int
+	// Nanoseconds since the epoch (see encodeTimestamp)
+	var updated int64
+	archiveDetails, element, err := scanRetrievedObject(rows, &revision, &updated)
+	if err != nil {
+		return nil, err
+	}
+	return &ObjectVersion{revision, decodeTimestamp(updated), archiveDetails, element}, nil
+}
+
+// ObjectHistory returns all the versions of an object, the oldest first
+// and the current version last
+func (backend *SQLBackend) ObjectHistory(objectType com.ObjectType, identifierList mal.IdentifierList, instID mal.Long) ([]*ObjectVersion, error) {
+	// Create the transaction to execute future queries
+	tx, err := backend.createReadTransaction()
+	if err != nil {
+		return nil, err
+	}
+	// Rollback the transaction if it has not been committed
+	defer tx.Rollback()
+
+	domain := utils.AdaptDomainToString(identifierList)
+
+	// The current version
+	builder, err := backend.keyQuery(retrieveColumns, objectType, domain, []int64{int64(instID)})
+	if err != nil {
+		return nil, err
+	}
+	builder.NotDeletedCondition()
+	rows, err := tx.Query(builder.String(), builder.Args()...)
+	if err != nil {
+		return nil, err
+	}
+	var current *ObjectVersion
+	for rows.Next() {
+		archiveDetails, element, err := scanRetrievedObject(rows)
+		if err != nil {
+			rows.Close()
+			return nil, err
+		}
+		current = &ObjectVersion{ArchiveDetails: archiveDetails, Element: element}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+	if current == nil {
+		return nil, errors.New(string(mal.ERROR_UNKNOWN_MESSAGE))
+	}
+
+	// The previous versions
+	rows, err = backend.query(tx, backend.queries.selectHistory,
+		instID,
+		objectType.Area,
+		objectType.Service,
+		objectType.Version,
+		objectType.Number,
+		domain)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var versions []*ObjectVersion
+	for rows.Next() {
+		version, err := scanVersion(rows)
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, version)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, err
+	}
+
+	current.Revision = 1
+	if len(versions) != 0 {
+		current.Revision = versions[len(versions)-1].Revision + 1
+	}
+
+	// Commit changes
+	tx.Commit()
+
+	return append(versions, current), nil
+}
+
+// RetrieveAsOf retrieves a set of objects as RetrieveInArchive, each one
+// in the version which was current at a given time
+func (backend *SQLBackend) RetrieveAsOf(objectType com.ObjectType, identifierList mal.IdentifierList, objectInstanceIdentifierList mal.LongList, asOf time.Time) (archive.ArchiveDetailsList, mal.ElementList, error) {
+	// An object updated while its history is read is also found in the
+	// history with the version replaced, which is then returned
+	archiveDetailsList, elementList, err := backend.RetrieveInArchive(objectType, identifierList, objectInstanceIdentifierList)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// Create the transaction to execute future queries
+	tx, err := backend.createReadTransaction()
+	if err != nil {
+		return nil, nil, err
+	}
+	// Rollback the transaction if it has not been committed
+	defer tx.Rollback()
+
+	domain := utils.AdaptDomainToString(identifierList)
+	var instIDs = make([]int64, archiveDetailsList.Size())
+	for i, archiveDetails := range archiveDetailsList {
+		instIDs[i] = int64(archiveDetails.InstId)
+	}
+
+	// The objects stored after the time didn't exist yet, the stored
+	// column isn't a field of the queries
+	builder, err := backend.keyQuery([]string{"objectInstanceIdentifier"}, objectType, domain, instIDs)
+	if err != nil {
+		return nil, nil, err
+	}
+	builder.and()
+	builder.WriteString(backend.quote(STORED_COLUMN) + " > ")
+	builder.Arg(encodeTimestamp(asOf))
+	rows, err := tx.Query(builder.String(), builder.Args()...)
+	if err != nil {
+		return nil, nil, err
+	}
+	var storedAfter = make(map[mal.Long]bool)
+	for rows.Next() {
+		var instID int64
+		if err = rows.Scan(&instID); err != nil {
+			rows.Close()
+			return nil, nil, err
+		}
+		storedAfter[mal.Long(instID)] = true
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+	archiveDetailsList, elementList, err = excludeObjects(objectType, archiveDetailsList, elementList, objectInstanceIdentifierList, storedAfter)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The first versions replaced after the time, by object
+	builder, err = backend.tableKeyQuery(backend.historyTable(), historyColumns, objectType, domain, instIDs)
+	if err != nil {
+		return nil, nil, err
+	}
+	// The updated column isn't a field of the queries
+	builder.and()
+	builder.WriteString(backend.quote("updated") + " > ")
+	builder.Arg(encodeTimestamp(asOf))
+	builder.WriteString(" ORDER BY " + backend.columns("objectInstanceIdentifier", "revision"))
+	rows, err = tx.Query(builder.String(), builder.Args()...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	var versions = make(map[mal.Long]*ObjectVersion)
+	for rows.Next() {
+		version, err := scanVersion(rows)
+		if err != nil {
+			return nil, nil, err
+		}
+		if _, ok := versions[version.ArchiveDetails.InstId]; !ok {
+			versions[version.ArchiveDetails.InstId] = version
+		}
+	}
+	if err = rows.Err(); err != nil {
+		return nil, nil, err
+	}
+
+	// Commit changes
+	tx.Commit()
+
+	return replaceVersions(objectType, archiveDetailsList, elementList, versions)
+}
+
+// excludeObjects removes from the objects retrieved by RetrieveAsOf the
+// objects which didn't exist yet at the time, an object requested by its
+// object instance identifier is then unknown
+func excludeObjects(objectType com.ObjectType, archiveDetailsList archive.ArchiveDetailsList, elementList mal.ElementList, objectInstanceIdentifierList mal.LongList, excluded map[mal.Long]bool) (archive.ArchiveDetailsList, mal.ElementList, error) {
+	if len(excluded) == 0 {
+		return archiveDetailsList, elementList, nil
+	}
+	var isAll = false
+	for _, instID := range objectInstanceIdentifierList {
+		if *instID == 0 {
+			isAll = true
+			break
+		}
+	}
+	if !isAll {
+		return nil, nil, errors.New(string(mal.ERROR_UNKNOWN_MESSAGE))
+	}
+
+	var existingDetailsList = *archive.NewArchiveDetailsList(0)
+	existingElementList, err := newElementList(objectType)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := 0; i < archiveDetailsList.Size(); i++ {
+		if !excluded[archiveDetailsList[i].InstId] {
+			existingDetailsList.AppendElement(archiveDetailsList[i])
+			existingElementList.AppendElement(elementList.GetElementAt(i))
+		}
+	}
+	if existingDetailsList.Size() == 0 {
+		return nil, nil, errors.New(string(mal.ERROR_UNKNOWN_MESSAGE))
+	}
+	return existingDetailsList, existingElementList, nil
+}
+
+// replaceVersions returns the objects retrieved with the objects replaced
+// by their versions, if any
+func replaceVersions(objectType com.ObjectType, archiveDetailsList archive.ArchiveDetailsList, elementList mal.ElementList, versions map[mal.Long]*ObjectVersion) (archive.ArchiveDetailsList, mal.ElementList, error) {
+	var versionDetailsList = *archive.NewArchiveDetailsList(0)
+	versionElementList, err := newElementList(objectType)
+	if err != nil {
+		return nil, nil, err
+	}
+	for i := 0; i < archiveDetailsList.Size(); i++ {
+		if version, ok := versions[archiveDetailsList[i].InstId]; ok {
+			versionDetailsList.AppendElement(version.ArchiveDetails)
+			versionElementList.AppendElement(version.Element)
+		} else {
+			versionDetailsList.AppendElement(archiveDetailsList[i])
+			versionElementList.AppendElement(elementList.GetElementAt(i))
+		}
+	}
+	return versionDetailsList, versionElementList, nil
+}
@@ -0,0 +1,1107 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package storage
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/CNES/ccsdsmo-malgo/com"
+	"github.com/CNES/ccsdsmo-malgo/com/archive"
+	"github.com/CNES/ccsdsmo-malgo/mal"
+
+	. "github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/constants"
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/utils"
+)
+
+// MemoryBackend is a volatile ArchiveBackend keeping all the objects in
+// memory. It is meant for tests and simulations, all the objects are lost
+// when the process stops. It is safe for concurrent use.
+type MemoryBackend struct {
+	mutex sync.RWMutex
+	// objects holds the archived objects indexed by their key, like the
+	// unique index of the table an object instance identifier is only
+	// used once per type and domain
+	objects map[memoryKey]*memoryObject
+	// lastID is the last internal id given to an object, it keeps
+	// track of the insertion order (like the id column of the table)
+	lastID int64
+	// lastInstIDs holds the last object instance identifier allocated
+	// to each object type in each domain
+	lastInstIDs map[memorySequenceKey]int64
+	// history holds the versions of the objects replaced by an update,
+	// the oldest first (like the history table)
+	history map[memoryKey][]*memoryVersion
+	// softDelete keeps the deleted objects as tombstones in deleted,
+	// where they keep their key and their history until they're purged
+	softDelete bool
+	deleted    map[memoryKey]*memoryObject
+}
+
+// memoryKey identifies an object in the archive
+type memoryKey struct {
+	objectType com.ObjectType
+	domain     mal.String
+	instID     mal.Long
+}
+
+// memorySequenceKey identifies the sequence of the object instance
+// identifiers of an object type in a domain
+type memorySequenceKey struct {
+	objectType com.ObjectType
+	domain     mal.String
+}
+
+// memoryObject is the equivalent of a row of the Archive table, the
+// element and the source are kept encoded so that the archived objects
+// cannot be modified by the callers
+type memoryObject struct {
+	id              int64
+	key             memoryKey
+	encodedElement  []byte
+	timestamp       time.Time
+	related         *mal.Long
+	network         mal.Identifier
+	provider        mal.URI
+	encodedObjectID []byte
+	// source is a decoded copy of the source used by the queries,
+	// it is nil when the object has no source
+	source *com.ObjectId
+	// deleted is the time at which the object has been deleted if
+	// it's a tombstone
+	deleted time.Time
+	// stored is the time at which the object has been stored, it's
+	// kept by the updates
+	stored time.Time
+}
+
+// memoryVersion is a version of an object replaced at the time updated
+type memoryVersion struct {
+	object  *memoryObject
+	updated time.Time
+}
+
+// NewMemoryBackend creates an empty in-memory backend
+func NewMemoryBackend() *MemoryBackend {
+	return &MemoryBackend{
+		objects:     make(map[memoryKey]*memoryObject),
+		lastInstIDs: make(map[memorySequenceKey]int64),
+		history:     make(map[memoryKey][]*memoryVersion),
+		deleted:     make(map[memoryKey]*memoryObject),
+	}
+}
+
+// Check that MemoryBackend implements the ArchiveBackend interface and all the
+// optional interfaces
+var (
+	_ ArchiveBackend    = (*MemoryBackend)(nil)
+	_ HistoryBackend    = (*MemoryBackend)(nil)
+	_ SoftDeleteBackend = (*MemoryBackend)(nil)
+	_ RetentionBackend  = (*MemoryBackend)(nil)
+)
+
+//======================================================================//
+//                            RETRIEVE                                  //
+//======================================================================//
+
+// RetrieveInArchive retrieves a set of objects identified by their
+// object instance identifiers
+func (backend *MemoryBackend) RetrieveInArchive(objectType com.ObjectType, identifierList mal.IdentifierList, objectInstanceIdentifierList mal.LongList) (archive.ArchiveDetailsList, mal.ElementList, error) {
+	backend.mutex.RLock()
+	defer backend.mutex.RUnlock()
+
+	return backend.retrieve(objectType, identifierList, objectInstanceIdentifierList)
+}
+
+// retrieve retrieves a set of objects, the mutex must be locked
+func (backend *MemoryBackend) retrieve(objectType com.ObjectType, identifierList mal.IdentifierList, objectInstanceIdentifierList mal.LongList) (archive.ArchiveDetailsList, mal.ElementList, error) {
+	// Convert domain
+	domain := utils.AdaptDomainToString(identifierList)
+
+	// First of all, we need to verity the object instance identifiers values
+	var isAll = false
+	for i := 0; i < objectInstanceIdentifierList.Size(); i++ {
+		if *objectInstanceIdentifierList[i] == 0 {
+			isAll = true
+			break
+		}
+	}
+
+	// Create the list of the objects to return
+	var objects []*memoryObject
+	if !isAll {
+		for i := 0; i < objectInstanceIdentifierList.Size(); i++ {
+			object, ok := backend.objects[memoryKey{objectType, domain, *objectInstanceIdentifierList[i]}]
+			if !ok {
+				return nil, nil, errors.New(string(mal.ERROR_UNKNOWN_MESSAGE))
+			}
+			objects = append(objects, object)
+		}
+	} else {
+		for key, object := range backend.objects {
+			if key.objectType == objectType && key.domain == domain {
+				objects = append(objects, object)
+			}
+		}
+		if len(objects) == 0 {
+			return nil, nil, errors.New(string(mal.ERROR_UNKNOWN_MESSAGE))
+		}
+		sortByID(objects)
+	}
+
+	// Create variables to return the elements and information
+	var archiveDetailsList = *archive.NewArchiveDetailsList(0)
+	elementList, err := newElementList(objectType)
+	if err != nil {
+		return nil, nil, err
+	}
+	for _, object := range objects {
+		archiveDetails, element, err := object.decode()
+		if err != nil {
+			return nil, nil, err
+		}
+		archiveDetailsList.AppendElement(archiveDetails)
+		elementList.AppendElement(element)
+	}
+
+	return archiveDetailsList, elementList, nil
+}
+
+//======================================================================//
+//                              QUERY                                   //
+//======================================================================//
+
+// QueryArchive retrieves the objects matching a query
+func (backend *MemoryBackend) QueryArchive(boolean *mal.Boolean, objectType com.ObjectType, archiveQuery archive.ArchiveQuery, queryFilter archive.QueryFilter) ([]*com.ObjectType, []*archive.ArchiveDetailsList, []*mal.IdentifierList, []mal.ElementList, error) {
+	backend.mutex.RLock()
+	defer backend.mutex.RUnlock()
+
+	// Verify the parameters
+	err := verifyParameters(objectType, archiveQuery, queryFilter)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	// Select the objects
+	objects, err := backend.selectObjects(objectType, archiveQuery, queryFilter)
+	if err != nil {
+		return nil, nil, nil, nil, err
+	}
+
+	var groups = newQueryGroups(boolean, objectType)
+	for _, object := range objects {
+		archiveDetails, element, err := object.decode()
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+		err = groups.add(object.key.objectType, object.key.domain, archiveDetails, element)
+		if err != nil {
+			return nil, nil, nil, nil, err
+		}
+	}
+
+	objectTypeToReturn, archiveDetailsListToReturn, identifierListToReturn, elementListToReturn := groups.lists()
+	return objectTypeToReturn, archiveDetailsListToReturn, identifierListToReturn, elementListToReturn, nil
+}
+
+// StreamQuery sends the objects matching a query in chunks, they are sorted
+// by group first like by the SQL backend unless the sort order of the query
+// is global. The objects are copied before the chunks are sent, so that the
+// archive can be modified while they are sent.
+func (backend *MemoryBackend) StreamQuery(boolean *mal.Boolean, objectType com.ObjectType, archiveQuery archive.ArchiveQuery, queryFilter archive.QueryFilter, limits ChunkLimits, globalOrder bool, send QuerySender) error {
+	// Verify the parameters
+	err := verifyParameters(objectType, archiveQuery, queryFilter)
+	if err != nil {
+		return err
+	}
+
+	objects, err := backend.copyObjects(objectType, archiveQuery, queryFilter)
+	if err != nil {
+		return err
+	}
+
+	// The order of the query is kept in each group
+	var chunker = newQueryChunker(boolean, objectType, limits, send)
+	if isSortedByGroup(archiveQuery, globalOrder) {
+		sort.SliceStable(objects, func(i, j int) bool {
+			return chunker.isGroupBefore(objects[i].key, objects[j].key)
+		})
+	}
+
+	for _, object := range objects {
+		archiveDetails, element, err := object.decode()
+		if err != nil {
+			return err
+		}
+		var encodedElement []byte
+		if chunker.isReturnBody {
+			encodedElement = object.encodedElement
+		} else {
+			element = nil
+		}
+		err = chunker.add(object.key.objectType, object.key.domain, archiveDetails, element,
+			objectSize(encodedElement, object.encodedObjectID, object.network, object.provider))
+		if err != nil {
+			return err
+		}
+	}
+
+	// Send the last chunk
+	return chunker.flush()
+}
+
+// copyObjects returns a copy of the objects matching a query, which can be
+// read without the lock of the backend
+func (backend *MemoryBackend) copyObjects(objectType com.ObjectType, archiveQuery archive.ArchiveQuery, queryFilter archive.QueryFilter) ([]*memoryObject, error) {
+	backend.mutex.RLock()
+	defer backend.mutex.RUnlock()
+
+	objects, err := backend.selectObjects(objectType, archiveQuery, queryFilter)
+	if err != nil {
+		return nil, err
+	}
+	var copies = make([]*memoryObject, len(objects))
+	for i, object := range objects {
+		var objectCopy = *object
+		copies[i] = &objectCopy
+	}
+	return copies, nil
+}
+
+//======================================================================//
+//                              COUNT                                   //
+//======================================================================//
+
+// CountInArchive counts the objects matching each query of the list
+func (backend *MemoryBackend) CountInArchive(objectType com.ObjectType, archiveQueryList archive.ArchiveQueryList, queryFilterList archive.QueryFilterList) (*mal.LongList, error) {
+	backend.mutex.RLock()
+	defer backend.mutex.RUnlock()
+
+	var longList = mal.NewLongList(0)
+
+	for i := 0; i < archiveQueryList.Size(); i++ {
+		var queryFilter archive.QueryFilter
+		if queryFilterList != nil {
+			queryFilter = queryFilterList.GetElementAt(i).(archive.QueryFilter)
+		}
+		// Verify the parameters
+		err := verifyParameters(objectType, *archiveQueryList[i], queryFilter)
+		if err != nil {
+			return nil, err
+		}
+
+		objects, err := backend.selectObjects(objectType, *archiveQueryList[i], queryFilter)
+		if err != nil {
+			return nil, err
+		}
+
+		// Add this response in the long list
+		longList.AppendElement(mal.NewLong(int64(len(objects))))
+	}
+
+	return longList, nil
+}
+
+//======================================================================//
+//                              STORE                                   //
+//======================================================================//
+
+// StoreInArchive stores new objects in the archive
+func (backend *MemoryBackend) StoreInArchive(boolean *mal.Boolean, objectType com.ObjectType, identifierList mal.IdentifierList, archiveDetailsList archive.ArchiveDetailsList, elementList mal.ElementList) (*mal.LongList, error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+
+	// Variable to return all the object instance identifiers
+	var longList *mal.LongList
+	if boolean != nil && *boolean {
+		longList = mal.NewLongList(0)
+	}
+
+	// Create the domain
+	domain := utils.AdaptDomainToString(identifierList)
+
+	// The objects are only added to the archive when all of them are
+	// valid (this is the equivalent of the rollback of the SQL backend)
+	var newObjects []*memoryObject
+
+	// The identifiers given in the request are reserved first, so that
+	// they are not allocated to the objects stored without identifier
+	var newKeys = make(map[memoryKey]bool)
+	for i := 0; i < archiveDetailsList.Size(); i++ {
+		if archiveDetailsList[i].InstId == 0 {
+			continue
+		}
+		var key = memoryKey{objectType, domain, archiveDetailsList[i].InstId}
+		if backend.isKeyUsed(key, newKeys) {
+			// This object is already in the archive, raise a DUPLICATE error
+			return nil, errors.New(string(com.ERROR_DUPLICATE))
+		}
+		newKeys[key] = true
+	}
+
+	var sequence = memorySequenceKey{objectType, domain}
+	var lastInstID = backend.lastInstIDs[sequence]
+	for i := 0; i < archiveDetailsList.Size(); i++ {
+		var instID = archiveDetailsList[i].InstId
+		if instID == 0 {
+			// Allocate the next unused object instance identifier
+			for {
+				lastInstID++
+				instID = mal.Long(lastInstID)
+				if !backend.isKeyUsed(memoryKey{objectType, domain, instID}, newKeys) {
+					break
+				}
+			}
+		}
+
+		var element mal.Element
+		if elementList != nil {
+			element = elementList.GetElementAt(i)
+		}
+		object, err := newMemoryObject(memoryKey{objectType, domain, instID}, element, *archiveDetailsList[i])
+		if err != nil {
+			return nil, err
+		}
+		newObjects = append(newObjects, object)
+		newKeys[object.key] = true
+
+		if longList != nil {
+			// Insert this new object instance identifier in the returned list
+			longList.AppendElement(mal.NewLong(int64(instID)))
+		}
+	}
+
+	// Everything is fine, add the objects in the archive
+	var stored = time.Now()
+	for _, object := range newObjects {
+		backend.lastID++
+		object.id = backend.lastID
+		object.stored = stored
+		backend.objects[object.key] = object
+	}
+	backend.lastInstIDs[sequence] = lastInstID
+
+	return longList, nil
+}
+
+//======================================================================//
+//                              UPDATE                                  //
+//======================================================================//
+
+// UpdateArchive updates objects already present in the archive
+func (backend *MemoryBackend) UpdateArchive(objectType com.ObjectType, identifierList mal.IdentifierList, archiveDetailsList archive.ArchiveDetailsList, elementList mal.ElementList) error {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+
+	// Create the domain
+	domain := utils.AdaptDomainToString(identifierList)
+
+	// Prepare all the new versions of the objects before modifying anything
+	var updatedObjects []*memoryObject
+	for i := 0; i < elementList.Size(); i++ {
+		key := memoryKey{objectType, domain, archiveDetailsList[i].InstId}
+		object, ok := backend.objects[key]
+		if !ok {
+			return errors.New(string(mal.ERROR_UNKNOWN_MESSAGE))
+		}
+
+		updatedObject, err := newMemoryObject(key, elementList.GetElementAt(i), *archiveDetailsList[i])
+		if err != nil {
+			return err
+		}
+		updatedObject.id = object.id
+		updatedObject.stored = object.stored
+		updatedObjects = append(updatedObjects, updatedObject)
+	}
+
+	// The versions replaced are kept in the history
+	var updated = time.Now()
+	for _, object := range updatedObjects {
+		backend.history[object.key] = append(backend.history[object.key], &memoryVersion{backend.objects[object.key], updated})
+		backend.objects[object.key] = object
+	}
+
+	return nil
+}
+
+//======================================================================//
+//                              DELETE                                  //
+//======================================================================//
+
+// DeleteInArchive deletes a set of objects, or turns them into tombstones
+// in soft delete mode
+func (backend *MemoryBackend) DeleteInArchive(objectType com.ObjectType, identifierList mal.IdentifierList, longListRequest mal.LongList) (mal.LongList, error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+
+	// Variable to return
+	var longList mal.LongList
+
+	// Create the domain
+	domain := utils.AdaptDomainToString(identifierList)
+
+	// Variable to say if we have to delete all of the objects or not
+	var isAll = false
+	for i := 0; i < longListRequest.Size(); i++ {
+		if *longListRequest[i] == 0 {
+			isAll = true
+			break
+		}
+	}
+
+	// Retrieve the objects to delete
+	var objects []*memoryObject
+	if isAll {
+		for key, object := range backend.objects {
+			if key.objectType == objectType && key.domain == domain {
+				objects = append(objects, object)
+			}
+		}
+		if len(objects) == 0 {
+			return nil, errors.New(string(mal.ERROR_UNKNOWN_MESSAGE))
+		}
+		sortByID(objects)
+	} else {
+		for i := 0; i < longListRequest.Size(); i++ {
+			object, ok := backend.objects[memoryKey{objectType, domain, *longListRequest[i]}]
+			if !ok {
+				return nil, errors.New(string(mal.ERROR_UNKNOWN_MESSAGE))
+			}
+			objects = append(objects, object)
+		}
+	}
+
+	// Delete them
+	var now = time.Now()
+	for _, object := range objects {
+		delete(backend.objects, object.key)
+		if backend.softDelete {
+			object.deleted = now
+			backend.deleted[object.key] = object
+		} else {
+			delete(backend.history, object.key)
+		}
+		longList.AppendElement(mal.NewLong(int64(object.key.instID)))
+	}
+
+	return longList, nil
+}
+
+// Close does nothing, there is no resource to release
+func (backend *MemoryBackend) Close() error {
+	return nil
+}
+
+//======================================================================//
+//                              HISTORY                                 //
+//======================================================================//
+
+// ObjectHistory returns all the versions of an object, the oldest first
+// and the current version last
+func (backend *MemoryBackend) ObjectHistory(objectType com.ObjectType, identifierList mal.IdentifierList, instID mal.Long) ([]*ObjectVersion, error) {
+	backend.mutex.RLock()
+	defer backend.mutex.RUnlock()
+
+	key := memoryKey{objectType, utils.AdaptDomainToString(identifierList), instID}
+	object, ok := backend.objects[key]
+	if !ok {
+		return nil, errors.New(string(mal.ERROR_UNKNOWN_MESSAGE))
+	}
+
+	var versions []*ObjectVersion
+	for i, version := range backend.history[key] {
+		archiveDetails, element, err := version.object.decode()
+		if err != nil {
+			return nil, err
+		}
+		versions = append(versions, &ObjectVersion{i + 1, version.updated, archiveDetails, element})
+	}
+	archiveDetails, element, err := object.decode()
+	if err != nil {
+		return nil, err
+	}
+	return append(versions, &ObjectVersion{len(versions) + 1, time.Time{}, archiveDetails, element}), nil
+}
+
+// RetrieveAsOf retrieves a set of objects as RetrieveInArchive, each one
+// in the version which was current at a given time
+func (backend *MemoryBackend) RetrieveAsOf(objectType com.ObjectType, identifierList mal.IdentifierList, objectInstanceIdentifierList mal.LongList, asOf time.Time) (archive.ArchiveDetailsList, mal.ElementList, error) {
+	backend.mutex.RLock()
+	defer backend.mutex.RUnlock()
+
+	archiveDetailsList, elementList, err := backend.retrieve(objectType, identifierList, objectInstanceIdentifierList)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The objects stored after the time didn't exist yet
+	domain := utils.AdaptDomainToString(identifierList)
+	var storedAfter = make(map[mal.Long]bool)
+	for _, archiveDetails := range archiveDetailsList {
+		if backend.objects[memoryKey{objectType, domain, archiveDetails.InstId}].stored.After(asOf) {
+			storedAfter[archiveDetails.InstId] = true
+		}
+	}
+	archiveDetailsList, elementList, err = excludeObjects(objectType, archiveDetailsList, elementList, objectInstanceIdentifierList, storedAfter)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// The first versions replaced after the time, by object
+	var versions = make(map[mal.Long]*ObjectVersion)
+	for _, archiveDetails := range archiveDetailsList {
+		for i, version := range backend.history[memoryKey{objectType, domain, archiveDetails.InstId}] {
+			if !version.updated.After(asOf) {
+				continue
+			}
+			versionDetails, element, err := version.object.decode()
+			if err != nil {
+				return nil, nil, err
+			}
+			versions[archiveDetails.InstId] = &ObjectVersion{i + 1, version.updated, versionDetails, element}
+			break
+		}
+	}
+	return replaceVersions(objectType, archiveDetailsList, elementList, versions)
+}
+
+//======================================================================//
+//                            SOFT DELETE                               //
+//======================================================================//
+
+// SetSoftDelete enables or disables the soft delete mode
+func (backend *MemoryBackend) SetSoftDelete(enabled bool) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+
+	backend.softDelete = enabled
+}
+
+// RestoreInArchive restores a set of tombstones (0 means all the
+// tombstones of the type in the domain)
+func (backend *MemoryBackend) RestoreInArchive(objectType com.ObjectType, identifierList mal.IdentifierList, longListRequest mal.LongList) (mal.LongList, error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+
+	objects, err := backend.selectTombstones(objectType, identifierList, longListRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	var longList mal.LongList
+	for _, object := range objects {
+		delete(backend.deleted, object.key)
+		object.deleted = time.Time{}
+		backend.objects[object.key] = object
+		longList.AppendElement(mal.NewLong(int64(object.key.instID)))
+	}
+	return longList, nil
+}
+
+// SelectDeleted returns the tombstones deleted before a time, the oldest
+// deletions first
+func (backend *MemoryBackend) SelectDeleted(deletedBefore time.Time, offset int, limit int) ([]*ExpiredObjects, error) {
+	backend.mutex.RLock()
+	defer backend.mutex.RUnlock()
+
+	var objects []*memoryObject
+	for _, object := range backend.deleted {
+		if object.deleted.Before(deletedBefore) {
+			objects = append(objects, object)
+		}
+	}
+	sort.Slice(objects, func(i, j int) bool {
+		if !objects[i].deleted.Equal(objects[j].deleted) {
+			return objects[i].deleted.Before(objects[j].deleted)
+		}
+		return objects[i].id < objects[j].id
+	})
+
+	var expired = newExpiredGroups()
+	for _, object := range skipObjects(objects, offset) {
+		if expired.isFull(limit) {
+			break
+		}
+		expired.add(object.key.objectType, object.key.domain, object.key.instID)
+	}
+	return expired.groups, nil
+}
+
+// PurgeDeleted permanently deletes a set of tombstones with their history
+func (backend *MemoryBackend) PurgeDeleted(objectType com.ObjectType, identifierList mal.IdentifierList, longListRequest mal.LongList) (mal.LongList, error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+
+	objects, err := backend.selectTombstones(objectType, identifierList, longListRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	var longList mal.LongList
+	for _, object := range objects {
+		delete(backend.deleted, object.key)
+		delete(backend.history, object.key)
+		longList.AppendElement(mal.NewLong(int64(object.key.instID)))
+	}
+	return longList, nil
+}
+
+// selectTombstones returns a set of tombstones (0 means all the tombstones
+// of the type in the domain), the mutex must be locked
+func (backend *MemoryBackend) selectTombstones(objectType com.ObjectType, identifierList mal.IdentifierList, longListRequest mal.LongList) ([]*memoryObject, error) {
+	domain := utils.AdaptDomainToString(identifierList)
+
+	var isAll = false
+	for i := 0; i < longListRequest.Size(); i++ {
+		if *longListRequest[i] == 0 {
+			isAll = true
+			break
+		}
+	}
+
+	var objects []*memoryObject
+	if isAll {
+		for key, object := range backend.deleted {
+			if key.objectType == objectType && key.domain == domain {
+				objects = append(objects, object)
+			}
+		}
+		if len(objects) == 0 {
+			return nil, errors.New(string(mal.ERROR_UNKNOWN_MESSAGE))
+		}
+		sortByID(objects)
+	} else {
+		for i := 0; i < longListRequest.Size(); i++ {
+			object, ok := backend.deleted[memoryKey{objectType, domain, *longListRequest[i]}]
+			if !ok {
+				return nil, errors.New(string(mal.ERROR_UNKNOWN_MESSAGE))
+			}
+			objects = append(objects, object)
+		}
+	}
+	return objects, nil
+}
+
+//======================================================================//
+//                             RETENTION                                //
+//======================================================================//
+
+// SelectExpired returns the objects exceeding the limits of a retention
+// rule, oldest first
+func (backend *MemoryBackend) SelectExpired(rule RetentionRule, now time.Time, offset int, limit int) ([]*ExpiredObjects, error) {
+	backend.mutex.RLock()
+	defer backend.mutex.RUnlock()
+
+	// The objects of the rule, by object type and domain
+	var groups = make(map[queryGroupKey][]*memoryObject)
+	for _, object := range backend.objects {
+		var objectType = rule.ObjectType
+		if (objectType.Area != 0 && objectType.Area != object.key.objectType.Area) ||
+			(objectType.Service != 0 && objectType.Service != object.key.objectType.Service) ||
+			(objectType.Version != 0 && objectType.Version != object.key.objectType.Version) ||
+			(objectType.Number != 0 && objectType.Number != object.key.objectType.Number) {
+			continue
+		}
+		if len(rule.Domain) != 0 && !utils.MatchDomain(utils.AdaptDomainToIdentifierList(string(object.key.domain)), rule.Domain) {
+			continue
+		}
+		var key = queryGroupKey{object.key.objectType, object.key.domain}
+		groups[key] = append(groups[key], object)
+	}
+
+	// The objects older than the maximum age, then the oldest objects
+	// beyond the maximum count of each group
+	var cutoff = rule.cutoff(now)
+	var objects []*memoryObject
+	for _, group := range groups {
+		sortByTimestamp(group)
+		var kept = len(group)
+		for _, object := range group {
+			if object.timestamp.Before(cutoff) {
+				objects = append(objects, object)
+				kept--
+			}
+		}
+		if rule.MaxCount > 0 && kept > rule.MaxCount {
+			objects = append(objects, group[len(group)-kept:len(group)-rule.MaxCount]...)
+		}
+	}
+	sortByTimestamp(objects)
+
+	var expired = newExpiredGroups()
+	for _, object := range skipObjects(objects, offset) {
+		if expired.isFull(limit) {
+			break
+		}
+		expired.add(object.key.objectType, object.key.domain, object.key.instID)
+	}
+	return expired.groups, nil
+}
+
+// skipObjects returns the objects following the first offset ones
+func skipObjects(objects []*memoryObject, offset int) []*memoryObject {
+	if offset <= 0 {
+		return objects
+	}
+	if offset >= len(objects) {
+		return nil
+	}
+	return objects[offset:]
+}
+
+// DeleteExpired deletes for good the objects selected by SelectExpired
+func (backend *MemoryBackend) DeleteExpired(objectType com.ObjectType, identifierList mal.IdentifierList, objectInstanceIdentifierList mal.LongList) (mal.LongList, error) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+
+	domain := utils.AdaptDomainToString(identifierList)
+	var longList = mal.NewLongList(0)
+	for _, instID := range objectInstanceIdentifierList {
+		key := memoryKey{objectType, domain, *instID}
+		if _, ok := backend.objects[key]; !ok {
+			continue
+		}
+		delete(backend.objects, key)
+		delete(backend.history, key)
+		longList.AppendElement(mal.NewLong(int64(*instID)))
+	}
+	return *longList, nil
+}
+
+// sortByTimestamp sorts the objects by timestamp, then in their insertion
+// order
+func sortByTimestamp(objects []*memoryObject) {
+	sort.Slice(objects, func(i, j int) bool {
+		if !objects[i].timestamp.Equal(objects[j].timestamp) {
+			return objects[i].timestamp.Before(objects[j].timestamp)
+		}
+		return objects[i].id < objects[j].id
+	})
+}
+
+//======================================================================//
+//                           LOCAL FUNCTIONS                            //
+//======================================================================//
+
+// isKeyUsed returns true if an object of the archive, a tombstone or an
+// object being stored already has the key
+func (backend *MemoryBackend) isKeyUsed(key memoryKey, newKeys map[memoryKey]bool) bool {
+	_, ok := backend.objects[key]
+	_, isDeleted := backend.deleted[key]
+	return ok || isDeleted || newKeys[key]
+}
+
+// newMemoryObject creates the object to store in the archive
+func newMemoryObject(key memoryKey, element mal.Element, archiveDetails archive.ArchiveDetails) (*memoryObject, error) {
+	// The timestamps are restricted like in the SQL backend
+	err := CheckTimestamp(time.Time(*archiveDetails.Timestamp))
+	if err != nil {
+		return nil, err
+	}
+
+	// Encode the Element and the ObjectId from the ArchiveDetails
+	encodedElement, encodedObjectID, err := utils.EncodeElements(element, archiveDetails.Details.Source)
+	if err != nil {
+		return nil, err
+	}
+
+	var related *mal.Long
+	if !archiveDetails.Details.Related.IsNull() {
+		related = mal.NewLong(int64(*archiveDetails.Details.Related))
+	}
+
+	var source *com.ObjectId
+	if archiveDetails.Details.Source != nil {
+		source, err = utils.DecodeObjectID(encodedObjectID)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return &memoryObject{
+		key:             key,
+		encodedElement:  encodedElement,
+		timestamp:       time.Time(*archiveDetails.Timestamp).UTC(),
+		related:         related,
+		network:         *archiveDetails.Network,
+		provider:        *archiveDetails.Provider,
+		encodedObjectID: encodedObjectID,
+		source:          source,
+	}, nil
+}
+
+// decode creates the ArchiveDetails and the Element of an archived object
+func (object *memoryObject) decode() (*archive.ArchiveDetails, mal.Element, error) {
+	// Decode the Element and the ObjectId for the ArchiveDetails
+	objectID, element, err := utils.DecodeElements(object.encodedObjectID, object.encodedElement)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var related = mal.NullLong
+	if object.related != nil {
+		related = mal.NewLong(int64(*object.related))
+	}
+	var network = object.network
+	var provider = object.provider
+
+	archiveDetails := &archive.ArchiveDetails{
+		object.key.instID,
+		com.ObjectDetails{related, objectID},
+		&network,
+		mal.NewFineTime(object.timestamp),
+		&provider,
+	}
+	return archiveDetails, element, nil
+}
+
+// field returns the value of a column of the archived object, nil is
+// returned for a NULL value
+func (object *memoryObject) field(fieldName string) (interface{}, error) {
+	switch strings.Trim(fieldName, "`") {
+	case "id":
+		return object.id, nil
+	case "objectInstanceIdentifier":
+		return int64(object.key.instID), nil
+	case "element":
+		return object.encodedElement, nil
+	case "area":
+		return int64(object.key.objectType.Area), nil
+	case "service":
+		return int64(object.key.objectType.Service), nil
+	case "version":
+		return int64(object.key.objectType.Version), nil
+	case "number":
+		return int64(object.key.objectType.Number), nil
+	case "domain":
+		return string(object.key.domain), nil
+	case "timestamp":
+		return object.timestamp, nil
+	case "details.related":
+		if object.related == nil {
+			return nil, nil
+		}
+		return int64(*object.related), nil
+	case "network":
+		return string(object.network), nil
+	case "provider":
+		return string(object.provider), nil
+	case "details.source":
+		return object.encodedObjectID, nil
+	case "details.source.area", "details.source.service", "details.source.version",
+		"details.source.number", "details.source.domain", "details.source.instId":
+		return object.sourceField(strings.Trim(fieldName, "`"))
+	default:
+		return nil, errors.New(string(ARCHIVE_SERVICE_QUERY_QUERY_FILTER_ERROR) + ": unknown field " + fieldName)
+	}
+}
+
+// selectObjects returns the objects matching a query, sorted as requested
+func (backend *MemoryBackend) selectObjects(objectType com.ObjectType, archiveQuery archive.ArchiveQuery, queryFilter archive.QueryFilter) ([]*memoryObject, error) {
+	var filters []*archive.CompositeFilter
+	columnFilters, bodyFilters := splitFilters(queryFilter)
+	if columnFilters != nil {
+		filters = columnFilters.(*archive.CompositeFilterSet).Filters
+	}
+
+	var objects []*memoryObject
+	for _, object := range backend.objects {
+		// Conditions on the object type attributes (0 is a wildcard)
+		if (objectType.Area != 0 && objectType.Area != object.key.objectType.Area) ||
+			(objectType.Service != 0 && objectType.Service != object.key.objectType.Service) ||
+			(objectType.Version != 0 && objectType.Version != object.key.objectType.Version) ||
+			(objectType.Number != 0 && objectType.Number != object.key.objectType.Number) {
+			continue
+		}
+		// Archive query conditions
+		if archiveQuery.Domain != nil && !utils.MatchDomain(utils.AdaptDomainToIdentifierList(string(object.key.domain)), *archiveQuery.Domain) {
+			continue
+		}
+		if archiveQuery.Network != nil && *archiveQuery.Network != object.network {
+			continue
+		}
+		if archiveQuery.Provider != nil && *archiveQuery.Provider != object.provider {
+			continue
+		}
+		// Related: 0 is a catch all value
+		if archiveQuery.Related != 0 && (object.related == nil || *object.related != archiveQuery.Related) {
+			continue
+		}
+		// Source: the wildcards of the source are handled by MatchObjectID
+		if archiveQuery.Source != nil && !utils.MatchObjectID(object.source, archiveQuery.Source) {
+			continue
+		}
+		if archiveQuery.StartTime != nil && object.timestamp.Before(time.Time(*archiveQuery.StartTime)) {
+			continue
+		}
+		if archiveQuery.EndTime != nil && object.timestamp.After(time.Time(*archiveQuery.EndTime)) {
+			continue
+		}
+
+		// Query filter conditions
+		var isMatching = true
+		for _, filter := range filters {
+			match, err := object.matchFilter(filter)
+			if err != nil {
+				return nil, err
+			}
+			if !match {
+				isMatching = false
+				break
+			}
+		}
+		if isMatching && len(bodyFilters) != 0 {
+			// The filters on the body are evaluated on the decoded element
+			element, err := utils.DecodeElement(object.encodedElement)
+			if err != nil {
+				return nil, err
+			}
+			isMatching, err = matchBodyFilters(element, bodyFilters)
+			if err != nil {
+				return nil, err
+			}
+		}
+		if isMatching {
+			objects = append(objects, object)
+		}
+	}
+
+	// Keep the insertion order, then apply the requested sort order
+	sortByID(objects)
+	if archiveQuery.SortOrder != nil {
+		return sortMemoryObjects(objects, archiveQuery)
+	}
+
+	return objects, nil
+}
+
+// sortMemoryObjects sorts objects by the sort fields of a query, the bodies
+// are only decoded if a sort field is a field of the body
+func sortMemoryObjects(objects []*memoryObject, archiveQuery archive.ArchiveQuery) ([]*memoryObject, error) {
+	var fields = sortFields(archiveQuery)
+	var sorted = make([]sortedObject, len(objects))
+	for i, object := range objects {
+		var element mal.Element
+		if isAnyBodyField(fields) {
+			var err error
+			element, err = utils.DecodeElement(object.encodedElement)
+			if err != nil {
+				return nil, err
+			}
+		}
+		values, err := sortValues(fields, object.field, element)
+		if err != nil {
+			return nil, err
+		}
+		sorted[i] = sortedObject{object, values}
+	}
+
+	err := sortObjects(sorted, bool(*archiveQuery.SortOrder))
+	if err != nil {
+		return nil, err
+	}
+	for i := range sorted {
+		objects[i] = sorted[i].object.(*memoryObject)
+	}
+	return objects, nil
+}
+
+// sourceField returns the value of a column holding an attribute of
+// the source of the object, nil if the object has no source
+func (object *memoryObject) sourceField(column string) (interface{}, error) {
+	if object.source == nil {
+		return nil, nil
+	}
+	switch column {
+	case "details.source.area":
+		return int64(object.source.Type.Area), nil
+	case "details.source.service":
+		return int64(object.source.Type.Service), nil
+	case "details.source.version":
+		return int64(object.source.Type.Version), nil
+	case "details.source.number":
+		return int64(object.source.Type.Number), nil
+	case "details.source.domain":
+		return string(utils.AdaptDomainToString(object.source.Key.Domain)), nil
+	default:
+		return int64(object.source.Key.InstId), nil
+	}
+}
+
+// matchFilter evaluates a filter of a CompositeFilterSet on a column of
+// an object
+func (object *memoryObject) matchFilter(filter *archive.CompositeFilter) (bool, error) {
+	column, ok := FieldColumn(string(filter.FieldName))
+	if !ok {
+		return false, errors.New(string(ARCHIVE_SERVICE_QUERY_QUERY_FILTER_ERROR) + ": unknown field " + string(filter.FieldName))
+	}
+	value, err := object.field(column)
+	if err != nil {
+		return false, err
+	}
+	return matchValue(value, filter)
+}
+
+// sortByID sorts the objects in their insertion order
+func sortByID(objects []*memoryObject) {
+	sort.Slice(objects, func(i, j int) bool {
+		return objects[i].id < objects[j].id
+	})
+}
+
+// isGroupBefore returns true if the group of the first object is sorted
+// before the group of the second one, in the order of the group columns
+// of the SQL backend
+func (chunker *queryChunker) isGroupBefore(first memoryKey, second memoryKey) bool {
+	if chunker.isObjectTypeEqualToZero && first.objectType != second.objectType {
+		var a, b = first.objectType, second.objectType
+		if a.Area != b.Area {
+			return a.Area < b.Area
+		}
+		if a.Service != b.Service {
+			return a.Service < b.Service
+		}
+		if a.Version != b.Version {
+			return a.Version < b.Version
+		}
+		return a.Number < b.Number
+	}
+	return chunker.isReturnBody && first.domain < second.domain
+}
+
+// newElementList creates an empty list for the bodies of an object type
+func newElementList(objectType com.ObjectType) (mal.ElementList, error) {
+	// Transform Type Short Form to List Short Form
+	listShortForm := utils.ConvertToListShortForm(objectType)
+	// Get Element in the MAL Registry
+	element, err := mal.LookupMALElement(listShortForm)
+	if err != nil {
+		return nil, err
+	}
+	return element.(mal.ElementList).CreateElement().(mal.ElementList), nil
+}
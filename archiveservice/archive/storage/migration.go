@@ -0,0 +1,613 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package storage
+
+import (
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/CNES/ccsdsmo-malgo/com"
+	"github.com/CNES/ccsdsmo-malgo/mal"
+
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/utils"
+)
+
+// Suffix of the name of the table holding the versions of the schema
+// applied to an Archive table (e.g. ArchiveSchemaVersion)
+const SCHEMA_VERSION_SUFFIX = "SchemaVersion"
+
+// Migration is a change of the schema of the archive. The migrations are
+// applied in the order of their versions, each one in a transaction.
+type Migration struct {
+	// Version is the version of the schema once the migration is applied
+	Version int
+	// Description is recorded with the version in the database
+	Description string
+	// Statements returns the statements of the migration for a dialect
+	// and the name of the Archive table
+	Statements func(dialect Dialect, table string) []string
+	// Apply applies the changes depending on the current structure of the
+	// table (e.g. of a table created before the migrations), it's called
+	// after the statements in the same transaction. It can be nil.
+	Apply func(backend *SQLBackend, tx *sql.Tx) error
+}
+
+// migrations holds all the changes of the schema since the creation of
+// the Archive table, ordered by version. A change of the schema must be
+// appended with the next version, the released migrations must never be
+// modified as they may already be applied to a database.
+var migrations = []Migration{
+	{
+		Version:     1,
+		Description: "create the Archive table",
+		Statements: func(dialect Dialect, table string) []string {
+			// A table created before the migrations is kept, it must
+			// have the columns described in the README
+			return dialect.SchemaStatements(table)
+		},
+	},
+	{
+		Version:     2,
+		Description: "store a null related as NULL instead of 0",
+		Statements: func(dialect Dialect, table string) []string {
+			var related = dialect.QuoteIdentifier("details.related")
+			return []string{
+				"UPDATE " + dialect.QuoteIdentifier(table) + " SET " + related + " = NULL WHERE " + related + " = 0",
+			}
+		},
+	},
+	{
+		Version:     3,
+		Description: "index the objects and make their instance identifiers unique per type and domain",
+		Statements: func(dialect Dialect, table string) []string {
+			var objectKey = quoteColumns(dialect, "area", "service", "version", "number", "domain", "objectInstanceIdentifier")
+			var typeTimestamp = quoteColumns(dialect, "area", "service", "version", "number", "timestamp")
+			if _, ok := dialect.(MySQLDialect); ok {
+				// A text column can't be in a unique index, the domain
+				// becomes a case sensitive string of 255 characters. A
+				// single statement is used so that the migration can be
+				// applied again if it fails (e.g. on duplicate objects).
+				return []string{
+					"ALTER TABLE " + dialect.QuoteIdentifier(table) +
+						" MODIFY `domain` varchar(255) CHARACTER SET utf8 COLLATE utf8_bin DEFAULT NULL" +
+						", ADD UNIQUE KEY " + dialect.QuoteIdentifier(table+"ObjectKey") + " (" + objectKey + ")" +
+						", ADD KEY " + dialect.QuoteIdentifier(table+"TypeTimestamp") + " (" + typeTimestamp + ")",
+				}
+			}
+			// The names of the indexes are prefixed by the table as they
+			// are shared by all the tables of a PostgreSQL schema
+			return []string{
+				"CREATE UNIQUE INDEX " + dialect.QuoteIdentifier(table+"ObjectKey") +
+					" ON " + dialect.QuoteIdentifier(table) + " (" + objectKey + ")",
+				"CREATE INDEX " + dialect.QuoteIdentifier(table+"TypeTimestamp") +
+					" ON " + dialect.QuoteIdentifier(table) + " (" + typeTimestamp + ")",
+			}
+		},
+	},
+	{
+		Version:     4,
+		Description: "create the sequences of the object instance identifiers",
+		Statements: func(dialect Dialect, table string) []string {
+			// The domain is the same as in the Archive table
+			var domainType, options = "TEXT", ""
+			if _, ok := dialect.(MySQLDialect); ok {
+				domainType = "varchar(255) CHARACTER SET utf8 COLLATE utf8_bin"
+				options = " ENGINE=InnoDB DEFAULT CHARSET=utf8"
+			}
+			return []string{
+				"CREATE TABLE IF NOT EXISTS " + dialect.QuoteIdentifier(table+INSTID_SEQUENCE_SUFFIX) + " (" +
+					dialect.QuoteIdentifier("area") + " INTEGER NOT NULL, " +
+					dialect.QuoteIdentifier("service") + " INTEGER NOT NULL, " +
+					dialect.QuoteIdentifier("version") + " INTEGER NOT NULL, " +
+					dialect.QuoteIdentifier("number") + " INTEGER NOT NULL, " +
+					dialect.QuoteIdentifier("domain") + " " + domainType + " NOT NULL, " +
+					dialect.QuoteIdentifier("lastInstID") + " BIGINT NOT NULL, " +
+					"PRIMARY KEY (" + quoteColumns(dialect, sequenceKeyColumns...) + "))" + options,
+			}
+		},
+	},
+	{
+		Version:     5,
+		Description: "create the history of the updated objects",
+		Statements:  historyStatements,
+	},
+	{
+		Version:     6,
+		Description: "keep the deleted objects as tombstones in soft delete mode",
+		Statements:  tombstoneStatements,
+	},
+	{
+		Version:     7,
+		Description: "store the timestamps of a table created with dates as nanoseconds",
+		Apply:       convertTimestamps,
+	},
+	{
+		Version:     8,
+		Description: "add the source columns to a table created without them",
+		Apply:       addSourceColumns,
+	},
+	{
+		Version:     9,
+		Description: "record the time at which the objects are stored",
+		Statements:  storedStatements,
+	},
+	{
+		Version:     10,
+		Description: "escape the identifiers of the domains stored before their escaping",
+		Apply:       escapeDomains,
+	},
+}
+
+// convertTimestamps converts the timestamp column of a table created with
+// a date (e.g. the DATETIME of the former archive.sql) to the number of
+// nanoseconds since the epoch, the dates are read as UTC dates
+func convertTimestamps(backend *SQLBackend, tx *sql.Tx) error {
+	columnType, err := backend.dialect.ColumnType(tx, backend.tableName, "timestamp")
+	if err != nil {
+		return err
+	}
+	if columnType == "bigint" {
+		// The table has been created by the first migration
+		return nil
+	}
+
+	var timestamp = backend.quote("timestamp")
+	switch backend.dialect.(type) {
+	case MySQLDialect:
+		// Each change of the structure commits the transaction, the new
+		// column is kept if the migration is applied again
+		var timestampNs = backend.quote("timestampNs")
+		nsType, err := backend.dialect.ColumnType(tx, backend.tableName, "timestampNs")
+		if err != nil {
+			return err
+		}
+		if nsType == "" {
+			_, err = tx.Exec("ALTER TABLE " + backend.table + " ADD COLUMN " + timestampNs + " bigint(20) DEFAULT NULL AFTER " + timestamp)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = tx.Exec("UPDATE " + backend.table + " SET " + timestampNs + " = TIMESTAMPDIFF(MICROSECOND, '1970-01-01 00:00:00', " + timestamp + ") * 1000")
+		if err != nil {
+			return err
+		}
+		// The index of the third migration loses the dropped column, it's
+		// created again with the new one
+		var typeTimestamp = backend.quote(backend.tableName + "TypeTimestamp")
+		_, err = tx.Exec("ALTER TABLE " + backend.table +
+			" DROP KEY " + typeTimestamp +
+			", DROP COLUMN " + timestamp +
+			", CHANGE " + timestampNs + " " + timestamp + " bigint(20) DEFAULT NULL" +
+			", ADD KEY " + typeTimestamp + " (" + backend.columns("area", "service", "version", "number", "timestamp") + ")")
+		return err
+	case PostgresDialect:
+		// The seconds and the microseconds are converted separately, the
+		// epoch is a double which can't hold the nanoseconds
+		_, err = tx.Exec("ALTER TABLE " + backend.table + " ALTER COLUMN " + timestamp + " TYPE BIGINT USING " +
+			"EXTRACT(EPOCH FROM date_trunc('second', " + timestamp + "))::BIGINT * 1000000000 + " +
+			"(EXTRACT(MICROSECONDS FROM " + timestamp + ")::BIGINT % 1000000) * 1000")
+		return err
+	default:
+		return convertDates(backend, tx)
+	}
+}
+
+// convertDates converts the dates of the timestamp column of a SQLite
+// table to nanoseconds. The declared type of a column can't be changed but
+// only gives the affinity of its values, and the dates were written by the
+// driver with time.Time.String, which the date functions of SQLite can't
+// read: the dates are read and converted by the driver.
+func convertDates(backend *SQLBackend, tx *sql.Tx) error {
+	var timestamp = backend.quote("timestamp")
+	rows, err := tx.Query("SELECT " + backend.columns("id", "timestamp") + " FROM " + backend.table +
+		" WHERE typeof(" + timestamp + ") = 'text'")
+	if err != nil {
+		return err
+	}
+	var ids []int64
+	var timestamps []time.Time
+	for rows.Next() {
+		var id int64
+		var date interface{}
+		if err = rows.Scan(&id, &date); err != nil {
+			rows.Close()
+			return err
+		}
+		value, ok := date.(time.Time)
+		if !ok {
+			rows.Close()
+			return errors.New("the timestamp of the row " + strconv.FormatInt(id, 10) + " is not a date")
+		}
+		ids = append(ids, id)
+		timestamps = append(timestamps, value)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	for i, id := range ids {
+		_, err = tx.Exec(backend.rebind("UPDATE "+backend.table+" SET "+timestamp+" = ? WHERE "+backend.quote("id")+" = ?"),
+			encodeTimestamp(timestamps[i]), id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// sourceColumnTypes returns the types of the source columns for a
+// dialect, in the order of sourceColumns (see SchemaStatements)
+func sourceColumnTypes(dialect Dialect) []string {
+	switch dialect.(type) {
+	case MySQLDialect:
+		return []string{"smallint(6) DEFAULT NULL", "smallint(6) DEFAULT NULL", "tinyint(4) DEFAULT NULL",
+			"smallint(6) DEFAULT NULL", "text", "bigint(20) DEFAULT NULL"}
+	case PostgresDialect:
+		return []string{"INTEGER", "INTEGER", "SMALLINT", "INTEGER", "TEXT", "BIGINT"}
+	default:
+		return []string{"SMALLINT", "SMALLINT", "TINYINT", "SMALLINT", "TEXT", "BIGINT"}
+	}
+}
+
+// addSourceColumns adds the source columns missing from the table, and
+// fills them from the encoded source of the objects already stored
+func addSourceColumns(backend *SQLBackend, tx *sql.Tx) error {
+	// With MySQL each column added commits the transaction, the columns
+	// already added are kept if the migration is applied again
+	var columnTypes = sourceColumnTypes(backend.dialect)
+	for i, column := range sourceColumns {
+		columnType, err := backend.dialect.ColumnType(tx, backend.tableName, column)
+		if err != nil {
+			return err
+		}
+		if columnType != "" {
+			continue
+		}
+		_, err = tx.Exec("ALTER TABLE " + backend.table + " ADD COLUMN " + backend.quote(column) + " " + columnTypes[i])
+		if err != nil {
+			return err
+		}
+	}
+
+	// The rows are read before they are updated on the same connection
+	rows, err := tx.Query("SELECT " + backend.columns("id", "details.source") + " FROM " + backend.table +
+		" WHERE " + backend.quote("details.source") + " IS NOT NULL AND " + backend.quote("details.source.instId") + " IS NULL")
+	if err != nil {
+		return err
+	}
+	var ids []int64
+	var sources []*com.ObjectId
+	for rows.Next() {
+		var id int64
+		var encodedSource []byte
+		if err = rows.Scan(&id, &encodedSource); err != nil {
+			rows.Close()
+			return err
+		}
+		source, err := utils.DecodeObjectID(encodedSource)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		if source != nil {
+			ids = append(ids, id)
+			sources = append(sources, source)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	var update = backend.rebind("UPDATE " + backend.table + " SET " +
+		strings.Join(backend.quoteAll(sourceColumns), " = ?, ") + " = ? WHERE " + backend.quote("id") + " = ?")
+	for i, id := range ids {
+		var values = newSourceValues(sources[i])
+		_, err = tx.Exec(update, values.area, values.service, values.version, values.number, values.domain, values.instID, id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// escapeDomains escapes the '%' of the identifiers of the domains stored
+// before the identifiers were escaped (see utils.AdaptDomainToString), and
+// writes again the source domains from the encoded sources. The dots of
+// such a domain can't be told apart, they all separate identifiers.
+func escapeDomains(backend *SQLBackend, tx *sql.Tx) error {
+	// The rows are read before they are updated on the same connection
+	var domain, sourceDomain = backend.quote("domain"), backend.quote("details.source.domain")
+	rows, err := tx.Query("SELECT " + backend.columns("id", "domain", "details.source", "details.source.domain") + " FROM " + backend.table +
+		" WHERE " + domain + " LIKE '%" + LIKE_ESCAPE + "%%' ESCAPE '" + LIKE_ESCAPE + "' OR " + sourceDomain + " IS NOT NULL")
+	if err != nil {
+		return err
+	}
+	var ids []int64
+	var domains, sourceDomains []sql.NullString
+	for rows.Next() {
+		var id int64
+		var rowDomain, rowSourceDomain sql.NullString
+		var encodedSource []byte
+		if err = rows.Scan(&id, &rowDomain, &encodedSource, &rowSourceDomain); err != nil {
+			rows.Close()
+			return err
+		}
+		var newDomain, newSourceDomain = rowDomain, rowSourceDomain
+		if rowDomain.Valid {
+			newDomain.String = escapeStoredDomain(rowDomain.String)
+		}
+		if encodedSource != nil {
+			source, err := utils.DecodeObjectID(encodedSource)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			if source != nil {
+				newSourceDomain.String = string(utils.AdaptDomainToString(source.Key.Domain))
+			}
+		}
+		if newDomain != rowDomain || newSourceDomain != rowSourceDomain {
+			ids = append(ids, id)
+			domains = append(domains, newDomain)
+			sourceDomains = append(sourceDomains, newSourceDomain)
+		}
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+
+	var update = backend.rebind("UPDATE " + backend.table + " SET " + domain + " = ?, " + sourceDomain + " = ? WHERE " + backend.quote("id") + " = ?")
+	for i, id := range ids {
+		_, err = tx.Exec(update, domains[i], sourceDomains[i], id)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// escapeStoredDomain escapes the '%' of the identifiers of a domain stored
+// before their escaping. A domain whose '%' are all followed by 25 or 2E
+// is already escaped and is returned unchanged.
+func escapeStoredDomain(domain string) string {
+	var isEscaped = true
+	for i := 0; i < len(domain); i++ {
+		if domain[i] == '%' && !strings.HasPrefix(domain[i:], "%25") && !strings.HasPrefix(domain[i:], "%2E") {
+			isEscaped = false
+			break
+		}
+	}
+	if isEscaped {
+		return domain
+	}
+	var identifiers = strings.Split(domain, ".")
+	for i, identifier := range identifiers {
+		identifiers[i] = utils.EscapeDomainIdentifier(mal.Identifier(identifier))
+	}
+	return strings.Join(identifiers, ".")
+}
+
+// Migrations returns the migrations of the schema ordered by version, the
+// version of the last one is the version expected by the SQLBackend
+func Migrations() []Migration {
+	return migrations
+}
+
+// SchemaVersion returns the version of the schema of the database, 0 if
+// no migration has been applied yet. The table of the versions is created
+// if it doesn't exist yet.
+func (backend *SQLBackend) SchemaVersion() (int, error) {
+	db, err := backend.open()
+	if err != nil {
+		return 0, err
+	}
+	err = backend.createVersionTable(db)
+	if err != nil {
+		return 0, err
+	}
+	return backend.schemaVersion(db)
+}
+
+// Migrate applies the migrations which haven't been applied to the
+// database yet, the tables are created from nothing on an empty database.
+// MySQL commits the transaction of a migration changing the structure of
+// a table, such a migration must then be written so that it can be applied
+// again if it fails.
+func (backend *SQLBackend) Migrate() error {
+	// The statements can't be prepared before the table exists, so the
+	// transactions are directly created from the pool of connections
+	db, err := backend.open()
+	if err != nil {
+		return err
+	}
+	err = backend.createVersionTable(db)
+	if err != nil {
+		return err
+	}
+	version, err := backend.schemaVersion(db)
+	if err != nil {
+		return err
+	}
+
+	var isSchemaChanged = false
+	for _, migration := range migrations {
+		if migration.Version <= version {
+			continue
+		}
+		err = backend.applyMigration(db, migration)
+		if err != nil {
+			return err
+		}
+		isSchemaChanged = true
+	}
+
+	if isSchemaChanged {
+		// The statements are prepared again with the new schema
+		backend.mutex.Lock()
+		defer backend.mutex.Unlock()
+		for _, statement := range backend.statements {
+			statement.Close()
+		}
+		backend.statements = nil
+	}
+	return nil
+}
+
+// MigrateIfEmpty applies the migrations which haven't been applied to the
+// database yet if the Archive table doesn't exist or holds no object, the
+// tables are then created from nothing on an empty database. The migrations
+// of a table holding objects change its structure and may lock it for a
+// long time, they are only applied by Migrate: an error is returned if such
+// a table isn't at the last version of the schema.
+func (backend *SQLBackend) MigrateIfEmpty() error {
+	db, err := backend.open()
+	if err != nil {
+		return err
+	}
+	err = backend.createVersionTable(db)
+	if err != nil {
+		return err
+	}
+	version, err := backend.schemaVersion(db)
+	if err != nil {
+		return err
+	}
+	var lastVersion = migrations[len(migrations)-1].Version
+	if version >= lastVersion {
+		return nil
+	}
+
+	isEmpty, err := backend.isTableEmpty(db)
+	if err != nil {
+		return err
+	}
+	if !isEmpty {
+		return errors.New("the table " + backend.tableName + " holds objects and its schema is at the version " +
+			strconv.Itoa(version) + " instead of " + strconv.Itoa(lastVersion) + ", its migrations must be applied explicitly")
+	}
+	return backend.Migrate()
+}
+
+// isTableEmpty tells if the Archive table doesn't exist or holds no object
+func (backend *SQLBackend) isTableEmpty(db *sql.DB) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	// Rollback the transaction, it only reads the table
+	defer tx.Rollback()
+
+	columnType, err := backend.dialect.ColumnType(tx, backend.tableName, "id")
+	if err != nil {
+		return false, err
+	}
+	if columnType == "" {
+		return true, nil
+	}
+	var id int64
+	err = tx.QueryRow("SELECT " + backend.quote("id") + " FROM " + backend.table + " LIMIT 1").Scan(&id)
+	if err == sql.ErrNoRows {
+		return true, nil
+	}
+	return false, err
+}
+
+// applyMigration applies a migration and records its version
+func (backend *SQLBackend) applyMigration(db *sql.DB, migration Migration) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	// Rollback the transaction if it has not been committed
+	defer tx.Rollback()
+
+	if migration.Statements != nil {
+		for _, statement := range migration.Statements(backend.dialect, backend.tableName) {
+			_, err = tx.Exec(statement)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	if migration.Apply != nil {
+		err = migration.Apply(backend, tx)
+		if err != nil {
+			return err
+		}
+	}
+
+	// Two providers migrating the same database at the same time can't
+	// both record the version, one of them fails
+	_, err = tx.Exec(backend.rebind("INSERT INTO "+backend.versionTable()+" ("+
+		backend.columns("version", "description", "applied")+") VALUES ( ? , ? , ? )"),
+		migration.Version, migration.Description, encodeTimestamp(time.Now()))
+	if err != nil {
+		return err
+	}
+
+	// Commit changes
+	return tx.Commit()
+}
+
+// createVersionTable creates the table of the versions of the schema if it
+// doesn't exist yet, its statement is understood by all the dialects
+func (backend *SQLBackend) createVersionTable(db *sql.DB) error {
+	_, err := db.Exec("CREATE TABLE IF NOT EXISTS " + backend.versionTable() + " (" +
+		backend.quote("version") + " INTEGER NOT NULL PRIMARY KEY, " +
+		backend.quote("description") + " VARCHAR(255) NOT NULL, " +
+		backend.quote("applied") + " BIGINT NOT NULL)")
+	return err
+}
+
+// schemaVersion returns the last version recorded in the table of the versions
+func (backend *SQLBackend) schemaVersion(db *sql.DB) (int, error) {
+	var version sql.NullInt64
+	err := db.QueryRow("SELECT MAX(" + backend.quote("version") + ") FROM " + backend.versionTable()).Scan(&version)
+	if err != nil {
+		return 0, err
+	}
+	return int(version.Int64), nil
+}
+
+// quoteColumns quotes a list of columns for a dialect and separates them
+// with commas
+func quoteColumns(dialect Dialect, columns ...string) string {
+	var quoted = make([]string, len(columns))
+	for i, column := range columns {
+		quoted[i] = dialect.QuoteIdentifier(column)
+	}
+	return strings.Join(quoted, ", ")
+}
+
+// versionTable returns the quoted name of the table of the versions
+func (backend *SQLBackend) versionTable() string {
+	return backend.dialect.QuoteIdentifier(backend.tableName + SCHEMA_VERSION_SUFFIX)
+}
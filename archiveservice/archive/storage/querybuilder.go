@@ -0,0 +1,311 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/CNES/ccsdsmo-malgo/com/archive"
+	"github.com/CNES/ccsdsmo-malgo/mal"
+
+	. "github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/constants"
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/utils"
+)
+
+// queryBuilder writes a SQL query whose values are all given as
+// parameters, so that the values sent by a consumer are never
+// interpreted as SQL. The names of the columns are checked against
+// the columns of the Archive table.
+type queryBuilder struct {
+	dialect Dialect
+	buffer  bytes.Buffer
+	// args holds the values of the placeholders of the query
+	args []interface{}
+	// isThereAlreadyACondition is true when a condition has already
+	// been written after WHERE
+	isThereAlreadyACondition bool
+}
+
+// newQueryBuilder creates an empty query for a dialect
+func newQueryBuilder(dialect Dialect) *queryBuilder {
+	return &queryBuilder{dialect: dialect}
+}
+
+// WriteString writes a part of the query which doesn't hold any value
+func (builder *queryBuilder) WriteString(s string) {
+	builder.buffer.WriteString(s)
+}
+
+// Where writes the WHERE keyword, the conditions must be added afterwards
+func (builder *queryBuilder) Where() {
+	builder.buffer.WriteString(" WHERE")
+	builder.isThereAlreadyACondition = false
+}
+
+// Column writes the quoted name of a column, the name may be written with
+// the MySQL quotes (e.g. `details.related`) and must be a column of the
+// Archive table
+func (builder *queryBuilder) Column(fieldName string) error {
+	column, ok := databaseField(fieldName)
+	if !ok {
+		return errors.New(string(ARCHIVE_SERVICE_QUERY_QUERY_FILTER_ERROR) + ": unknown field " + fieldName)
+	}
+	builder.buffer.WriteString(builder.dialect.QuoteIdentifier(column))
+	return nil
+}
+
+// Condition adds the condition "column operator value" to the conditions
+// of the query, the value is given as a parameter
+func (builder *queryBuilder) Condition(fieldName string, operator string, value interface{}) error {
+	builder.and()
+	err := builder.Column(fieldName)
+	if err != nil {
+		return err
+	}
+	builder.buffer.WriteString(" " + operator + " ")
+	builder.Arg(value)
+	return nil
+}
+
+// NotDeletedCondition adds the condition hiding the tombstones of the
+// deleted objects to the conditions of the query
+func (builder *queryBuilder) NotDeletedCondition() {
+	builder.and()
+	builder.buffer.WriteString(builder.dialect.QuoteIdentifier(DELETED_COLUMN) + " IS NULL")
+}
+
+// NullCondition adds the condition "column operator NULL" to the
+// conditions of the query
+func (builder *queryBuilder) NullCondition(fieldName string, operator string) error {
+	builder.and()
+	err := builder.Column(fieldName)
+	if err != nil {
+		return err
+	}
+	builder.buffer.WriteString(" " + operator + " NULL")
+	return nil
+}
+
+// InCondition adds the condition "column IN (values)" to the conditions
+// of the query, an empty list of values matches no row. The values are
+// integers written in the query, the callers bound their number (e.g. by
+// READ_OBJECTS_BATCH) so that the query stays within the database limits.
+func (builder *queryBuilder) InCondition(fieldName string, values []int64) error {
+	builder.and()
+	if len(values) == 0 {
+		builder.WriteString("1 = 0")
+		return nil
+	}
+	err := builder.Column(fieldName)
+	if err != nil {
+		return err
+	}
+	builder.WriteString(" IN (")
+	for i, value := range values {
+		if i > 0 {
+			builder.WriteString(", ")
+		}
+		builder.WriteString(strconv.FormatInt(value, 10))
+	}
+	builder.WriteString(")")
+	return nil
+}
+
+// FilterCondition adds the condition of a filter of a CompositeFilterSet
+// to the conditions of the query. A NULL value is compared with IS NULL
+// or IS NOT NULL, the strings are compared with their case except by
+// ICONTAINS, and the value of CONTAINS and ICONTAINS is escaped so that
+// its '%' and '_' are not wildcards of the LIKE pattern.
+func (builder *queryBuilder) FilterCondition(filter *archive.CompositeFilter) error {
+	column, ok := FieldColumn(string(filter.FieldName))
+	if !ok {
+		return errors.New(string(ARCHIVE_SERVICE_QUERY_QUERY_FILTER_ERROR) + ": unknown field " + string(filter.FieldName))
+	}
+	var expression = builder.dialect.QuoteIdentifier(column)
+
+	// Comparison with a NULL value
+	if filter.FieldValue == nil || reflect.ValueOf(filter.FieldValue).IsNil() {
+		switch filter.Type {
+		case archive.EXPRESSIONOPERATOR_EQUAL:
+			return builder.NullCondition(column, "IS")
+		case archive.EXPRESSIONOPERATOR_DIFFER:
+			return builder.NullCondition(column, "IS NOT")
+		default:
+			return errors.New(string(ARCHIVE_SERVICE_QUERY_QUERY_FILTER_ERROR) + ": must not contain NULL value")
+		}
+	}
+
+	var value = sqlValue(filter.FieldValue)
+	// String, Identifier or URI
+	var isString = reflect.ValueOf(value).Kind() == reflect.String
+	switch filter.Type {
+	case archive.EXPRESSIONOPERATOR_CONTAINS, archive.EXPRESSIONOPERATOR_ICONTAINS:
+		if !isString {
+			return errors.New(string(ARCHIVE_SERVICE_QUERY_QUERY_FILTER_ERROR) + ": must not use this expression operator for a non-String")
+		}
+		var pattern = "%" + escapeLike(reflect.ValueOf(value).String()) + "%"
+		builder.and()
+		if filter.Type == archive.EXPRESSIONOPERATOR_ICONTAINS {
+			// Both sides are converted by the database so that they
+			// follow the same rules
+			builder.WriteString("LOWER(" + expression + ") LIKE LOWER(")
+			builder.Arg(pattern)
+			builder.WriteString(")")
+		} else {
+			builder.WriteString(builder.dialect.CaseSensitive(expression) + " LIKE ")
+			builder.Arg(pattern)
+		}
+		builder.WriteString(" ESCAPE '" + LIKE_ESCAPE + "'")
+		return nil
+	}
+
+	var operator = TransformOperator(filter.Type)
+	if operator == "" {
+		return errors.New(string(ARCHIVE_SERVICE_QUERY_QUERY_FILTER_ERROR) + ": unknown expression operator")
+	}
+	if isString {
+		expression = builder.dialect.CaseSensitive(expression)
+	}
+	builder.and()
+	builder.WriteString(expression + " " + operator + " ")
+	builder.Arg(value)
+	return nil
+}
+
+// DomainCondition adds a condition matching a domain given in a query to
+// the conditions of the query, the '*' identifiers of the domain match
+// any identifier at their level and a last '*' identifier also matches
+// the deeper levels (i.e. all the sub-domains, see utils.MatchDomain)
+func (builder *queryBuilder) DomainCondition(fieldName string, domain mal.IdentifierList) error {
+	var wildcards = 0
+	var patterns = make([]string, domain.Size())
+	for i := 0; i < domain.Size(); i++ {
+		if *domain[i] == "*" {
+			wildcards++
+			patterns[i] = "%"
+		} else {
+			patterns[i] = escapeLike(utils.EscapeDomainIdentifier(*domain[i]))
+		}
+	}
+	if wildcards == 0 {
+		return builder.Condition(fieldName, "=", string(utils.AdaptDomainToString(domain)))
+	}
+
+	// The wildcards match any identifier, the dots of the identifiers are
+	// escaped. The identifiers before the first wildcard are a prefix of
+	// the pattern, so that the index of the column can be used.
+	err := builder.Condition(fieldName, "LIKE", strings.Join(patterns, "."))
+	if err != nil {
+		return err
+	}
+	builder.WriteString(" ESCAPE '" + LIKE_ESCAPE + "'")
+	var column = builder.dialect.QuoteIdentifier(strings.Trim(fieldName, "`"))
+	var levels = domain.Size()
+	if *domain[levels-1] != "*" {
+		// The domain has as many levels (i.e. dots) as in the query, so
+		// that a wildcard matches a single identifier
+		builder.and()
+		builder.WriteString("LENGTH(" + column + ") - LENGTH(REPLACE(" + column + ", '.', '')) = ")
+		builder.Arg(int64(levels - 1))
+	} else if wildcards > 1 {
+		// The last wildcard matches any number of levels, the wildcards
+		// before it are matched on the levels before the last one only
+		builder.and()
+		builder.WriteString(builder.dialect.DomainPrefix(column, levels-1) + " LIKE ")
+		builder.Arg(strings.Join(patterns[:levels-1], "."))
+		builder.WriteString(" ESCAPE '" + LIKE_ESCAPE + "'")
+	}
+	return nil
+}
+
+// Arg writes the placeholder of a value and adds the value to the
+// arguments of the query
+func (builder *queryBuilder) Arg(value interface{}) {
+	builder.args = append(builder.args, value)
+	builder.buffer.WriteString(builder.dialect.Placeholder(len(builder.args)))
+}
+
+// String returns the query
+func (builder *queryBuilder) String() string {
+	return builder.buffer.String()
+}
+
+// Args returns the values of the placeholders of the query
+func (builder *queryBuilder) Args() []interface{} {
+	return builder.args
+}
+
+// and separates a new condition from the previous one
+func (builder *queryBuilder) and() {
+	if builder.isThereAlreadyACondition {
+		builder.buffer.WriteString(" AND")
+	}
+	builder.isThereAlreadyACondition = true
+	builder.buffer.WriteString(" ")
+}
+
+// Escape character of the LIKE patterns, the backslash isn't used as
+// it's also an escape character of the MySQL strings
+const LIKE_ESCAPE = "!"
+
+// escapeLike escapes the special characters of a LIKE pattern
+func escapeLike(value string) string {
+	value = strings.Replace(value, LIKE_ESCAPE, LIKE_ESCAPE+LIKE_ESCAPE, -1)
+	value = strings.Replace(value, "%", LIKE_ESCAPE+"%", -1)
+	return strings.Replace(value, "_", LIKE_ESCAPE+"_", -1)
+}
+
+// databaseField returns the name of the column referenced by a field name,
+// the name may be written with the MySQL quotes (e.g. `details.related`)
+func databaseField(fieldName string) (string, bool) {
+	var column = strings.Trim(fieldName, "`")
+	for _, databaseField := range databaseFields {
+		if column == databaseField {
+			return column, true
+		}
+	}
+	return "", false
+}
+
+// sqlValue converts the value of a CompositeFilter to a value
+// accepted by the database drivers, the times are converted to
+// the values of the timestamp column
+func sqlValue(fieldValue interface{}) interface{} {
+	switch value := fieldValue.(type) {
+	case *mal.Time:
+		return encodeTimestamp(time.Time(*value))
+	case *mal.FineTime:
+		return encodeTimestamp(time.Time(*value))
+	case *mal.Blob:
+		return []byte(*value)
+	}
+	// The other attributes are based on the basic types of Go
+	return reflect.ValueOf(fieldValue).Elem().Interface()
+}
@@ -0,0 +1,114 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package storage
+
+import (
+	"time"
+
+	"github.com/CNES/ccsdsmo-malgo/com"
+	"github.com/CNES/ccsdsmo-malgo/mal"
+
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/utils"
+)
+
+// RetentionRule limits the time the objects of a set of object types and
+// domains are kept in the archive, the objects exceeding the limits are
+// selected by SelectExpired
+type RetentionRule struct {
+	// ObjectType selects the object types, the attributes equal to 0
+	// are wildcards
+	ObjectType com.ObjectType
+	// Domain selects the domains, the '*' identifiers are wildcards and
+	// an empty domain selects all of them
+	Domain mal.IdentifierList
+	// MaxAge is the maximum age of an object, computed from its
+	// timestamp, 0 means no limit
+	MaxAge time.Duration
+	// MaxCount is the maximum number of objects kept for each object
+	// type and domain, the newest ones are kept, 0 means no limit
+	MaxCount int
+}
+
+// cutoff returns the timestamp from which the objects are not expired by
+// the maximum age of the rule, the zero time if the rule has no maximum age
+func (rule RetentionRule) cutoff(now time.Time) time.Time {
+	if rule.MaxAge <= 0 {
+		return time.Time{}
+	}
+	return now.Add(-rule.MaxAge)
+}
+
+// ExpiredObjects are objects of an object type and domain exceeding the
+// limits of a retention rule
+type ExpiredObjects struct {
+	ObjectType com.ObjectType
+	Domain     mal.IdentifierList
+	InstIDs    mal.LongList
+}
+
+// expiredGroups gathers the expired objects by object type and domain, in
+// the order in which the groups are found
+type expiredGroups struct {
+	indexes map[queryGroupKey]int
+	groups  []*ExpiredObjects
+	count   int
+}
+
+// newExpiredGroups creates an empty set of expired objects
+func newExpiredGroups() *expiredGroups {
+	return &expiredGroups{indexes: make(map[queryGroupKey]int)}
+}
+
+// add adds an expired object to the group of its object type and domain
+func (expired *expiredGroups) add(objectType com.ObjectType, domain mal.String, instID mal.Long) {
+	var key = queryGroupKey{objectType, domain}
+	index, ok := expired.indexes[key]
+	if !ok {
+		index = len(expired.groups)
+		expired.indexes[key] = index
+		expired.groups = append(expired.groups, &ExpiredObjects{
+			ObjectType: objectType,
+			Domain:     utils.AdaptDomainToIdentifierList(string(domain)),
+			InstIDs:    *mal.NewLongList(0),
+		})
+	}
+	expired.groups[index].InstIDs.AppendElement(mal.NewLong(int64(instID)))
+	expired.count++
+}
+
+// isFull returns true if the limit of the number of objects is reached,
+// a limit lower or equal to 0 is not applied
+func (expired *expiredGroups) isFull(limit int) bool {
+	return limit > 0 && expired.count >= limit
+}
+
+// remaining returns the number of objects which can still be added below
+// the limit, 0 if there is no limit
+func (expired *expiredGroups) remaining(limit int) int {
+	if limit <= 0 {
+		return 0
+	}
+	return limit - expired.count
+}
@@ -0,0 +1,118 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package storage
+
+import (
+	"database/sql"
+
+	"github.com/CNES/ccsdsmo-malgo/com"
+	"github.com/CNES/ccsdsmo-malgo/mal"
+)
+
+// Suffix of the name of the table holding the last object instance
+// identifier allocated to each object type in each domain
+// (e.g. ArchiveInstIDSequence)
+const INSTID_SEQUENCE_SUFFIX = "InstIDSequence"
+
+// Columns identifying the sequence of an object type in a domain
+var sequenceKeyColumns = []string{"area", "service", "version", "number", "domain"}
+
+// allocateInstIDs allocates count increasing object instance identifiers to
+// objects of a type in a domain. The counter of the sequence is incremented
+// in the transaction and its row stays locked until the transaction ends,
+// so that concurrent Store operations, even from several providers sharing
+// the database, get distinct identifiers. The identifiers already used by
+// archived objects or reserved by the request are skipped.
+func (backend *SQLBackend) allocateInstIDs(tx *sql.Tx, objectType com.ObjectType, domain mal.String, count int, reserved map[int64]bool) ([]int64, error) {
+	var instIDs = make([]int64, 0, count)
+	for len(instIDs) < count {
+		var missing = int64(count - len(instIDs))
+		_, err := backend.exec(tx, backend.queries.incrementInstID,
+			objectType.Area,
+			objectType.Service,
+			objectType.Version,
+			objectType.Number,
+			domain,
+			missing)
+		if err != nil {
+			return nil, err
+		}
+		var last int64
+		err = backend.queryRow(tx, backend.queries.selectLastInstID,
+			objectType.Area,
+			objectType.Service,
+			objectType.Version,
+			objectType.Number,
+			domain).Scan(&last)
+		if err != nil {
+			return nil, err
+		}
+
+		// Objects may have been stored with an identifier of the range
+		used, err := backend.selectUsedInstIDs(tx, objectType, domain, last-missing+1, last)
+		if err != nil {
+			return nil, err
+		}
+		for instID := last - missing + 1; instID <= last; instID++ {
+			if !used[instID] && !reserved[instID] {
+				instIDs = append(instIDs, instID)
+			}
+		}
+	}
+	return instIDs, nil
+}
+
+// selectUsedInstIDs returns the object instance identifiers of a range
+// used by the archived objects of a type in a domain
+func (backend *SQLBackend) selectUsedInstIDs(tx *sql.Tx, objectType com.ObjectType, domain mal.String, first int64, last int64) (map[int64]bool, error) {
+	rows, err := backend.query(tx, backend.queries.selectUsedInstIDs,
+		objectType.Area,
+		objectType.Service,
+		objectType.Version,
+		objectType.Number,
+		domain,
+		first,
+		last)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var used = make(map[int64]bool)
+	for rows.Next() {
+		var instID int64
+		err = rows.Scan(&instID)
+		if err != nil {
+			return nil, err
+		}
+		used[instID] = true
+	}
+	return used, rows.Err()
+}
+
+// sequenceTable returns the quoted name of the table of the sequences
+func (backend *SQLBackend) sequenceTable() string {
+	return backend.dialect.QuoteIdentifier(backend.tableName + INSTID_SEQUENCE_SUFFIX)
+}
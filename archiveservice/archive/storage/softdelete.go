@@ -0,0 +1,211 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package storage
+
+import (
+	"errors"
+	"time"
+
+	"github.com/CNES/ccsdsmo-malgo/com"
+	"github.com/CNES/ccsdsmo-malgo/mal"
+
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/utils"
+)
+
+// Column of the Archive table holding the time at which an object has
+// been deleted in soft delete mode, it's NULL for the objects which are
+// not deleted
+const DELETED_COLUMN = "deleted"
+
+// tombstoneStatements returns the statements adding the deleted column to
+// the Archive table, with an index to select the oldest tombstones
+func tombstoneStatements(dialect Dialect, table string) []string {
+	var deleted = dialect.QuoteIdentifier(DELETED_COLUMN)
+	var index = dialect.QuoteIdentifier(table + "Deleted")
+	if _, ok := dialect.(MySQLDialect); ok {
+		// A single statement is used so that the migration can be
+		// applied again if it fails
+		return []string{
+			"ALTER TABLE " + dialect.QuoteIdentifier(table) +
+				" ADD COLUMN " + deleted + " bigint(20) DEFAULT NULL" +
+				", ADD KEY " + index + " (" + deleted + ")",
+		}
+	}
+	return []string{
+		"ALTER TABLE " + dialect.QuoteIdentifier(table) + " ADD COLUMN " + deleted + " BIGINT",
+		"CREATE INDEX " + index + " ON " + dialect.QuoteIdentifier(table) + " (" + deleted + ")",
+	}
+}
+
+// SetSoftDelete enables or disables the soft delete mode
+func (backend *SQLBackend) SetSoftDelete(enabled bool) {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+
+	backend.softDelete = enabled
+}
+
+// isSoftDelete returns true if the soft delete mode is enabled
+func (backend *SQLBackend) isSoftDelete() bool {
+	backend.mutex.Lock()
+	defer backend.mutex.Unlock()
+
+	return backend.softDelete
+}
+
+// RestoreInArchive restores a set of tombstones (0 means all the
+// tombstones of the type in the domain)
+func (backend *SQLBackend) RestoreInArchive(objectType com.ObjectType, identifierList mal.IdentifierList, longListRequest mal.LongList) (mal.LongList, error) {
+	return backend.updateTombstones(objectType, identifierList, longListRequest, false)
+}
+
+// PurgeDeleted permanently deletes a set of tombstones with their history,
+// the sequence of the ids isn't reset as the purges run in the background
+func (backend *SQLBackend) PurgeDeleted(objectType com.ObjectType, identifierList mal.IdentifierList, longListRequest mal.LongList) (mal.LongList, error) {
+	return backend.updateTombstones(objectType, identifierList, longListRequest, true)
+}
+
+// updateTombstones restores a set of tombstones, or purges them
+func (backend *SQLBackend) updateTombstones(objectType com.ObjectType, identifierList mal.IdentifierList, longListRequest mal.LongList, isPurge bool) (mal.LongList, error) {
+	// Create the transaction to execute future queries
+	tx, err := backend.createTransaction()
+	if err != nil {
+		return nil, err
+	}
+	// Rollback the transaction if it has not been committed
+	defer tx.Rollback()
+
+	domain := utils.AdaptDomainToString(identifierList)
+
+	var isAll = false
+	for i := 0; i < longListRequest.Size(); i++ {
+		if *longListRequest[i] == 0 {
+			isAll = true
+			break
+		}
+	}
+
+	var longList mal.LongList
+	if isAll {
+		rows, err := backend.query(tx, backend.queries.selectDeletedInstIDs,
+			objectType.Area,
+			objectType.Service,
+			objectType.Version,
+			objectType.Number,
+			domain)
+		if err != nil {
+			return nil, err
+		}
+		for rows.Next() {
+			var instID mal.Long
+			if err = rows.Scan(&instID); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			longList.AppendElement(&instID)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return nil, err
+		}
+		if longList.Size() == 0 {
+			return nil, errors.New(string(mal.ERROR_UNKNOWN_MESSAGE))
+		}
+	} else {
+		longList = longListRequest
+	}
+
+	var query = backend.queries.restore
+	if isPurge {
+		query = backend.queries.purge
+	}
+	for _, instID := range longList {
+		result, err := backend.exec(tx, query,
+			*instID,
+			objectType.Area,
+			objectType.Service,
+			objectType.Version,
+			objectType.Number,
+			domain)
+		if err != nil {
+			return nil, err
+		}
+		count, err := result.RowsAffected()
+		if err != nil {
+			return nil, err
+		}
+		if count == 0 {
+			// Not a tombstone
+			return nil, errors.New(string(mal.ERROR_UNKNOWN_MESSAGE))
+		}
+	}
+
+	if isPurge {
+		err = backend.deleteHistory(tx, objectType, domain, longList)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	// Commit changes
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	return longList, nil
+}
+
+// SelectDeleted returns the tombstones deleted before a time, the oldest
+// deletions first
+func (backend *SQLBackend) SelectDeleted(deletedBefore time.Time, offset int, limit int) ([]*ExpiredObjects, error) {
+	// Create the transaction to execute future queries
+	tx, err := backend.createReadTransaction()
+	if err != nil {
+		return nil, err
+	}
+	// Rollback the transaction if it has not been committed
+	defer tx.Rollback()
+
+	var builder = newQueryBuilder(backend.dialect)
+	builder.WriteString("SELECT " + backend.columns("area", "service", "version", "number", "domain", "objectInstanceIdentifier") +
+		" FROM " + backend.table)
+	builder.Where()
+	builder.and()
+	builder.WriteString(backend.quote(DELETED_COLUMN) + " < ")
+	builder.Arg(encodeTimestamp(deletedBefore))
+	builder.WriteString(" ORDER BY " + backend.columns(DELETED_COLUMN, "id"))
+	backend.limit(builder, limit, offset)
+
+	var expired = newExpiredGroups()
+	err = backend.scanExpired(tx, builder, expired)
+	if err != nil {
+		return nil, err
+	}
+
+	// Commit changes
+	tx.Commit()
+
+	return expired.groups, nil
+}
@@ -0,0 +1,168 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package storage
+
+import (
+	"database/sql"
+	"database/sql/driver"
+	"strconv"
+	"strings"
+
+	// Init sqlite driver (pure go, no cgo needed)
+	"modernc.org/sqlite"
+	sqlite3 "modernc.org/sqlite/lib"
+)
+
+// SQLiteDialect is the Dialect of SQLite
+type SQLiteDialect struct{}
+
+// Name of the SQLite function returning the first levels of a domain (see
+// DomainPrefix), SQLite has no function splitting a string
+const SQLITE_DOMAIN_PREFIX = "archive_domain_prefix"
+
+func init() {
+	sqlite.MustRegisterDeterministicScalarFunction(SQLITE_DOMAIN_PREFIX, 2, func(ctx *sqlite.FunctionContext, args []driver.Value) (driver.Value, error) {
+		domain, ok := args[0].(string)
+		if !ok {
+			return nil, nil
+		}
+		levels, _ := args[1].(int64)
+		var identifiers = strings.Split(domain, ".")
+		if int64(len(identifiers)) > levels {
+			identifiers = identifiers[:levels]
+		}
+		return strings.Join(identifiers, "."), nil
+	})
+}
+
+// DriverName returns the name of the modernc.org/sqlite driver
+func (SQLiteDialect) DriverName() string {
+	return "sqlite"
+}
+
+// QuoteIdentifier quotes a name with double quotes
+func (SQLiteDialect) QuoteIdentifier(name string) string {
+	return `"` + strings.Replace(name, `"`, `""`, -1) + `"`
+}
+
+// Placeholder returns '?' whatever the position of the parameter
+func (SQLiteDialect) Placeholder(n int) string {
+	return "?"
+}
+
+// CaseSensitive returns the column, the comparisons of strings are case
+// sensitive and so is LIKE with the case_sensitive_like pragma set by
+// NewSQLiteBackend
+func (SQLiteDialect) CaseSensitive(column string) string {
+	return column
+}
+
+// SchemaStatements returns the statement creating the table, the
+// columns are declared in the same order as in the MySQL table
+func (dialect SQLiteDialect) SchemaStatements(table string) []string {
+	return []string{
+		"CREATE TABLE IF NOT EXISTS " + dialect.QuoteIdentifier(table) + " (" +
+			`"id" INTEGER PRIMARY KEY, ` +
+			`"objectInstanceIdentifier" BIGINT, ` +
+			`"element" BLOB, ` +
+			`"area" SMALLINT, ` +
+			`"service" SMALLINT, ` +
+			`"version" TINYINT, ` +
+			`"number" SMALLINT, ` +
+			`"domain" TEXT, ` +
+			`"timestamp" BIGINT, ` +
+			`"details.related" BIGINT, ` +
+			`"network" TEXT, ` +
+			`"provider" TEXT, ` +
+			`"details.source" BLOB, ` +
+			`"details.source.area" SMALLINT, ` +
+			`"details.source.service" SMALLINT, ` +
+			`"details.source.version" TINYINT, ` +
+			`"details.source.number" SMALLINT, ` +
+			`"details.source.domain" TEXT, ` +
+			`"details.source.instId" BIGINT)`,
+	}
+}
+
+// ResetSequence does nothing: the ids are generated from max(id)+1
+// as the table does not use the AUTOINCREMENT keyword
+func (SQLiteDialect) ResetSequence(tx *sql.Tx, table string) error {
+	return nil
+}
+
+// IncrementStatement returns an INSERT ... ON CONFLICT DO UPDATE statement
+func (dialect SQLiteDialect) IncrementStatement(table string, keys []string, counter string) string {
+	return onConflictIncrement(dialect, table, keys, counter)
+}
+
+// IsUniqueViolation returns true if the error is raised by a UNIQUE or
+// PRIMARY KEY constraint (the driver reports the extended result codes)
+func (SQLiteDialect) IsUniqueViolation(err error) bool {
+	sqliteErr, ok := err.(*sqlite.Error)
+	if !ok {
+		return false
+	}
+	return sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_UNIQUE ||
+		sqliteErr.Code() == sqlite3.SQLITE_CONSTRAINT_PRIMARYKEY
+}
+
+// ColumnType reads the declared type of the column, which only gives
+// the affinity of its values
+func (SQLiteDialect) ColumnType(tx *sql.Tx, table string, column string) (string, error) {
+	return scanColumnType(tx.QueryRow("SELECT type FROM pragma_table_info(?) WHERE name = ?", table, column))
+}
+
+// DomainPrefix calls the function registered by the package
+func (SQLiteDialect) DomainPrefix(column string, levels int) string {
+	return SQLITE_DOMAIN_PREFIX + "(" + column + ", " + strconv.Itoa(levels) + ")"
+}
+
+// SQLiteDataSourceName returns the data source name of a SQLite file
+// for the SQLiteDialect
+func SQLiteDataSourceName(path string) string {
+	// Wait instead of failing when another goroutine holds the lock, and
+	// make LIKE case sensitive like the comparisons of strings. A write
+	// transaction takes the lock when it begins: a deferred transaction
+	// reading before its first write (e.g. the identifiers checked by
+	// StoreInArchive) would fail with SQLITE_BUSY_SNAPSHOT if another
+	// connection wrote in between, the read-only transactions are still
+	// deferred.
+	return "file:" + path + "?_pragma=busy_timeout(5000)&_pragma=journal_mode(WAL)&_pragma=case_sensitive_like(1)&_txlock=immediate"
+}
+
+// NewSQLiteBackend creates a backend storing the objects in a local SQLite
+// file. The file is created if it doesn't exist yet and the migrations of
+// the schema are applied.
+func NewSQLiteBackend(path string, table string) (*SQLBackend, error) {
+	backend := NewSQLBackend(SQLiteDialect{}, SQLiteDataSourceName(path), table)
+
+	// Create or update the schema
+	err := backend.Migrate()
+	if err != nil {
+		return nil, err
+	}
+
+	return backend, nil
+}
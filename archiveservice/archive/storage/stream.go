@@ -0,0 +1,183 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package storage
+
+import (
+	"github.com/CNES/ccsdsmo-malgo/com"
+	"github.com/CNES/ccsdsmo-malgo/com/archive"
+	"github.com/CNES/ccsdsmo-malgo/mal"
+
+	. "github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/constants"
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/utils"
+)
+
+// Default maximum number of objects sent in a message by a streamed query,
+// the default maximum size of a message is LENGTH
+const DEFAULT_CHUNK_OBJECTS = 1000
+
+// Size added to the lengths of the encoded element, the encoded source, the
+// network and the provider of an object to estimate its encoded size (it
+// holds the object instance identifier, the timestamp and the related)
+const OBJECT_SIZE_OVERHEAD = 32
+
+// ChunkLimits bounds the chunks of objects sent by StreamQuery, so that the
+// messages sent by the provider have a bounded size. A limit lower or equal
+// to 0 is not applied.
+type ChunkLimits struct {
+	// MaxObjects is the maximum number of objects of a chunk
+	MaxObjects int
+	// MaxBytes is the maximum estimated encoded size of the objects of a
+	// chunk, an object bigger than this size is sent alone
+	MaxBytes int
+}
+
+// DefaultChunkLimits returns the default limits of the chunks
+func DefaultChunkLimits() ChunkLimits {
+	return ChunkLimits{
+		MaxObjects: DEFAULT_CHUNK_OBJECTS,
+		MaxBytes:   LENGTH,
+	}
+}
+
+// QuerySender sends a chunk of the objects matching a query. As in the
+// results of QueryArchive, the object type is nil unless the query has a
+// wildcard in its object type, and the domain and the elements are nil
+// unless the bodies are returned.
+type QuerySender func(objectType *com.ObjectType, domain *mal.IdentifierList, archiveDetailsList *archive.ArchiveDetailsList, elementList mal.ElementList) error
+
+// queryChunker gathers the objects read by a streamed query into chunks of
+// objects of the same group (see QueryArchive) and sends them as soon as
+// they are full, the objects of a group must be read consecutively
+type queryChunker struct {
+	limits                  ChunkLimits
+	send                    QuerySender
+	isObjectTypeEqualToZero bool
+	isReturnBody            bool
+
+	// Group and content of the chunk being filled
+	objectType         com.ObjectType
+	domain             mal.String
+	archiveDetailsList *archive.ArchiveDetailsList
+	elementList        mal.ElementList
+	size               int
+}
+
+// newQueryChunker creates a chunker for the results of a query
+func newQueryChunker(boolean *mal.Boolean, objectType com.ObjectType, limits ChunkLimits, send QuerySender) *queryChunker {
+	return &queryChunker{
+		limits:                  limits,
+		send:                    send,
+		isObjectTypeEqualToZero: objectType.Area == 0 || objectType.Number == 0 || objectType.Service == 0 || objectType.Version == 0,
+		isReturnBody:            boolean != nil && *boolean,
+	}
+}
+
+// add adds an object to the chunk being filled. The chunk is sent first
+// if the object is in another group or if the chunk would exceed the
+// limits with this object.
+func (chunker *queryChunker) add(objectType com.ObjectType, domain mal.String, archiveDetails *archive.ArchiveDetails, element mal.Element, size int) error {
+	if chunker.archiveDetailsList != nil {
+		var count = chunker.archiveDetailsList.Size()
+		if !chunker.isInGroup(objectType, domain) ||
+			(chunker.limits.MaxObjects > 0 && count >= chunker.limits.MaxObjects) ||
+			(chunker.limits.MaxBytes > 0 && chunker.size+size > chunker.limits.MaxBytes) {
+			err := chunker.flush()
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	if chunker.archiveDetailsList == nil {
+		// Start a new chunk
+		chunker.objectType = objectType
+		chunker.domain = domain
+		chunker.archiveDetailsList = archive.NewArchiveDetailsList(0)
+		chunker.size = 0
+		if chunker.isReturnBody {
+			elementList, err := newElementList(objectType)
+			if err != nil {
+				return err
+			}
+			chunker.elementList = elementList
+		}
+	}
+
+	chunker.archiveDetailsList.AppendElement(archiveDetails)
+	if chunker.isReturnBody {
+		chunker.elementList.AppendElement(element)
+	}
+	chunker.size += size
+	return nil
+}
+
+// isInGroup returns true if an object is in the group of the chunk being
+// filled: the objects are grouped by object type if the query has a
+// wildcard in its object type, and by domain if the bodies are returned
+func (chunker *queryChunker) isInGroup(objectType com.ObjectType, domain mal.String) bool {
+	return (!chunker.isObjectTypeEqualToZero || objectType == chunker.objectType) &&
+		(!chunker.isReturnBody || domain == chunker.domain)
+}
+
+// flush sends the chunk being filled if it holds objects
+func (chunker *queryChunker) flush() error {
+	if chunker.archiveDetailsList == nil {
+		return nil
+	}
+
+	var objectType *com.ObjectType
+	if chunker.isObjectTypeEqualToZero {
+		objType := chunker.objectType
+		objectType = &objType
+	}
+	var domain *mal.IdentifierList
+	var elementList mal.ElementList
+	if chunker.isReturnBody {
+		idList := utils.AdaptDomainToIdentifierList(string(chunker.domain))
+		domain = &idList
+		elementList = chunker.elementList
+	} else {
+		var longList *mal.LongList
+		elementList = longList
+	}
+
+	var archiveDetailsList = chunker.archiveDetailsList
+	chunker.archiveDetailsList = nil
+	chunker.elementList = nil
+	return chunker.send(objectType, domain, archiveDetailsList, elementList)
+}
+
+// isSortedByGroup returns true if the objects of a streamed query are sorted
+// by group before the sort field of the query: the sort order is only kept
+// across the groups if it's global and if the query has one
+func isSortedByGroup(archiveQuery archive.ArchiveQuery, globalOrder bool) bool {
+	return !globalOrder || archiveQuery.SortOrder == nil
+}
+
+// objectSize estimates the encoded size of an object in a message from its
+// encoded element (nil if the body isn't returned) and its encoded source
+func objectSize(encodedElement []byte, encodedObjectID []byte, network mal.Identifier, provider mal.URI) int {
+	return len(encodedElement) + len(encodedObjectID) + len(network) + len(provider) + OBJECT_SIZE_OVERHEAD
+}
@@ -32,12 +32,18 @@ import (
 	"github.com/CNES/ccsdsmo-malgo/mal/encoding/binary"
 )
 
+// Escape of the dots of the identifiers of a domain, so that the dots of
+// a domain string only separate its identifiers (e.g. the domain
+// [fr, cnes.test] is fr.cnes%2Etest), and of the escape character
+var domainEscaper = strings.NewReplacer("%", "%25", ".", "%2E")
+var domainUnescaper = strings.NewReplacer("%25", "%", "%2E", ".")
+
 // AdaptDomainToString transforms a list of Identifiers to a domain of this
 // type: first.second.third.[...]
 func AdaptDomainToString(identifierList mal.IdentifierList) mal.String {
 	var domain mal.String
 	for i := 0; i < identifierList.Size(); i++ {
-		domain += mal.String(*identifierList.GetElementAt(i).(*mal.Identifier))
+		domain += mal.String(EscapeDomainIdentifier(*identifierList.GetElementAt(i).(*mal.Identifier)))
 		if i+1 < identifierList.Size() {
 			domain += "."
 		}
@@ -51,11 +57,50 @@ func AdaptDomainToIdentifierList(domain string) mal.IdentifierList {
 	var identifierList = mal.NewIdentifierList(0)
 	var domains = strings.Split(domain, ".")
 	for i := 0; i < len(domains); i++ {
-		identifierList.AppendElement(mal.NewIdentifier(domains[i]))
+		identifierList.AppendElement(mal.NewIdentifier(domainUnescaper.Replace(domains[i])))
 	}
 	return *identifierList
 }
 
+// EscapeDomainIdentifier returns an identifier as written in a domain
+// string (see AdaptDomainToString)
+func EscapeDomainIdentifier(identifier mal.Identifier) string {
+	return domainEscaper.Replace(string(identifier))
+}
+
+// MatchDomain checks if a domain matches a domain given in a query,
+// the '*' identifier of the query matches any identifier at its level,
+// and the last one also matches any number of deeper levels (i.e. all
+// the sub-domains)
+func MatchDomain(domain mal.IdentifierList, pattern mal.IdentifierList) bool {
+	var isTrailingWildcard = pattern.Size() != 0 && *pattern[pattern.Size()-1] == "*"
+	if domain.Size() != pattern.Size() && !(isTrailingWildcard && domain.Size() > pattern.Size()) {
+		return false
+	}
+	for i := 0; i < pattern.Size(); i++ {
+		if *pattern[i] != "*" && *pattern[i] != *domain[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// MatchObjectID checks if an ObjectId matches an ObjectId given in a
+// query: the attributes of its object type and its object instance
+// identifier equal to 0 match any value, and its domain may contain
+// wildcards (see MatchDomain)
+func MatchObjectID(objectID *com.ObjectId, pattern *com.ObjectId) bool {
+	if objectID == nil {
+		return false
+	}
+	return (pattern.Type.Area == 0 || pattern.Type.Area == objectID.Type.Area) &&
+		(pattern.Type.Service == 0 || pattern.Type.Service == objectID.Type.Service) &&
+		(pattern.Type.Version == 0 || pattern.Type.Version == objectID.Type.Version) &&
+		(pattern.Type.Number == 0 || pattern.Type.Number == objectID.Type.Number) &&
+		(pattern.Key.InstId == 0 || pattern.Key.InstId == objectID.Key.InstId) &&
+		MatchDomain(objectID.Key.Domain, pattern.Key.Domain)
+}
+
 func DecodeObjectID(encodedObjectId []byte) (*com.ObjectId, error) {
 	// Create the factory
 	factory := new(binary.FixedBinaryEncoding)
@@ -0,0 +1,81 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/config"
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/storage"
+)
+
+// Applies the migrations of the schema of the database described by the
+// configuration of the provider, without starting the provider
+func main() {
+	err := migrate(os.Args[1:])
+	if err != nil {
+		fmt.Println("Error:", err)
+		os.Exit(1)
+	}
+}
+
+// migrate applies the migrations and prints them
+func migrate(args []string) error {
+	// Load the configuration (file, environment and command line)
+	cfg, err := config.Load(args)
+	if err != nil {
+		return err
+	}
+
+	// Create the storage backend, the migrations are applied below
+	backend, err := cfg.OpenBackend()
+	if err != nil {
+		return err
+	}
+	defer backend.Close()
+	sqlBackend, ok := backend.(*storage.SQLBackend)
+	if !ok {
+		return errors.New("the " + cfg.Database.Backend + " backend has no schema")
+	}
+
+	version, err := sqlBackend.SchemaVersion()
+	if err != nil {
+		return err
+	}
+	fmt.Println("Schema version:", version)
+
+	err = sqlBackend.Migrate()
+	if err != nil {
+		return err
+	}
+	for _, migration := range storage.Migrations() {
+		if migration.Version > version {
+			fmt.Printf("Applied migration %d: %s\n", migration.Version, migration.Description)
+		}
+	}
+	return nil
+}
@@ -25,25 +25,47 @@ package main
 
 import (
 	"fmt"
+	"os"
 
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/config"
 	. "github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/service"
 )
 
-// Constants for the providers and consumers
-const (
-	providerURL = "maltcp://127.0.0.1:12400"
-)
-
 func main() {
+	// Load the configuration (file, environment and command line)
+	cfg, err := config.Load(os.Args[1:])
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+	err = cfg.ConfigureLogging()
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+
 	// Variable that defines the ArchiveService
 	var archiveService *ArchiveService
-	// Variable to retrieve the error
-	var err error
 	// Create the Archive Service
 	archiveService = archiveService.CreateService().(*ArchiveService)
+	archiveService.ProviderName = cfg.Provider.Name
+	archiveService.QueryChunkLimits = cfg.ChunkLimits()
+	archiveService.GlobalSortOrder = cfg.Provider.GlobalSortOrder
+	archiveService.Retention, err = cfg.RetentionPolicy()
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
+
+	// Create the storage backend
+	archiveService.Backend, err = cfg.NewBackend()
+	if err != nil {
+		fmt.Println("Error:", err)
+		return
+	}
 
 	// Start the providers
-	err = archiveService.StartProvider(providerURL)
+	err = archiveService.StartProvider(cfg.Provider.URI)
 
 	if err != nil {
 		fmt.Println("Error:", err)
@@ -50,4 +50,16 @@ func init() {
 	if err != nil {
 		logger.Errorf("ValueOfSine.init, cannot register COM object: %s", err.Error())
 	}
+
+	// Same mapping for the Sine objects
+	sineObjType := com.ObjectType{
+		Area:    testarchivearea.AREA_NUMBER,
+		Service: SERVICE_NUMBER,
+		Version: testarchivearea.AREA_VERSION,
+		Number:  mal.UShort(SINE_TYPE_SHORT_FORM),
+	}
+	err = sineObjType.RegisterMALBodyType(SINE_SHORT_FORM)
+	if err != nil {
+		logger.Errorf("Sine.init, cannot register COM object: %s", err.Error())
+	}
 }
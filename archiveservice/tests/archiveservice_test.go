@@ -24,21 +24,21 @@
 package tests
 
 import (
-	"database/sql"
 	"fmt"
 	"math/rand"
 	"os"
 	"testing"
 	"time"
 
-	_ "github.com/go-sql-driver/mysql"
-
 	"github.com/CNES/ccsdsmo-malgo/com"
 	"github.com/CNES/ccsdsmo-malgo/com/archive"
 	"github.com/CNES/ccsdsmo-malgo/mal"
 	malapi "github.com/CNES/ccsdsmo-malgo/mal/api"
 
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/config"
+	archprovider "github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/provider"
 	. "github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/service"
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/storage"
 	//	. "github.com/CNES/ccsdsmo-malgo-examples/archiveservice/errors"
 	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/testarchivearea"
 	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/testarchivearea/testarchiveservice"
@@ -46,17 +46,12 @@ import (
 
 // Constants for the providers and consumers
 const (
-	providerURL = "maltcp://127.0.0.1:12400"
 	consumerURL = "maltcp://127.0.0.1:14200"
 )
 
-// Database ids
-const (
-	USERNAME = "archiveService"
-	PASSWORD = "1a2B3c4D!@?"
-	DATABASE = "archive"
-	TABLE    = "Archive"
-)
+// providerURL is the URL of the provider, it's read from the configuration
+// (e.g. the ARCHIVE_PROVIDER_URI environment variable) by testSetup
+var providerURL = config.DEFAULT_PROVIDER_URI
 
 const (
 	numberOfRows = 80
@@ -73,58 +68,43 @@ var isDatabaseInitialized = false
 func initDabase() error {
 	rand.Seed(time.Now().UnixNano())
 
-	// Open the database
-	db, err := sql.Open("mysql", USERNAME+":"+PASSWORD+"@/"+DATABASE+"?parseTime=true")
-	if err != nil {
-		return err
-	}
-
-	// Validate the connection by pinging it
-	err = db.Ping()
-	if err != nil {
-		return err
-	}
-
-	// Create the transaction (we have to use this method to use rollback and commit)
-	tx, err := db.Begin()
-	if err != nil {
-		return err
-	}
+	// Variable that defines the ArchiveService
+	var archiveService *ArchiveService
+	// Create the Archive Service
+	archiveService = archiveService.CreateService().(*ArchiveService)
 
-	// If there are already 80 elements in the Archive table then
-	// it's useless to reset and add new elements to the database
-	var maxID sql.NullInt64 // Better to use the type sql.NullInt64 to avoid nil error conversion
-	err = tx.QueryRow("SELECT MAX(id) FROM " + TABLE).Scan(&maxID)
+	// Retrieve all the objects of the archive (the object type only
+	// contains wildcard values), the database is only accessed through
+	// the provider so that the tests work whatever its backend
+	archiveQueryList := archive.NewArchiveQueryList(0)
+	archiveQueryList.AppendElement(&archive.ArchiveQuery{
+		Related: mal.Long(0),
+	})
+	var queryFilterList *archive.CompositeFilterSetList
+	responses, err := archiveService.Query(providerURL, mal.NewBoolean(true), com.ObjectType{}, *archiveQueryList, queryFilterList)
 	if err != nil {
 		fmt.Println(err)
 		return err
 	}
-
-	// If maxID's Valid parameter is set to false then it means its value is nil
-	if !maxID.Valid || maxID.Int64 != numberOfRows {
-		// Delete all the elements of the table Archive
-		_, err = tx.Exec("DELETE FROM " + TABLE)
-		if err != nil {
-			return err
-		}
-
-		// Reset the AUTO_INCREMENT value
-		_, err = tx.Exec("ALTER TABLE " + TABLE + " AUTO_INCREMENT=0")
-		if err != nil {
-			return err
+	var countObjects int
+	for i := 0; i < len(responses)/4; i++ {
+		countObjects += responses[i*4+2].(*archive.ArchiveDetailsList).Size()
+	}
+
+	// If there are already 80 elements in the archive then
+	// it's useless to reset and add new elements to the archive
+	if countObjects != numberOfRows {
+		// Delete all the elements of the archive
+		for i := 0; i < len(responses)/4; i++ {
+			objType := responses[i*4].(*com.ObjectType)
+			domain := responses[i*4+1].(*mal.IdentifierList)
+			_, err = archiveService.Delete(providerURL, *objType, *domain, mal.LongList([]*mal.Long{mal.NewLong(0)}))
+			if err != nil {
+				return err
+			}
 		}
 
-		// Commit changes
-		tx.Commit()
-		// Close the connection with the database
-		db.Close()
-
-		// Variable that defines the ArchiveService
-		var archiveService *ArchiveService
-		// Create the Archive Service
-		archiveService = archiveService.CreateService().(*ArchiveService)
-
-		// Insert elements in the table Archive for future tests
+		// Insert elements in the archive for future tests
 		var elementList = testarchiveservice.NewValueOfSineList(0)
 		var boolean = mal.NewBoolean(false)
 		// Variable for the different networks
@@ -193,11 +173,6 @@ func initDabase() error {
 		if err != nil {
 			return err
 		}
-	} else {
-		// Commit changes
-		tx.Commit()
-		// Close the connection with the database
-		db.Close()
 	}
 
 	return nil
@@ -229,7 +204,28 @@ func TestMain(m *testing.M) {
 var malContext *mal.Context = nil
 var clientContext *malapi.ClientContext = nil
 
+// testProvider is the provider started by the tests themselves when the
+// ARCHIVE_TEST_BACKEND environment variable is set to "memory", otherwise
+// a provider must already be running at providerURL
+var testProvider *archive.Provider = nil
+
 func testSetup() error {
+	cfg, err := config.Load(nil)
+	if err != nil {
+		fmt.Printf("error loading the configuration: %s", err)
+		return err
+	}
+	providerURL = cfg.Provider.URI
+
+	if os.Getenv("ARCHIVE_TEST_BACKEND") == "memory" {
+		// Start a provider using a volatile archive, no database is needed
+		testProvider, err = archprovider.StartProvider(providerURL, archprovider.PROVIDER_NAME, storage.NewMemoryBackend(), storage.DefaultChunkLimits(), false)
+		if err != nil {
+			fmt.Printf("error starting the provider for URI %s: %s", providerURL, err)
+			return err
+		}
+	}
+
 	dfltConsumerURL := "maltcp://127.0.0.1:14200"
 	malContext, err := mal.NewContext(dfltConsumerURL)
 	if err != nil {
@@ -247,6 +243,9 @@ func testSetup() error {
 }
 
 func testTeardown() error {
+	if testProvider != nil {
+		return testProvider.Close()
+	}
 	return nil
 }
 
@@ -2008,3 +2007,335 @@ func TestDeleteKO_3_4_8_2_6(t *testing.T) {
 		t.FailNow()
 	}
 }
+
+//======================================================================//
+//								QUERY PAGE								//
+//======================================================================//
+// countPage returns the number of objects of a page and checks that it
+// holds at most pageSize objects
+func countPage(t *testing.T, responses []interface{}, pageSize int) int {
+	var count int
+	for i := 0; i < len(responses)/4; i++ {
+		archiveDetailsList := responses[i*4+2].(*archive.ArchiveDetailsList)
+		elementList := responses[i*4+3].(mal.ElementList)
+		if elementList.Size() != archiveDetailsList.Size() {
+			t.Errorf("%d elements returned with %d ArchiveDetails", elementList.Size(), archiveDetailsList.Size())
+		}
+		count += archiveDetailsList.Size()
+	}
+	if count > pageSize {
+		t.Errorf("%d objects returned in a page of %d", count, pageSize)
+	}
+	return count
+}
+
+// queryNextPages returns the number of objects of the pages following a
+// token, all the pages but the last one must be full
+func queryNextPages(t *testing.T, archiveService *ArchiveService, token string, pageSize int) int {
+	var count int
+	for token != "" {
+		responses, nextToken, err := archiveService.NextQueryPage(token, pageSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		pageCount := countPage(t, responses, pageSize)
+		if nextToken != "" && pageCount != pageSize {
+			t.Errorf("%d objects returned in a page of %d which is not the last one", pageCount, pageSize)
+		}
+		count += pageCount
+		token = nextToken
+	}
+	return count
+}
+
+// newPagedQuery returns the query list of the ValueOfSine objects of a domain
+func newPagedQuery(domain mal.IdentifierList) archive.ArchiveQueryList {
+	archiveQueryList := archive.NewArchiveQueryList(0)
+	archiveQueryList.AppendElement(&archive.ArchiveQuery{
+		Domain:    &domain,
+		Related:   mal.Long(0),
+		SortOrder: mal.NewBoolean(true),
+	})
+	return *archiveQueryList
+}
+
+func TestQueryPageOK(t *testing.T) {
+	// Check if the Archive table is initialized or not
+	err := checkAndInitDatabase()
+	if err != nil {
+		t.FailNow()
+	}
+
+	var archiveService *ArchiveService
+	archiveService = archiveService.CreateService().(*ArchiveService)
+	var domain = newTestDomain("fr", "cnes", "archiveservice", "test")
+
+	// The pages hold the same objects as the responses of Query
+	responses, err := archiveService.Query(providerURL, mal.NewBoolean(true), valueOfSineType, newPagedQuery(domain), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var expected int
+	for i := 0; i < len(responses)/4; i++ {
+		expected += responses[i*4+2].(*archive.ArchiveDetailsList).Size()
+	}
+	if expected == 0 {
+		t.Fatal("no object in the archive")
+	}
+
+	for _, pageSize := range []int{1, 7, expected, expected + 1} {
+		responses, token, err := archiveService.QueryPage(providerURL, mal.NewBoolean(true), valueOfSineType, newPagedQuery(domain), nil, pageSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		count := countPage(t, responses, pageSize)
+		count += queryNextPages(t, archiveService, token, pageSize)
+		if count != expected {
+			t.Errorf("%d objects returned by pages of %d instead of %d", count, pageSize, expected)
+		}
+	}
+}
+
+func TestQueryPageStable(t *testing.T) {
+	// Check if the Archive table is initialized or not
+	err := checkAndInitDatabase()
+	if err != nil {
+		t.FailNow()
+	}
+
+	var archiveService *ArchiveService
+	archiveService = archiveService.CreateService().(*ArchiveService)
+	var domain = newTestDomain("fr", "cnes", "archiveservice", "paging")
+	var store = func(count int) {
+		archiveDetailsList, elementList := newTestObjects(count, domain, "tests/network1", time.Now())
+		_, err := archiveService.Store(providerURL, mal.NewBoolean(false), valueOfSineType, domain, archiveDetailsList, elementList)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	defer archiveService.Delete(providerURL, valueOfSineType, domain, mal.LongList([]*mal.Long{mal.NewLong(0)}))
+
+	store(10)
+	responses, token, err := archiveService.QueryPage(providerURL, mal.NewBoolean(true), valueOfSineType, newPagedQuery(domain), nil, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	count := countPage(t, responses, 3)
+
+	// The objects stored after the first page are not returned
+	store(5)
+	count += queryNextPages(t, archiveService, token, 3)
+	if count != 10 {
+		t.Errorf("%d objects returned instead of 10", count)
+	}
+}
+
+func TestQueryPageKO(t *testing.T) {
+	// Check if the Archive table is initialized or not
+	err := checkAndInitDatabase()
+	if err != nil {
+		t.FailNow()
+	}
+
+	var archiveService *ArchiveService
+	archiveService = archiveService.CreateService().(*ArchiveService)
+	var domain = newTestDomain("fr", "cnes", "archiveservice", "test")
+
+	// Invalid page size
+	_, _, err = archiveService.QueryPage(providerURL, mal.NewBoolean(true), valueOfSineType, newPagedQuery(domain), nil, 0)
+	if err == nil {
+		t.Errorf("an error should be returned for an invalid page size")
+	}
+
+	// Unknown token
+	_, _, err = archiveService.NextQueryPage("unknown", 1)
+	if err == nil || err.Error() != UNKNOWN_QUERY_TOKEN_ERROR {
+		t.Errorf("an error should be returned for an unknown token: %v", err)
+	}
+
+	// Closed query
+	_, token, err := archiveService.QueryPage(providerURL, mal.NewBoolean(true), valueOfSineType, newPagedQuery(domain), nil, 1)
+	if err != nil || token == "" {
+		t.Fatal("a token should be returned:", err)
+	}
+	archiveService.CloseQueryPage(token)
+	_, _, err = archiveService.NextQueryPage(token, 1)
+	if err == nil || err.Error() != UNKNOWN_QUERY_TOKEN_ERROR {
+		t.Errorf("an error should be returned for a closed query: %v", err)
+	}
+}
+
+//======================================================================//
+//								GLOBAL ORDER								//
+//======================================================================//
+func TestQueryGlobalSortOrder(t *testing.T) {
+	// Check if the Archive table is initialized or not
+	err := checkAndInitDatabase()
+	if err != nil {
+		t.FailNow()
+	}
+
+	var archiveService *ArchiveService
+	archiveService = archiveService.CreateService().(*ArchiveService)
+	archiveService.GlobalSortOrder = true
+
+	// Objects of two domains whose timestamps are interleaved
+	var domains = []mal.IdentifierList{
+		newTestDomain("fr", "cnes", "archiveservice", "global", "a"),
+		newTestDomain("fr", "cnes", "archiveservice", "global", "b"),
+	}
+	var start = time.Now().Truncate(time.Second)
+	for i, domain := range domains {
+		archiveDetailsList, elementList := newTestObjects(5, domain, "tests/network1", start.Add(time.Duration(i)*100*time.Millisecond))
+		_, err := archiveService.Store(providerURL, mal.NewBoolean(false), valueOfSineType, domain, archiveDetailsList, elementList)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer archiveService.Delete(providerURL, valueOfSineType, domain, mal.LongList([]*mal.Long{mal.NewLong(0)}))
+	}
+
+	var anyDomain = newTestDomain("fr", "cnes", "archiveservice", "global", "*")
+	var archiveQueryList = archive.NewArchiveQueryList(0)
+	archiveQueryList.AppendElement(&archive.ArchiveQuery{
+		Domain:    &anyDomain,
+		Related:   mal.Long(0),
+		SortOrder: mal.NewBoolean(true),
+	})
+	responses, err := archiveService.Query(providerURL, mal.NewBoolean(true), valueOfSineType, *archiveQueryList, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The objects of the two domains alternate, so each response holds a
+	// single object and the responses are in chronological order
+	if len(responses)/4 != 10 {
+		t.Fatalf("%d responses instead of 10", len(responses)/4)
+	}
+	var previous time.Time
+	for i := 0; i < len(responses)/4; i++ {
+		archiveDetailsList := responses[i*4+2].(*archive.ArchiveDetailsList)
+		elementList := responses[i*4+3].(mal.ElementList)
+		if archiveDetailsList.Size() != 1 || elementList.Size() != 1 {
+			t.Fatalf("%d objects in a response instead of 1", archiveDetailsList.Size())
+		}
+		timestamp := time.Time(*(*archiveDetailsList)[0].Timestamp)
+		if i > 0 && !previous.Before(timestamp) {
+			t.Errorf("object at %v returned after the object at %v", timestamp, previous)
+		}
+		var domain = responses[i*4+1].(*mal.IdentifierList)
+		if *(*domain)[4] != *domains[i%2][4] {
+			t.Errorf("object of the domain %s returned instead of %s", *(*domain)[4], *domains[i%2][4])
+		}
+		previous = timestamp
+	}
+
+	// Each query is merged in its own sort order, the objects of the
+	// second query are returned after the objects of the first one
+	archiveQueryList.AppendElement(&archive.ArchiveQuery{
+		Domain:    &anyDomain,
+		Related:   mal.Long(0),
+		SortOrder: mal.NewBoolean(false),
+	})
+	responses, err = archiveService.Query(providerURL, mal.NewBoolean(false), valueOfSineType, *archiveQueryList, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(responses)/4 != 20 {
+		t.Fatalf("%d responses instead of 20", len(responses)/4)
+	}
+	for i := 1; i < len(responses)/4; i++ {
+		if i == 10 {
+			continue
+		}
+		previous := time.Time(*(*responses[(i-1)*4+2].(*archive.ArchiveDetailsList))[0].Timestamp)
+		timestamp := time.Time(*(*responses[i*4+2].(*archive.ArchiveDetailsList))[0].Timestamp)
+		if i < 10 && !previous.Before(timestamp) || i > 10 && !previous.After(timestamp) {
+			t.Errorf("object at %v of the query %d returned after the object at %v", timestamp, i/10+1, previous)
+		}
+	}
+
+	// The objects can't be merged on a field of the body
+	archiveQueryList = archive.NewArchiveQueryList(0)
+	archiveQueryList.AppendElement(&archive.ArchiveQuery{
+		Domain:        &anyDomain,
+		Related:       mal.Long(0),
+		SortOrder:     mal.NewBoolean(true),
+		SortFieldName: mal.NewString("value"),
+	})
+	_, err = archiveService.Query(providerURL, mal.NewBoolean(true), valueOfSineType, *archiveQueryList, nil)
+	if err == nil {
+		t.Error("a query sorted on a field of the body merged by the consumer")
+	}
+}
+
+//======================================================================//
+//								RETENTION								//
+//======================================================================//
+func TestRetentionHandler(t *testing.T) {
+	// Variable that defines the ArchiveService
+	var archiveService *ArchiveService
+	// Create the Archive Service
+	archiveService = archiveService.CreateService().(*ArchiveService)
+	if archiveService.RetentionHandler == nil {
+		t.Error("no default handler of the purge reports")
+	}
+
+	// The purger goroutine hands its purges as soon as it's started
+	var backend = storage.NewMemoryBackend()
+	storeRetentionTestObjects(t, backend, time.Now())
+	var policy = archprovider.RetentionPolicy{
+		Rules: []storage.RetentionRule{
+			{ObjectType: valueOfSineType, MaxCount: 1},
+		},
+		Interval:  time.Hour,
+		BatchSize: 2,
+	}
+	var handled = make(chan archprovider.PurgeReport, 10)
+	var purger = archprovider.StartPurger(backend, policy, func(report archprovider.PurgeReport) {
+		handled <- report
+	})
+	select {
+	case report := <-handled:
+		if report.DryRun || report.Rule != 0 || len(report.Objects) == 0 {
+			t.Errorf("unexpected report: %+v", report)
+		}
+	case <-time.After(10 * time.Second):
+		t.Error("no purge handled by the goroutine")
+	}
+	purger.Stop()
+	if counts := countRetentionTestObjects(t, backend); counts[0] != 1 || counts[1] != 1 {
+		t.Errorf("%v objects left instead of [1 1]", counts)
+	}
+}
+
+func TestServiceWithoutProvider(t *testing.T) {
+	// Variable that defines the ArchiveService
+	var archiveService *ArchiveService
+	// Create the Archive Service
+	archiveService = archiveService.CreateService().(*ArchiveService)
+	archiveService.Backend = storage.NewMemoryBackend()
+
+	// The history and the tombstones are only read on the backend of the
+	// provider started by the service
+	var domain = newTestDomain("fr", "cnes", "archiveservice")
+	_, err := archiveService.History(valueOfSineType, domain, 1)
+	if err == nil {
+		t.Error("history read without a started provider")
+	}
+	_, _, err = archiveService.RetrieveAsOf(valueOfSineType, domain, longListOf(0), time.Now())
+	if err == nil {
+		t.Error("objects retrieved as of a time without a started provider")
+	}
+	_, err = archiveService.DeletedObjects(time.Now())
+	if err == nil {
+		t.Error("tombstones read without a started provider")
+	}
+	_, err = archiveService.Restore(valueOfSineType, domain, longListOf(0))
+	if err == nil {
+		t.Error("objects restored without a started provider")
+	}
+	_, err = archiveService.PurgeDeleted(valueOfSineType, domain, longListOf(0))
+	if err == nil {
+		t.Error("tombstones purged without a started provider")
+	}
+}
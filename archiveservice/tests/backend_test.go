@@ -0,0 +1,111 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package tests
+
+import (
+	"testing"
+
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/storage"
+)
+
+// backendCheck checks a part of the contract of storage.ArchiveBackend on
+// a new, empty backend
+type backendCheck struct {
+	name  string
+	check func(t *testing.T, backend storage.ArchiveBackend)
+}
+
+// backendChecks is the contract suite which every backend must pass
+var backendChecks = []backendCheck{
+	{"TimeRange", checkTimeRange},
+	{"SourceMatching", checkSourceMatching},
+	{"BodyFilters", checkBodyFilters},
+	{"ExpressionOperators", checkExpressionOperators},
+	{"DomainWildcards", checkDomainWildcards},
+	{"NullRelated", checkNullRelated},
+	{"InstIDUniqueness", checkInstIDUniqueness},
+	{"InstIDAllocation", checkInstIDAllocation},
+	{"BatchStoreRetrieve", checkBatchStoreRetrieve},
+	{"StreamQuery", checkStreamQuery},
+	{"StreamQueryGlobalOrder", checkStreamQueryGlobalOrder},
+	{"QueryGrouping", checkQueryGrouping},
+	{"SortFields", checkSortFields},
+	{"StreamQuerySortFields", checkStreamQuerySortFields},
+	{"ObjectHistory", checkObjectHistory},
+	{"SoftDelete", checkSoftDelete},
+	{"DeletedGracePeriod", checkDeletedGracePeriod},
+	{"SelectExpired", checkSelectExpired},
+	{"Purger", checkPurger},
+}
+
+// historyOf returns the history of a backend of the suite, which must
+// implement all the optional interfaces
+func historyOf(t *testing.T, backend storage.ArchiveBackend) storage.HistoryBackend {
+	history, ok := backend.(storage.HistoryBackend)
+	if !ok {
+		t.Fatalf("%T doesn't implement HistoryBackend", backend)
+	}
+	return history
+}
+
+// softDeleteOf returns the soft delete of a backend of the suite
+func softDeleteOf(t *testing.T, backend storage.ArchiveBackend) storage.SoftDeleteBackend {
+	softDelete, ok := backend.(storage.SoftDeleteBackend)
+	if !ok {
+		t.Fatalf("%T doesn't implement SoftDeleteBackend", backend)
+	}
+	return softDelete
+}
+
+// retentionOf returns the retention of a backend of the suite
+func retentionOf(t *testing.T, backend storage.ArchiveBackend) storage.RetentionBackend {
+	retention, ok := backend.(storage.RetentionBackend)
+	if !ok {
+		t.Fatalf("%T doesn't implement RetentionBackend", backend)
+	}
+	return retention
+}
+
+// runBackendChecks runs each check of the suite on a new backend
+func runBackendChecks(t *testing.T, newBackend func(t *testing.T) storage.ArchiveBackend) {
+	for _, backendCheck := range backendChecks {
+		backendCheck := backendCheck
+		t.Run(backendCheck.name, func(t *testing.T) {
+			backendCheck.check(t, newBackend(t))
+		})
+	}
+}
+
+func TestMemoryBackendContract(t *testing.T) {
+	runBackendChecks(t, func(t *testing.T) storage.ArchiveBackend {
+		return storage.NewMemoryBackend()
+	})
+}
+
+func TestSQLiteBackendContract(t *testing.T) {
+	runBackendChecks(t, func(t *testing.T) storage.ArchiveBackend {
+		return newSQLiteTestBackend(t, storage.PoolConfig{})
+	})
+}
@@ -0,0 +1,121 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package tests
+
+import (
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/CNES/ccsdsmo-malgo/mal"
+
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/storage"
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/testarchivearea/testarchiveservice"
+)
+
+// Numbers of objects per call of the batch benchmarks
+var batchSizes = []int{1, 100, 10000}
+
+// checkBatchStoreRetrieve stores more objects than a multi-row statement
+// inserts and checks that they are retrieved in the order of the request
+func checkBatchStoreRetrieve(t *testing.T, backend storage.ArchiveBackend) {
+	var domain = newTestDomain("fr", "cnes", "batch")
+	var count = storage.MAX_INSERT_ROWS + 500
+	archiveDetailsList, elementList := newTestObjects(count, domain, "network", time.Now())
+	longList, err := backend.StoreInArchive(mal.NewBoolean(true), valueOfSineType, domain, archiveDetailsList, elementList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if longList.Size() != count {
+		t.Fatalf("%d identifiers returned instead of %d", longList.Size(), count)
+	}
+
+	// The object stored at the index i has the value i
+	var request = mal.LongList{(*longList)[1200], (*longList)[3], (*longList)[1499], (*longList)[0], (*longList)[3]}
+	var expected = []mal.Float{1200, 3, 1499, 0, 3}
+	retDetails, retElements, err := backend.RetrieveInArchive(valueOfSineType, domain, request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if retDetails.Size() != len(expected) || retElements.Size() != len(expected) {
+		t.Fatalf("%d objects retrieved instead of %d", retDetails.Size(), len(expected))
+	}
+	for i := range expected {
+		if retDetails[i].InstId != *request[i] {
+			t.Errorf("object %d retrieved instead of %d", retDetails[i].InstId, *request[i])
+		}
+		if value := retElements.GetElementAt(i).(*testarchiveservice.ValueOfSine).Value; value != expected[i] {
+			t.Errorf("value %v retrieved instead of %v", value, expected[i])
+		}
+	}
+
+	// All of them
+	retDetails, _, err = backend.RetrieveInArchive(valueOfSineType, domain, *longList)
+	if err != nil || retDetails.Size() != count {
+		t.Fatal("retrieve of the whole batch failed:", err)
+	}
+
+	// An unknown object in the request
+	_, _, err = backend.RetrieveInArchive(valueOfSineType, domain, mal.LongList{(*longList)[0], mal.NewLong(-1)})
+	if err == nil || err.Error() != string(mal.ERROR_UNKNOWN_MESSAGE) {
+		t.Error("UNKNOWN error expected:", err)
+	}
+}
+
+func BenchmarkSQLiteBackendStoreBatch(b *testing.B) {
+	for _, size := range batchSizes {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			backend := newSQLiteTestBackend(b, storage.PoolConfig{})
+			archiveDetailsList, elementList := newTestObjects(size, sqliteTestDomain, "network", time.Now())
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, err := backend.StoreInArchive(nil, valueOfSineType, sqliteTestDomain, archiveDetailsList, elementList)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkSQLiteBackendRetrieveBatch(b *testing.B) {
+	for _, size := range batchSizes {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			backend := newSQLiteTestBackend(b, storage.PoolConfig{})
+			archiveDetailsList, elementList := newTestObjects(size, sqliteTestDomain, "network", time.Now())
+			longList, err := backend.StoreInArchive(mal.NewBoolean(true), valueOfSineType, sqliteTestDomain, archiveDetailsList, elementList)
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, _, err := backend.RetrieveInArchive(valueOfSineType, sqliteTestDomain, *longList)
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
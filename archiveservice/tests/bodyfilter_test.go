@@ -0,0 +1,228 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package tests
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/CNES/ccsdsmo-malgo/com"
+	"github.com/CNES/ccsdsmo-malgo/com/archive"
+	"github.com/CNES/ccsdsmo-malgo/mal"
+
+	. "github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/constants"
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/storage"
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/testarchivearea/testarchiveservice"
+)
+
+// sineType is the object type of the Sine objects
+var sineType = com.ObjectType{
+	Area:    valueOfSineType.Area,
+	Service: valueOfSineType.Service,
+	Version: valueOfSineType.Version,
+	Number:  mal.UShort(testarchiveservice.SINE_TYPE_SHORT_FORM),
+}
+
+// objectIDType is the object type of test objects whose body is an
+// ObjectId, a composite holding other composites
+var objectIDType = com.ObjectType{
+	Area:    valueOfSineType.Area,
+	Service: valueOfSineType.Service,
+	Version: valueOfSineType.Version,
+	Number:  100,
+}
+
+func init() {
+	err := objectIDType.RegisterMALBodyType(com.OBJECTID_SHORT_FORM)
+	if err != nil {
+		panic(err)
+	}
+}
+
+// bodyFilterQuery is a query with a single filter on a field of the body
+type bodyFilterQuery struct {
+	name       string
+	fieldName  string
+	operator   archive.ExpressionOperator
+	fieldValue mal.Attribute
+	expected   int64
+}
+
+// countWithFilter counts the objects of a domain matching a filter
+func countWithFilter(backend storage.ArchiveBackend, objectType com.ObjectType, domain mal.IdentifierList, fieldName string, operator archive.ExpressionOperator, fieldValue mal.Attribute) (int64, error) {
+	var archiveQueryList = archive.NewArchiveQueryList(0)
+	archiveQueryList.AppendElement(&archive.ArchiveQuery{
+		Domain:  &domain,
+		Related: mal.Long(0),
+	})
+	var filters = archive.NewCompositeFilterList(0)
+	filters.AppendElement(&archive.CompositeFilter{
+		FieldName:  mal.String(fieldName),
+		Type:       operator,
+		FieldValue: fieldValue,
+	})
+	var queryFilterList = archive.NewCompositeFilterSetList(0)
+	queryFilterList.AppendElement(&archive.CompositeFilterSet{*filters})
+	longList, err := backend.CountInArchive(objectType, *archiveQueryList, queryFilterList)
+	if err != nil {
+		return 0, err
+	}
+	return int64(*(*longList)[0]), nil
+}
+
+// checkBodyQueries runs a list of queries and checks the number of
+// objects selected by Count and by Query
+func checkBodyQueries(t *testing.T, backend storage.ArchiveBackend, objectType com.ObjectType, domain mal.IdentifierList, queries []bodyFilterQuery) {
+	for _, query := range queries {
+		count, err := countWithFilter(backend, objectType, domain, query.fieldName, query.operator, query.fieldValue)
+		if err != nil {
+			t.Fatal(query.name, err)
+		}
+		if count != query.expected {
+			t.Errorf("%s: %d objects counted instead of %d", query.name, count, query.expected)
+		}
+
+		var filters = archive.NewCompositeFilterList(0)
+		filters.AppendElement(&archive.CompositeFilter{
+			FieldName:  mal.String(query.fieldName),
+			Type:       query.operator,
+			FieldValue: query.fieldValue,
+		})
+		_, archiveDetails, _, _, err := backend.QueryArchive(nil, objectType, archive.ArchiveQuery{
+			Domain:  &domain,
+			Related: mal.Long(0),
+		}, &archive.CompositeFilterSet{*filters})
+		if err != nil {
+			t.Fatal(query.name, err)
+		}
+		var found int64
+		for _, list := range archiveDetails {
+			found += int64(list.Size())
+		}
+		if found != query.expected {
+			t.Errorf("%s: %d objects found instead of %d", query.name, found, query.expected)
+		}
+	}
+}
+
+// checkBodyFilters stores objects of different types and checks the
+// filters on the fields of their bodies
+func checkBodyFilters(t *testing.T, backend storage.ArchiveBackend) {
+	var domain = newTestDomain("fr", "cnes", "body")
+
+	// ValueOfSine objects holding the values 0 to 4
+	archiveDetailsList, elementList := newTestObjects(5, domain, "network", time.Now())
+	_, err := backend.StoreInArchive(nil, valueOfSineType, domain, archiveDetailsList, elementList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkBodyQueries(t, backend, valueOfSineType, domain, []bodyFilterQuery{
+		{"equal", "value", archive.EXPRESSIONOPERATOR_EQUAL, mal.NewFloat(2), 1},
+		{"differ", "value", archive.EXPRESSIONOPERATOR_DIFFER, mal.NewFloat(2), 4},
+		{"greater", "value", archive.EXPRESSIONOPERATOR_GREATER, mal.NewFloat(2), 2},
+		{"greater or equal", "value", archive.EXPRESSIONOPERATOR_GREATER_OR_EQUAL, mal.NewFloat(2), 3},
+		{"less", "value", archive.EXPRESSIONOPERATOR_LESS, mal.NewFloat(2), 2},
+		{"less or equal", "value", archive.EXPRESSIONOPERATOR_LESS_OR_EQUAL, mal.NewFloat(2), 3},
+		{"other numeric type", "value", archive.EXPRESSIONOPERATOR_LESS, mal.NewLong(1), 1},
+		{"prefixed name", "element.value", archive.EXPRESSIONOPERATOR_GREATER, mal.NewFloat(3.5), 1},
+		{"not null", "value", archive.EXPRESSIONOPERATOR_DIFFER, nil, 5},
+	})
+
+	// Sine objects
+	var sineDetailsList, _ = newTestObjects(3, domain, "network", time.Now())
+	var sineList = testarchiveservice.NewSineList(0)
+	for i := 0; i < 3; i++ {
+		sineDetailsList[i].Details.Source.Type = sineType
+		sineList.AppendElement(&testarchiveservice.Sine{T: mal.Long(10 * i), Y: mal.Float(-i)})
+	}
+	_, err = backend.StoreInArchive(nil, sineType, domain, sineDetailsList, sineList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkBodyQueries(t, backend, sineType, domain, []bodyFilterQuery{
+		{"T", "T", archive.EXPRESSIONOPERATOR_GREATER_OR_EQUAL, mal.NewLong(10), 2},
+		{"Y", "Y", archive.EXPRESSIONOPERATOR_LESS, mal.NewFloat(-0.5), 2},
+		{"lower case", "t", archive.EXPRESSIONOPERATOR_EQUAL, mal.NewLong(20), 1},
+	})
+
+	// The Long values are compared exactly, 2^53 + 1 can't be held by a float
+	var largeDetailsList, _ = newTestObjects(1, domain, "network", time.Now())
+	largeDetailsList[0].Details.Source.Type = sineType
+	var largeList = testarchiveservice.NewSineList(0)
+	largeList.AppendElement(&testarchiveservice.Sine{T: mal.Long(1<<53 + 1), Y: mal.Float(0)})
+	_, err = backend.StoreInArchive(nil, sineType, domain, largeDetailsList, largeList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkBodyQueries(t, backend, sineType, domain, []bodyFilterQuery{
+		{"large long equal", "T", archive.EXPRESSIONOPERATOR_EQUAL, mal.NewLong(1 << 53), 0},
+		{"large long greater", "T", archive.EXPRESSIONOPERATOR_GREATER, mal.NewLong(1 << 53), 1},
+	})
+
+	// ObjectId objects: the fields of the nested composites are reached
+	// through their path
+	var idDetailsList, _ = newTestObjects(2, domain, "network", time.Now())
+	var objectIDList = com.NewObjectIdList(0)
+	for i := 0; i < 2; i++ {
+		objectIDList.AppendElement(&com.ObjectId{
+			Type: sineType,
+			Key:  com.ObjectKey{Domain: newTestDomain("fr", "cnes"), InstId: mal.Long(i + 1)},
+		})
+	}
+	_, err = backend.StoreInArchive(nil, objectIDType, domain, idDetailsList, objectIDList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkBodyQueries(t, backend, objectIDType, domain, []bodyFilterQuery{
+		{"nested field", "key.instId", archive.EXPRESSIONOPERATOR_EQUAL, mal.NewLong(2), 1},
+		{"nested composite", "type.number", archive.EXPRESSIONOPERATOR_EQUAL, mal.NewUShort(uint16(sineType.Number)), 2},
+	})
+
+	// With a wildcard in the object type, the objects whose body doesn't
+	// hold the field are not selected
+	var anyNumber = valueOfSineType
+	anyNumber.Number = 0
+	checkBodyQueries(t, backend, anyNumber, domain, []bodyFilterQuery{
+		{"wildcard type", "value", archive.EXPRESSIONOPERATOR_GREATER_OR_EQUAL, mal.NewFloat(0), 5},
+	})
+
+	// The unknown fields are rejected
+	for _, query := range []struct {
+		objectType com.ObjectType
+		fieldName  string
+	}{
+		{valueOfSineType, "unknown"},
+		{valueOfSineType, "value.unknown"},
+		{sineType, "value"},
+		{objectIDType, "key.unknown"},
+		{objectIDType, "key"},
+	} {
+		_, err := countWithFilter(backend, query.objectType, domain, query.fieldName, archive.EXPRESSIONOPERATOR_EQUAL, mal.NewLong(0))
+		if err == nil || !strings.Contains(err.Error(), string(ARCHIVE_SERVICE_QUERY_QUERY_FILTER_ERROR)) {
+			t.Errorf("%s: unknown field accepted: %v", query.fieldName, err)
+		}
+	}
+}
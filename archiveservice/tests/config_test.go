@@ -0,0 +1,313 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package tests
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/config"
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/storage"
+)
+
+// writeTestFile writes a file in the temporary directory of a test
+func writeTestFile(t *testing.T, dir string, name string, content string) string {
+	path := filepath.Join(dir, name)
+	err := ioutil.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+// newTestDir creates a temporary directory removed at the end of a test
+func newTestDir(tb testing.TB) string {
+	dir, err := ioutil.TempDir("", "archive")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+// setTestEnv sets an environment variable until the end of a test
+func setTestEnv(t *testing.T, name string, value string) {
+	oldValue, isSet := os.LookupEnv(name)
+	os.Setenv(name, value)
+	t.Cleanup(func() {
+		if isSet {
+			os.Setenv(name, oldValue)
+		} else {
+			os.Unsetenv(name)
+		}
+	})
+}
+
+// clearConfigEnv clears the environment variables of the configuration
+// until the end of a test
+func clearConfigEnv(t *testing.T) {
+	for _, name := range []string{config.ENV_CONFIG, config.ENV_PROVIDER_URI, config.ENV_PROVIDER_NAME,
+		config.ENV_QUERY_CHUNK_OBJECTS, config.ENV_QUERY_CHUNK_BYTES, config.ENV_GLOBAL_SORT_ORDER,
+		config.ENV_BACKEND, config.ENV_DSN, config.ENV_DSN_FILE, config.ENV_TABLE, config.ENV_MAX_OPEN_CONNS,
+		config.ENV_MAX_IDLE_CONNS, config.ENV_CONN_MAX_LIFETIME, config.ENV_MIGRATE, config.ENV_LOG_LEVEL,
+		config.ENV_RETENTION_INTERVAL, config.ENV_RETENTION_BATCH_SIZE, config.ENV_RETENTION_DRY_RUN,
+		config.ENV_SOFT_DELETE, config.ENV_RETENTION_DELETED_GRACE_PERIOD} {
+		setTestEnv(t, name, "")
+	}
+}
+
+func TestConfigDefault(t *testing.T) {
+	clearConfigEnv(t)
+	cfg, err := config.Load([]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Provider.URI != config.DEFAULT_PROVIDER_URI || cfg.Provider.Name != "archiveServiceProvider" {
+		t.Errorf("unexpected provider: %+v", cfg.Provider)
+	}
+	if cfg.Database.Backend != "mysql" || cfg.Database.Table != "Archive" {
+		t.Errorf("unexpected database: %+v", cfg.Database)
+	}
+	dsn, err := cfg.DataSourceName()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dsn != config.DEFAULT_MYSQL_DSN {
+		t.Errorf("unexpected data source name: %s", dsn)
+	}
+}
+
+func TestConfigOverrides(t *testing.T) {
+	clearConfigEnv(t)
+	dir := newTestDir(t)
+	configFile := writeTestFile(t, dir, "archive.json", `{
+		"provider": {"uri": "maltcp://127.0.0.1:13000", "name": "fileProvider"},
+		"database": {"backend": "postgres", "dsn": "postgres://file@localhost/archive", "table": "FileArchive"},
+		"logLevel": "DEBUG"
+	}`)
+
+	// The environment overrides the file
+	setTestEnv(t, config.ENV_CONFIG, configFile)
+	setTestEnv(t, config.ENV_PROVIDER_NAME, "envProvider")
+	setTestEnv(t, config.ENV_TABLE, "EnvArchive")
+
+	// The command line overrides the environment
+	cfg, err := config.Load([]string{"-table", "FlagArchive", "-log-level", "WARNING"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.Provider.URI != "maltcp://127.0.0.1:13000" {
+		t.Errorf("the provider URI should be read from the file: %s", cfg.Provider.URI)
+	}
+	if cfg.Provider.Name != "envProvider" {
+		t.Errorf("the provider name should be read from the environment: %s", cfg.Provider.Name)
+	}
+	if cfg.Database.Backend != "postgres" || cfg.Database.DSN != "postgres://file@localhost/archive" {
+		t.Errorf("the database should be read from the file: %+v", cfg.Database)
+	}
+	if cfg.Database.Table != "FlagArchive" {
+		t.Errorf("the table should be read from the command line: %s", cfg.Database.Table)
+	}
+	if cfg.LogLevel != "WARNING" {
+		t.Errorf("the log level should be read from the command line: %s", cfg.LogLevel)
+	}
+}
+
+func TestConfigDSNFile(t *testing.T) {
+	clearConfigEnv(t)
+	dir := newTestDir(t)
+	dsnFile := writeTestFile(t, dir, "dsn", "archiveService:secret@/archive?parseTime=true\n")
+
+	cfg, err := config.Load([]string{"-dsn", "ignored", "-dsn-file", dsnFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dsn, err := cfg.DataSourceName()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dsn != "archiveService:secret@/archive?parseTime=true" {
+		t.Errorf("the data source name should be read from the file: %s", dsn)
+	}
+
+	// A missing file is reported
+	cfg.Database.DSNFile = filepath.Join(dir, "missing")
+	_, err = cfg.DataSourceName()
+	if err == nil {
+		t.Errorf("an error should be returned for a missing file")
+	}
+}
+
+func TestConfigPool(t *testing.T) {
+	clearConfigEnv(t)
+	setTestEnv(t, config.ENV_MAX_OPEN_CONNS, "8")
+
+	cfg, err := config.Load([]string{"-max-idle-conns", "4", "-conn-max-lifetime", "5m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, err := cfg.Pool()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pool.MaxOpenConns != 8 || pool.MaxIdleConns != 4 || pool.ConnMaxLifetime != 5*time.Minute {
+		t.Errorf("unexpected pool: %+v", pool)
+	}
+
+	// Invalid values are reported
+	_, err = config.Load([]string{"-max-open-conns", "many"})
+	if err == nil {
+		t.Errorf("an error should be returned for an invalid number of connections")
+	}
+	cfg.Database.ConnMaxLifetime = "forever"
+	_, err = cfg.Pool()
+	if err == nil {
+		t.Errorf("an error should be returned for an invalid lifetime")
+	}
+}
+
+func TestConfigQueryChunkLimits(t *testing.T) {
+	clearConfigEnv(t)
+	cfg, err := config.Load([]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ChunkLimits() != storage.DefaultChunkLimits() {
+		t.Errorf("unexpected default limits: %+v", cfg.ChunkLimits())
+	}
+
+	setTestEnv(t, config.ENV_QUERY_CHUNK_OBJECTS, "10")
+	cfg, err = config.Load([]string{"-query-chunk-bytes", "0"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.ChunkLimits() != (storage.ChunkLimits{MaxObjects: 10, MaxBytes: 0}) {
+		t.Errorf("unexpected limits: %+v", cfg.ChunkLimits())
+	}
+}
+
+func TestConfigRetention(t *testing.T) {
+	clearConfigEnv(t)
+	cfg, err := config.Load([]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, err := cfg.RetentionPolicy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policy.Rules) != 0 || policy.Interval != time.Hour || policy.BatchSize != 1000 || policy.DryRun || policy.DeletedGracePeriod != 0 {
+		t.Errorf("unexpected default policy: %+v", policy)
+	}
+
+	dir := newTestDir(t)
+	configFile := writeTestFile(t, dir, "archive.json", `{
+		"retention": {
+			"interval": "10m",
+			"rules": [
+				{"area": 2, "service": 3, "version": 1, "number": 1, "domain": "fr.cnes.*", "maxAge": "720h"},
+				{"area": 2, "maxCount": 100}
+			]
+		}
+	}`)
+	setTestEnv(t, config.ENV_RETENTION_BATCH_SIZE, "50")
+	cfg, err = config.Load([]string{"-config", configFile, "-retention-dry-run", "true"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	policy, err = cfg.RetentionPolicy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.Interval != 10*time.Minute || policy.BatchSize != 50 || !policy.DryRun || len(policy.Rules) != 2 {
+		t.Fatalf("unexpected policy: %+v", policy)
+	}
+	var rule = policy.Rules[0]
+	if rule.ObjectType.Number != 1 || len(rule.Domain) != 3 || *rule.Domain[2] != "*" || rule.MaxAge != 720*time.Hour || rule.MaxCount != 0 {
+		t.Errorf("unexpected rule: %+v", rule)
+	}
+	rule = policy.Rules[1]
+	if rule.ObjectType.Area != 2 || rule.ObjectType.Number != 0 || rule.Domain != nil || rule.MaxAge != 0 || rule.MaxCount != 100 {
+		t.Errorf("unexpected rule: %+v", rule)
+	}
+
+	// A rule without limit is rejected
+	cfg.Retention.Rules[1].MaxCount = 0
+	_, err = cfg.RetentionPolicy()
+	if err == nil {
+		t.Errorf("a rule without limit should be rejected")
+	}
+}
+
+func TestConfigSoftDelete(t *testing.T) {
+	clearConfigEnv(t)
+	cfg, err := config.Load([]string{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Database.SoftDelete || cfg.Retention.DeletedGracePeriod != "" {
+		t.Errorf("soft delete enabled by default: %+v", cfg)
+	}
+
+	setTestEnv(t, config.ENV_SOFT_DELETE, "true")
+	setTestEnv(t, config.ENV_RETENTION_DELETED_GRACE_PERIOD, "1h")
+	cfg, err = config.Load([]string{"-retention-deleted-grace-period", "720h"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !cfg.Database.SoftDelete {
+		t.Errorf("soft delete not enabled by the environment")
+	}
+	policy, err := cfg.RetentionPolicy()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.DeletedGracePeriod != 720*time.Hour {
+		t.Errorf("grace period %v instead of 720h", policy.DeletedGracePeriod)
+	}
+
+	// A negative grace period is rejected
+	cfg.Retention.DeletedGracePeriod = "-1h"
+	_, err = cfg.RetentionPolicy()
+	if err == nil {
+		t.Errorf("a negative grace period should be rejected")
+	}
+}
+
+func TestConfigUnknownBackend(t *testing.T) {
+	clearConfigEnv(t)
+	cfg, err := config.Load([]string{"-backend", "unknown"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cfg.NewBackend()
+	if err == nil {
+		t.Errorf("an error should be returned for an unknown backend")
+	}
+}
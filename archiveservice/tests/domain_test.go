@@ -0,0 +1,114 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/CNES/ccsdsmo-malgo/com/archive"
+	"github.com/CNES/ccsdsmo-malgo/mal"
+
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/storage"
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/utils"
+)
+
+// checkDomainWildcards stores objects in different domains and checks
+// the wildcards of the domain given in a query
+func checkDomainWildcards(t *testing.T, backend storage.ArchiveBackend) {
+	var domains = []mal.IdentifierList{
+		newTestDomain("fr", "cnes", "a"),
+		newTestDomain("fr", "cnes", "b"),
+		newTestDomain("fr", "cnes", "test"),
+		newTestDomain("fr", "esa", "test"),
+		newTestDomain("fr", "cnes"),
+		newTestDomain("fr", "cnes", "a", "b"),
+		newTestDomain("fr", "cnes", "b", "c"),
+		newTestDomain("fr", "x", "y", "b", "c"),
+		// An identifier holding a dot is not a level of the domain
+		newTestDomain("fr", "cnes.test"),
+		newTestDomain("fr", "c%", "test"),
+	}
+	for _, domain := range domains {
+		archiveDetailsList, elementList := newTestObjects(1, domain, "network", time.Now())
+		_, err := backend.StoreInArchive(nil, valueOfSineType, domain, archiveDetailsList, elementList)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, query := range []struct {
+		name     string
+		domain   mal.IdentifierList
+		expected int64
+	}{
+		{"exact domain", newTestDomain("fr", "cnes", "a"), 1},
+		{"wildcard at the end", newTestDomain("fr", "cnes", "*"), 5},
+		{"wildcard in the middle", newTestDomain("fr", "*", "test"), 3},
+		{"wildcard at the beginning", newTestDomain("*", "cnes", "b"), 1},
+		{"all the sub-domains", newTestDomain("fr", "*"), 10},
+		{"sub-domains of a longer domain", newTestDomain("*", "*", "*", "*"), 3},
+		{"wildcards in the middle and at the end", newTestDomain("fr", "*", "b", "*"), 1},
+		{"wildcard at the end of an exact level", newTestDomain("fr", "cnes", "a", "*"), 1},
+		{"identifier with a dot", newTestDomain("fr", "cnes.test"), 1},
+		{"levels of the identifier with a dot", newTestDomain("fr", "cnes", "test"), 1},
+		{"wildcard and identifier with a dot", newTestDomain("*", "cnes.test"), 1},
+		{"percent is not a wildcard", newTestDomain("fr", "c%", "*"), 1},
+		{"unknown domain", newTestDomain("fr", "*", "unknown"), 0},
+	} {
+		var domain = query.domain
+		var archiveQueryList = archive.NewArchiveQueryList(0)
+		archiveQueryList.AppendElement(&archive.ArchiveQuery{
+			Domain:  &domain,
+			Related: mal.Long(0),
+		})
+		longList, err := backend.CountInArchive(valueOfSineType, *archiveQueryList, nil)
+		if err != nil {
+			t.Fatal(query.name, err)
+		}
+		if int64(*(*longList)[0]) != query.expected {
+			t.Errorf("%s: %d objects counted instead of %d", query.name, *(*longList)[0], query.expected)
+		}
+
+		// Query returns the domains of the selected objects
+		_, archiveDetails, identifierLists, _, err := backend.QueryArchive(mal.NewBoolean(true), valueOfSineType, archive.ArchiveQuery{
+			Domain:  &domain,
+			Related: mal.Long(0),
+		}, nil)
+		if err != nil {
+			t.Fatal(query.name, err)
+		}
+		var found int64
+		for i, list := range archiveDetails {
+			found += int64(list.Size())
+			if !utils.MatchDomain(*identifierLists[i], query.domain) {
+				t.Errorf("%s: domain %v returned", query.name, utils.AdaptDomainToString(*identifierLists[i]))
+			}
+		}
+		if found != query.expected {
+			t.Errorf("%s: %d objects found instead of %d", query.name, found, query.expected)
+		}
+	}
+}
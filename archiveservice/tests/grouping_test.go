@@ -0,0 +1,202 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package tests
+
+import (
+	"fmt"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/CNES/ccsdsmo-malgo/com"
+	"github.com/CNES/ccsdsmo-malgo/com/archive"
+	"github.com/CNES/ccsdsmo-malgo/mal"
+
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/storage"
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/testarchivearea/testarchiveservice"
+)
+
+// Numbers of object types and of domains over which the objects of the
+// grouping tests are spread
+const (
+	groupingTypes   = 20
+	groupingDomains = 25
+)
+
+// Numbers of objects per query of the grouping benchmarks
+var groupingSizes = []int{1000, 10000, 100000}
+
+// groupingType returns the i-th object type of the grouping tests, their
+// bodies are ValueOfSine
+func groupingType(i int) com.ObjectType {
+	var objectType = valueOfSineType
+	objectType.Number = mal.UShort(1000 + i)
+	return objectType
+}
+
+// groupingDomain returns the i-th domain of the grouping tests
+func groupingDomain(i int) mal.IdentifierList {
+	return newTestDomain("fr", "cnes", "grouping", "d"+strconv.Itoa(i))
+}
+
+func init() {
+	for i := 0; i < groupingTypes; i++ {
+		objectType := groupingType(i)
+		err := objectType.RegisterMALBodyType(testarchiveservice.VALUEOFSINE_SHORT_FORM)
+		if err != nil {
+			panic(err)
+		}
+	}
+}
+
+// storeGroupingObjects stores perGroup objects of each object type in each
+// domain of the grouping tests
+func storeGroupingObjects(tb testing.TB, backend storage.ArchiveBackend, perGroup int) {
+	for i := 0; i < groupingTypes; i++ {
+		for j := 0; j < groupingDomains; j++ {
+			domain := groupingDomain(j)
+			archiveDetailsList, elementList := newTestObjects(perGroup, domain, "network", time.Now())
+			_, err := backend.StoreInArchive(nil, groupingType(i), domain, archiveDetailsList, elementList)
+			if err != nil {
+				tb.Fatal(err)
+			}
+		}
+	}
+}
+
+// queryGroupingObjects queries the objects of the grouping tests
+func queryGroupingObjects(backend storage.ArchiveBackend, boolean *mal.Boolean, objectType com.ObjectType) ([]*com.ObjectType, []*archive.ArchiveDetailsList, []*mal.IdentifierList, []mal.ElementList, error) {
+	var domain = newTestDomain("fr", "cnes", "grouping", "*")
+	return backend.QueryArchive(boolean, objectType, archive.ArchiveQuery{
+		Domain:  &domain,
+		Related: mal.Long(0),
+	}, nil)
+}
+
+// checkQueryGrouping checks the groups returned by QueryArchive for the
+// four combinations of returned bodies and wildcard in the object type
+func checkQueryGrouping(t *testing.T, backend storage.ArchiveBackend) {
+	const perGroup = 3
+	storeGroupingObjects(t, backend, perGroup)
+
+	var anyNumber = valueOfSineType
+	anyNumber.Number = 0
+	for _, query := range []struct {
+		name       string
+		returnBody bool
+		objectType com.ObjectType
+		groups     int
+		perGroup   int
+	}{
+		{"bodies and wildcard", true, anyNumber, groupingTypes * groupingDomains, perGroup},
+		{"bodies", true, groupingType(0), groupingDomains, perGroup},
+		{"wildcard", false, anyNumber, groupingTypes, groupingDomains * perGroup},
+		{"neither bodies nor wildcard", false, groupingType(0), 1, groupingDomains * perGroup},
+	} {
+		objectTypes, archiveDetailsLists, domains, elementLists, err := queryGroupingObjects(backend, mal.NewBoolean(query.returnBody), query.objectType)
+		if err != nil {
+			t.Fatal(query.name, err)
+		}
+		if len(archiveDetailsLists) != query.groups || len(objectTypes) != query.groups || len(domains) != query.groups || len(elementLists) != query.groups {
+			t.Errorf("%s: %d groups instead of %d", query.name, len(archiveDetailsLists), query.groups)
+			continue
+		}
+
+		var seen = make(map[string]bool)
+		for i := range archiveDetailsLists {
+			if archiveDetailsLists[i].Size() != query.perGroup {
+				t.Errorf("%s: %d objects in a group instead of %d", query.name, archiveDetailsLists[i].Size(), query.perGroup)
+			}
+			if (objectTypes[i] != nil) != (query.objectType == anyNumber) {
+				t.Errorf("%s: unexpected object type %v", query.name, objectTypes[i])
+			}
+			if (domains[i] != nil) != query.returnBody || elementLists[i].IsNull() == query.returnBody {
+				t.Errorf("%s: unexpected domain %v", query.name, domains[i])
+			}
+
+			// Each group is returned once and holds objects of its
+			// object type and domain
+			var key string
+			if objectTypes[i] != nil {
+				key = fmt.Sprint(objectTypes[i].Number)
+			}
+			if domains[i] != nil {
+				key += " " + string(*(*domains[i])[3])
+			}
+			if seen[key] {
+				t.Errorf("%s: the group %s is returned twice", query.name, key)
+			}
+			seen[key] = true
+			for _, archiveDetails := range *archiveDetailsLists[i] {
+				var source = archiveDetails.Details.Source
+				if domains[i] != nil && *source.Key.Domain[3] != *(*domains[i])[3] {
+					t.Errorf("%s: object of the domain %s in the group %s", query.name, *source.Key.Domain[3], key)
+				}
+			}
+			if query.returnBody && elementLists[i].Size() != query.perGroup {
+				t.Errorf("%s: %d elements in a group instead of %d", query.name, elementLists[i].Size(), query.perGroup)
+			}
+		}
+	}
+}
+
+// benchmarkQueryGrouping queries objects spread over all the object types
+// and domains of the grouping tests, with the bodies. The time per object
+// is reported: it doesn't depend on the number of objects as the objects
+// are grouped in linear time.
+func benchmarkQueryGrouping(b *testing.B, newBackend func(b *testing.B) storage.ArchiveBackend) {
+	var anyNumber = valueOfSineType
+	anyNumber.Number = 0
+	for _, size := range groupingSizes {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			backend := newBackend(b)
+			storeGroupingObjects(b, backend, size/(groupingTypes*groupingDomains))
+			b.ResetTimer()
+			var start = time.Now()
+			for i := 0; i < b.N; i++ {
+				_, archiveDetailsLists, _, _, err := queryGroupingObjects(backend, mal.NewBoolean(true), anyNumber)
+				if err != nil {
+					b.Fatal(err)
+				}
+				if len(archiveDetailsLists) != groupingTypes*groupingDomains {
+					b.Fatalf("%d groups instead of %d", len(archiveDetailsLists), groupingTypes*groupingDomains)
+				}
+			}
+			b.ReportMetric(float64(time.Since(start).Nanoseconds())/float64(b.N*size), "ns/object")
+		})
+	}
+}
+
+func BenchmarkMemoryBackendQueryGrouping(b *testing.B) {
+	benchmarkQueryGrouping(b, func(b *testing.B) storage.ArchiveBackend {
+		return storage.NewMemoryBackend()
+	})
+}
+
+func BenchmarkSQLiteBackendQueryGrouping(b *testing.B) {
+	benchmarkQueryGrouping(b, func(b *testing.B) storage.ArchiveBackend {
+		return newSQLiteTestBackend(b, storage.PoolConfig{})
+	})
+}
@@ -0,0 +1,197 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/CNES/ccsdsmo-malgo/mal"
+
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/storage"
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/testarchivearea/testarchiveservice"
+)
+
+// updateTestObject updates an object with a new value and network
+func updateTestObject(t *testing.T, backend storage.ArchiveBackend, domain mal.IdentifierList, instID mal.Long, value float64, network string) {
+	archiveDetailsList, elementList := newTestObjects(1, domain, network, time.Now())
+	archiveDetailsList[0].InstId = instID
+	(*elementList)[0] = NewValueOfSine(mal.Float(value))
+	err := backend.UpdateArchive(valueOfSineType, domain, archiveDetailsList, elementList)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// retrievedValues retrieves objects as of a time and returns the values
+// of their bodies
+func retrievedValues(t *testing.T, backend storage.ArchiveBackend, domain mal.IdentifierList, instIDs []int64, asOf time.Time) []float64 {
+	var longList = mal.NewLongList(0)
+	for _, instID := range instIDs {
+		longList.AppendElement(mal.NewLong(instID))
+	}
+	_, elementList, err := historyOf(t, backend).RetrieveAsOf(valueOfSineType, domain, *longList, asOf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return bodyValues(elementList)
+}
+
+// checkObjectHistory checks that the versions replaced by the Update
+// operation are kept and can be retrieved
+func checkObjectHistory(t *testing.T, backend storage.ArchiveBackend) {
+	var history = historyOf(t, backend)
+	var domain = newTestDomain("fr", "cnes", "history")
+	var created = time.Now()
+	err := storeWithInstIDs(backend, valueOfSineType, domain, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Object 1 is updated twice, object 2 is never updated
+	var stored = time.Now()
+	updateTestObject(t, backend, domain, 1, 10, "first")
+	var firstUpdate = time.Now()
+	updateTestObject(t, backend, domain, 1, 20, "second")
+	var secondUpdate = time.Now()
+
+	versions, err := history.ObjectHistory(valueOfSineType, domain, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 3 {
+		t.Fatalf("%d versions instead of 3", len(versions))
+	}
+	for i, expected := range []struct {
+		value   float64
+		network string
+		from    time.Time
+		to      time.Time
+	}{
+		{0, "network", stored, firstUpdate},
+		{10, "first", firstUpdate, secondUpdate},
+		{20, "second", time.Time{}, time.Time{}},
+	} {
+		var version = versions[i]
+		if version.Revision != i+1 {
+			t.Errorf("revision %d instead of %d", version.Revision, i+1)
+		}
+		if value := float64(version.Element.(*testarchiveservice.ValueOfSine).Value); value != expected.value {
+			t.Errorf("version %d: value %v instead of %v", version.Revision, value, expected.value)
+		}
+		if network := string(*version.ArchiveDetails.Network); network != expected.network {
+			t.Errorf("version %d: network %s instead of %s", version.Revision, network, expected.network)
+		}
+		if expected.from.IsZero() {
+			if !version.IsCurrent() {
+				t.Errorf("version %d is not the current version", version.Revision)
+			}
+		} else if version.Updated.Before(expected.from) || version.Updated.After(expected.to) {
+			t.Errorf("version %d: updated at %v, not between %v and %v", version.Revision, version.Updated, expected.from, expected.to)
+		}
+	}
+
+	// An object never updated only has its current version
+	versions, err = history.ObjectHistory(valueOfSineType, domain, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 1 || versions[0].Revision != 1 || !versions[0].IsCurrent() {
+		t.Errorf("unexpected history of an object never updated: %v", versions)
+	}
+	_, err = history.ObjectHistory(valueOfSineType, domain, 3)
+	if err == nil || err.Error() != string(mal.ERROR_UNKNOWN_MESSAGE) {
+		t.Errorf("UNKNOWN error expected: %v", err)
+	}
+
+	// The objects as of a time, in the order of the request or by id
+	for _, asOf := range []struct {
+		time     time.Time
+		instIDs  []int64
+		expected []float64
+	}{
+		{stored, []int64{1, 2}, []float64{0, 1}},
+		{firstUpdate, []int64{2, 1}, []float64{1, 10}},
+		{secondUpdate, []int64{1}, []float64{20}},
+		{firstUpdate, []int64{0}, []float64{10, 1}},
+	} {
+		values := retrievedValues(t, backend, domain, asOf.instIDs, asOf.time)
+		if !isEqualValues(values, asOf.expected) {
+			t.Errorf("%v as of %v instead of %v", values, asOf.time, asOf.expected)
+		}
+	}
+	_, _, err = history.RetrieveAsOf(valueOfSineType, domain, mal.LongList{mal.NewLong(3)}, stored)
+	if err == nil || err.Error() != string(mal.ERROR_UNKNOWN_MESSAGE) {
+		t.Errorf("UNKNOWN error expected: %v", err)
+	}
+
+	// The objects stored after the time didn't exist yet
+	err = storeWithInstIDs(backend, valueOfSineType, domain, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values := retrievedValues(t, backend, domain, []int64{0}, secondUpdate); !isEqualValues(values, []float64{20, 1}) {
+		t.Errorf("%v as of %v instead of the objects stored before", values, secondUpdate)
+	}
+	for _, instIDs := range [][]int64{{3}, {1, 3}} {
+		_, _, err = history.RetrieveAsOf(valueOfSineType, domain, longListOf(instIDs...), secondUpdate)
+		if err == nil || err.Error() != string(mal.ERROR_UNKNOWN_MESSAGE) {
+			t.Errorf("%v: UNKNOWN error expected: %v", instIDs, err)
+		}
+	}
+	_, _, err = history.RetrieveAsOf(valueOfSineType, domain, longListOf(0), created)
+	if err == nil || err.Error() != string(mal.ERROR_UNKNOWN_MESSAGE) {
+		t.Errorf("UNKNOWN error expected before the objects are stored: %v", err)
+	}
+
+	// Retrieve and Query only return the current versions
+	_, elementList, err := backend.RetrieveInArchive(valueOfSineType, domain, mal.LongList{mal.NewLong(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values := bodyValues(elementList); !isEqualValues(values, []float64{20}) {
+		t.Errorf("%v retrieved instead of the current version", values)
+	}
+	if count := countObjects(t, backend, valueOfSineType, domain); count != 3 {
+		t.Errorf("%d objects counted instead of 3", count)
+	}
+
+	// The history is deleted with the object
+	_, err = backend.DeleteInArchive(valueOfSineType, domain, mal.LongList{mal.NewLong(1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = storeWithInstIDs(backend, valueOfSineType, domain, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions, err = history.ObjectHistory(valueOfSineType, domain, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 1 {
+		t.Errorf("%d versions of a new object instead of 1", len(versions))
+	}
+}
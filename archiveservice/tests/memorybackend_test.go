@@ -0,0 +1,227 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+package tests
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/CNES/ccsdsmo-malgo/com"
+	"github.com/CNES/ccsdsmo-malgo/com/archive"
+	"github.com/CNES/ccsdsmo-malgo/mal"
+
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/storage"
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/testarchivearea"
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/testarchivearea/testarchiveservice"
+)
+
+// valueOfSineType is the object type of the ValueOfSine objects
+var valueOfSineType = com.ObjectType{
+	Area:    testarchivearea.AREA_NUMBER,
+	Service: testarchiveservice.SERVICE_NUMBER,
+	Version: testarchivearea.AREA_VERSION,
+	Number:  mal.UShort(testarchiveservice.VALUEOFSINE_TYPE_SHORT_FORM),
+}
+
+// newTestObjects creates count ValueOfSine objects and their ArchiveDetails,
+// the timestamps are separated by one second starting at start
+func newTestObjects(count int, domain mal.IdentifierList, network string, start time.Time) (archive.ArchiveDetailsList, *testarchiveservice.ValueOfSineList) {
+	var archiveDetailsList = *archive.NewArchiveDetailsList(0)
+	var elementList = testarchiveservice.NewValueOfSineList(0)
+	for i := 0; i < count; i++ {
+		elementList.AppendElement(NewValueOfSine(mal.Float(i)))
+		var objectID = com.ObjectId{
+			Type: valueOfSineType,
+			Key: com.ObjectKey{
+				Domain: domain,
+				InstId: mal.Long(0),
+			},
+		}
+		var objectDetails = com.ObjectDetails{
+			Related: mal.NewLong(1),
+			Source:  &objectID,
+		}
+		archiveDetailsList.AppendElement(&archive.ArchiveDetails{
+			mal.Long(0),
+			objectDetails,
+			mal.NewIdentifier(network),
+			mal.NewFineTime(start.Add(time.Duration(i) * time.Second)),
+			mal.NewURI("tests/provider"),
+		})
+	}
+	return archiveDetailsList, elementList
+}
+
+func TestMemoryBackendStoreRetrieve(t *testing.T) {
+	var backend = storage.NewMemoryBackend()
+	var domain = mal.IdentifierList([]*mal.Identifier{mal.NewIdentifier("fr"), mal.NewIdentifier("cnes")})
+	archiveDetailsList, elementList := newTestObjects(10, domain, "network", time.Now())
+
+	longList, err := backend.StoreInArchive(mal.NewBoolean(true), valueOfSineType, domain, archiveDetailsList, elementList)
+	if err != nil || longList == nil || longList.Size() != 10 {
+		t.Fatal("store failed:", err)
+	}
+
+	// Retrieve one object
+	retDetails, retElements, err := backend.RetrieveInArchive(valueOfSineType, domain, mal.LongList([]*mal.Long{(*longList)[3]}))
+	if err != nil || retDetails.Size() != 1 || retElements.Size() != 1 {
+		t.Fatal("retrieve failed:", err)
+	}
+	if retElements.GetElementAt(0).(*testarchiveservice.ValueOfSine).Value != 3 {
+		t.Fatal("wrong element retrieved")
+	}
+
+	// Retrieve all of them
+	retDetails, _, err = backend.RetrieveInArchive(valueOfSineType, domain, mal.LongList([]*mal.Long{mal.NewLong(0)}))
+	if err != nil || retDetails.Size() != 10 {
+		t.Fatal("retrieve all failed:", err)
+	}
+
+	// Store an object with an existing identifier
+	archiveDetailsList, elementList = newTestObjects(1, domain, "network", time.Now())
+	archiveDetailsList[0].InstId = *(*longList)[0]
+	_, err = backend.StoreInArchive(nil, valueOfSineType, domain, archiveDetailsList, elementList)
+	if err == nil || err.Error() != string(com.ERROR_DUPLICATE) {
+		t.Fatal("DUPLICATE error expected:", err)
+	}
+
+	// Retrieve an unknown object
+	_, _, err = backend.RetrieveInArchive(valueOfSineType, domain, mal.LongList([]*mal.Long{mal.NewLong(-1)}))
+	if err == nil || err.Error() != string(mal.ERROR_UNKNOWN_MESSAGE) {
+		t.Fatal("UNKNOWN error expected:", err)
+	}
+}
+
+func TestMemoryBackendQueryCount(t *testing.T) {
+	var backend = storage.NewMemoryBackend()
+	var domain1 = mal.IdentifierList([]*mal.Identifier{mal.NewIdentifier("fr"), mal.NewIdentifier("cnes")})
+	var domain2 = mal.IdentifierList([]*mal.Identifier{mal.NewIdentifier("en"), mal.NewIdentifier("cnes")})
+	var start = time.Now()
+	archiveDetailsList, elementList := newTestObjects(10, domain1, "network1", start)
+	_, err := backend.StoreInArchive(nil, valueOfSineType, domain1, archiveDetailsList, elementList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	archiveDetailsList, elementList = newTestObjects(5, domain2, "network2", start)
+	_, err = backend.StoreInArchive(nil, valueOfSineType, domain2, archiveDetailsList, elementList)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Query all the objects in descending order, with a wildcard object type
+	archiveQuery := archive.ArchiveQuery{
+		Related:   mal.Long(0),
+		SortOrder: mal.NewBoolean(false),
+	}
+	objectTypes, archiveDetails, domains, elements, err := backend.QueryArchive(mal.NewBoolean(true), com.ObjectType{}, archiveQuery, nil)
+	if err != nil || len(archiveDetails) != 2 || objectTypes[0] == nil || domains[0] == nil {
+		t.Fatal("query failed:", err)
+	}
+	if archiveDetails[0].Size()+archiveDetails[1].Size() != 15 || elements[0].Size() != archiveDetails[0].Size() {
+		t.Fatal("wrong number of objects")
+	}
+	for i := 1; i < archiveDetails[0].Size(); i++ {
+		if time.Time(*(*archiveDetails[0])[i].Timestamp).After(time.Time(*(*archiveDetails[0])[i-1].Timestamp)) {
+			t.Fatal("objects are not sorted")
+		}
+	}
+
+	// Count with a filter on the network and a time window
+	var filters = archive.NewCompositeFilterList(0)
+	filters.AppendElement(&archive.CompositeFilter{
+		FieldName:  mal.String("network"),
+		Type:       archive.EXPRESSIONOPERATOR_EQUAL,
+		FieldValue: mal.NewString("network1"),
+	})
+	var queryFilterList = archive.NewCompositeFilterSetList(0)
+	queryFilterList.AppendElement(&archive.CompositeFilterSet{*filters})
+	var startTime = mal.NewFineTime(start.Add(2 * time.Second))
+	var archiveQueryList = archive.NewArchiveQueryList(0)
+	archiveQueryList.AppendElement(&archive.ArchiveQuery{
+		Related:   mal.Long(1),
+		StartTime: startTime,
+	})
+	longList, err := backend.CountInArchive(valueOfSineType, *archiveQueryList, queryFilterList)
+	if err != nil || longList.Size() != 1 || *(*longList)[0] != 8 {
+		t.Fatal("count failed:", err, longList)
+	}
+}
+
+func TestMemoryBackendUpdateDelete(t *testing.T) {
+	var backend = storage.NewMemoryBackend()
+	var domain = mal.IdentifierList([]*mal.Identifier{mal.NewIdentifier("fr"), mal.NewIdentifier("cnes")})
+	archiveDetailsList, elementList := newTestObjects(3, domain, "network", time.Now())
+	longList, err := backend.StoreInArchive(mal.NewBoolean(true), valueOfSineType, domain, archiveDetailsList, elementList)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Update the first object
+	archiveDetailsList, elementList = newTestObjects(1, domain, "new.network", time.Now())
+	archiveDetailsList[0].InstId = *(*longList)[0]
+	(*elementList)[0].Value = 0.5
+	err = backend.UpdateArchive(valueOfSineType, domain, archiveDetailsList, elementList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	retDetails, retElements, err := backend.RetrieveInArchive(valueOfSineType, domain, mal.LongList([]*mal.Long{(*longList)[0]}))
+	if err != nil || *(*retDetails)[0].Network != "new.network" || retElements.GetElementAt(0).(*testarchiveservice.ValueOfSine).Value != 0.5 {
+		t.Fatal("update failed:", err)
+	}
+
+	// Delete all the objects
+	deleted, err := backend.DeleteInArchive(valueOfSineType, domain, mal.LongList([]*mal.Long{mal.NewLong(0)}))
+	if err != nil || deleted.Size() != 3 {
+		t.Fatal("delete failed:", err)
+	}
+	_, err = backend.DeleteInArchive(valueOfSineType, domain, mal.LongList([]*mal.Long{mal.NewLong(0)}))
+	if err == nil || err.Error() != string(mal.ERROR_UNKNOWN_MESSAGE) {
+		t.Fatal("UNKNOWN error expected:", err)
+	}
+}
+
+func TestMemoryBackendConcurrentStore(t *testing.T) {
+	var backend = storage.NewMemoryBackend()
+	var domain = mal.IdentifierList([]*mal.Identifier{mal.NewIdentifier("fr"), mal.NewIdentifier("cnes")})
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			archiveDetailsList, elementList := newTestObjects(10, domain, "network", time.Now())
+			_, err := backend.StoreInArchive(nil, valueOfSineType, domain, archiveDetailsList, elementList)
+			if err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	retDetails, _, err := backend.RetrieveInArchive(valueOfSineType, domain, mal.LongList([]*mal.Long{mal.NewLong(0)}))
+	if err != nil || retDetails.Size() != 100 {
+		t.Fatal("concurrent stores failed:", err)
+	}
+}
@@ -0,0 +1,386 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package tests
+
+import (
+	"database/sql"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/CNES/ccsdsmo-malgo/com"
+	"github.com/CNES/ccsdsmo-malgo/com/archive"
+	"github.com/CNES/ccsdsmo-malgo/mal"
+
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/config"
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/storage"
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/utils"
+)
+
+// lastSchemaVersion is the version of the schema expected by the backend
+func lastSchemaVersion() int {
+	var migrations = storage.Migrations()
+	return migrations[len(migrations)-1].Version
+}
+
+func TestMigrationsOrder(t *testing.T) {
+	for i, migration := range storage.Migrations() {
+		if migration.Version != i+1 {
+			t.Errorf("migration %d has the version %d", i, migration.Version)
+		}
+		if migration.Description == "" || (migration.Statements == nil && migration.Apply == nil) {
+			t.Errorf("migration %d is incomplete", migration.Version)
+		}
+	}
+}
+
+func TestSQLiteBackendMigrateFromNothing(t *testing.T) {
+	var path = filepath.Join(newTestDir(t), "archive.db")
+	backend := storage.NewSQLBackend(storage.SQLiteDialect{}, storage.SQLiteDataSourceName(path), storage.TABLE)
+	defer backend.Close()
+
+	version, err := backend.SchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 0 {
+		t.Errorf("version %d of an empty database", version)
+	}
+
+	// All the migrations are applied, then none
+	for i := 0; i < 2; i++ {
+		err = backend.Migrate()
+		if err != nil {
+			t.Fatal(err)
+		}
+		version, err = backend.SchemaVersion()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != lastSchemaVersion() {
+			t.Errorf("version %d instead of %d", version, lastSchemaVersion())
+		}
+	}
+
+	// The created table can be used
+	var instIDs = storeTestObjects(t, backend, 3)
+	archiveDetailsList, _, err := backend.RetrieveInArchive(valueOfSineType, sqliteTestDomain, instIDs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if archiveDetailsList.Size() != 3 {
+		t.Errorf("%d objects retrieved instead of 3", archiveDetailsList.Size())
+	}
+}
+
+func TestSQLiteBackendMigrateExistingTable(t *testing.T) {
+	var path = filepath.Join(newTestDir(t), "archive.db")
+	var dialect = storage.SQLiteDialect{}
+
+	// A table created before the migrations, whose null related are 0
+	db, err := sql.Open(dialect.DriverName(), storage.SQLiteDataSourceName(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, statement := range dialect.SchemaStatements(storage.TABLE) {
+		if _, err = db.Exec(statement); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, err = db.Exec(`INSERT INTO "Archive" ("objectInstanceIdentifier", "details.related") VALUES (1, 0), (2, 5)`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend, err := storage.NewSQLiteBackend(path, storage.TABLE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	version, err := backend.SchemaVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != lastSchemaVersion() {
+		t.Errorf("version %d instead of %d", version, lastSchemaVersion())
+	}
+
+	// The rows are kept and their null related are NULL
+	var related []sql.NullInt64
+	rows, err := db.Query(`SELECT "details.related" FROM "Archive" ORDER BY "objectInstanceIdentifier"`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var value sql.NullInt64
+		if err = rows.Scan(&value); err != nil {
+			t.Fatal(err)
+		}
+		related = append(related, value)
+	}
+	if len(related) != 2 || related[0].Valid || !related[1].Valid || related[1].Int64 != 5 {
+		t.Errorf("unexpected related after the migration: %v", related)
+	}
+}
+
+// Archive table created before the timestamps were stored as nanoseconds
+// and the source columns were added
+const baselineSQLiteSchema = "CREATE TABLE Archive (" +
+	"id INTEGER PRIMARY KEY, " +
+	"objectInstanceIdentifier BIGINT, " +
+	"element BLOB, " +
+	"area SMALLINT, " +
+	"service SMALLINT, " +
+	"version TINYINT, " +
+	"number SMALLINT, " +
+	"domain TEXT, " +
+	"timestamp DATETIME, " +
+	"`details.related` BIGINT, " +
+	"network TEXT, " +
+	"provider TEXT, " +
+	"`details.source` BLOB)"
+
+func TestSQLiteBackendMigrateBaselineTable(t *testing.T) {
+	var path = filepath.Join(newTestDir(t), "archive.db")
+
+	// An object stored in the baseline table, whose timestamp is written
+	// by the driver as a date
+	db, err := sql.Open(storage.SQLiteDialect{}.DriverName(), storage.SQLiteDataSourceName(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err = db.Exec(baselineSQLiteSchema); err != nil {
+		t.Fatal(err)
+	}
+	var timestamp = time.Date(2020, 1, 2, 3, 4, 5, 123456789, time.UTC)
+	var source = com.ObjectId{Type: valueOfSineType, Key: com.ObjectKey{Domain: newTestDomain("fr", "cnes", "a"), InstId: 7}}
+	encodedElement, encodedSource, err := utils.EncodeElements(NewValueOfSine(1), &source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO Archive (objectInstanceIdentifier, element, area, service, version, number, domain, timestamp, `details.related`, network, provider, `details.source`)"+
+		" VALUES (1, ?, ?, ?, ?, ?, ?, ?, 0, 'network', 'provider', ?)",
+		encodedElement, valueOfSineType.Area, valueOfSineType.Service, valueOfSineType.Version, valueOfSineType.Number,
+		string(utils.AdaptDomainToString(sqliteTestDomain)), timestamp, encodedSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An object stored before the '%' of the identifiers were escaped
+	var percentDomain = newTestDomain("fr", "50%", "test")
+	var percentSource = com.ObjectId{Type: valueOfSineType, Key: com.ObjectKey{Domain: newTestDomain("fr", "50%"), InstId: 8}}
+	encodedElement, encodedSource, err = utils.EncodeElements(NewValueOfSine(2), &percentSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO Archive (objectInstanceIdentifier, element, area, service, version, number, domain, timestamp, `details.related`, network, provider, `details.source`)"+
+		" VALUES (2, ?, ?, ?, ?, ?, 'fr.50%.test', ?, 0, 'network', 'provider', ?)",
+		encodedElement, valueOfSineType.Area, valueOfSineType.Service, valueOfSineType.Version, valueOfSineType.Number,
+		timestamp, encodedSource)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	backend, err := storage.NewSQLiteBackend(path, storage.TABLE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+
+	// The timestamp is converted to nanoseconds
+	archiveDetailsList, _, err := backend.RetrieveInArchive(valueOfSineType, sqliteTestDomain, longListOf(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if archiveDetailsList.Size() != 1 {
+		t.Fatalf("%d objects retrieved instead of 1", archiveDetailsList.Size())
+	}
+	if !time.Time(*archiveDetailsList[0].Timestamp).Equal(timestamp) {
+		t.Errorf("wrong timestamp: %v instead of %v", time.Time(*archiveDetailsList[0].Timestamp), timestamp)
+	}
+
+	// The source columns are filled from the encoded source
+	var archiveQueryList = archive.NewArchiveQueryList(0)
+	archiveQueryList.AppendElement(&archive.ArchiveQuery{
+		Domain:  &sqliteTestDomain,
+		Related: mal.Long(0),
+		Source:  &source,
+	})
+	longList, err := backend.CountInArchive(valueOfSineType, *archiveQueryList, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *(*longList)[0] != 1 {
+		t.Errorf("%d objects of the source instead of 1", *(*longList)[0])
+	}
+
+	// The domains are escaped
+	archiveDetailsList, _, err = backend.RetrieveInArchive(valueOfSineType, percentDomain, longListOf(2))
+	if err != nil || archiveDetailsList.Size() != 1 {
+		t.Errorf("object of the domain with a '%%' not retrieved: %v", err)
+	}
+	archiveQueryList = archive.NewArchiveQueryList(0)
+	archiveQueryList.AppendElement(&archive.ArchiveQuery{
+		Domain:  &percentDomain,
+		Related: mal.Long(0),
+		Source:  &percentSource,
+	})
+	longList, err = backend.CountInArchive(valueOfSineType, *archiveQueryList, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *(*longList)[0] != 1 {
+		t.Errorf("%d objects of the source with a '%%' instead of 1", *(*longList)[0])
+	}
+
+	// New objects can be stored in the converted table
+	storeTestObjects(t, backend, 2)
+}
+
+func TestConfigMigrate(t *testing.T) {
+	clearConfigEnv(t)
+	var dir = newTestDir(t)
+
+	// An empty database is created from nothing by default
+	cfg, err := config.Load([]string{"-backend", "sqlite", "-dsn", filepath.Join(dir, "archive.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Database.Migrate {
+		t.Error("the migrations of a table holding objects are applied by default")
+	}
+	backend, err := cfg.NewBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, err := backend.(*storage.SQLBackend).SchemaVersion()
+	if err != nil || version != lastSchemaVersion() {
+		t.Errorf("version %d instead of %d: %v", version, lastSchemaVersion(), err)
+	}
+	_, err = backend.CountInArchive(valueOfSineType, *archive.NewArchiveQueryList(0), nil)
+	if err != nil {
+		t.Error(err)
+	}
+	backend.Close()
+
+	// A table holding objects isn't migrated without the flag
+	var path = filepath.Join(dir, "baseline.db")
+	db, err := sql.Open(storage.SQLiteDialect{}.DriverName(), storage.SQLiteDataSourceName(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err = db.Exec(baselineSQLiteSchema); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Exec("INSERT INTO Archive (objectInstanceIdentifier) VALUES (1)"); err != nil {
+		t.Fatal(err)
+	}
+	cfg, err = config.Load([]string{"-backend", "sqlite", "-dsn", path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = cfg.NewBackend()
+	if err == nil {
+		t.Error("a table holding objects has been migrated without the flag")
+	}
+	backend, err = cfg.OpenBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+	version, err = backend.(*storage.SQLBackend).SchemaVersion()
+	backend.Close()
+	if err != nil || version != 0 {
+		t.Errorf("version %d of a table which hasn't been migrated: %v", version, err)
+	}
+
+	// It's migrated with the flag
+	cfg.Database.Migrate = true
+	backend, err = cfg.NewBackend()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+	version, err = backend.(*storage.SQLBackend).SchemaVersion()
+	if err != nil || version != lastSchemaVersion() {
+		t.Errorf("version %d instead of %d: %v", version, lastSchemaVersion(), err)
+	}
+}
+
+func TestSQLiteBackendIndexes(t *testing.T) {
+	var path = filepath.Join(newTestDir(t), "archive.db")
+	var dialect = storage.SQLiteDialect{}
+	backend, err := storage.NewSQLiteBackend(path, storage.TABLE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer backend.Close()
+
+	db, err := sql.Open(dialect.DriverName(), storage.SQLiteDataSourceName(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// The indexes are created by the migrations
+	var indexes = make(map[string]bool)
+	rows, err := db.Query(`SELECT "name" FROM "sqlite_master" WHERE "type" = 'index' AND "tbl_name" = ?`, storage.TABLE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var name string
+		if err = rows.Scan(&name); err != nil {
+			t.Fatal(err)
+		}
+		indexes[name] = true
+	}
+	for _, name := range []string{storage.TABLE + "ObjectKey", storage.TABLE + "TypeTimestamp"} {
+		if !indexes[name] {
+			t.Errorf("index %s not found in %v", name, indexes)
+		}
+	}
+
+	// The database rejects an object instance identifier used twice
+	// for a type in a domain
+	var insert = `INSERT INTO "Archive" ("objectInstanceIdentifier", "area", "service", "version", "number", "domain") VALUES (1, 2, 3, 1, 1, ?)`
+	if _, err = db.Exec(insert, "fr.cnes"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err = db.Exec(insert, "fr.cnes.other"); err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec(insert, "fr.cnes")
+	if err == nil || !dialect.IsUniqueViolation(err) {
+		t.Errorf("unique violation expected: %v", err)
+	}
+	if dialect.IsUniqueViolation(sql.ErrNoRows) {
+		t.Error("unique violation detected on another error")
+	}
+}
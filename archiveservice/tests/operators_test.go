@@ -0,0 +1,153 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/CNES/ccsdsmo-malgo/com/archive"
+	"github.com/CNES/ccsdsmo-malgo/mal"
+
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/storage"
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/utils"
+)
+
+// operatorQuery is a filter and the number of objects it must select,
+// an invalid filter must be rejected
+type operatorQuery struct {
+	name       string
+	operator   archive.ExpressionOperator
+	fieldValue mal.Attribute
+	expected   int64
+	invalid    bool
+}
+
+// checkOperators counts the objects selected by a list of filters on a field
+func checkOperators(t *testing.T, backend storage.ArchiveBackend, domain mal.IdentifierList, fieldName string, queries []operatorQuery) {
+	for _, query := range queries {
+		count, err := countWithFilter(backend, valueOfSineType, domain, fieldName, query.operator, query.fieldValue)
+		if query.invalid {
+			if err == nil {
+				t.Errorf("%s %s: invalid filter accepted", fieldName, query.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(fieldName, query.name, err)
+		}
+		if count != query.expected {
+			t.Errorf("%s %s: %d objects instead of %d", fieldName, query.name, count, query.expected)
+		}
+	}
+}
+
+// checkExpressionOperators stores five objects and checks every expression
+// operator on string, numeric, time and blob fields
+func checkExpressionOperators(t *testing.T, backend storage.ArchiveBackend) {
+	var domain = newTestDomain("fr", "cnes", "operators")
+	var start = time.Date(2020, 3, 1, 12, 0, 0, 0, time.UTC)
+	var networks = []string{"alpha", "Alpha", "be%ta", "delta", "gam_ma"}
+	archiveDetailsList, elementList := newTestObjects(len(networks), domain, "network", start)
+	for i, network := range networks {
+		archiveDetailsList[i].InstId = mal.Long(i + 1)
+		archiveDetailsList[i].Network = mal.NewIdentifier(network)
+		if i >= 3 {
+			// The source columns of these objects are NULL
+			archiveDetailsList[i].Details.Source = nil
+		}
+	}
+	_, err := backend.StoreInArchive(nil, valueOfSineType, domain, archiveDetailsList, elementList)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// String
+	checkOperators(t, backend, domain, "network", []operatorQuery{
+		{"equal", archive.EXPRESSIONOPERATOR_EQUAL, mal.NewIdentifier("alpha"), 1, false},
+		{"differ", archive.EXPRESSIONOPERATOR_DIFFER, mal.NewIdentifier("alpha"), 4, false},
+		{"greater", archive.EXPRESSIONOPERATOR_GREATER, mal.NewIdentifier("b"), 3, false},
+		{"greater or equal", archive.EXPRESSIONOPERATOR_GREATER_OR_EQUAL, mal.NewIdentifier("delta"), 2, false},
+		{"less", archive.EXPRESSIONOPERATOR_LESS, mal.NewIdentifier("b"), 2, false},
+		{"less or equal", archive.EXPRESSIONOPERATOR_LESS_OR_EQUAL, mal.NewIdentifier("alpha"), 2, false},
+		{"contains", archive.EXPRESSIONOPERATOR_CONTAINS, mal.NewString("lph"), 2, false},
+		{"contains with case", archive.EXPRESSIONOPERATOR_CONTAINS, mal.NewString("Al"), 1, false},
+		{"contains percent", archive.EXPRESSIONOPERATOR_CONTAINS, mal.NewString("%"), 1, false},
+		{"contains underscore", archive.EXPRESSIONOPERATOR_CONTAINS, mal.NewString("m_m"), 1, false},
+		{"underscore is not a wildcard", archive.EXPRESSIONOPERATOR_CONTAINS, mal.NewString("a_"), 0, false},
+		{"contains escape character", archive.EXPRESSIONOPERATOR_CONTAINS, mal.NewString("!"), 0, false},
+		{"icontains", archive.EXPRESSIONOPERATOR_ICONTAINS, mal.NewString("AL"), 2, false},
+		{"icontains percent", archive.EXPRESSIONOPERATOR_ICONTAINS, mal.NewString("E%T"), 1, false},
+		{"icontains nothing", archive.EXPRESSIONOPERATOR_ICONTAINS, mal.NewString("zeta"), 0, false},
+	})
+
+	// Numeric
+	checkOperators(t, backend, domain, "objectInstanceIdentifier", []operatorQuery{
+		{"equal", archive.EXPRESSIONOPERATOR_EQUAL, mal.NewLong(3), 1, false},
+		{"differ", archive.EXPRESSIONOPERATOR_DIFFER, mal.NewLong(3), 4, false},
+		{"greater", archive.EXPRESSIONOPERATOR_GREATER, mal.NewLong(3), 2, false},
+		{"greater or equal", archive.EXPRESSIONOPERATOR_GREATER_OR_EQUAL, mal.NewLong(3), 3, false},
+		{"less", archive.EXPRESSIONOPERATOR_LESS, mal.NewLong(3), 2, false},
+		{"less or equal", archive.EXPRESSIONOPERATOR_LESS_OR_EQUAL, mal.NewLong(3), 3, false},
+		{"contains", archive.EXPRESSIONOPERATOR_CONTAINS, mal.NewLong(3), 0, true},
+		{"icontains", archive.EXPRESSIONOPERATOR_ICONTAINS, mal.NewLong(3), 0, true},
+	})
+
+	// Time
+	var middle = start.Add(2 * time.Second)
+	checkOperators(t, backend, domain, "timestamp", []operatorQuery{
+		{"equal", archive.EXPRESSIONOPERATOR_EQUAL, mal.NewFineTime(middle), 1, false},
+		{"differ", archive.EXPRESSIONOPERATOR_DIFFER, mal.NewFineTime(middle), 4, false},
+		{"greater", archive.EXPRESSIONOPERATOR_GREATER, mal.NewFineTime(middle), 2, false},
+		{"greater or equal", archive.EXPRESSIONOPERATOR_GREATER_OR_EQUAL, mal.NewFineTime(middle), 3, false},
+		{"less", archive.EXPRESSIONOPERATOR_LESS, mal.NewFineTime(middle), 2, false},
+		{"less or equal", archive.EXPRESSIONOPERATOR_LESS_OR_EQUAL, mal.NewFineTime(middle), 3, false},
+		{"contains", archive.EXPRESSIONOPERATOR_CONTAINS, mal.NewFineTime(middle), 0, true},
+	})
+
+	// Blob: the element column holds the encoded bodies
+	encodedElement, _, err := utils.EncodeElements(NewValueOfSine(2), archiveDetailsList[2].Details.Source)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkOperators(t, backend, domain, "element", []operatorQuery{
+		{"equal", archive.EXPRESSIONOPERATOR_EQUAL, mal.NewBlob(encodedElement), 1, false},
+		{"differ", archive.EXPRESSIONOPERATOR_DIFFER, mal.NewBlob(encodedElement), 4, false},
+		{"greater", archive.EXPRESSIONOPERATOR_GREATER, mal.NewBlob(encodedElement), 0, true},
+		{"less", archive.EXPRESSIONOPERATOR_LESS, mal.NewBlob(encodedElement), 0, true},
+		{"contains", archive.EXPRESSIONOPERATOR_CONTAINS, mal.NewBlob(encodedElement), 0, true},
+	})
+
+	// NULL
+	checkOperators(t, backend, domain, "details.source.instId", []operatorQuery{
+		{"is null", archive.EXPRESSIONOPERATOR_EQUAL, nil, 2, false},
+		{"is not null", archive.EXPRESSIONOPERATOR_DIFFER, nil, 3, false},
+		{"greater than null", archive.EXPRESSIONOPERATOR_GREATER, nil, 0, true},
+		{"contains null", archive.EXPRESSIONOPERATOR_CONTAINS, nil, 0, true},
+		// A NULL column doesn't differ from a value
+		{"differ", archive.EXPRESSIONOPERATOR_DIFFER, mal.NewLong(1), 3, false},
+		{"equal", archive.EXPRESSIONOPERATOR_EQUAL, mal.NewLong(0), 3, false},
+	})
+}
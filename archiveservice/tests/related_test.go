@@ -0,0 +1,107 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/CNES/ccsdsmo-malgo/com/archive"
+	"github.com/CNES/ccsdsmo-malgo/mal"
+
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/storage"
+)
+
+// checkNullRelated stores objects with and without related object and
+// checks that a NULL related is kept and can be selected by a query
+func checkNullRelated(t *testing.T, backend storage.ArchiveBackend) {
+	var domain = newTestDomain("fr", "cnes", "related")
+	var relatedList = []*mal.Long{nil, nil, mal.NewLong(5), mal.NewLong(7)}
+	archiveDetailsList, elementList := newTestObjects(len(relatedList), domain, "network", time.Now())
+	for i, related := range relatedList {
+		archiveDetailsList[i].InstId = mal.Long(i + 1)
+		archiveDetailsList[i].Details.Related = related
+	}
+	_, err := backend.StoreInArchive(nil, valueOfSineType, domain, archiveDetailsList, elementList)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The related objects are returned as they were stored
+	retrieved, _, err := backend.RetrieveInArchive(valueOfSineType, domain, mal.LongList{mal.NewLong(1), mal.NewLong(3)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !retrieved[0].Details.Related.IsNull() {
+		t.Errorf("NULL related retrieved as %d", *retrieved[0].Details.Related)
+	}
+	if retrieved[1].Details.Related.IsNull() || *retrieved[1].Details.Related != 5 {
+		t.Errorf("related 5 retrieved as %v", retrieved[1].Details.Related)
+	}
+
+	for _, query := range []struct {
+		name     string
+		related  mal.Long
+		operator archive.ExpressionOperator
+		filter   bool
+		expected int64
+	}{
+		{"any related", 0, 0, false, 4},
+		{"given related", 5, 0, false, 1},
+		{"no related", 0, archive.EXPRESSIONOPERATOR_EQUAL, true, 2},
+		{"some related", 0, archive.EXPRESSIONOPERATOR_DIFFER, true, 2},
+		{"given related and no related", 5, archive.EXPRESSIONOPERATOR_EQUAL, true, 0},
+	} {
+		var archiveQuery = archive.ArchiveQuery{
+			Domain:  &domain,
+			Related: query.related,
+		}
+		var queryFilter archive.QueryFilter
+		if query.filter {
+			var filters = archive.NewCompositeFilterList(0)
+			filters.AppendElement(&archive.CompositeFilter{
+				FieldName: mal.String("details.related"),
+				Type:      query.operator,
+			})
+			queryFilter = &archive.CompositeFilterSet{*filters}
+		}
+		_, archiveDetails, _, _, err := backend.QueryArchive(nil, valueOfSineType, archiveQuery, queryFilter)
+		if err != nil {
+			t.Fatal(query.name, err)
+		}
+		var found int64
+		for _, list := range archiveDetails {
+			for _, details := range *list {
+				found++
+				if query.filter && query.operator == archive.EXPRESSIONOPERATOR_EQUAL && !details.Details.Related.IsNull() {
+					t.Errorf("%s: related %d returned", query.name, *details.Details.Related)
+				}
+			}
+		}
+		if found != query.expected {
+			t.Errorf("%s: %d objects instead of %d", query.name, found, query.expected)
+		}
+	}
+}
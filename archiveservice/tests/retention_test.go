@@ -0,0 +1,255 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package tests
+
+import (
+	"fmt"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/CNES/ccsdsmo-malgo/com/archive"
+	"github.com/CNES/ccsdsmo-malgo/mal"
+
+	archprovider "github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/provider"
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/storage"
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/testarchivearea/testarchiveservice"
+)
+
+// storeRetentionTestObjects stores objects aged of 10 hours to 1 hour, one
+// per hour: 10 ValueOfSine objects and 3 Sine objects in the domain a and
+// 4 ValueOfSine objects in the domain b. The objects of the same age are
+// stored in the domain a first.
+func storeRetentionTestObjects(t *testing.T, backend storage.ArchiveBackend, now time.Time) {
+	var start = now.Add(-10 * time.Hour)
+	for _, objects := range []struct {
+		domain mal.IdentifierList
+		count  int
+	}{{newTestDomain("fr", "cnes", "retention", "a"), 10}, {newTestDomain("fr", "cnes", "retention", "b"), 4}} {
+		archiveDetailsList, elementList := newTestObjects(objects.count, objects.domain, "network", start)
+		setHourlyTimestamps(archiveDetailsList, start)
+		_, err := backend.StoreInArchive(nil, valueOfSineType, objects.domain, archiveDetailsList, elementList)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var domain = newTestDomain("fr", "cnes", "retention", "a")
+	var sineDetailsList, _ = newTestObjects(3, domain, "network", start)
+	setHourlyTimestamps(sineDetailsList, start)
+	var sineList = testarchiveservice.NewSineList(0)
+	for i := 0; i < 3; i++ {
+		sineDetailsList[i].Details.Source.Type = sineType
+		sineList.AppendElement(&testarchiveservice.Sine{T: mal.Long(i), Y: mal.Float(i)})
+	}
+	_, err := backend.StoreInArchive(nil, sineType, domain, sineDetailsList, sineList)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// setHourlyTimestamps sets the timestamps of objects one hour apart
+func setHourlyTimestamps(archiveDetailsList archive.ArchiveDetailsList, start time.Time) {
+	for i, archiveDetails := range archiveDetailsList {
+		archiveDetails.Timestamp = mal.NewFineTime(start.Add(time.Duration(i) * time.Hour))
+	}
+}
+
+// expiredIDs returns the object instance identifiers of expired objects,
+// by object type number and last identifier of their domain (e.g. "1 a")
+func expiredIDs(objects []*storage.ExpiredObjects) map[string][]int64 {
+	var ids = make(map[string][]int64)
+	for _, expired := range objects {
+		var key = fmt.Sprintf("%d %s", expired.ObjectType.Number, *expired.Domain[len(expired.Domain)-1])
+		for _, instID := range expired.InstIDs {
+			ids[key] = append(ids[key], int64(*instID))
+		}
+	}
+	return ids
+}
+
+// checkExpiredIDs compares the expired objects with the expected ones, the
+// identifiers are compared in the order of the expired objects
+func checkExpiredIDs(t *testing.T, name string, objects []*storage.ExpiredObjects, expected map[string][]int64) {
+	var ids = expiredIDs(objects)
+	if fmt.Sprint(ids) != fmt.Sprint(expected) {
+		t.Errorf("%s: %v expired instead of %v", name, ids, expected)
+	}
+}
+
+// checkSelectExpired checks the objects selected by the retention rules
+func checkSelectExpired(t *testing.T, backend storage.ArchiveBackend) {
+	var now = time.Now()
+	storeRetentionTestObjects(t, backend, now)
+	var sine = fmt.Sprint(sineType.Number)
+	var value = fmt.Sprint(valueOfSineType.Number)
+	var anyDomain = newTestDomain("fr", "cnes", "retention", "*")
+	var domainA = newTestDomain("fr", "cnes", "retention", "a")
+	var anyNumber = valueOfSineType
+	anyNumber.Number = 0
+
+	for _, test := range []struct {
+		name     string
+		rule     storage.RetentionRule
+		offset   int
+		limit    int
+		expected map[string][]int64
+	}{
+		{"max age", storage.RetentionRule{ObjectType: valueOfSineType, Domain: anyDomain, MaxAge: 330 * time.Minute}, 0, 0,
+			map[string][]int64{value + " a": {1, 2, 3, 4, 5}, value + " b": {1, 2, 3, 4}}},
+		{"oldest first", storage.RetentionRule{ObjectType: valueOfSineType, Domain: anyDomain, MaxAge: 330 * time.Minute}, 0, 3,
+			map[string][]int64{value + " a": {1, 2}, value + " b": {1}}},
+		{"max count", storage.RetentionRule{ObjectType: valueOfSineType, Domain: anyDomain, MaxCount: 3}, 0, 0,
+			map[string][]int64{value + " a": {1, 2, 3, 4, 5, 6, 7}, value + " b": {1}}},
+		{"max age and count", storage.RetentionRule{ObjectType: valueOfSineType, Domain: anyDomain, MaxAge: 330 * time.Minute, MaxCount: 3}, 0, 0,
+			map[string][]int64{value + " a": {1, 2, 3, 4, 5, 6, 7}, value + " b": {1, 2, 3, 4}}},
+		{"object type pattern", storage.RetentionRule{ObjectType: anyNumber, Domain: newTestDomain("fr", "cnes", "retention", "a"), MaxCount: 1}, 0, 0,
+			map[string][]int64{value + " a": {1, 2, 3, 4, 5, 6, 7, 8, 9}, sine + " a": {1, 2}}},
+		{"all the objects", storage.RetentionRule{MaxAge: 330 * time.Minute}, 0, 0,
+			map[string][]int64{value + " a": {1, 2, 3, 4, 5}, value + " b": {1, 2, 3, 4}, sine + " a": {1, 2, 3}}},
+		{"next objects", storage.RetentionRule{ObjectType: valueOfSineType, Domain: anyDomain, MaxAge: 330 * time.Minute}, 3, 3,
+			map[string][]int64{value + " a": {3}, value + " b": {2, 3}}},
+		{"next objects of a group", storage.RetentionRule{ObjectType: valueOfSineType, Domain: domainA, MaxCount: 3}, 5, 0,
+			map[string][]int64{value + " a": {6, 7}}},
+		{"next objects beyond the max age", storage.RetentionRule{ObjectType: valueOfSineType, Domain: domainA, MaxAge: 330 * time.Minute, MaxCount: 3}, 6, 0,
+			map[string][]int64{value + " a": {7}}},
+		{"no expired object", storage.RetentionRule{ObjectType: valueOfSineType, MaxAge: 24 * time.Hour, MaxCount: 100}, 0, 0,
+			map[string][]int64{}},
+	} {
+		objects, err := retentionOf(t, backend).SelectExpired(test.rule, now, test.offset, test.limit)
+		if err != nil {
+			t.Fatal(test.name, err)
+		}
+		checkExpiredIDs(t, test.name, objects, test.expected)
+	}
+}
+
+// countRetentionTestObjects counts the ValueOfSine objects of each domain
+func countRetentionTestObjects(t *testing.T, backend storage.ArchiveBackend) []int64 {
+	var archiveQueryList = archive.NewArchiveQueryList(0)
+	for _, name := range []string{"a", "b"} {
+		var domain = newTestDomain("fr", "cnes", "retention", name)
+		archiveQueryList.AppendElement(&archive.ArchiveQuery{Domain: &domain, Related: mal.Long(0)})
+	}
+	longList, err := backend.CountInArchive(valueOfSineType, *archiveQueryList, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return []int64{int64(*(*longList)[0]), int64(*(*longList)[1])}
+}
+
+// checkPurger checks the purges of a retention policy, in dry-run mode
+// then by batches
+func checkPurger(t *testing.T, backend storage.ArchiveBackend) {
+	var now = time.Now()
+	storeRetentionTestObjects(t, backend, now)
+	var reports []archprovider.PurgeReport
+	var handle = func(report archprovider.PurgeReport) {
+		reports = append(reports, report)
+	}
+	var policy = archprovider.RetentionPolicy{
+		Rules: []storage.RetentionRule{
+			{ObjectType: valueOfSineType, MaxCount: 3},
+		},
+		Interval:  time.Hour,
+		BatchSize: 2,
+		DryRun:    true,
+	}
+
+	// Dry run: the objects are reported by batches, none is deleted
+	statistics, err := archprovider.NewPurger(backend, policy, handle).Purge(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var reported = make(map[string]bool)
+	for _, report := range reports {
+		if !report.DryRun {
+			t.Errorf("dry run: unexpected report %+v", report)
+		}
+		for key, ids := range expiredIDs(report.Objects) {
+			for _, id := range ids {
+				reported[fmt.Sprint(key, " ", id)] = true
+			}
+		}
+	}
+	if statistics.Objects != 8 || statistics.Batches != 4 || len(reports) != 4 || len(reported) != 8 {
+		t.Errorf("dry run: unexpected statistics %+v and objects reported %v", statistics, reported)
+	}
+	if counts := countRetentionTestObjects(t, backend); counts[0] != 10 || counts[1] != 4 {
+		t.Errorf("dry run: %v objects left instead of [10 4]", counts)
+	}
+
+	// Purge by batches of 2 objects
+	reports = nil
+	policy.DryRun = false
+	statistics, err = archprovider.NewPurger(backend, policy, handle).Purge(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var purged []string
+	for _, report := range reports {
+		if report.DryRun || report.Rule != 0 {
+			t.Errorf("unexpected report: %+v", report)
+		}
+		for key, ids := range expiredIDs(report.Objects) {
+			for _, id := range ids {
+				purged = append(purged, fmt.Sprint(key, " ", id))
+			}
+		}
+	}
+	sort.Strings(purged)
+	if statistics.Objects != 8 || statistics.Batches != 4 || len(purged) != 8 {
+		t.Errorf("unexpected statistics %+v and objects purged %v", statistics, purged)
+	}
+	if counts := countRetentionTestObjects(t, backend); counts[0] != 3 || counts[1] != 3 {
+		t.Errorf("%v objects left instead of [3 3]", counts)
+	}
+
+	// Nothing is left to purge
+	statistics, err = archprovider.NewPurger(backend, policy, handle).Purge(now)
+	if err != nil || statistics.Objects != 0 {
+		t.Errorf("unexpected second purge: %+v %v", statistics, err)
+	}
+
+	// The objects are deleted for good in soft delete mode
+	softDeleteOf(t, backend).SetSoftDelete(true)
+	policy.Rules[0] = storage.RetentionRule{ObjectType: valueOfSineType, MaxAge: time.Minute}
+	_, err = archprovider.NewPurger(backend, policy, nil).Purge(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counts := countRetentionTestObjects(t, backend); counts[0] != 0 || counts[1] != 0 {
+		t.Errorf("%v objects left instead of [0 0]", counts)
+	}
+	tombstones, err := softDeleteOf(t, backend).SelectDeleted(now.Add(time.Hour), 0, 0)
+	if err != nil || len(tombstones) != 0 {
+		t.Errorf("tombstones left by the retention: %v %v", tombstones, err)
+	}
+
+	// The objects which no longer exist are skipped
+	longList, err := retentionOf(t, backend).DeleteExpired(valueOfSineType, newTestDomain("fr", "cnes", "retention", "a"), longListOf(1, 1000))
+	if err != nil || longList.Size() != 0 {
+		t.Errorf("unexpected deletion of objects which no longer exist: %v %v", longValues(longList), err)
+	}
+}
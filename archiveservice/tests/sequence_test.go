@@ -0,0 +1,151 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package tests
+
+import (
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/CNES/ccsdsmo-malgo/mal"
+
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/storage"
+)
+
+// storeAndReturn stores objects with the given object instance
+// identifiers and returns the identifiers of the stored objects
+func storeAndReturn(t *testing.T, backend storage.ArchiveBackend, domain mal.IdentifierList, instIDs ...mal.Long) []int64 {
+	archiveDetailsList, elementList := newTestObjects(len(instIDs), domain, "network", time.Now())
+	for i, instID := range instIDs {
+		archiveDetailsList[i].InstId = instID
+	}
+	longList, err := backend.StoreInArchive(mal.NewBoolean(true), valueOfSineType, domain, archiveDetailsList, elementList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored []int64
+	for _, instID := range *longList {
+		stored = append(stored, int64(*instID))
+	}
+	return stored
+}
+
+// checkInstIDAllocation checks that the object instance identifiers are
+// allocated in increasing order for each object type in each domain
+func checkInstIDAllocation(t *testing.T, backend storage.ArchiveBackend) {
+	var domain = newTestDomain("fr", "cnes", "sequence")
+	var otherDomain = newTestDomain("fr", "cnes", "other")
+
+	for _, store := range []struct {
+		name     string
+		domain   mal.IdentifierList
+		instIDs  []mal.Long
+		expected []int64
+	}{
+		{"first objects", domain, []mal.Long{0, 0, 0}, []int64{1, 2, 3}},
+		{"other domain", otherDomain, []mal.Long{0}, []int64{1}},
+		{"given identifier", domain, []mal.Long{5}, []int64{5}},
+		{"used identifier skipped", domain, []mal.Long{0, 0, 0}, []int64{4, 6, 7}},
+		{"identifier of the request skipped", domain, []mal.Long{0, 8, 0}, []int64{9, 8, 10}},
+	} {
+		var stored = storeAndReturn(t, backend, store.domain, store.instIDs...)
+		if len(stored) != len(store.expected) {
+			t.Fatalf("%s: %v stored instead of %v", store.name, stored, store.expected)
+		}
+		for i := range stored {
+			if stored[i] != store.expected[i] {
+				t.Errorf("%s: %v stored instead of %v", store.name, stored, store.expected)
+				break
+			}
+		}
+	}
+
+	// The identifiers of the deleted objects are not allocated again
+	_, err := backend.DeleteInArchive(valueOfSineType, domain, mal.LongList{mal.NewLong(0)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stored := storeAndReturn(t, backend, domain, 0); stored[0] != 11 {
+		t.Errorf("%d allocated after a deletion instead of 11", stored[0])
+	}
+}
+
+func TestSQLiteBackendConcurrentStore(t *testing.T) {
+	// Two backends sharing the same database, as two providers would
+	var path = filepath.Join(newTestDir(t), "archive.db")
+	var backends []storage.ArchiveBackend
+	for i := 0; i < 2; i++ {
+		backend, err := storage.NewSQLiteBackend(path, storage.TABLE)
+		if err != nil {
+			t.Fatal(err)
+		}
+		backend.SetPool(storage.PoolConfig{MaxOpenConns: 4})
+		defer backend.Close()
+		backends = append(backends, backend)
+	}
+
+	var mutex sync.Mutex
+	var allocated = make(map[int64]bool)
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func(i int, backend storage.ArchiveBackend) {
+			defer wg.Done()
+			archiveDetailsList, elementList := newTestObjects(10, sqliteTestDomain, "network", time.Now())
+			// Half of the stores give an identifier, which is checked
+			// before the objects are written
+			if i%2 == 1 {
+				archiveDetailsList[0].InstId = mal.Long(1000 + i)
+			}
+			longList, err := backend.StoreInArchive(mal.NewBoolean(true), valueOfSineType, sqliteTestDomain, archiveDetailsList, elementList)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			mutex.Lock()
+			defer mutex.Unlock()
+			for _, instID := range *longList {
+				if allocated[int64(*instID)] {
+					t.Errorf("%d allocated twice", *instID)
+				}
+				allocated[int64(*instID)] = true
+			}
+		}(i, backends[i%2])
+	}
+	wg.Wait()
+
+	// All the identifiers from 1 to 95 are allocated, and the 5 given ones
+	for instID := int64(1); instID <= 95; instID++ {
+		if !allocated[instID] {
+			t.Errorf("%d not allocated", instID)
+		}
+	}
+	for i := 1; i < 10; i += 2 {
+		if !allocated[int64(1000+i)] {
+			t.Errorf("%d not stored", 1000+i)
+		}
+	}
+}
@@ -0,0 +1,264 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package tests
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/CNES/ccsdsmo-malgo/com"
+	"github.com/CNES/ccsdsmo-malgo/mal"
+
+	archprovider "github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/provider"
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/storage"
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/testarchivearea/testarchiveservice"
+)
+
+// softDeleteTestDomain is the domain of the objects of the soft delete tests
+var softDeleteTestDomain = newTestDomain("fr", "cnes", "softdelete")
+
+// longListOf converts object instance identifiers to a LongList
+func longListOf(ids ...int64) mal.LongList {
+	var longList = mal.NewLongList(0)
+	for _, id := range ids {
+		longList.AppendElement(mal.NewLong(id))
+	}
+	return *longList
+}
+
+// longValues returns the values of a LongList
+func longValues(longList mal.LongList) []int64 {
+	var values []int64
+	for _, value := range longList {
+		values = append(values, int64(*value))
+	}
+	return values
+}
+
+// deletedIDs returns the identifiers of the tombstones deleted before a time
+func deletedIDs(t *testing.T, backend storage.ArchiveBackend, deletedBefore time.Time) map[string][]int64 {
+	objects, err := softDeleteOf(t, backend).SelectDeleted(deletedBefore, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return expiredIDs(objects)
+}
+
+// isUnknownError returns true if an error is the UNKNOWN error
+func isUnknownError(err error) bool {
+	return err != nil && err.Error() == string(mal.ERROR_UNKNOWN_MESSAGE)
+}
+
+// checkSoftDelete checks that the objects deleted in soft delete mode are
+// hidden until they are restored or purged
+func checkSoftDelete(t *testing.T, backend storage.ArchiveBackend) {
+	var domain = softDeleteTestDomain
+	var softDelete = softDeleteOf(t, backend)
+	var key = fmt.Sprintf("%d softdelete", valueOfSineType.Number)
+	softDelete.SetSoftDelete(true)
+	err := storeWithInstIDs(backend, valueOfSineType, domain, 1, 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	updateTestObject(t, backend, domain, 1, 10, "updated")
+
+	// A tombstone is hidden from the other operations
+	deleted, err := backend.DeleteInArchive(valueOfSineType, domain, longListOf(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 1 || *deleted[0] != 1 {
+		t.Errorf("unexpected objects deleted: %v", deleted)
+	}
+	if count := countObjects(t, backend, valueOfSineType, domain); count != 2 {
+		t.Errorf("%d objects counted instead of 2", count)
+	}
+	_, _, err = backend.RetrieveInArchive(valueOfSineType, domain, longListOf(1))
+	if !isUnknownError(err) {
+		t.Errorf("UNKNOWN error expected from Retrieve: %v", err)
+	}
+	_, elementList, err := backend.RetrieveInArchive(valueOfSineType, domain, longListOf(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if values := bodyValues(elementList); !isEqualValues(values, []float64{1, 2}) {
+		t.Errorf("%v retrieved instead of [1 2]", values)
+	}
+	_, err = backend.DeleteInArchive(valueOfSineType, domain, longListOf(1))
+	if !isUnknownError(err) {
+		t.Errorf("UNKNOWN error expected from Delete: %v", err)
+	}
+	_, err = historyOf(t, backend).ObjectHistory(valueOfSineType, domain, 1)
+	if !isUnknownError(err) {
+		t.Errorf("UNKNOWN error expected from ObjectHistory: %v", err)
+	}
+	archiveDetailsList, updateElements := newTestObjects(1, domain, "network", time.Now())
+	archiveDetailsList[0].InstId = 1
+	err = backend.UpdateArchive(valueOfSineType, domain, archiveDetailsList, updateElements)
+	if !isUnknownError(err) {
+		t.Errorf("UNKNOWN error expected from Update: %v", err)
+	}
+	// The tombstone keeps its identifier
+	err = storeWithInstIDs(backend, valueOfSineType, domain, 1)
+	if err == nil || err.Error() != string(com.ERROR_DUPLICATE) {
+		t.Errorf("DUPLICATE error expected: %v", err)
+	}
+
+	// The tombstones deleted before a time
+	var ids = deletedIDs(t, backend, time.Now().Add(time.Second))
+	if fmt.Sprint(ids) != fmt.Sprint(map[string][]int64{key: {1}}) {
+		t.Errorf("unexpected tombstones: %v", ids)
+	}
+	if ids = deletedIDs(t, backend, time.Now().Add(-time.Hour)); len(ids) != 0 {
+		t.Errorf("unexpected tombstones deleted an hour ago: %v", ids)
+	}
+
+	// A restored object gets back its last version and its history
+	restored, err := softDelete.RestoreInArchive(valueOfSineType, domain, longListOf(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(restored) != 1 || *restored[0] != 1 {
+		t.Errorf("unexpected objects restored: %v", restored)
+	}
+	versions, err := historyOf(t, backend).ObjectHistory(valueOfSineType, domain, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[1].Element.(*testarchiveservice.ValueOfSine).Value != 10 {
+		t.Errorf("the restored object lost its versions: %v", versions)
+	}
+	_, err = softDelete.RestoreInArchive(valueOfSineType, domain, longListOf(1))
+	if !isUnknownError(err) {
+		t.Errorf("UNKNOWN error expected when restoring an object which isn't deleted: %v", err)
+	}
+
+	// All the objects are deleted then restored
+	deleted, err = backend.DeleteInArchive(valueOfSineType, domain, longListOf(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(deleted) != 3 {
+		t.Errorf("%d objects deleted instead of 3", len(deleted))
+	}
+	if count := countObjects(t, backend, valueOfSineType, domain); count != 0 {
+		t.Errorf("%d objects counted instead of 0", count)
+	}
+	restored, err = softDelete.RestoreInArchive(valueOfSineType, domain, longListOf(0))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(longValues(restored)) != fmt.Sprint([]int64{1, 2, 3}) {
+		t.Errorf("unexpected objects restored: %v", restored)
+	}
+	if count := countObjects(t, backend, valueOfSineType, domain); count != 3 {
+		t.Errorf("%d objects counted instead of 3", count)
+	}
+
+	// Only the tombstones are purged, their identifier can then be used
+	_, err = backend.DeleteInArchive(valueOfSineType, domain, longListOf(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = softDelete.PurgeDeleted(valueOfSineType, domain, longListOf(3))
+	if !isUnknownError(err) {
+		t.Errorf("UNKNOWN error expected when purging an object which isn't deleted: %v", err)
+	}
+	_, err = softDelete.PurgeDeleted(valueOfSineType, domain, longListOf(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids = deletedIDs(t, backend, time.Now().Add(time.Second)); len(ids) != 0 {
+		t.Errorf("unexpected tombstones after the purge: %v", ids)
+	}
+	err = storeWithInstIDs(backend, valueOfSineType, domain, 2)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Without soft delete the objects are deleted
+	softDelete.SetSoftDelete(false)
+	_, err = backend.DeleteInArchive(valueOfSineType, domain, longListOf(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = softDelete.RestoreInArchive(valueOfSineType, domain, longListOf(3))
+	if !isUnknownError(err) {
+		t.Errorf("UNKNOWN error expected when restoring an object deleted without soft delete: %v", err)
+	}
+}
+
+// checkDeletedGracePeriod checks that the purger purges the tombstones
+// whose grace period is over
+func checkDeletedGracePeriod(t *testing.T, backend storage.ArchiveBackend) {
+	var domain = softDeleteTestDomain
+	var softDelete = softDeleteOf(t, backend)
+	softDelete.SetSoftDelete(true)
+	err := storeWithInstIDs(backend, valueOfSineType, domain, 1, 2, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = backend.DeleteInArchive(valueOfSineType, domain, longListOf(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var firstDeletion = time.Now()
+	_, err = backend.DeleteInArchive(valueOfSineType, domain, longListOf(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var reports []archprovider.PurgeReport
+	var handle = func(report archprovider.PurgeReport) {
+		reports = append(reports, report)
+	}
+	var policy = archprovider.DefaultRetentionPolicy()
+	policy.DeletedGracePeriod = time.Hour
+
+	// Only the first tombstone is over its grace period
+	statistics, err := archprovider.NewPurger(backend, policy, handle).Purge(firstDeletion.Add(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statistics.Objects != 1 || len(reports) != 1 || reports[0].Rule != archprovider.DELETED_OBJECTS_RULE {
+		t.Errorf("unexpected purge: %+v %+v", statistics, reports)
+	}
+	if ids := deletedIDs(t, backend, time.Now().Add(time.Second)); fmt.Sprint(ids) != fmt.Sprint(map[string][]int64{fmt.Sprintf("%d softdelete", valueOfSineType.Number): {2}}) {
+		t.Errorf("unexpected tombstones: %v", ids)
+	}
+
+	// The objects which aren't deleted are never purged
+	statistics, err = archprovider.NewPurger(backend, policy, handle).Purge(time.Now().Add(2 * time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if statistics.Objects != 1 {
+		t.Errorf("%d objects purged instead of 1", statistics.Objects)
+	}
+	if count := countObjects(t, backend, valueOfSineType, domain); count != 1 {
+		t.Errorf("%d objects counted instead of 1", count)
+	}
+}
@@ -0,0 +1,196 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/CNES/ccsdsmo-malgo/com/archive"
+	"github.com/CNES/ccsdsmo-malgo/mal"
+
+	. "github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/constants"
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/storage"
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/testarchivearea/testarchiveservice"
+)
+
+// sortTestValues are the values of the bodies of the objects sorted by
+// checkSortFields, in their insertion order. The related of the objects
+// are 1 and 2 alternately.
+var sortTestValues = []float64{3, 1, 4, 1, 5, 9}
+
+// storeSortTestObjects stores the objects of sortTestValues in a domain
+func storeSortTestObjects(t *testing.T, backend storage.ArchiveBackend, domain mal.IdentifierList) {
+	archiveDetailsList, elementList := newTestObjects(len(sortTestValues), domain, "network", time.Now())
+	for i, value := range sortTestValues {
+		(*elementList)[i].Value = mal.Float(value)
+		archiveDetailsList[i].Details.Related = mal.NewLong(int64(1 + i%2))
+	}
+	_, err := backend.StoreInArchive(nil, valueOfSineType, domain, archiveDetailsList, elementList)
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+// bodyValues returns the values of the bodies of a list of ValueOfSine
+func bodyValues(elementList mal.ElementList) []float64 {
+	var values []float64
+	for _, element := range *elementList.(*testarchiveservice.ValueOfSineList) {
+		values = append(values, float64(element.Value))
+	}
+	return values
+}
+
+// sortedValues queries the objects of a domain sorted by a SortFieldName
+// and returns the values of their bodies
+func sortedValues(backend storage.ArchiveBackend, domain mal.IdentifierList, sortFieldName string, sortOrder bool) ([]float64, error) {
+	_, _, _, elementLists, err := backend.QueryArchive(mal.NewBoolean(true), valueOfSineType, archive.ArchiveQuery{
+		Domain:        &domain,
+		Related:       mal.Long(0),
+		SortOrder:     mal.NewBoolean(sortOrder),
+		SortFieldName: mal.NewString(sortFieldName),
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	var values []float64
+	for _, elementList := range elementLists {
+		values = append(values, bodyValues(elementList)...)
+	}
+	return values, nil
+}
+
+// isEqualValues compares two lists of values
+func isEqualValues(a []float64, b []float64) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// checkSortFields checks the names of the fields accepted by SortFieldName
+// and by the filters, and the sorting by several fields
+func checkSortFields(t *testing.T, backend storage.ArchiveBackend) {
+	var domain = newTestDomain("fr", "cnes", "sort")
+	storeSortTestObjects(t, backend, domain)
+
+	for _, query := range []struct {
+		sortFieldName string
+		sortOrder     bool
+		expected      []float64
+	}{
+		{"element.value", true, []float64{1, 1, 3, 4, 5, 9}},
+		{"value", false, []float64{9, 5, 4, 3, 1, 1}},
+		{"instId", false, []float64{9, 5, 1, 4, 1, 3}},
+		{"objectInstanceIdentifier", false, []float64{9, 5, 1, 4, 1, 3}},
+		{"`timestamp`", true, []float64{3, 1, 4, 1, 5, 9}},
+		{"details.related, timestamp", true, []float64{3, 4, 5, 1, 1, 9}},
+		{"details.related,element.value", true, []float64{3, 4, 5, 1, 1, 9}},
+		{"details.related, value", false, []float64{9, 1, 1, 5, 4, 3}},
+		{"details.source.key.instId, instId", true, []float64{3, 1, 4, 1, 5, 9}},
+	} {
+		values, err := sortedValues(backend, domain, query.sortFieldName, query.sortOrder)
+		if err != nil {
+			t.Fatal(query.sortFieldName, err)
+		}
+		if !isEqualValues(values, query.expected) {
+			t.Errorf("%s: objects sorted as %v instead of %v", query.sortFieldName, values, query.expected)
+		}
+	}
+
+	// The internal columns and the unknown fields are rejected
+	for _, sortFieldName := range []string{"", "timestamp,", "id", "element", "invalidname", "timestamp; DROP TABLE Archive"} {
+		_, err := sortedValues(backend, domain, sortFieldName, true)
+		if err == nil || err.Error() != string(ARCHIVE_SERVICE_QUERY_SORT_FIELD_NAME_INVALID_ERROR) {
+			t.Errorf("%q: the sort field should be rejected: %v", sortFieldName, err)
+		}
+	}
+
+	// The filters accept the same names
+	checkBodyQueries(t, backend, valueOfSineType, domain, []bodyFilterQuery{
+		{"related", "details.related", archive.EXPRESSIONOPERATOR_EQUAL, mal.NewLong(2), 3},
+		{"source number", "details.source.type.number", archive.EXPRESSIONOPERATOR_EQUAL, mal.NewUShort(uint16(valueOfSineType.Number)), 6},
+		{"source instance", "details.source.key.instId", archive.EXPRESSIONOPERATOR_EQUAL, mal.NewLong(0), 6},
+		{"source domain", "details.source.key.domain", archive.EXPRESSIONOPERATOR_CONTAINS, mal.NewString("sort"), 6},
+	})
+}
+
+// checkStreamQuerySortFields checks the chunks sent by StreamQuery when
+// the objects are sorted by a field of the body
+func checkStreamQuerySortFields(t *testing.T, backend storage.ArchiveBackend) {
+	var domainA = newTestDomain("fr", "cnes", "sortstream", "a")
+	var domainB = newTestDomain("fr", "cnes", "sortstream", "b")
+	var anyDomain = newTestDomain("fr", "cnes", "sortstream", "*")
+	storeSortTestObjects(t, backend, domainA)
+	storeSortTestObjects(t, backend, domainB)
+
+	var query = archive.ArchiveQuery{
+		Domain:        &anyDomain,
+		Related:       mal.Long(0),
+		SortOrder:     mal.NewBoolean(true),
+		SortFieldName: mal.NewString("value"),
+	}
+	var limits = storage.ChunkLimits{MaxObjects: 4}
+
+	// The objects are sorted in each domain, the domains being sent one
+	// after the other
+	chunks := streamQuery(t, backend, mal.NewBoolean(true), valueOfSineType, query, nil, limits, false)
+	checkStreamedValues(t, "grouped", chunks, []int{4, 2, 4, 2}, "aabb",
+		[]float64{1, 1, 3, 4, 5, 9, 1, 1, 3, 4, 5, 9})
+
+	// With a global sort order, the objects of both domains are sorted
+	// together, the objects with the same value keep their insertion order
+	chunks = streamQuery(t, backend, mal.NewBoolean(true), valueOfSineType, query, nil, limits, true)
+	checkStreamedValues(t, "global", chunks, []int{2, 2, 1, 1, 1, 1, 1, 1, 1, 1}, "ababababab",
+		[]float64{1, 1, 1, 1, 3, 3, 4, 4, 5, 5, 9, 9})
+
+	// A field of the body is accepted with a wildcard in the object type,
+	// the objects are then only split by the limits
+	var anyNumber = valueOfSineType
+	anyNumber.Number = 0
+	chunks = streamQuery(t, backend, nil, anyNumber, query, nil, limits, true)
+	checkChunkSizes(t, "wildcard", chunkSizes(chunks), []int{4, 4, 4})
+}
+
+// checkStreamedValues checks the sizes, the last identifier of the domain
+// and the values of the bodies of the chunks sent by StreamQuery
+func checkStreamedValues(t *testing.T, name string, chunks []streamedChunk, sizes []int, domains string, expected []float64) {
+	checkChunkSizes(t, name, chunkSizes(chunks), sizes)
+	var values []float64
+	for i, chunk := range chunks {
+		if i < len(domains) && string(*(*chunk.domain)[3]) != domains[i:i+1] {
+			t.Errorf("%s: chunk %d of the domain %s instead of %s", name, i, *(*chunk.domain)[3], domains[i:i+1])
+		}
+		values = append(values, bodyValues(chunk.elementList)...)
+	}
+	if !isEqualValues(values, expected) {
+		t.Errorf("%s: objects sorted as %v instead of %v", name, values, expected)
+	}
+}
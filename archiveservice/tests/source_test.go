@@ -0,0 +1,121 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/CNES/ccsdsmo-malgo/com"
+	"github.com/CNES/ccsdsmo-malgo/com/archive"
+	"github.com/CNES/ccsdsmo-malgo/mal"
+
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/storage"
+)
+
+// newTestDomain creates a domain from its identifiers
+func newTestDomain(identifiers ...string) mal.IdentifierList {
+	var domain = mal.NewIdentifierList(0)
+	for _, identifier := range identifiers {
+		domain.AppendElement(mal.NewIdentifier(identifier))
+	}
+	return *domain
+}
+
+// checkSourceMatching stores objects with different sources and checks
+// the wildcards of the source given in a query
+func checkSourceMatching(t *testing.T, backend storage.ArchiveBackend) {
+	var domain = newTestDomain("fr", "cnes", "source")
+	var otherType = valueOfSineType
+	otherType.Number++
+	var sources = []*com.ObjectId{
+		{Type: valueOfSineType, Key: com.ObjectKey{Domain: newTestDomain("fr", "cnes", "a"), InstId: 1}},
+		{Type: valueOfSineType, Key: com.ObjectKey{Domain: newTestDomain("fr", "cnes", "b"), InstId: 2}},
+		{Type: valueOfSineType, Key: com.ObjectKey{Domain: newTestDomain("fr", "esa", "a"), InstId: 1}},
+		{Type: otherType, Key: com.ObjectKey{Domain: newTestDomain("fr", "cnes", "a"), InstId: 1}},
+		nil,
+	}
+	archiveDetailsList, elementList := newTestObjects(len(sources), domain, "network", time.Now())
+	for i, source := range sources {
+		archiveDetailsList[i].Details.Source = source
+	}
+	_, err := backend.StoreInArchive(nil, valueOfSineType, domain, archiveDetailsList, elementList)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var typeWithoutNumber = valueOfSineType
+	typeWithoutNumber.Number = 0
+	for _, query := range []struct {
+		name     string
+		source   com.ObjectId
+		expected int64
+	}{
+		{"exact source", com.ObjectId{Type: valueOfSineType, Key: com.ObjectKey{Domain: newTestDomain("fr", "cnes", "a"), InstId: 1}}, 1},
+		{"any instance", com.ObjectId{Type: valueOfSineType, Key: com.ObjectKey{Domain: newTestDomain("fr", "cnes", "b"), InstId: 0}}, 1},
+		{"other instance", com.ObjectId{Type: valueOfSineType, Key: com.ObjectKey{Domain: newTestDomain("fr", "cnes", "b"), InstId: 1}}, 0},
+		{"any type", com.ObjectId{Key: com.ObjectKey{Domain: newTestDomain("fr", "cnes", "a"), InstId: 1}}, 2},
+		{"any number", com.ObjectId{Type: typeWithoutNumber, Key: com.ObjectKey{Domain: newTestDomain("fr", "cnes", "a"), InstId: 0}}, 2},
+		{"wildcard in the middle", com.ObjectId{Type: valueOfSineType, Key: com.ObjectKey{Domain: newTestDomain("fr", "*", "a"), InstId: 0}}, 2},
+		{"wildcard at the end", com.ObjectId{Type: valueOfSineType, Key: com.ObjectKey{Domain: newTestDomain("fr", "cnes", "*"), InstId: 0}}, 2},
+		{"wildcards only", com.ObjectId{Type: valueOfSineType, Key: com.ObjectKey{Domain: newTestDomain("*", "*", "*"), InstId: 1}}, 2},
+		{"all the sub-domains", com.ObjectId{Type: valueOfSineType, Key: com.ObjectKey{Domain: newTestDomain("fr", "*"), InstId: 0}}, 3},
+		{"other number of levels", com.ObjectId{Type: valueOfSineType, Key: com.ObjectKey{Domain: newTestDomain("*", "cnes"), InstId: 0}}, 0},
+		{"any source", com.ObjectId{Key: com.ObjectKey{Domain: newTestDomain("*", "*", "*"), InstId: 0}}, 4},
+	} {
+		var source = query.source
+		var archiveQueryList = archive.NewArchiveQueryList(0)
+		archiveQueryList.AppendElement(&archive.ArchiveQuery{
+			Domain:  &domain,
+			Related: mal.Long(0),
+			Source:  &source,
+		})
+		longList, err := backend.CountInArchive(valueOfSineType, *archiveQueryList, nil)
+		if err != nil {
+			t.Fatal(query.name, err)
+		}
+		if int64(*(*longList)[0]) != query.expected {
+			t.Errorf("%s: %d objects instead of %d", query.name, *(*longList)[0], query.expected)
+		}
+	}
+
+	// The attributes of the source can be used in a filter
+	var filters = archive.NewCompositeFilterList(0)
+	filters.AppendElement(&archive.CompositeFilter{
+		FieldName:  mal.String("details.source.instId"),
+		Type:       archive.EXPRESSIONOPERATOR_GREATER,
+		FieldValue: mal.NewLong(1),
+	})
+	_, archiveDetails, _, _, err := backend.QueryArchive(nil, valueOfSineType, archive.ArchiveQuery{
+		Domain:  &domain,
+		Related: mal.Long(0),
+	}, &archive.CompositeFilterSet{*filters})
+	if err != nil || len(archiveDetails) != 1 || archiveDetails[0].Size() != 1 {
+		t.Fatal("query failed:", err)
+	}
+	if (*archiveDetails[0])[0].Details.Source.Key.InstId != 2 {
+		t.Errorf("wrong object: %v", (*archiveDetails[0])[0].Details.Source)
+	}
+}
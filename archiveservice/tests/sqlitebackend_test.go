@@ -0,0 +1,191 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package tests
+
+import (
+	"math/rand"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/CNES/ccsdsmo-malgo/com/archive"
+	"github.com/CNES/ccsdsmo-malgo/mal"
+
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/storage"
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/testarchivearea/testarchiveservice"
+)
+
+// Pools compared by the benchmarks, without idle connections each call
+// opens a new connection and prepares its statements again as it was
+// done before the connections were shared
+var benchmarkPools = []struct {
+	name string
+	pool storage.PoolConfig
+}{
+	{"Pooled", storage.PoolConfig{}},
+	{"Unpooled", storage.PoolConfig{MaxIdleConns: -1}},
+}
+
+// sqliteTestDomain is the domain of the objects stored by the SQLite tests
+var sqliteTestDomain = mal.IdentifierList([]*mal.Identifier{mal.NewIdentifier("fr"), mal.NewIdentifier("cnes"), mal.NewIdentifier("sqlite")})
+
+// newSQLiteTestBackend creates a SQLite backend in a temporary directory
+func newSQLiteTestBackend(tb testing.TB, pool storage.PoolConfig) *storage.SQLBackend {
+	dir := newTestDir(tb)
+	backend, err := storage.NewSQLiteBackend(filepath.Join(dir, "archive.db"), storage.TABLE)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	backend.SetPool(pool)
+	tb.Cleanup(func() { backend.Close() })
+	return backend
+}
+
+// storeTestObjects stores count objects in a backend one by one and
+// returns their object instance identifiers
+func storeTestObjects(tb testing.TB, backend storage.ArchiveBackend, count int) mal.LongList {
+	var archiveDetailsList, elementList = newTestObjects(count, sqliteTestDomain, "network", time.Now())
+	var instIDs = mal.NewLongList(0)
+	for i := 0; i < count; i++ {
+		var element = testarchiveservice.ValueOfSineList((*elementList)[i : i+1])
+		longList, err := backend.StoreInArchive(mal.NewBoolean(true), valueOfSineType, sqliteTestDomain,
+			archiveDetailsList[i:i+1], &element)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		instIDs.AppendElement((*longList)[0])
+	}
+	return *instIDs
+}
+
+func TestSQLiteBackendStoreRetrieve(t *testing.T) {
+	backend := newSQLiteTestBackend(t, storage.PoolConfig{MaxOpenConns: 2})
+	instIDs := storeTestObjects(t, backend, 10)
+
+	archiveDetailsList, elementList, err := backend.RetrieveInArchive(valueOfSineType, sqliteTestDomain, instIDs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if archiveDetailsList.Size() != 10 || elementList.Size() != 10 {
+		t.Fatalf("10 objects should be retrieved, got %d", archiveDetailsList.Size())
+	}
+
+	// The backend can be used again after it has been closed
+	err = backend.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = backend.RetrieveInArchive(valueOfSineType, sqliteTestDomain, instIDs[:1])
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func BenchmarkSQLiteBackendStore(b *testing.B) {
+	for _, benchmarkPool := range benchmarkPools {
+		b.Run(benchmarkPool.name, func(b *testing.B) {
+			backend := newSQLiteTestBackend(b, benchmarkPool.pool)
+			b.ResetTimer()
+			storeTestObjects(b, backend, b.N)
+		})
+	}
+}
+
+func BenchmarkSQLiteBackendRetrieve(b *testing.B) {
+	for _, benchmarkPool := range benchmarkPools {
+		b.Run(benchmarkPool.name, func(b *testing.B) {
+			backend := newSQLiteTestBackend(b, benchmarkPool.pool)
+			instIDs := storeTestObjects(b, backend, 100)
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, _, err := backend.RetrieveInArchive(valueOfSineType, sqliteTestDomain, mal.LongList{instIDs[rand.Intn(len(instIDs))]})
+				if err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestSQLiteBackendQueryParameters(t *testing.T) {
+	backend := newSQLiteTestBackend(t, storage.PoolConfig{})
+	var network = "it's a network"
+	var archiveDetailsList, elementList = newTestObjects(5, sqliteTestDomain, network, time.Now())
+	_, err := backend.StoreInArchive(nil, valueOfSineType, sqliteTestDomain, archiveDetailsList, elementList)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A quote in a value doesn't break the query
+	var archiveQueryList = archive.NewArchiveQueryList(0)
+	archiveQueryList.AppendElement(&archive.ArchiveQuery{
+		Domain:  &sqliteTestDomain,
+		Network: mal.NewIdentifier(network),
+		Related: mal.Long(0),
+	})
+	longList, err := backend.CountInArchive(valueOfSineType, *archiveQueryList, nil)
+	if err != nil || *(*longList)[0] != 5 {
+		t.Fatal("count failed:", err, longList)
+	}
+
+	// A value can't be interpreted as SQL
+	(*archiveQueryList)[0].Network = mal.NewIdentifier("' OR '1'='1")
+	longList, err = backend.CountInArchive(valueOfSineType, *archiveQueryList, nil)
+	if err != nil || *(*longList)[0] != 0 {
+		t.Fatal("count failed:", err, longList)
+	}
+
+	// A field name must be a column of the table
+	var filters = archive.NewCompositeFilterList(0)
+	filters.AppendElement(&archive.CompositeFilter{
+		FieldName:  mal.String("network = network OR 1"),
+		Type:       archive.EXPRESSIONOPERATOR_EQUAL,
+		FieldValue: mal.NewString(network),
+	})
+	var queryFilterList = archive.NewCompositeFilterSetList(0)
+	queryFilterList.AppendElement(&archive.CompositeFilterSet{*filters})
+	_, err = backend.CountInArchive(valueOfSineType, *archiveQueryList, queryFilterList)
+	if err == nil {
+		t.Fatal("an unknown field name should be rejected")
+	}
+	var sortFieldName = mal.NewString("timestamp; DROP TABLE Archive")
+	_, _, _, _, err = backend.QueryArchive(nil, valueOfSineType, archive.ArchiveQuery{
+		Related:       mal.Long(0),
+		SortOrder:     mal.NewBoolean(true),
+		SortFieldName: sortFieldName,
+	}, nil)
+	if err == nil {
+		t.Fatal("an unknown sort field name should be rejected")
+	}
+
+	// The quoted and unquoted names of the columns are both accepted
+	(*filters)[0].FieldName = mal.String("`details.related`")
+	(*filters)[0].FieldValue = mal.NewLong(1)
+	(*archiveQueryList)[0].Network = mal.NewIdentifier(network)
+	longList, err = backend.CountInArchive(valueOfSineType, *archiveQueryList, queryFilterList)
+	if err != nil || *(*longList)[0] != 5 {
+		t.Fatal("count failed:", err, longList)
+	}
+}
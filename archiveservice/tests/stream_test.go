@@ -0,0 +1,275 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package tests
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/CNES/ccsdsmo-malgo/com"
+	"github.com/CNES/ccsdsmo-malgo/com/archive"
+	"github.com/CNES/ccsdsmo-malgo/mal"
+
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/storage"
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/testarchivearea/testarchiveservice"
+)
+
+// streamedChunk is a chunk of objects sent by StreamQuery
+type streamedChunk struct {
+	objectType         *com.ObjectType
+	domain             *mal.IdentifierList
+	archiveDetailsList *archive.ArchiveDetailsList
+	elementList        mal.ElementList
+}
+
+// streamQuery runs a streamed query and returns the chunks it sent
+func streamQuery(t *testing.T, backend storage.ArchiveBackend, boolean *mal.Boolean, objectType com.ObjectType, archiveQuery archive.ArchiveQuery, queryFilter archive.QueryFilter, limits storage.ChunkLimits, globalOrder bool) []streamedChunk {
+	var chunks []streamedChunk
+	err := backend.StreamQuery(boolean, objectType, archiveQuery, queryFilter, limits, globalOrder, func(objectType *com.ObjectType, domain *mal.IdentifierList, archiveDetailsList *archive.ArchiveDetailsList, elementList mal.ElementList) error {
+		chunks = append(chunks, streamedChunk{objectType, domain, archiveDetailsList, elementList})
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return chunks
+}
+
+// chunkSizes returns the number of objects of each chunk
+func chunkSizes(chunks []streamedChunk) []int {
+	var sizes []int
+	for _, chunk := range chunks {
+		sizes = append(sizes, chunk.archiveDetailsList.Size())
+	}
+	return sizes
+}
+
+// checkChunkSizes compares the number of objects of each chunk with the
+// expected ones
+func checkChunkSizes(t *testing.T, name string, sizes []int, expected []int) {
+	if len(sizes) != len(expected) {
+		t.Errorf("%s: chunks of %v objects instead of %v", name, sizes, expected)
+		return
+	}
+	for i := range sizes {
+		if sizes[i] != expected[i] {
+			t.Errorf("%s: chunks of %v objects instead of %v", name, sizes, expected)
+			return
+		}
+	}
+}
+
+// checkStreamQuery stores objects of two types in two domains and checks
+// the chunks sent by StreamQuery
+func checkStreamQuery(t *testing.T, backend storage.ArchiveBackend) {
+	var domainA = newTestDomain("fr", "cnes", "stream", "a")
+	var domainB = newTestDomain("fr", "cnes", "stream", "b")
+	var anyDomain = newTestDomain("fr", "cnes", "stream", "*")
+
+	// 10 ValueOfSine objects in the domain a, 5 in the domain b and 3 Sine
+	// objects in the domain a
+	for _, objects := range []struct {
+		domain mal.IdentifierList
+		count  int
+	}{{domainA, 10}, {domainB, 5}} {
+		archiveDetailsList, elementList := newTestObjects(objects.count, objects.domain, "network", time.Now())
+		_, err := backend.StoreInArchive(nil, valueOfSineType, objects.domain, archiveDetailsList, elementList)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var sineDetailsList, _ = newTestObjects(3, domainA, "network", time.Now())
+	var sineList = testarchiveservice.NewSineList(0)
+	for i := 0; i < 3; i++ {
+		sineDetailsList[i].Details.Source.Type = sineType
+		sineList.AppendElement(&testarchiveservice.Sine{T: mal.Long(i), Y: mal.Float(i)})
+	}
+	_, err := backend.StoreInArchive(nil, sineType, domainA, sineDetailsList, sineList)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Without the bodies nor a wildcard in the object type, the objects are
+	// only split by the limits
+	var query = archive.ArchiveQuery{Domain: &anyDomain, Related: mal.Long(0)}
+	for _, limits := range []struct {
+		name     string
+		limits   storage.ChunkLimits
+		expected []int
+	}{
+		{"object count", storage.ChunkLimits{MaxObjects: 4}, []int{4, 4, 4, 3}},
+		{"object size", storage.ChunkLimits{MaxBytes: 1}, []int{1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1}},
+		{"no limit", storage.ChunkLimits{}, []int{15}},
+		{"default limits", storage.DefaultChunkLimits(), []int{15}},
+	} {
+		chunks := streamQuery(t, backend, mal.NewBoolean(false), valueOfSineType, query, nil, limits.limits, false)
+		checkChunkSizes(t, limits.name, chunkSizes(chunks), limits.expected)
+		for _, chunk := range chunks {
+			if chunk.objectType != nil || chunk.domain != nil || !chunk.elementList.IsNull() {
+				t.Errorf("%s: only the ArchiveDetails should be sent: %+v", limits.name, chunk)
+			}
+		}
+	}
+
+	// With the bodies and a wildcard in the object type, each chunk holds
+	// objects of a single object type and domain, and the objects of a
+	// group are sent consecutively
+	var anyNumber = valueOfSineType
+	anyNumber.Number = 0
+	chunks := streamQuery(t, backend, mal.NewBoolean(true), anyNumber, query, nil, storage.ChunkLimits{MaxObjects: 4}, false)
+	var groups = map[string][]int{}
+	var lastGroup string
+	for _, chunk := range chunks {
+		if chunk.objectType == nil || chunk.domain == nil {
+			t.Fatalf("the object type and the domain of the chunk should be sent: %+v", chunk)
+		}
+		if chunk.elementList.Size() != chunk.archiveDetailsList.Size() {
+			t.Errorf("%d elements sent with %d ArchiveDetails", chunk.elementList.Size(), chunk.archiveDetailsList.Size())
+		}
+		var group = fmt.Sprintf("%d %s", chunk.objectType.Number, *(*chunk.domain)[3])
+		if _, ok := groups[group]; ok && group != lastGroup {
+			t.Errorf("the objects of the group %s are not sent consecutively", group)
+		}
+		groups[group] = append(groups[group], chunk.archiveDetailsList.Size())
+		lastGroup = group
+	}
+	checkChunkSizes(t, "ValueOfSine in a", groups[fmt.Sprintf("%d a", valueOfSineType.Number)], []int{4, 4, 2})
+	checkChunkSizes(t, "ValueOfSine in b", groups[fmt.Sprintf("%d b", valueOfSineType.Number)], []int{4, 1})
+	checkChunkSizes(t, "Sine in a", groups[fmt.Sprintf("%d a", sineType.Number)], []int{3})
+	if len(groups) != 3 {
+		t.Errorf("%d groups sent instead of 3", len(groups))
+	}
+
+	// The filters on the bodies are applied before the objects are chunked
+	var filters = archive.NewCompositeFilterList(0)
+	filters.AppendElement(&archive.CompositeFilter{
+		FieldName:  mal.String("value"),
+		Type:       archive.EXPRESSIONOPERATOR_GREATER_OR_EQUAL,
+		FieldValue: mal.NewFloat(5),
+	})
+	chunks = streamQuery(t, backend, mal.NewBoolean(true), valueOfSineType, archive.ArchiveQuery{
+		Domain:  &domainA,
+		Related: mal.Long(0),
+	}, &archive.CompositeFilterSet{*filters}, storage.ChunkLimits{MaxObjects: 2}, false)
+	checkChunkSizes(t, "body filter", chunkSizes(chunks), []int{2, 2, 1})
+	for _, chunk := range chunks {
+		for i := 0; i < chunk.elementList.Size(); i++ {
+			if value := chunk.elementList.GetElementAt(i).(*testarchiveservice.ValueOfSine).Value; value < 5 {
+				t.Errorf("the value %v doesn't match the filter", value)
+			}
+		}
+	}
+
+	// Nothing is sent if no object matches the query
+	var unknownDomain = newTestDomain("fr", "cnes", "stream", "unknown")
+	chunks = streamQuery(t, backend, mal.NewBoolean(true), valueOfSineType, archive.ArchiveQuery{
+		Domain:  &unknownDomain,
+		Related: mal.Long(0),
+	}, nil, storage.DefaultChunkLimits(), false)
+	if len(chunks) != 0 {
+		t.Errorf("%d chunks sent for an empty result", len(chunks))
+	}
+
+	// An error of the sender stops the query
+	var sendErr = errors.New("send failed")
+	var sent int
+	err = backend.StreamQuery(nil, valueOfSineType, query, nil, storage.ChunkLimits{MaxObjects: 1}, false, func(*com.ObjectType, *mal.IdentifierList, *archive.ArchiveDetailsList, mal.ElementList) error {
+		sent++
+		return sendErr
+	})
+	if err != sendErr || sent != 1 {
+		t.Errorf("the query should stop at the first error of the sender: %v after %d chunks", err, sent)
+	}
+}
+
+// checkStreamQueryGlobalOrder stores objects of two types in two domains
+// whose timestamps are interleaved and checks that a query with a global
+// sort order sends them in chronological order
+func checkStreamQueryGlobalOrder(t *testing.T, backend storage.ArchiveBackend) {
+	var domainA = newTestDomain("fr", "cnes", "global", "a")
+	var domainB = newTestDomain("fr", "cnes", "global", "b")
+	var anyDomain = newTestDomain("fr", "cnes", "global", "*")
+	var start = time.Now().Truncate(time.Second)
+
+	// ValueOfSine objects at 0s, 1s, 2s in the domain a and at 0.25s,
+	// 1.25s, 2.25s in the domain b, Sine objects at 0.5s, 1.5s, 2.5s in
+	// the domain a
+	for _, objects := range []struct {
+		domain mal.IdentifierList
+		offset time.Duration
+	}{{domainA, 0}, {domainB, 250 * time.Millisecond}} {
+		archiveDetailsList, elementList := newTestObjects(3, objects.domain, "network", start.Add(objects.offset))
+		_, err := backend.StoreInArchive(nil, valueOfSineType, objects.domain, archiveDetailsList, elementList)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var sineDetailsList, _ = newTestObjects(3, domainA, "network", start.Add(500*time.Millisecond))
+	var sineList = testarchiveservice.NewSineList(0)
+	for i := 0; i < 3; i++ {
+		sineDetailsList[i].Details.Source.Type = sineType
+		sineList.AppendElement(&testarchiveservice.Sine{T: mal.Long(i), Y: mal.Float(i)})
+	}
+	_, err := backend.StoreInArchive(nil, sineType, domainA, sineDetailsList, sineList)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var anyNumber = valueOfSineType
+	anyNumber.Number = 0
+	for _, order := range []struct {
+		name      string
+		sortOrder bool
+	}{{"ascending", true}, {"descending", false}} {
+		chunks := streamQuery(t, backend, mal.NewBoolean(true), anyNumber, archive.ArchiveQuery{
+			Domain:    &anyDomain,
+			Related:   mal.Long(0),
+			SortOrder: mal.NewBoolean(order.sortOrder),
+		}, nil, storage.DefaultChunkLimits(), true)
+
+		// Each object is in another group than the previous one, so each
+		// chunk holds a single object
+		checkChunkSizes(t, order.name, chunkSizes(chunks), []int{1, 1, 1, 1, 1, 1, 1, 1, 1})
+		for i := 1; i < len(chunks); i++ {
+			previous := time.Time(*(*chunks[i-1].archiveDetailsList)[0].Timestamp)
+			current := time.Time(*(*chunks[i].archiveDetailsList)[0].Timestamp)
+			if (order.sortOrder && !previous.Before(current)) || (!order.sortOrder && !previous.After(current)) {
+				t.Errorf("%s: object at %v sent after the object at %v", order.name, current, previous)
+			}
+			if *chunks[i-1].objectType == *chunks[i].objectType && *(*chunks[i-1].domain)[3] == *(*chunks[i].domain)[3] {
+				t.Errorf("%s: consecutive objects of the same group are not sent together", order.name)
+			}
+		}
+	}
+
+	// Without a sort order, the objects are still grouped
+	chunks := streamQuery(t, backend, mal.NewBoolean(true), anyNumber, archive.ArchiveQuery{
+		Domain:  &anyDomain,
+		Related: mal.Long(0),
+	}, nil, storage.DefaultChunkLimits(), true)
+	checkChunkSizes(t, "no sort order", chunkSizes(chunks), []int{3, 3, 3})
+}
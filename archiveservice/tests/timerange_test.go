@@ -0,0 +1,205 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package tests
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/CNES/ccsdsmo-malgo/com/archive"
+	"github.com/CNES/ccsdsmo-malgo/mal"
+
+	. "github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/constants"
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/storage"
+)
+
+// checkTimeRange stores objects separated by one microsecond and one
+// nanosecond, then checks the time windows at the edges of these objects
+func checkTimeRange(t *testing.T, backend storage.ArchiveBackend) {
+	var domain = mal.IdentifierList([]*mal.Identifier{mal.NewIdentifier("fr"), mal.NewIdentifier("cnes"), mal.NewIdentifier("timerange")})
+	// The timestamps are not given in UTC and use all the digits of a FineTime
+	var start = time.Date(2020, time.February, 29, 23, 59, 59, 999998999, time.FixedZone("CET", 3600))
+	var timestamps = make([]time.Time, 5)
+	archiveDetailsList, elementList := newTestObjects(len(timestamps), domain, "network", start)
+	for i := range timestamps {
+		timestamps[i] = start.Add(time.Duration(i) * (time.Microsecond + time.Nanosecond))
+		archiveDetailsList[i].Timestamp = mal.NewFineTime(timestamps[i])
+	}
+	longList, err := backend.StoreInArchive(nil, valueOfSineType, domain, archiveDetailsList, elementList)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Retrieve returns the exact timestamps
+	retDetails, _, err := backend.RetrieveInArchive(valueOfSineType, domain, *longList)
+	if err != nil || retDetails.Size() != len(timestamps) {
+		t.Fatal("retrieve failed:", err)
+	}
+	for i := range timestamps {
+		if !time.Time(*retDetails[i].Timestamp).Equal(timestamps[i]) {
+			t.Errorf("wrong timestamp %d: %v instead of %v", i, time.Time(*retDetails[i].Timestamp), timestamps[i])
+		}
+	}
+
+	var count = func(startTime *time.Time, endTime *time.Time) int64 {
+		var archiveQuery = &archive.ArchiveQuery{
+			Domain:  &domain,
+			Related: mal.Long(0),
+		}
+		if startTime != nil {
+			archiveQuery.StartTime = mal.NewFineTime(*startTime)
+		}
+		if endTime != nil {
+			archiveQuery.EndTime = mal.NewFineTime(*endTime)
+		}
+		var archiveQueryList = archive.NewArchiveQueryList(0)
+		archiveQueryList.AppendElement(archiveQuery)
+		longList, err := backend.CountInArchive(valueOfSineType, *archiveQueryList, nil)
+		if err != nil {
+			t.Fatal("count failed:", err)
+		}
+		return int64(*(*longList)[0])
+	}
+	var at = func(i int, offset time.Duration) *time.Time {
+		var timestamp = timestamps[i].Add(offset)
+		return &timestamp
+	}
+	var inUTC = func(timestamp *time.Time) *time.Time {
+		var utc = timestamp.UTC()
+		return &utc
+	}
+
+	for _, window := range []struct {
+		name      string
+		startTime *time.Time
+		endTime   *time.Time
+		expected  int64
+	}{
+		{"no window", nil, nil, 5},
+		{"inclusive edges", at(1, 0), at(3, 0), 3},
+		{"start after an object", at(1, time.Nanosecond), at(3, 0), 2},
+		{"end before an object", at(1, 0), at(3, -time.Nanosecond), 2},
+		{"single object", at(2, 0), at(2, 0), 1},
+		{"between two objects", at(2, time.Nanosecond), at(3, -time.Nanosecond), 0},
+		{"start only", at(4, 0), nil, 1},
+		{"end only", nil, at(0, 0), 1},
+		{"start after end", at(3, 0), at(1, 0), 0},
+		{"window in UTC", inUTC(at(1, 0)), inUTC(at(3, 0)), 3},
+	} {
+		if n := count(window.startTime, window.endTime); n != window.expected {
+			t.Errorf("%s: %d objects instead of %d", window.name, n, window.expected)
+		}
+	}
+
+	// Query returns the exact timestamps of the objects in the window
+	_, archiveDetails, _, _, err := backend.QueryArchive(nil, valueOfSineType, archive.ArchiveQuery{
+		Domain:    &domain,
+		Related:   mal.Long(0),
+		StartTime: mal.NewFineTime(timestamps[1]),
+		EndTime:   mal.NewFineTime(timestamps[2]),
+		SortOrder: mal.NewBoolean(true),
+	}, nil)
+	if err != nil || len(archiveDetails) != 1 || archiveDetails[0].Size() != 2 {
+		t.Fatal("query failed:", err)
+	}
+	for i := 0; i < 2; i++ {
+		if !time.Time(*(*archiveDetails[0])[i].Timestamp).Equal(timestamps[i+1]) {
+			t.Errorf("wrong timestamp %d: %v instead of %v", i, time.Time(*(*archiveDetails[0])[i].Timestamp), timestamps[i+1])
+		}
+	}
+
+	checkTimestampBounds(t, backend)
+}
+
+// checkTimestampBounds checks that the timestamps at the edges of the range
+// stored as nanoseconds since the epoch are kept exactly, and that the
+// timestamps outside of this range are rejected
+func checkTimestampBounds(t *testing.T, backend storage.ArchiveBackend) {
+	var domain = mal.IdentifierList([]*mal.Identifier{mal.NewIdentifier("fr"), mal.NewIdentifier("cnes"), mal.NewIdentifier("timebounds")})
+	var first = time.Unix(0, math.MinInt64)
+	var last = time.Unix(0, math.MaxInt64)
+
+	// The first and the last timestamps are stored
+	archiveDetailsList, elementList := newTestObjects(2, domain, "network", first)
+	archiveDetailsList[1].Timestamp = mal.NewFineTime(last)
+	longList, err := backend.StoreInArchive(mal.NewBoolean(true), valueOfSineType, domain, archiveDetailsList, elementList)
+	if err != nil {
+		t.Fatal(err)
+	}
+	retDetails, _, err := backend.RetrieveInArchive(valueOfSineType, domain, *longList)
+	if err != nil || retDetails.Size() != 2 {
+		t.Fatal("retrieve failed:", err)
+	}
+	for i, timestamp := range []time.Time{first, last} {
+		if !time.Time(*retDetails[i].Timestamp).Equal(timestamp) {
+			t.Errorf("wrong timestamp %d: %v instead of %v", i, time.Time(*retDetails[i].Timestamp), timestamp)
+		}
+	}
+
+	for _, timestamp := range []time.Time{
+		first.Add(-time.Nanosecond),
+		last.Add(time.Nanosecond),
+		time.Date(1600, time.January, 1, 0, 0, 0, 0, time.UTC),
+		time.Date(2300, time.January, 1, 0, 0, 0, 0, time.UTC),
+	} {
+		// Store and Update reject the timestamp
+		archiveDetailsList, elementList := newTestObjects(1, domain, "network", timestamp)
+		_, err = backend.StoreInArchive(nil, valueOfSineType, domain, archiveDetailsList, elementList)
+		if err == nil {
+			t.Errorf("object stored at %v", timestamp)
+		}
+		archiveDetailsList[0].InstId = *(*longList)[0]
+		err = backend.UpdateArchive(valueOfSineType, domain, archiveDetailsList, elementList)
+		if err == nil {
+			t.Errorf("object updated at %v", timestamp)
+		}
+
+		// And so do the bounds of a query
+		for _, archiveQuery := range []archive.ArchiveQuery{
+			{Domain: &domain, Related: mal.Long(0), StartTime: mal.NewFineTime(timestamp)},
+			{Domain: &domain, Related: mal.Long(0), EndTime: mal.NewFineTime(timestamp)},
+		} {
+			var archiveQueryList = archive.NewArchiveQueryList(0)
+			archiveQueryList.AppendElement(&archiveQuery)
+			_, err = backend.CountInArchive(valueOfSineType, *archiveQueryList, nil)
+			if err == nil || err.Error() != string(ARCHIVE_SERVICE_TIMESTAMP_RANGE_ERROR) {
+				t.Errorf("query bounded at %v: %v", timestamp, err)
+			}
+		}
+	}
+
+	// The objects are unchanged
+	retDetails, _, err = backend.RetrieveInArchive(valueOfSineType, domain, *longList)
+	if err != nil || retDetails.Size() != 2 || !time.Time(*retDetails[0].Timestamp).Equal(first) {
+		t.Error("object updated with a timestamp out of range:", err)
+	}
+	var archiveQueryList = archive.NewArchiveQueryList(0)
+	archiveQueryList.AppendElement(&archive.ArchiveQuery{Domain: &domain, Related: mal.Long(0)})
+	count, err := backend.CountInArchive(valueOfSineType, *archiveQueryList, nil)
+	if err != nil || *(*count)[0] != 2 {
+		t.Error("object stored with a timestamp out of range:", err)
+	}
+}
@@ -0,0 +1,115 @@
+/**
+ * MIT License
+ *
+ * Copyright (c) 2020 CNES
+ *
+ * Permission is hereby granted, free of charge, to any person obtaining a copy
+ * of this software and associated documentation files (the "Software"), to deal
+ * in the Software without restriction, including without limitation the rights
+ * to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+ * copies of the Software, and to permit persons to whom the Software is
+ * furnished to do so, subject to the following conditions:
+ *
+ * The above copyright notice and this permission notice shall be included in all
+ * copies or substantial portions of the Software.
+ *
+ * THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+ * IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+ * FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+ * AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+ * LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+ * OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN THE
+ * SOFTWARE.
+ */
+
+package tests
+
+import (
+	"testing"
+	"time"
+
+	"github.com/CNES/ccsdsmo-malgo/com"
+	"github.com/CNES/ccsdsmo-malgo/com/archive"
+	"github.com/CNES/ccsdsmo-malgo/mal"
+
+	"github.com/CNES/ccsdsmo-malgo-examples/archiveservice/archive/storage"
+)
+
+// storeWithInstIDs stores objects with the given object instance identifiers
+func storeWithInstIDs(backend storage.ArchiveBackend, objectType com.ObjectType, domain mal.IdentifierList, instIDs ...mal.Long) error {
+	archiveDetailsList, elementList := newTestObjects(len(instIDs), domain, "network", time.Now())
+	for i, instID := range instIDs {
+		archiveDetailsList[i].InstId = instID
+	}
+	_, err := backend.StoreInArchive(nil, objectType, domain, archiveDetailsList, elementList)
+	return err
+}
+
+// countObjects counts the objects of a type in a domain
+func countObjects(t *testing.T, backend storage.ArchiveBackend, objectType com.ObjectType, domain mal.IdentifierList) int64 {
+	var archiveQueryList = archive.NewArchiveQueryList(0)
+	archiveQueryList.AppendElement(&archive.ArchiveQuery{
+		Domain:  &domain,
+		Related: mal.Long(0),
+	})
+	longList, err := backend.CountInArchive(objectType, *archiveQueryList, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return int64(*(*longList)[0])
+}
+
+// checkInstIDUniqueness checks that an object instance identifier can be
+// used once per object type and domain
+func checkInstIDUniqueness(t *testing.T, backend storage.ArchiveBackend) {
+	var domain = newTestDomain("fr", "cnes", "unique")
+	var otherDomain = newTestDomain("fr", "cnes", "other")
+	var otherType = valueOfSineType
+	otherType.Number++
+
+	// The same identifier in other domains and for other types
+	for _, store := range []struct {
+		objectType com.ObjectType
+		domain     mal.IdentifierList
+	}{
+		{valueOfSineType, domain},
+		{valueOfSineType, otherDomain},
+		{otherType, domain},
+	} {
+		err := storeWithInstIDs(backend, store.objectType, store.domain, 7)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The same identifier twice for a type in a domain
+	for _, instIDs := range [][]mal.Long{{7}, {8, 7}, {9, 9}} {
+		err := storeWithInstIDs(backend, valueOfSineType, domain, instIDs...)
+		if err == nil || err.Error() != string(com.ERROR_DUPLICATE) {
+			t.Errorf("DUPLICATE error expected for %v: %v", instIDs, err)
+		}
+	}
+	// None of the objects of a rejected list is stored
+	if count := countObjects(t, backend, valueOfSineType, domain); count != 1 {
+		t.Errorf("%d objects stored instead of 1", count)
+	}
+
+	// The generated identifiers are unique too
+	err := storeWithInstIDs(backend, valueOfSineType, domain, 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if count := countObjects(t, backend, valueOfSineType, domain); count != 4 {
+		t.Errorf("%d objects stored instead of 4", count)
+	}
+
+	// An identifier can be used again once its object is deleted
+	_, err = backend.DeleteInArchive(valueOfSineType, domain, mal.LongList{mal.NewLong(7)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = storeWithInstIDs(backend, valueOfSineType, domain, 7)
+	if err != nil {
+		t.Error(err)
+	}
+}